@@ -35,6 +35,19 @@
 //	h.Pause()  // later: h.Resume()
 //	if err := h.Wait(context.Background()); err != nil { ... }
 //
+// # Progress
+//
+// Besides a percentage, work functions can report byte counters and a
+// phase name; the engine derives a smoothed throughput and ETA from them.
+// Long tasks made of parallel or successive parts report each part on
+// its own step and the engine rolls the steps up into the task's
+// progress:
+//
+//	rep.SetPhase("copy")
+//	sda := rep.Step("sda", 3) // weight: sda is three times larger
+//	sdb := rep.Step("sdb", 1)
+//	sda.ReportBytes(done, total)
+//
 // # Periodic checks (watchers)
 //
 // A task may carry Watchers: periodic checks that run while the task is
@@ -57,6 +70,130 @@
 //		}},
 //	}
 //
+// # Scheduling
+//
+// Ready tasks compete for WithConcurrency slots. A slot goes to the
+// waiting task with the highest Task.Priority; among equal priorities,
+// scheduling groups (Task.Group) share slots in proportion to their
+// WithGroupWeight weights; remaining ties are served in submission order.
+// A task takes Task.Weight slots, so heavy copies count for more than
+// light bookkeeping tasks, and SetConcurrency resizes the pool at runtime,
+// e.g. to throttle an agent during business hours.
+// With WithPreemption, urgent tasks can additionally make lower-priority
+// running tasks yield their slot at their next Reporter.Checkpoint:
+//
+//	engine, _ := backup.New(
+//		backup.WithConcurrency(4),
+//		backup.WithGroupWeight("tenant-a", 2),
+//		backup.WithPreemption(100),
+//	)
+//	engine.Submit(backup.Task{ID: "restore-vm-1", Priority: 100, Work: restore})
+//
+// # Resources
+//
+// Tasks that must not run at the same time declare the resources they
+// touch instead of chaining DependsOn by hand. A task is admitted only
+// when all of its resources can be acquired together:
+//
+//	backup.Task{
+//		ID: "copy-sdb",
+//		Resources: []backup.Resource{
+//			{Key: "/dev/sdb", Mode: backup.Exclusive},
+//			{Key: "disk-io-slots", Mode: backup.Shared}, // see WithResourceLimit
+//		},
+//		Work: work,
+//	}
+//
+// # Throttling
+//
+// Concurrent disk copies can saturate production storage. Work functions
+// call Reporter.Throttle around their IO to draw from shared token
+// buckets: an engine-wide limit and one per scheduling group, both in
+// bytes and operations per second, adjustable at runtime and switched by
+// time of day:
+//
+//	engine, _ := backup.New(
+//		backup.WithThrottle(backup.Limit{BytesPerSec: 200 << 20}),
+//		backup.WithThrottleSchedule(backup.ThrottleSchedule{Rules: []backup.ThrottleRule{{
+//			Window: backup.Window{Start: 8 * time.Hour, End: 18 * time.Hour},
+//			Global: backup.Limit{BytesPerSec: 50 << 20, OpsPerSec: 2000},
+//		}}}),
+//	)
+//
+// # Schedules
+//
+// Schedule submits a task template on a cron expression or fixed
+// interval, with an overlap policy, jitter and maintenance windows:
+//
+//	engine.Schedule(backup.ScheduleSpec{
+//		ID:       "nightly-vm-1",
+//		Cron:     "0 2 * * *",
+//		Overlap:  backup.OverlapSkip,
+//		Template: backup.Task{Kind: "backup-vm", Payload: args},
+//	})
+//
+// # Workflows
+//
+// SubmitGraph registers a whole DAG of tasks atomically, in any order,
+// and returns a GroupHandle that waits on, cancels, pauses and reports
+// progress for all of them:
+//
+//	g, err := engine.SubmitGraph([]backup.Task{
+//		{ID: "verify", DependsOn: []string{"catalog"}, Work: verify},
+//		{ID: "catalog", DependsOn: []string{"disk-0", "disk-1"}, Work: catalog},
+//		{ID: "disk-0", Work: copyDisk0},
+//		{ID: "disk-1", Work: copyDisk1},
+//	})
+//	if err != nil { ... } // nothing was registered
+//	err = g.Wait(ctx)
+//
+// A dependency's DependencyPolicy turns a task into a finally step that
+// runs whatever happened upstream, or a compensation step that runs only
+// on failure; Reporter.Dependency tells it what happened:
+//
+//	{ID: "unmount", DependsOn: []string{"copy"},
+//		DependencyPolicy: map[string]backup.DependencyPolicy{"copy": backup.RunAlways},
+//		Work: unmount},
+//
+// # Durable journal
+//
+// WithJournal records tasks in an append-only file so that unfinished
+// work survives a crash or restart. Journaled tasks are bound to code by
+// Kind rather than by closure, so a journaled engine rejects tasks without
+// one, and they carry their parameters in Payload:
+//
+//	engine, _ := backup.New(backup.WithJournal("/var/lib/agent/tasks.journal"))
+//	engine.RegisterKind("disk-copy", copyDisk) // before Start
+//	engine.Start() // resumes tasks left unfinished by the last run
+//	engine.Submit(backup.Task{ID: "copy-sdb", Kind: "disk-copy", Payload: args})
+//
+// # Retention
+//
+// By default finished tasks stay in the engine until Shutdown. Long-lived
+// agents bound them with WithRetention; evicted tasks leave a compact
+// history that keeps their IDs reserved and still shows up in List:
+//
+//	engine, _ := backup.New(backup.WithRetention(backup.RetentionPolicy{
+//		MaxFinished:  1000,
+//		MaxAge:       24 * time.Hour,
+//		FailedMaxAge: 7 * 24 * time.Hour,
+//		ReuseIDs:     backup.ReuseAfterFailure,
+//	}))
+//	failed := engine.List(backup.TaskFilter{States: []backup.TaskState{backup.StateFailed}, Evicted: true})
+//
+// # Metrics
+//
+// Engine.Metrics returns queue depth, running counts, retries, dropped
+// events and task duration histograms per group; MetricsHandler serves
+// them to Prometheus:
+//
+//	http.Handle("/metrics", engine.MetricsHandler())
+//
+// # Remote control
+//
+// Package backuprpc registers list, control and event-feed methods of an
+// engine on a minirpc server, so remote consoles can drive it.
+//
 // Task work functions must honor ctx cancellation: the engine cancels the
 // context when a task is cancelled or its deadline is exceeded, but the
 // actual stop only happens when the work function returns.
@@ -86,7 +223,8 @@ var (
 // Task-level errors.
 var (
 	// ErrTaskExists is returned by Submit when the task ID is already
-	// known to the engine (in any state).
+	// known to the engine (in any state), or was used by an evicted task
+	// and the RetentionPolicy forbids reusing it.
 	ErrTaskExists = errors.New("backup: task already exists")
 
 	// ErrTaskNotFound is returned when an operation references an
@@ -107,10 +245,32 @@ var (
 	// dependencies was cancelled before it could complete.
 	ErrDependencyCancelled = errors.New("backup: dependency cancelled")
 
+	// ErrSkipped is set on a task whose RunOnFailure dependency completed
+	// successfully, so the compensation it stands for is not needed. The
+	// task ends StateCancelled without running.
+	ErrSkipped = errors.New("backup: task skipped by dependency policy")
+
 	// ErrCancelled is set on a task whose work was cancelled by the
 	// user or by engine shutdown.
 	ErrCancelled = errors.New("backup: task cancelled")
 
+	// ErrKindNotRegistered is returned by Submit for a task whose Kind
+	// has no WorkFunc registered with RegisterKind, and set on journaled
+	// tasks that cannot be resumed for the same reason.
+	ErrKindNotRegistered = errors.New("backup: task kind not registered")
+
+	// ErrScheduleExists is returned by Schedule when the schedule ID is
+	// already registered.
+	ErrScheduleExists = errors.New("backup: schedule already exists")
+
+	// ErrRunMissed is the cause carried by EventMissed events for
+	// scheduled runs that were not started.
+	ErrRunMissed = errors.New("backup: scheduled run missed")
+
+	// ErrResultType is returned by DependencyResult when a task result
+	// cannot be converted to the requested type.
+	ErrResultType = errors.New("backup: task result has unexpected type")
+
 	// ErrInvalidState is returned by handle operations that are not
 	// applicable in the task's current state, e.g. Pause on a task that
 	// has already finished.
@@ -130,4 +290,14 @@ var (
 	// ErrInvalidWatcher is returned when a Task.Watchers entry fails
 	// validation (non-positive Interval or nil Check).
 	ErrInvalidWatcher = errors.New("backup: invalid watcher")
+
+	// ErrInvalidSchedule is returned by Schedule when a ScheduleSpec
+	// fails validation (empty ID, bad cron expression, both or neither
+	// of Cron and Every).
+	ErrInvalidSchedule = errors.New("backup: invalid schedule")
+
+	// ErrInvalidLimit is returned by New, SetThrottle, SetGroupThrottle
+	// and SetThrottleSchedule for negative limits or windows outside a
+	// day.
+	ErrInvalidLimit = errors.New("backup: invalid throughput limit")
 )
@@ -0,0 +1,361 @@
+// Package backuprpc exposes a backup.Engine to remote consoles through the
+// minirpc GenericService. Engine operations are registered as dynamic
+// methods with JSON payloads:
+//
+//	backup.list    TaskFilter            -> ListResult
+//	backup.get     TaskRef               -> TaskInfo
+//	backup.pause   TaskRef               -> {}
+//	backup.resume  TaskRef               -> {}
+//	backup.cancel  TaskRef               -> {}
+//	backup.retry   TaskRef               -> {}
+//	backup.events  EventsRequest         -> EventsResult
+//
+// GenericService has no server-streaming call, so backup.events is a
+// long-poll feed: the service subscribes to the engine once and keeps the
+// most recent events in a ring buffer, each numbered with a sequence;
+// clients call backup.events repeatedly with the last sequence they saw
+// and receive the same Event stream a local subscriber would.
+//
+//	srv := minirpc.NewServer()
+//	svc, err := backuprpc.Register(srv, engine)
+//	if err != nil { ... }
+//	defer svc.Close()
+package backuprpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kisun-bit/drpkg/backup"
+	"github.com/kisun-bit/drpkg/rpc/aio/minirpc"
+	"github.com/kisun-bit/drpkg/rpc/aio/proto"
+)
+
+// Method names registered by Register.
+const (
+	MethodList   = "backup.list"
+	MethodGet    = "backup.get"
+	MethodPause  = "backup.pause"
+	MethodResume = "backup.resume"
+	MethodCancel = "backup.cancel"
+	MethodRetry  = "backup.retry"
+	MethodEvents = "backup.events"
+)
+
+// Registrar is the part of *minirpc.Server used by Register.
+type Registrar interface {
+	RegisterMethod(name string, handler minirpc.InvokeHandler) error
+}
+
+// Service serves one engine over minirpc. Create it with Register.
+type Service struct {
+	engine *backup.Engine
+	feed   *eventFeed
+}
+
+// Option configures a Service.
+type Option func(*config)
+
+type config struct {
+	feedSize int
+	maxWait  time.Duration
+}
+
+// WithFeedSize sets how many recent events the event feed keeps for
+// clients to catch up on. Default: 4096.
+func WithFeedSize(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.feedSize = n
+		}
+	}
+}
+
+// WithMaxWait caps how long one backup.events call waits for new
+// events. Default: 30s.
+func WithMaxWait(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.maxWait = d
+		}
+	}
+}
+
+// Register subscribes to e's events and registers the backup.* methods on
+// srv. The returned Service must be closed to end the subscription.
+//
+// minirpc cannot unregister methods: when Register fails, the methods
+// registered before the failure stay on srv (backup.events then fails
+// with the feed closed), so srv should be discarded.
+func Register(srv Registrar, e *backup.Engine, opts ...Option) (*Service, error) {
+	c := config{feedSize: 4096, maxWait: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	// The feed exists before any method can be called.
+	s := &Service{engine: e, feed: newEventFeed(e, c.feedSize, c.maxWait)}
+	methods := []struct {
+		name    string
+		handler minirpc.InvokeHandler
+	}{
+		{MethodList, jsonMethod(s.list)},
+		{MethodGet, jsonMethod(s.get)},
+		{MethodPause, jsonMethod(s.control((*backup.Handle).Pause))},
+		{MethodResume, jsonMethod(s.control((*backup.Handle).Resume))},
+		{MethodCancel, jsonMethod(s.control((*backup.Handle).Cancel))},
+		{MethodRetry, jsonMethod(s.control((*backup.Handle).Retry))},
+		{MethodEvents, jsonMethod(s.events)},
+	}
+	for _, m := range methods {
+		if err := srv.RegisterMethod(m.name, m.handler); err != nil {
+			s.feed.close()
+			return nil, fmt.Errorf("backuprpc: register %s: %w", m.name, err)
+		}
+	}
+	return s, nil
+}
+
+// Close ends the event subscription. Pending backup.events calls return
+// what they have; later calls fail.
+func (s *Service) Close() {
+	s.feed.close()
+}
+
+// TaskRef names the task of a single-task method.
+type TaskRef struct {
+	ID string `json:"id"`
+}
+
+// TaskFilter is the argument of backup.list; see backup.TaskFilter.
+type TaskFilter struct {
+	States   []backup.TaskState `json:"states,omitempty"`
+	Groups   []string           `json:"groups,omitempty"`
+	Kinds    []string           `json:"kinds,omitempty"`
+	IDPrefix string             `json:"idPrefix,omitempty"`
+	Evicted  bool               `json:"evicted,omitempty"`
+	Limit    int                `json:"limit,omitempty"`
+}
+
+// ListResult is the result of backup.list.
+type ListResult struct {
+	Tasks []TaskInfo `json:"tasks"`
+}
+
+// TaskInfo is the wire form of backup.TaskInfo.
+type TaskInfo struct {
+	ID          string           `json:"id"`
+	Kind        string           `json:"kind,omitempty"`
+	Group       string           `json:"group,omitempty"`
+	Priority    int              `json:"priority,omitempty"`
+	State       backup.TaskState `json:"state"`
+	Err         string           `json:"err,omitempty"`
+	Attempt     int              `json:"attempt,omitempty"`
+	Progress    Progress         `json:"progress"`
+	SubmittedAt *time.Time       `json:"submittedAt,omitempty"`
+	StartedAt   *time.Time       `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time       `json:"finishedAt,omitempty"`
+	Evicted     bool             `json:"evicted,omitempty"`
+}
+
+// Progress is the wire form of backup.Progress. Durations are in
+// milliseconds.
+type Progress struct {
+	Percent    int32          `json:"percent"`
+	Message    string         `json:"message,omitempty"`
+	Phase      string         `json:"phase,omitempty"`
+	BytesDone  int64          `json:"bytesDone,omitempty"`
+	BytesTotal int64          `json:"bytesTotal,omitempty"`
+	Throughput float64        `json:"throughput,omitempty"`
+	ETAMs      int64          `json:"etaMs,omitempty"`
+	Steps      []StepProgress `json:"steps,omitempty"`
+	UpdatedAt  *time.Time     `json:"updatedAt,omitempty"`
+}
+
+// StepProgress is the wire form of backup.StepProgress.
+type StepProgress struct {
+	Name       string  `json:"name"`
+	Weight     float64 `json:"weight"`
+	Percent    int32   `json:"percent"`
+	BytesDone  int64   `json:"bytesDone,omitempty"`
+	BytesTotal int64   `json:"bytesTotal,omitempty"`
+}
+
+// EventsRequest is the argument of backup.events.
+type EventsRequest struct {
+	// After is the sequence of the last event the client has seen; zero
+	// starts with the oldest event still buffered.
+	After uint64 `json:"after"`
+	// Limit caps the number of returned events. Zero means 256.
+	Limit int `json:"limit,omitempty"`
+	// WaitMs is how long to wait for new events when none are
+	// available, capped by the service's maximum. Zero returns at once.
+	WaitMs int64 `json:"waitMs,omitempty"`
+}
+
+// EventsResult is the result of backup.events.
+type EventsResult struct {
+	Events []Event `json:"events"`
+	// Next is the value to pass as After in the next call.
+	Next uint64 `json:"next"`
+	// Missed is set when events after the requested sequence were
+	// already discarded from the buffer, or dropped by the engine because
+	// the feed fell behind; the client should resync with backup.list.
+	Missed bool `json:"missed,omitempty"`
+}
+
+// Event is the wire form of backup.Event.
+type Event struct {
+	Seq    uint64           `json:"seq"`
+	Kind   backup.EventKind `json:"kind"`
+	TaskID string           `json:"taskId"`
+	State  backup.TaskState `json:"state"`
+	// Progress is set for progress and final events.
+	Progress *Progress       `json:"progress,omitempty"`
+	Attempt  int             `json:"attempt,omitempty"`
+	DelayMs  int64           `json:"delayMs,omitempty"`
+	Err      string          `json:"err,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Time     time.Time       `json:"time"`
+}
+
+func (s *Service) list(ctx context.Context, f TaskFilter) (ListResult, error) {
+	infos := s.engine.List(backup.TaskFilter{
+		States:   f.States,
+		Groups:   f.Groups,
+		Kinds:    f.Kinds,
+		IDPrefix: f.IDPrefix,
+		Evicted:  f.Evicted,
+		Limit:    f.Limit,
+	})
+	res := ListResult{Tasks: make([]TaskInfo, 0, len(infos))}
+	for i := range infos {
+		res.Tasks = append(res.Tasks, taskInfo(&infos[i]))
+	}
+	return res, nil
+}
+
+func (s *Service) get(ctx context.Context, ref TaskRef) (TaskInfo, error) {
+	info, err := s.engine.Info(ref.ID)
+	if err != nil {
+		return TaskInfo{}, err
+	}
+	return taskInfo(&info), nil
+}
+
+// control returns a method that applies op to the referenced task.
+func (s *Service) control(op func(*backup.Handle) error) func(context.Context, TaskRef) (struct{}, error) {
+	return func(ctx context.Context, ref TaskRef) (struct{}, error) {
+		h, err := s.engine.Get(ref.ID)
+		if err != nil {
+			return struct{}{}, err
+		}
+		return struct{}{}, op(h)
+	}
+}
+
+func (s *Service) events(ctx context.Context, req EventsRequest) (EventsResult, error) {
+	return s.feed.read(ctx, req)
+}
+
+// jsonMethod adapts a typed function into a minirpc handler that decodes
+// JSON arguments (empty arguments decode as the zero A) and encodes the
+// result as JSON.
+func jsonMethod[A, R any](fn func(context.Context, A) (R, error)) minirpc.InvokeHandler {
+	return func(ctx context.Context, argsType proto.PayloadType, args []byte) (proto.PayloadType, []byte, error) {
+		var a A
+		if len(args) > 0 {
+			if argsType != proto.PayloadType_JSON && argsType != proto.PayloadType_PAYLOAD_TYPE_UNSPECIFIED {
+				return proto.PayloadType_PAYLOAD_TYPE_UNSPECIFIED, nil, fmt.Errorf("backuprpc: unsupported args type %v, want JSON", argsType)
+			}
+			if err := json.Unmarshal(args, &a); err != nil {
+				return proto.PayloadType_PAYLOAD_TYPE_UNSPECIFIED, nil, fmt.Errorf("backuprpc: decode args: %w", err)
+			}
+		}
+		r, err := fn(ctx, a)
+		if err != nil {
+			return proto.PayloadType_PAYLOAD_TYPE_UNSPECIFIED, nil, err
+		}
+		out, err := json.Marshal(r)
+		if err != nil {
+			return proto.PayloadType_PAYLOAD_TYPE_UNSPECIFIED, nil, fmt.Errorf("backuprpc: encode result: %w", err)
+		}
+		return proto.PayloadType_JSON, out, nil
+	}
+}
+
+func taskInfo(ti *backup.TaskInfo) TaskInfo {
+	return TaskInfo{
+		ID:          ti.ID,
+		Kind:        ti.Kind,
+		Group:       ti.Group,
+		Priority:    ti.Priority,
+		State:       ti.State,
+		Err:         errString(ti.Err),
+		Attempt:     ti.Attempt,
+		Progress:    progress(&ti.Progress),
+		SubmittedAt: timePtr(ti.SubmittedAt),
+		StartedAt:   timePtr(ti.StartedAt),
+		FinishedAt:  timePtr(ti.FinishedAt),
+		Evicted:     ti.Evicted,
+	}
+}
+
+func progress(p *backup.Progress) Progress {
+	out := Progress{
+		Percent:    p.Percent,
+		Message:    p.Message,
+		Phase:      p.Phase,
+		BytesDone:  p.BytesDone,
+		BytesTotal: p.BytesTotal,
+		Throughput: p.Throughput,
+		ETAMs:      p.ETA.Milliseconds(),
+		UpdatedAt:  timePtr(p.UpdatedAt),
+	}
+	for _, st := range p.Steps {
+		out.Steps = append(out.Steps, StepProgress(st))
+	}
+	return out
+}
+
+func wireEvent(seq uint64, ev *backup.Event) Event {
+	out := Event{
+		Seq:     seq,
+		Kind:    ev.Kind,
+		TaskID:  ev.TaskID,
+		State:   ev.State,
+		Attempt: ev.Attempt,
+		DelayMs: ev.Delay.Milliseconds(),
+		Err:     errString(ev.Err),
+		Time:    ev.Time,
+	}
+	if ev.Kind == backup.EventProgress || ev.Kind == backup.EventFinal {
+		p := progress(&ev.Progress)
+		out.Progress = &p
+	}
+	if ev.Result != nil {
+		if raw, err := json.Marshal(ev.Result); err == nil {
+			out.Result = raw
+		}
+	}
+	return out
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// errClosed is returned by backup.events after Service.Close.
+var errClosed = errors.New("backuprpc: service closed")
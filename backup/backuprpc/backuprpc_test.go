@@ -0,0 +1,244 @@
+package backuprpc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kisun-bit/drpkg/backup"
+	"github.com/kisun-bit/drpkg/rpc/aio/minirpc"
+	"github.com/kisun-bit/drpkg/rpc/aio/proto"
+)
+
+func setup(t *testing.T, opts ...Option) (*backup.Engine, *minirpc.Server) {
+	t.Helper()
+	e, err := backup.New(backup.WithConcurrency(2))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := e.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	srv := minirpc.NewServer()
+	svc, err := Register(srv, e, opts...)
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		_ = e.Shutdown(ctx)
+		svc.Close()
+		_ = srv.Close()
+	})
+	return e, srv
+}
+
+// call invokes method with JSON args and decodes the JSON result into out.
+// It returns the error message of a failed call.
+func call(t *testing.T, srv *minirpc.Server, method string, args, out any) string {
+	t.Helper()
+	raw, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Invoke(context.Background(), &proto.GenericRequest{
+		Method:   method,
+		ArgsType: proto.PayloadType_JSON,
+		Args:     raw,
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	if !resp.Success {
+		return resp.ErrorMessage
+	}
+	if resp.ReturnType != proto.PayloadType_JSON {
+		t.Fatalf("%s: return type %v", method, resp.ReturnType)
+	}
+	if out != nil {
+		if err := json.Unmarshal(resp.Result, out); err != nil {
+			t.Fatalf("%s: decode %s: %v", method, resp.Result, err)
+		}
+	}
+	return ""
+}
+
+func TestControl(t *testing.T) {
+	e, srv := setup(t)
+	release := make(chan struct{})
+	h, err := e.Submit(backup.Task{ID: "disk0", Kind: "disk", Work: func(ctx context.Context, rep *backup.Reporter) error {
+		rep.ReportBytes(10, 100)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for h.Progress().BytesDone != 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("task did not report progress")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var list ListResult
+	if msg := call(t, srv, MethodList, TaskFilter{Kinds: []string{"disk"}}, &list); msg != "" {
+		t.Fatal(msg)
+	}
+	if len(list.Tasks) != 1 || list.Tasks[0].ID != "disk0" || list.Tasks[0].State != backup.StateRunning ||
+		list.Tasks[0].Progress.BytesTotal != 100 {
+		t.Fatalf("list = %+v", list.Tasks)
+	}
+	var info TaskInfo
+	if msg := call(t, srv, MethodGet, TaskRef{ID: "disk0"}, &info); msg != "" || info.StartedAt == nil {
+		t.Fatalf("get = %+v, %q", info, msg)
+	}
+	if msg := call(t, srv, MethodGet, TaskRef{ID: "nope"}, nil); msg == "" {
+		t.Fatal("get of unknown task succeeded")
+	}
+
+	if msg := call(t, srv, MethodCancel, TaskRef{ID: "disk0"}, nil); msg != "" {
+		t.Fatal(msg)
+	}
+	<-h.Done()
+	if st := h.State(); st != backup.StateCancelled {
+		t.Fatalf("state = %s", st)
+	}
+	if msg := call(t, srv, MethodRetry, TaskRef{ID: "disk0"}, nil); msg != "" {
+		t.Fatal(msg)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	h, err = e.Get("disk0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Wait(ctx); err != nil {
+		t.Fatalf("retried task: %v", err)
+	}
+	if msg := call(t, srv, MethodList, TaskFilter{States: []backup.TaskState{backup.StateCompleted}}, &list); msg != "" || len(list.Tasks) != 1 {
+		t.Fatalf("list completed = %+v, %q", list.Tasks, msg)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	e, srv := setup(t, WithFeedSize(4))
+
+	// A waiting poll returns as soon as the first event arrives.
+	got := make(chan EventsResult, 1)
+	go func() {
+		var res EventsResult
+		call(t, srv, MethodEvents, EventsRequest{WaitMs: 5000}, &res)
+		got <- res
+	}()
+	time.Sleep(20 * time.Millisecond)
+	h, err := e.Submit(backup.Task{ID: "t1", Work: backup.ResultWork(func(ctx context.Context, rep *backup.Reporter) (int, error) {
+		return 42, nil
+	})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case res := <-got:
+		if len(res.Events) == 0 || res.Events[0].Seq != 1 || res.Events[0].TaskID != "t1" {
+			t.Fatalf("first poll = %+v", res)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("long poll did not return")
+	}
+	<-h.Done()
+
+	// Poll until the final event; the ring is small, so early events may
+	// be reported as missed but the final one must arrive.
+	var after uint64
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		var res EventsResult
+		if msg := call(t, srv, MethodEvents, EventsRequest{After: after, WaitMs: 100}, &res); msg != "" {
+			t.Fatal(msg)
+		}
+		for _, ev := range res.Events {
+			if ev.Kind == backup.EventFinal {
+				if ev.State != backup.StateCompleted || string(ev.Result) != "42" || ev.Progress == nil {
+					t.Fatalf("final event = %+v", ev)
+				}
+				return
+			}
+		}
+		after = res.Next
+		if time.Now().After(deadline) {
+			t.Fatal("no final event")
+		}
+	}
+}
+
+func TestEventsMissed(t *testing.T) {
+	e, srv := setup(t, WithFeedSize(2))
+	for _, id := range []string{"a", "b", "c"} {
+		h, err := e.Submit(backup.Task{ID: id, Work: func(ctx context.Context, rep *backup.Reporter) error { return nil }})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-h.Done()
+	}
+	var res EventsResult
+	deadline := time.Now().Add(3 * time.Second)
+	for !res.Missed {
+		if msg := call(t, srv, MethodEvents, EventsRequest{After: 0, Limit: 1}, &res); msg != "" {
+			t.Fatal(msg)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("events after 0 = %+v, want missed", res)
+		}
+	}
+	if len(res.Events) != 1 || res.Events[0].Seq != res.Next || res.Next < 3 {
+		t.Fatalf("events = %+v", res)
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	// Feed the ring directly: the engine dropped Seq 3 before the feed
+	// could read it.
+	ch := make(chan backup.Event, 4)
+	f := &eventFeed{
+		cancel: func() {},
+		done:   make(chan struct{}),
+		ring:   make([]Event, 8),
+		gaps:   make([]bool, 8),
+		notify: make(chan struct{}),
+	}
+	for _, seq := range []uint64{1, 2, 4} {
+		ch <- backup.Event{Kind: backup.EventProgress, TaskID: "a", Seq: seq}
+	}
+	close(ch)
+	f.run(ch)
+
+	ctx := context.Background()
+	res, err := f.read(ctx, EventsRequest{After: 0, Limit: 2})
+	if err != nil || res.Missed || len(res.Events) != 2 {
+		t.Fatalf("events after 0 = %+v, %v; want 2 events, not missed", res, err)
+	}
+	res, err = f.read(ctx, EventsRequest{After: res.Next})
+	if err != nil || !res.Missed || len(res.Events) != 1 || res.Next != 3 {
+		t.Fatalf("events after 2 = %+v, %v; want 1 event, missed", res, err)
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	e, srv := setup(t)
+	if _, err := Register(srv, e); err == nil {
+		t.Fatal("second Register on the same server succeeded")
+	}
+	// The failed Register does not leak its event subscription.
+	if n := e.Metrics().Subscribers; n != 1 {
+		t.Errorf("subscribers after failed Register = %d, want 1", n)
+	}
+}
@@ -0,0 +1,140 @@
+package backuprpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kisun-bit/drpkg/backup"
+)
+
+// defaultEventsLimit is the batch size of backup.events when the request
+// does not set one.
+const defaultEventsLimit = 256
+
+// eventFeed keeps the most recent engine events in a ring buffer, numbered
+// with consecutive sequences starting at 1, for long-polling clients.
+type eventFeed struct {
+	maxWait time.Duration
+	cancel  func()
+	done    chan struct{}
+
+	mu     sync.Mutex
+	ring   []Event
+	gaps   []bool        // engine events were dropped before the ring entry
+	last   uint64        // sequence of the newest event, 0 when empty
+	notify chan struct{} // closed and replaced on every append
+	closed bool
+}
+
+func newEventFeed(e *backup.Engine, size int, maxWait time.Duration) *eventFeed {
+	ch, cancel := e.Subscribe(size)
+	f := &eventFeed{
+		maxWait: maxWait,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		ring:    make([]Event, size),
+		gaps:    make([]bool, size),
+		notify:  make(chan struct{}),
+	}
+	go f.run(ch)
+	return f
+}
+
+// run copies engine events into the ring until the subscription ends.
+// A gap in the subscription's Seq means the engine dropped events because
+// the feed fell behind; the next entry is marked so that readers crossing
+// it get Missed.
+func (f *eventFeed) run(ch <-chan backup.Event) {
+	defer close(f.done)
+	var seq uint64
+	for ev := range ch {
+		gap := ev.Seq != seq+1
+		seq = ev.Seq
+		f.mu.Lock()
+		f.last++
+		i := f.last % uint64(len(f.ring))
+		f.ring[i] = wireEvent(f.last, &ev)
+		f.gaps[i] = gap
+		close(f.notify)
+		f.notify = make(chan struct{})
+		f.mu.Unlock()
+	}
+	f.mu.Lock()
+	f.closed = true
+	close(f.notify)
+	f.mu.Unlock()
+}
+
+func (f *eventFeed) close() {
+	f.cancel()
+	<-f.done
+}
+
+// read returns the buffered events after req.After, waiting up to
+// req.WaitMs for the first one to arrive.
+func (f *eventFeed) read(ctx context.Context, req EventsRequest) (EventsResult, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultEventsLimit
+	}
+	wait := time.Duration(req.WaitMs) * time.Millisecond
+	if wait > f.maxWait {
+		wait = f.maxWait
+	}
+	var timer <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	for {
+		f.mu.Lock()
+		if f.last > req.After || f.closed || timer == nil {
+			res, closed := f.collectLocked(req.After, limit), f.closed
+			f.mu.Unlock()
+			if closed && len(res.Events) == 0 {
+				return res, errClosed
+			}
+			return res, nil
+		}
+		notify := f.notify
+		f.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-timer:
+			timer = nil
+		case <-ctx.Done():
+			return EventsResult{}, ctx.Err()
+		}
+	}
+}
+
+// collectLocked returns up to limit events after the sequence after. Missed
+// is set when events in that range fell out of the ring or were dropped by
+// the engine before reaching the feed.
+func (f *eventFeed) collectLocked(after uint64, limit int) EventsResult {
+	res := EventsResult{Events: []Event{}, Next: after}
+	if after > f.last {
+		// The client saw a previous feed (e.g. the server restarted).
+		after, res.Missed = 0, true
+	}
+	oldest := uint64(1)
+	if n := uint64(len(f.ring)); f.last > n {
+		oldest = f.last - n + 1
+	}
+	if after+1 < oldest {
+		after, res.Missed = oldest-1, true
+	}
+	for seq := after + 1; seq <= f.last && len(res.Events) < limit; seq++ {
+		i := seq % uint64(len(f.ring))
+		if f.gaps[i] {
+			res.Missed = true
+		}
+		res.Events = append(res.Events, f.ring[i])
+	}
+	res.Next = after + uint64(len(res.Events))
+	return res
+}
@@ -0,0 +1,113 @@
+package backup
+
+import "fmt"
+
+// DependencyPolicy decides how a task reacts to the outcome of one of its
+// dependencies (see Task.DependencyPolicy).
+type DependencyPolicy int
+
+// Dependency policies.
+const (
+	// RunOnSuccess runs the task only if the dependency completed
+	// successfully; otherwise the task fails with ErrDependencyFailed or
+	// ErrDependencyCancelled. This is the zero value.
+	RunOnSuccess DependencyPolicy = iota
+	// RunAlways runs the task once the dependency has finished, whatever
+	// its outcome. Use it for finally steps: unmount, release a
+	// snapshot, delete a temporary image.
+	RunAlways
+	// RunOnFailure runs the task only if the dependency failed, timed
+	// out or was cancelled. Use it for compensation steps. When the
+	// dependency completes instead, the task is skipped: it ends
+	// StateCancelled with ErrSkipped.
+	RunOnFailure
+)
+
+// String returns the policy name.
+func (p DependencyPolicy) String() string {
+	switch p {
+	case RunOnSuccess:
+		return "on-success"
+	case RunAlways:
+		return "always"
+	case RunOnFailure:
+		return "on-failure"
+	default:
+		return "unknown"
+	}
+}
+
+// dependencyPolicy returns the task's policy for dependency id.
+func (t *Task) dependencyPolicy(id string) DependencyPolicy {
+	return t.DependencyPolicy[id]
+}
+
+// guardedBy reports whether the task is a finally or compensation step
+// of one of the given tasks: it has a policy other than RunOnSuccess on
+// one of them.
+func (t *Task) guardedBy(ids map[string]bool) bool {
+	for id, p := range t.DependencyPolicy {
+		if p != RunOnSuccess && ids[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDependencyPolicy checks that every policy names a dependency
+// and is known.
+func (t *Task) validateDependencyPolicy() error {
+	for id, p := range t.DependencyPolicy {
+		if p < RunOnSuccess || p > RunOnFailure {
+			return fmt.Errorf("%v: %s: invalid policy %d for dependency %q", ErrInvalidTask, t.ID, int(p), id)
+		}
+		if !containsString(t.DependsOn, id) {
+			return fmt.Errorf("%v: %s: policy for %q, which is not in DependsOn", ErrInvalidTask, t.ID, id)
+		}
+	}
+	return nil
+}
+
+// dependencyOutcome decides how a task that depends on id under policy p
+// reacts to id finishing in state st. ok means the dependency is
+// satisfied; otherwise the task must be finalized in fst with err.
+func dependencyOutcome(p DependencyPolicy, id string, st TaskState) (ok bool, fst TaskState, err error) {
+	switch p {
+	case RunAlways:
+		return true, 0, nil
+	case RunOnFailure:
+		if st == StateCompleted {
+			return false, StateCancelled, fmt.Errorf("%w: dependency %q completed", ErrSkipped, id)
+		}
+		return true, 0, nil
+	}
+	switch st {
+	case StateCompleted:
+		return true, 0, nil
+	case StateCancelled:
+		return false, StateFailed, fmt.Errorf("%w: dependency %q was cancelled", ErrDependencyCancelled, id)
+	default: // Failed, TimedOut
+		return false, StateFailed, fmt.Errorf("%w: dependency %q failed", ErrDependencyFailed, id)
+	}
+}
+
+// Dependency returns a snapshot of dependency id, so that finally and
+// compensation steps can tell what happened upstream from its State and
+// Err. It returns ErrTaskNotFound when id is not in the task's DependsOn.
+// Evicted dependencies are taken from the history.
+func (r *Reporter) Dependency(id string) (TaskInfo, error) {
+	it := r.item
+	if !containsString(it.task.DependsOn, id) {
+		return TaskInfo{}, fmt.Errorf("%v: %s is not a dependency of %s", ErrTaskNotFound, id, it.id)
+	}
+	e := it.engine
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if dep := e.items[id]; dep != nil {
+		return dep.info(), nil
+	}
+	if h := e.history.get(id); h != nil {
+		return h.info(), nil
+	}
+	return TaskInfo{}, fmt.Errorf("%v: %s", ErrTaskNotFound, id)
+}
@@ -2,10 +2,12 @@ package backup
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kisun-bit/drpkg/logger"
@@ -48,6 +50,17 @@ type options struct {
 	lockPath    string
 	concurrency int
 	eventBuffer int
+	journalPath string
+
+	groupWeights    map[string]int
+	preempt         bool
+	preemptPriority int
+	resourceLimits  map[string]int
+	retention       *RetentionPolicy
+
+	throttle         Limit
+	groupThrottles   map[string]Limit
+	throttleSchedule *ThrottleSchedule
 }
 
 // WithMode selects the engine run mode. Default: MultiInstance.
@@ -60,8 +73,10 @@ func WithLockPath(path string) Option {
 	return func(o *options) { o.lockPath = path }
 }
 
-// WithConcurrency sets the maximum number of tasks executed in parallel.
-// Non-positive values keep the default (runtime.NumCPU).
+// WithConcurrency sets the number of concurrency slots, i.e. the maximum
+// number of tasks executed in parallel when every task has weight 1 (see
+// Task.Weight). Non-positive values keep the default (runtime.NumCPU).
+// Engine.SetConcurrency changes it at runtime.
 func WithConcurrency(n int) Option {
 	return func(o *options) {
 		if n > 0 {
@@ -70,6 +85,40 @@ func WithConcurrency(n int) Option {
 	}
 }
 
+// WithGroupWeight sets the fair-share weight of a scheduling group (see
+// Task.Group). Among waiting tasks of equal priority, concurrency slots go
+// to the group whose held slot count divided by its weight is smallest,
+// so a group of weight 3 gets about three times the slots of a group of
+// weight 1 when both have work queued. Groups default to weight 1;
+// non-positive weights are ignored.
+func WithGroupWeight(group string, weight int) Option {
+	return func(o *options) {
+		if weight > 0 {
+			if o.groupWeights == nil {
+				o.groupWeights = make(map[string]int)
+			}
+			o.groupWeights[group] = weight
+		}
+	}
+}
+
+// WithPreemption lets waiting tasks whose Priority is at least
+// minPriority preempt running tasks of lower priority when no
+// concurrency slot is free. At its next Reporter.Checkpoint the preempted
+// task gives up its slot, shows as StatePaused, and resumes automatically
+// once a slot is available for it again; Handle.Resume does not apply to
+// it. Preemption is independent of Handle.Pause: a task paused by the
+// user is not preempted, and a user pause requested while the task is
+// preempted takes effect once it is re-admitted. Work functions that
+// never call Checkpoint cannot be preempted. Preemption is disabled by
+// default.
+func WithPreemption(minPriority int) Option {
+	return func(o *options) {
+		o.preempt = true
+		o.preemptPriority = minPriority
+	}
+}
+
 // WithEventBuffer sets the default subscriber channel buffer used by
 // Subscribe when its buffer argument is not positive.
 func WithEventBuffer(n int) Option {
@@ -80,6 +129,23 @@ func WithEventBuffer(n int) Option {
 	}
 }
 
+// WithJournal makes the engine durable: every submission, state
+// transition, attempt and final result is appended to the journal file at
+// path. On Start, tasks that had not finished when the previous engine
+// stopped are scheduled again, using the WorkFunc registered for their
+// Kind (see RegisterKind). Finished tasks are restored in their terminal
+// state so their IDs stay reserved.
+//
+// Every task submitted to a journaled engine must have a Kind: Submit and
+// SubmitGraph reject tasks with only a Work closure with ErrInvalidTask,
+// since they could not be resumed. The file is compacted when it is
+// opened and whenever it has doubled in size. Tasks cancelled by Shutdown
+// are not recorded as cancelled, so an interrupted run resumes on the
+// next Start. Watchers are not persisted.
+func WithJournal(path string) Option {
+	return func(o *options) { o.journalPath = path }
+}
+
 var (
 	processModeMu      sync.Mutex
 	processModeRunning bool
@@ -98,12 +164,28 @@ type Engine struct {
 	engineCancel context.CancelFunc
 	stopCh       chan struct{}
 	wake         chan struct{}
-	workerSem    chan struct{}
 	wg           sync.WaitGroup
 
+	// Concurrency slot admission, see sched.go. Guarded by mu.
+	seq          uint64 // submission counter
+	slotsUsed    int
+	waiters      []*slotWaiter
+	groupRunning map[string]int
+	resources    map[string]*resourceState
+	stats        map[string]*groupStats // per-group counters, see metrics.go
+	history      *taskHistory           // evicted tasks, see retention.go
+	gcPending    bool                   // a task finished since the last gcLocked
+
+	throttle *throttler // IO limits, see throttle.go; has its own lock
+
 	lock     fileLock
 	procHeld bool
 	released bool
+
+	kinds     map[string]WorkFunc  // guarded by mu
+	schedules map[string]*Schedule // guarded by mu
+	journal   *journal
+	replay    []*journalTask // journal contents restored by the first Start
 }
 
 // New creates an engine. In HostSingleton mode the OS file lock is taken
@@ -119,12 +201,21 @@ func New(opts ...Option) (*Engine, error) {
 	for _, opt := range opts {
 		opt(&o)
 	}
+	if err := o.validateThrottle(); err != nil {
+		return nil, err
+	}
 
 	e := &Engine{
-		opts:      o,
-		hub:       newEventHub(),
-		items:     make(map[string]*taskItem),
-		workerSem: make(chan struct{}, o.concurrency),
+		opts:         o,
+		hub:          newEventHub(),
+		items:        make(map[string]*taskItem),
+		groupRunning: make(map[string]int),
+		resources:    make(map[string]*resourceState),
+		stats:        make(map[string]*groupStats),
+		history:      newTaskHistory(o.historySize()),
+		throttle:     newThrottler(&o),
+		kinds:        make(map[string]WorkFunc),
+		schedules:    make(map[string]*Schedule),
 	}
 
 	switch o.mode {
@@ -147,9 +238,39 @@ func New(opts ...Option) (*Engine, error) {
 		}
 		e.lock = lk
 	}
+
+	// The journal is opened after the run-mode reservation so that two
+	// engines never compact the same file concurrently.
+	if o.journalPath != "" {
+		j, tasks, history, err := openJournal(o.journalPath, o.historySize())
+		if err != nil {
+			e.releaseMode()
+			return nil, err
+		}
+		e.journal = j
+		e.replay = tasks
+		for _, h := range history {
+			e.history.add(h)
+		}
+	}
 	return e, nil
 }
 
+// RegisterKind associates a WorkFunc with a task kind. A task submitted
+// with Kind set and a nil Work runs the registered function, and tasks
+// restored from the journal (see WithJournal) are bound to their kind's
+// function. Kinds used by a journal must be registered before Start. It
+// returns ErrInvalidTask for an empty kind or nil fn.
+func (e *Engine) RegisterKind(kind string, fn WorkFunc) error {
+	if kind == "" || fn == nil {
+		return fmt.Errorf("%v: empty kind or nil WorkFunc", ErrInvalidTask)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.kinds[kind] = fn
+	return nil
+}
+
 // Start launches the scheduler. It is idempotent and returns ErrEngineClosed
 // after Shutdown.
 func (e *Engine) Start() error {
@@ -164,6 +285,10 @@ func (e *Engine) Start() error {
 	e.engineCtx, e.engineCancel = context.WithCancel(context.Background())
 	e.stopCh = make(chan struct{})
 	e.wake = make(chan struct{}, 1)
+	if e.replay != nil {
+		e.replayLocked(e.replay)
+		e.replay = nil
+	}
 	e.wg.Add(1)
 	go e.scheduler()
 	e.started = true
@@ -173,75 +298,129 @@ func (e *Engine) Start() error {
 
 // Submit validates and registers a task, returning its control Handle.
 // Dependencies must already be submitted; because of this ordering a
-// dependency cycle other than a self-dependency cannot form.
+// dependency cycle other than a self-dependency cannot form. A task with
+// a Kind and a nil Work runs the WorkFunc registered for that kind. With
+// WithJournal every task needs a Kind, and its submission is on stable
+// storage when Submit returns.
 func (e *Engine) Submit(t Task) (*Handle, error) {
-	if err := t.validate(); err != nil {
+	e.mu.Lock()
+	h, err := e.submitLocked(t)
+	e.mu.Unlock()
+	if err == nil {
+		e.syncJournal()
+	}
+	return h, err
+}
+
+// submitLocked is Submit for callers holding e.mu. The submit record is
+// written but not synced.
+func (e *Engine) submitLocked(t Task) (*Handle, error) {
+	if err := e.prepareLocked(&t); err != nil {
 		return nil, err
 	}
-	e.mu.Lock()
-	defer e.mu.Unlock()
 	if e.closed {
 		return nil, ErrEngineClosed
 	}
 	if !e.started {
 		return nil, ErrEngineNotStarted
 	}
-	if _, ok := e.items[t.ID]; ok {
-		return nil, fmt.Errorf("%v: %s", ErrTaskExists, t.ID)
+	if err := e.checkIDLocked(t.ID); err != nil {
+		return nil, err
 	}
 	for _, d := range t.DependsOn {
-		if _, ok := e.items[d]; !ok {
+		if !e.knownLocked(d) {
 			return nil, fmt.Errorf("%v: %s depends on unknown task %q", ErrTaskNotFound, t.ID, d)
 		}
 	}
+	if e.journal != nil {
+		if err := e.journal.append(submitRecord(&t)); err != nil {
+			return nil, fmt.Errorf("backup: journal task %s: %v", t.ID, err)
+		}
+	}
+	return &Handle{item: e.addLocked(t)}, nil
+}
 
+// prepareLocked binds a task with a Kind and a nil Work to the registered
+// WorkFunc and validates the task definition on its own, before its ID and
+// dependencies are checked against the engine.
+func (e *Engine) prepareLocked(t *Task) error {
+	if t.Work == nil && t.Kind != "" {
+		if t.Work = e.kinds[t.Kind]; t.Work == nil {
+			return fmt.Errorf("%w: %q", ErrKindNotRegistered, t.Kind)
+		}
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if err := e.checkJournalable(t); err != nil {
+		return err
+	}
+	return e.validateResources(t)
+}
+
+// addLocked registers a validated task whose dependencies are all known,
+// publishes EventSubmitted and wakes the scheduler. A task with an
+// unsuccessful dependency is finalized right away.
+func (e *Engine) addLocked(t Task) *taskItem {
 	// Register as dependent and count dependencies that are not
 	// finished yet. Dependencies already in a terminal state cannot
 	// fire their completion path again, so resolve them right here.
 	pending := 0
-	var depErr error
+	var (
+		depErr  error
+		finalSt TaskState
+	)
 	for _, d := range t.DependsOn {
-		dep := e.items[d]
-		dep.mu.Lock()
-		depFinished, depSt := dep.finished, dep.state
-		dep.mu.Unlock()
-		dep.dependents = append(dep.dependents, t.ID)
+		var depFinished bool
+		var depSt TaskState
+		if dep := e.items[d]; dep != nil {
+			dep.mu.Lock()
+			depFinished, depSt = dep.finished, dep.state
+			dep.mu.Unlock()
+			dep.dependents = append(dep.dependents, t.ID)
+		} else {
+			// Evicted: its outcome is in the history.
+			depFinished, depSt = true, e.history.get(d).State
+		}
 		if !depFinished {
 			pending++
 			continue
 		}
-		if depSt == StateCompleted || depErr != nil {
+		if depErr != nil {
 			continue
 		}
-		if depSt == StateCancelled {
-			depErr = fmt.Errorf("%v: dependency %q was cancelled", ErrDependencyCancelled, d)
-		} else {
-			depErr = fmt.Errorf("%v: dependency %q failed", ErrDependencyFailed, d)
+		if ok, st, err := dependencyOutcome(t.dependencyPolicy(d), d, depSt); !ok {
+			depErr, finalSt = err, st
 		}
 	}
 
+	e.seq++
 	it := &taskItem{
 		engine:      e,
 		id:          t.ID,
+		seq:         e.seq,
 		task:        t,
 		state:       StatePending,
 		doneCh:      make(chan struct{}),
 		gate:        newPauseGate(),
 		depsPending: pending,
+		submitted:   time.Now(),
 	}
 	if pending > 0 && depErr == nil {
 		it.state = StateWaiting
 	}
 	it.taskCtx, it.taskCancel = context.WithCancel(e.engineCtx)
 	e.items[t.ID] = it
+	e.history.remove(t.ID)
+	e.statsLocked(t.Group).submitted++
 
 	e.hub.publish(Event{Kind: EventSubmitted, TaskID: t.ID, State: it.state})
 	if depErr != nil {
-		e.finalizeLocked(it, StateFailed, depErr)
-		return &Handle{item: it}, nil
+		e.finalizeLocked(it, finalSt, depErr)
+		return it
 	}
 	e.wakeLocked()
-	return &Handle{item: it}, nil
+	return it
 }
 
 // SubmitSync submits the task and blocks until it reaches a terminal
@@ -268,9 +447,22 @@ func (e *Engine) SubmitSync(ctx context.Context, t Task) (*Handle, error) {
 	return h, err
 }
 
+// Get returns the Handle of a known task, including tasks restored from
+// the journal. It returns ErrTaskNotFound for an unknown ID.
+func (e *Engine) Get(id string) (*Handle, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	it, ok := e.items[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+	return &Handle{item: it}, nil
+}
+
 // Subscribe registers an event consumer. If buffer is not positive the
 // engine default (WithEventBuffer) is used. It returns the event channel
-// and an unsubscribe function that closes the channel.
+// and an unsubscribe function that closes the channel. Events that do not
+// fit in the buffer are dropped, which shows as a gap in Event.Seq.
 func (e *Engine) Subscribe(buffer int) (<-chan Event, func()) {
 	if buffer <= 0 {
 		buffer = e.opts.eventBuffer
@@ -299,6 +491,9 @@ func (e *Engine) Shutdown(ctx context.Context) error {
 	e.mu.Unlock()
 
 	if !wasStarted {
+		if e.journal != nil {
+			_ = e.journal.close()
+		}
 		e.releaseMode()
 		return nil
 	}
@@ -325,6 +520,11 @@ func (e *Engine) Shutdown(ctx context.Context) error {
 	if e.engineCancel != nil {
 		e.engineCancel()
 	}
+	if e.journal != nil {
+		if cerr := e.journal.close(); cerr != nil {
+			logger.Warnf("backup: close journal: %v", cerr)
+		}
+	}
 	e.releaseMode()
 	logger.Debugf("backup: engine shut down")
 	return err
@@ -356,14 +556,30 @@ func (e *Engine) releaseMode() {
 func (e *Engine) scheduler() {
 	defer e.wg.Done()
 	defer e.onSchedulerExit()
+	var gcTick <-chan time.Time
+	if p := e.opts.retention; p != nil && p.gcInterval() > 0 {
+		t := time.NewTicker(p.gcInterval())
+		defer t.Stop()
+		gcTick = t.C
+	}
+	gc := true // tasks restored from the journal may be due for eviction
 	for {
 		e.mu.Lock()
 		ready := e.pickReadyLocked()
 		e.launchLocked(ready)
+		// Eviction only changes when a task finishes or ages out, so
+		// skip the scan on the other wakes.
+		if gc || e.gcPending {
+			e.gcPending = false
+			e.gcLocked(time.Now())
+		}
 		e.mu.Unlock()
 
+		gc = false
 		select {
 		case <-e.wake:
+		case <-gcTick:
+			gc = true
 		case <-e.stopCh:
 			return
 		}
@@ -433,7 +649,9 @@ func (e *Engine) launchLocked(ready []*taskItem) {
 		it.mu.Unlock()
 		it.inFlight = true
 		it.generation++
+		it.started = time.Now()
 		e.hub.publish(Event{Kind: EventStateChange, TaskID: it.id, State: StateRunning})
+		e.writeJournal(journalRecord{Op: journalOpState, ID: it.id, State: StateRunning.String()})
 		e.wg.Add(1)
 		go e.worker(it, it.generation)
 
@@ -463,6 +681,8 @@ func (e *Engine) worker(it *taskItem, gen int) {
 		}
 		e.mu.Unlock()
 	}()
+	policy := it.task.retryPolicy()
+	var firstStart time.Time // start of this run's first attempt
 	for {
 		if it.isFinished() {
 			return
@@ -490,9 +710,8 @@ func (e *Engine) worker(it *taskItem, gen int) {
 		}
 
 		// Acquire a concurrency slot.
-		select {
-		case e.workerSem <- struct{}{}:
-		case <-taskCtx.Done():
+		slot, err := e.acquireSlot(it, taskCtx)
+		if err != nil {
 			e.mu.Lock()
 			stale = it.generation != gen
 			e.mu.Unlock()
@@ -508,15 +727,25 @@ func (e *Engine) worker(it *taskItem, gen int) {
 			attemptCtx, cancel = context.WithTimeout(taskCtx, it.task.Timeout)
 		}
 
+		if firstStart.IsZero() {
+			firstStart = time.Now()
+		}
 		it.mu.Lock()
 		it.attempt++
+		it.attemptSeq++
 		attempt := it.attempt
+		it.result = nil // a failed attempt's result does not count
+		// Each attempt reports its progress from scratch: drop the
+		// previous attempt's steps and byte rate.
+		it.progress = Progress{UpdatedAt: time.Now()}
+		it.meter = rateMeter{}
 		it.mu.Unlock()
+		e.writeJournal(journalRecord{Op: journalOpAttempt, ID: it.id, Attempt: attempt})
 
-		err := e.runWork(it, attemptCtx)
+		err = e.runWork(it, attemptCtx)
 		ctxErr := attemptCtx.Err()
 		cancel()
-		<-e.workerSem // release slot
+		e.releaseSlot(slot)
 
 		e.mu.Lock()
 		stale = it.generation != gen
@@ -528,6 +757,11 @@ func (e *Engine) worker(it *taskItem, gen int) {
 		timedOut := errors.Is(ctxErr, context.DeadlineExceeded)
 		userCancelled := errors.Is(ctxErr, context.Canceled)
 
+		var delay time.Duration
+		retry := false
+		if err != nil && !userCancelled && policy.Retryable(err) {
+			delay, retry = policy.Backoff(attempt, time.Since(firstStart))
+		}
 		switch {
 		case err == nil:
 			e.finalize(it, StateCompleted, nil)
@@ -535,22 +769,22 @@ func (e *Engine) worker(it *taskItem, gen int) {
 		case userCancelled:
 			e.finalize(it, StateCancelled, ErrCancelled)
 			return
-		case timedOut && attempt > it.task.Retry:
-			if err == nil {
-				err = fmt.Errorf("backup: task %s timed out after %s", it.id, it.task.Timeout)
-			}
+		case timedOut && !retry:
 			e.finalize(it, StateTimedOut, err)
 			return
-		case attempt > it.task.Retry:
+		case !retry:
 			e.finalize(it, StateFailed, err)
 			return
 		}
 
 		// Schedule a retry: wait out the backoff, then loop.
+		e.mu.Lock()
+		e.statsLocked(it.task.Group).retries++
+		e.mu.Unlock()
 		e.transition(it, StateWaiting)
-		e.hub.publish(Event{Kind: EventRetry, TaskID: it.id, Attempt: attempt, Err: err, State: StateWaiting})
-		if it.task.RetryBackoff > 0 {
-			timer := time.NewTimer(it.task.RetryBackoff)
+		e.hub.publish(Event{Kind: EventRetry, TaskID: it.id, Attempt: attempt, Delay: delay, Err: err, State: StateWaiting})
+		if delay > 0 {
+			timer := time.NewTimer(delay)
 			select {
 			case <-timer.C:
 			case <-taskCtx.Done():
@@ -575,14 +809,21 @@ func (e *Engine) runWork(it *taskItem, ctx context.Context) (err error) {
 			err = fmt.Errorf("backup: task %s panicked: %v", it.id, r)
 		}
 	}()
+	ctx = context.WithValue(ctx, taskItemKey{}, it)
 	return it.task.Work(ctx, &Reporter{item: it})
 }
 
-// pauseWait blocks while the task's pause gate is closed, keeping the
-// task state in sync (StatePaused while waiting, StateRunning after
-// resume). It returns ctx.Err() if ctx is cancelled while paused, and
-// nil immediately when the gate is open.
+// pauseWait gives the task's slot back when it was preempted, then blocks
+// while the task's pause gate is closed, keeping the task state in sync
+// (StatePaused while waiting, StateRunning after resume). It returns
+// ctx.Err() if ctx is cancelled while waiting, and nil immediately when
+// the task is neither preempted nor paused.
 func (e *Engine) pauseWait(it *taskItem, ctx context.Context) error {
+	if it.preempted.Load() {
+		if err := e.yieldSlot(it, ctx); err != nil {
+			return err
+		}
+	}
 	if !it.gate.isPaused() {
 		return nil
 	}
@@ -678,6 +919,7 @@ func (e *Engine) transition(it *taskItem, st TaskState) {
 	it.state = st
 	it.mu.Unlock()
 	e.hub.publish(Event{Kind: EventStateChange, TaskID: it.id, State: st})
+	e.writeJournal(journalRecord{Op: journalOpState, ID: it.id, State: st.String()})
 }
 
 // finalize moves a task to a terminal state exactly once, publishes
@@ -724,23 +966,52 @@ func (e *Engine) finalizeLocked(it *taskItem, st TaskState, err error) {
 	it.finished = true
 	it.state = st
 	it.err = err
-	prog := it.progress
+	it.finishedAt = time.Now()
+	if st != StateCompleted {
+		it.result = nil
+	}
+	result := it.result
+	prog := it.progress.clone()
 	close(it.doneCh)
 	it.mu.Unlock()
 
 	if it.taskCancel != nil {
 		it.taskCancel()
 	}
-	e.hub.publish(Event{Kind: EventFinal, TaskID: it.id, State: st, Err: err, Progress: prog})
+	e.hub.publish(Event{Kind: EventFinal, TaskID: it.id, State: st, Err: err, Progress: prog, Result: result})
+	if !(e.closed && (st == StateCancelled || errors.Is(err, ErrDependencyCancelled))) {
+		// Cancellations caused by Shutdown stay unfinished in the
+		// journal so that the next engine resumes them.
+		rec := journalRecord{Op: journalOpFinal, ID: it.id, State: st.String()}
+		if err != nil {
+			rec.Err = err.Error()
+		}
+		if result != nil && e.journal != nil {
+			raw, jerr := json.Marshal(result)
+			if jerr != nil {
+				logger.Warnf("backup: task %s: result not journaled: %v", it.id, jerr)
+			} else {
+				rec.Result = raw
+			}
+		}
+		e.writeJournal(rec)
+	}
+	stats := e.statsLocked(it.task.Group)
+	stats.finished[st]++
+	if !it.started.IsZero() {
+		stats.duration.observe(time.Since(it.started).Seconds())
+	}
 	logger.Debugf("backup: task %s finished: state=%s err=%v", it.id, st, err)
+	e.gcPending = true
 	e.onTerminalLocked(it)
 	e.wakeLocked()
 }
 
 // onTerminalLocked updates dependents of a task that reached a terminal
-// state: success decrements their pending counter; failure or cancellation
-// finalizes them with the corresponding dependency error. Dependents that
-// are already running are left untouched.
+// state: an outcome their DependencyPolicy accepts decrements their
+// pending counter, any other finalizes them with the corresponding
+// dependency error (see dependencyOutcome). Dependents that are already
+// running are left untouched.
 func (e *Engine) onTerminalLocked(it *taskItem) {
 	for _, id := range it.dependents {
 		dep := e.items[id]
@@ -753,17 +1024,11 @@ func (e *Engine) onTerminalLocked(it *taskItem) {
 		if finished {
 			continue
 		}
-		switch it.state {
-		case StateCompleted:
-			if dep.depsPending > 0 {
-				dep.depsPending--
-			}
-		case StateCancelled:
-			e.finalizeLocked(dep, StateFailed,
-				fmt.Errorf("%v: dependency %q was cancelled", ErrDependencyCancelled, it.id))
-		default: // Failed, TimedOut
-			e.finalizeLocked(dep, StateFailed,
-				fmt.Errorf("%v: dependency %q failed", ErrDependencyFailed, it.id))
+		ok, st, err := dependencyOutcome(dep.task.dependencyPolicy(it.id), it.id, it.state)
+		if !ok {
+			e.finalizeLocked(dep, st, err)
+		} else if dep.depsPending > 0 {
+			dep.depsPending--
 		}
 	}
 }
@@ -786,21 +1051,35 @@ type taskItem struct {
 	task   Task
 
 	// Fields below are guarded by mu.
-	mu       sync.Mutex
-	state    TaskState
-	err      error
-	progress Progress
-	attempt  int
-	finished bool
-	doneCh   chan struct{}
-
-	gate *pauseGate
+	mu         sync.Mutex
+	state      TaskState
+	err        error
+	progress   Progress
+	meter      rateMeter
+	finishedAt time.Time
+	result     any // kept only once the task completed
+	attempt    int
+	attemptSeq uint64 // attempts started over all runs; never reset
+	finished   bool
+	doneCh     chan struct{}
+
+	gate *pauseGate // user pause, see Handle.Pause
+
+	// preempted asks the task to yield its slot at the next checkpoint
+	// (see preemptLocked). It is separate from gate so that preemption
+	// and user pauses do not undo each other. Written under engine.mu;
+	// read without it by Checkpoint.
+	preempted atomic.Bool
 
 	// Fields below are guarded by engine.mu.
 	depsPending int
 	dependents  []string
 	inFlight    bool
-	generation  int // incremented each time a worker takes ownership
+	generation  int         // incremented each time a worker takes ownership
+	seq         uint64      // submission order, for FIFO among equals
+	slot        *slotWaiter // concurrency slot held by the current attempt
+	started     time.Time   // when the current run was launched
+	submitted   time.Time
 
 	taskCtx    context.Context
 	taskCancel context.CancelFunc
@@ -1,9 +1,12 @@
 package backup
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -424,7 +427,7 @@ func TestDependencyFailurePropagation(t *testing.T) {
 			ctx, cancel := waitCtx(t)
 			defer cancel()
 			err = h.Wait(ctx)
-			if !errHas(err, tc.wantErr) {
+			if !errors.Is(err, tc.wantErr) {
 				t.Fatalf("child Wait = %v, want %v", err, tc.wantErr)
 			}
 			if h.State() != StateFailed {
@@ -1066,3 +1069,1891 @@ func TestWatcherRearmsOnRetry(t *testing.T) {
 		t.Fatalf("second run Wait = %v, want ErrCancelled", err)
 	}
 }
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.journal")
+
+	e1, err := New(WithJournal(path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e1.RegisterKind("ok", func(ctx context.Context, rep *Reporter) error { return nil })
+	_ = e1.RegisterKind("copy", blockingWork())
+	if err := e1.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	done, err := e1.Submit(Task{ID: "done", Kind: "ok"})
+	if err != nil {
+		t.Fatalf("Submit done: %v", err)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := done.Wait(ctx); err != nil {
+		t.Fatalf("Wait done: %v", err)
+	}
+	copyH, err := e1.Submit(Task{ID: "copy", Kind: "copy", Payload: []byte("sdb"), Retry: 2})
+	if err != nil {
+		t.Fatalf("Submit copy: %v", err)
+	}
+	if _, err := e1.Submit(Task{ID: "verify", Kind: "ok", DependsOn: []string{"copy"}}); err != nil {
+		t.Fatalf("Submit verify: %v", err)
+	}
+	waitFor(t, waitLimit, "copy running", func() bool { return copyH.State() == StateRunning })
+	if err := e1.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Second engine: the interrupted copy resumes with its payload and
+	// attempt counter, and its dependent runs after it.
+	var gotPayload atomic.Value
+	e2, err := New(WithJournal(path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e2.RegisterKind("ok", func(ctx context.Context, rep *Reporter) error { return nil })
+	_ = e2.RegisterKind("copy", func(ctx context.Context, rep *Reporter) error {
+		gotPayload.Store(string(rep.Payload()))
+		return nil
+	})
+	if err := e2.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer e2.Shutdown(context.Background())
+
+	if _, err := e2.Submit(Task{ID: "done", Kind: "ok"}); !errHas(err, ErrTaskExists) {
+		t.Errorf("resubmit finished task = %v, want ErrTaskExists", err)
+	}
+	h, err := e2.Get("done")
+	if err != nil || h.State() != StateCompleted {
+		t.Errorf("restored done = %v, %v; want completed", h, err)
+	}
+	verify, err := e2.Get("verify")
+	if err != nil {
+		t.Fatalf("Get verify: %v", err)
+	}
+	if err := verify.Wait(ctx); err != nil {
+		t.Fatalf("Wait verify: %v", err)
+	}
+	if got, _ := gotPayload.Load().(string); got != "sdb" {
+		t.Errorf("payload = %q, want sdb", got)
+	}
+	copyH, _ = e2.Get("copy")
+	copyH.item.mu.Lock()
+	attempt := copyH.item.attempt
+	copyH.item.mu.Unlock()
+	if attempt != 2 {
+		t.Errorf("copy attempt = %d, want 2 (one before restart, one after)", attempt)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.journal")
+	const n = 200
+	e1, err := New(WithJournal(path), WithConcurrency(4))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	e1.journal.compactMin, e1.journal.compactAt = 4096, 4096
+	_ = e1.RegisterKind("ok", func(ctx context.Context, rep *Reporter) error { return nil })
+	if err := e1.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		h, err := e1.Submit(Task{ID: fmt.Sprintf("t%03d", i), Kind: "ok"})
+		if err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		_ = h.Wait(ctx)
+	}
+	// Compaction drops the state records of finished tasks.
+	waitFor(t, waitLimit, "compaction", func() bool {
+		data, err := os.ReadFile(path)
+		return err == nil && bytes.Count(data, []byte(`"op":"state"`)) < n
+	})
+	_ = e1.Shutdown(ctx)
+
+	e2, err := New(WithJournal(path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e2.RegisterKind("ok", func(ctx context.Context, rep *Reporter) error { return nil })
+	if err := e2.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer e2.Shutdown(context.Background())
+	got := e2.List(TaskFilter{States: []TaskState{StateCompleted}})
+	if len(got) != n {
+		t.Errorf("restored %d completed tasks, want %d", len(got), n)
+	}
+}
+
+func TestJournalUnregisteredKind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.journal")
+
+	e1, err := New(WithJournal(path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e1.RegisterKind("gone", blockingWork())
+	if err := e1.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if _, err := e1.Submit(Task{ID: "orphan", Kind: "gone"}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if _, err := e1.Submit(Task{ID: "anon", Kind: "missing"}); !errors.Is(err, ErrKindNotRegistered) {
+		t.Errorf("Submit unknown kind = %v, want ErrKindNotRegistered", err)
+	}
+	// A closure cannot be restored from the journal.
+	work := func(ctx context.Context, rep *Reporter) error { return nil }
+	if _, err := e1.Submit(Task{ID: "closure", Work: work}); !errHas(err, ErrInvalidTask) {
+		t.Errorf("Submit without Kind = %v, want ErrInvalidTask", err)
+	}
+	if _, err := e1.SubmitGraph([]Task{{ID: "g1", Kind: "gone"}, {ID: "g2", Work: work}}); !errHas(err, ErrInvalidTask) {
+		t.Errorf("SubmitGraph without Kind = %v, want ErrInvalidTask", err)
+	}
+	_ = e1.Shutdown(context.Background())
+
+	e2 := startEngine(t, WithJournal(path))
+	h, err := e2.Get("orphan")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := h.Wait(ctx); !errors.Is(err, ErrKindNotRegistered) {
+		t.Errorf("Wait = %v, want ErrKindNotRegistered", err)
+	}
+	if err := h.Retry(); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Retry = %v, want ErrInvalidState", err)
+	}
+}
+
+// waitersQueued reports the number of workers waiting for a slot.
+func waitersQueued(e *Engine) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.waiters)
+}
+
+// recordingWork returns a WorkFunc that appends id to order.
+func recordingWork(mu *sync.Mutex, order *[]string, id string) WorkFunc {
+	return func(ctx context.Context, rep *Reporter) error {
+		mu.Lock()
+		*order = append(*order, id)
+		mu.Unlock()
+		return nil
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	e := startEngine(t, WithConcurrency(1))
+	release := make(chan struct{})
+	blocker, err := e.Submit(Task{ID: "blocker", Work: func(ctx context.Context, rep *Reporter) error {
+		<-release
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "blocker running", func() bool { return blocker.State() == StateRunning })
+
+	var mu sync.Mutex
+	var order []string
+	var handles []*Handle
+	for _, tc := range []struct {
+		id       string
+		priority int
+	}{{"low-1", 0}, {"low-2", 0}, {"high", 10}, {"mid", 5}} {
+		h, err := e.Submit(Task{ID: tc.id, Priority: tc.priority, Work: recordingWork(&mu, &order, tc.id)})
+		if err != nil {
+			t.Fatalf("Submit %s: %v", tc.id, err)
+		}
+		handles = append(handles, h)
+	}
+	waitFor(t, waitLimit, "all queued", func() bool { return waitersQueued(e) == 4 })
+	close(release)
+
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	for _, h := range handles {
+		if err := h.Wait(ctx); err != nil {
+			t.Fatalf("Wait %s: %v", h.ID(), err)
+		}
+	}
+	want := []string{"high", "mid", "low-1", "low-2"}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+}
+
+func TestGroupWeightedFairShare(t *testing.T) {
+	e := startEngine(t, WithConcurrency(3), WithGroupWeight("tenant-a", 2))
+	release := make(chan struct{})
+	var blockers []*Handle
+	for i := 0; i < 3; i++ {
+		h, err := e.Submit(Task{ID: fmt.Sprintf("blocker-%d", i), Work: func(ctx context.Context, rep *Reporter) error {
+			<-release
+			return nil
+		}})
+		if err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		blockers = append(blockers, h)
+	}
+	waitFor(t, waitLimit, "blockers running", func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.slotsUsed == 3
+	})
+
+	// Six tenant-a tasks are queued before three tenant-b tasks; with
+	// weights 2:1 the three freed slots go a, b, a (the recorded order
+	// may interleave since the admitted tasks run concurrently).
+	gate := make(chan struct{})
+	var mu sync.Mutex
+	var admitted []string
+	for _, id := range []string{"a1", "a2", "a3", "a4", "a5", "a6", "b1", "b2", "b3"} {
+		id := id
+		group := "tenant-a"
+		if id[0] == 'b' {
+			group = "tenant-b"
+		}
+		_, err := e.Submit(Task{ID: id, Group: group, Work: func(ctx context.Context, rep *Reporter) error {
+			mu.Lock()
+			admitted = append(admitted, id[:1])
+			mu.Unlock()
+			select {
+			case <-gate:
+			case <-ctx.Done():
+			}
+			return nil
+		}})
+		if err != nil {
+			t.Fatalf("Submit %s: %v", id, err)
+		}
+	}
+	waitFor(t, waitLimit, "all queued", func() bool { return waitersQueued(e) == 9 })
+
+	close(release)
+	waitFor(t, waitLimit, "three admitted", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(admitted) == 3
+	})
+	mu.Lock()
+	got := fmt.Sprint(admitted)
+	mu.Unlock()
+	if strings.Count(got, "a") != 2 || strings.Count(got, "b") != 1 {
+		t.Errorf("admitted groups = %s, want two of tenant-a and one of tenant-b", got)
+	}
+	close(gate)
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	for _, h := range blockers {
+		_ = h.Wait(ctx)
+	}
+}
+
+func TestPreemption(t *testing.T) {
+	e := startEngine(t, WithConcurrency(1), WithPreemption(10))
+	var lowTicks atomic.Int32
+	low, err := e.Submit(Task{ID: "full-backup", Work: func(ctx context.Context, rep *Reporter) error {
+		for lowTicks.Load() < 50 {
+			if err := rep.Checkpoint(ctx); err != nil {
+				return err
+			}
+			lowTicks.Add(1)
+			time.Sleep(2 * time.Millisecond)
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "backup running", func() bool { return lowTicks.Load() > 0 })
+
+	urgentRan := make(chan struct{})
+	urgent, err := e.Submit(Task{ID: "restore", Priority: 10, Work: func(ctx context.Context, rep *Reporter) error {
+		if st := low.State(); st != StatePaused {
+			t.Errorf("preempted task state = %v, want paused", st)
+		}
+		close(urgentRan)
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := urgent.Wait(ctx); err != nil {
+		t.Fatalf("urgent Wait: %v", err)
+	}
+	<-urgentRan
+	if lowTicks.Load() >= 50 {
+		t.Errorf("low priority task finished before the urgent one was admitted")
+	}
+	if err := low.Wait(ctx); err != nil {
+		t.Fatalf("low Wait: %v", err)
+	}
+}
+
+// overlapWork returns a WorkFunc that tracks how many tasks sharing the
+// counters run at the same time.
+// slotsUsed returns the number of concurrency slots held.
+func slotsUsed(e *Engine) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.slotsUsed
+}
+
+// gatedWork returns a WorkFunc that runs until release is closed.
+func gatedWork(release <-chan struct{}) WorkFunc {
+	return func(ctx context.Context, rep *Reporter) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestPreemptionAndUserPause(t *testing.T) {
+	e := startEngine(t, WithConcurrency(1), WithPreemption(10))
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+
+	// Preempted, then paused by the user while waiting for a slot: the
+	// task stays paused after it is re-admitted.
+	var ticks atomic.Int32
+	low, err := e.Submit(Task{ID: "low", Work: func(ctx context.Context, rep *Reporter) error {
+		for ticks.Load() < 1000 {
+			if err := rep.Checkpoint(ctx); err != nil {
+				return err
+			}
+			ticks.Add(1)
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "low running", func() bool { return ticks.Load() > 0 })
+	release := make(chan struct{})
+	urgent, err := e.Submit(Task{ID: "urgent", Priority: 10, Work: gatedWork(release)})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "urgent running", func() bool { return urgent.State() == StateRunning })
+	if err := low.Pause(); err != nil {
+		t.Fatalf("Pause of a preempted task: %v", err)
+	}
+	close(release)
+	_ = urgent.Wait(ctx)
+	waitFor(t, waitLimit, "low re-admitted", func() bool { return slotsUsed(e) == 1 })
+	n := ticks.Load()
+	time.Sleep(20 * time.Millisecond)
+	if st := low.State(); st != StatePaused || ticks.Load() != n {
+		t.Errorf("low after re-admission = %v, %d ticks (was %d); want paused", st, ticks.Load(), n)
+	}
+	if err := low.Resume(); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	_ = low.Cancel()
+	_ = low.Wait(ctx)
+
+	// Preempted, then resumed by the user before its checkpoint: the
+	// Resume does not cancel the preemption and the waiter gets the slot.
+	reached := make(chan struct{})
+	proceed := make(chan struct{})
+	low2, err := e.Submit(Task{ID: "low-2", Work: func(ctx context.Context, rep *Reporter) error {
+		close(reached)
+		<-proceed
+		if err := rep.Checkpoint(ctx); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	<-reached
+	urgent2, err := e.Submit(Task{ID: "urgent-2", Priority: 10, Work: func(ctx context.Context, rep *Reporter) error { return nil }})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "urgent-2 queued", func() bool { return waitersQueued(e) == 1 })
+	if err := low2.Resume(); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Resume of a preempted task = %v, want ErrInvalidState", err)
+	}
+	close(proceed)
+	if err := urgent2.Wait(ctx); err != nil {
+		t.Fatalf("urgent-2 Wait: %v", err)
+	}
+	_ = low2.Cancel()
+	_ = low2.Wait(ctx)
+}
+
+func TestPreemptionWeight(t *testing.T) {
+	e := startEngine(t, WithConcurrency(2), WithPreemption(10))
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	checkpointed := func(ctx context.Context, rep *Reporter) error {
+		for {
+			if err := rep.Checkpoint(ctx); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(2 * time.Millisecond):
+			}
+		}
+	}
+	submit := func(task Task) *Handle {
+		t.Helper()
+		h, err := e.Submit(task)
+		if err != nil {
+			t.Fatalf("Submit %s: %v", task.ID, err)
+		}
+		return h
+	}
+
+	// A waiter of weight 2 cannot run on the slot of one victim: it
+	// preempts both low-priority tasks.
+	low1 := submit(Task{ID: "low-1", Work: checkpointed})
+	low2 := submit(Task{ID: "low-2", Work: checkpointed})
+	waitFor(t, waitLimit, "low running", func() bool { return slotsUsed(e) == 2 })
+	heavy := submit(Task{ID: "heavy", Priority: 10, Weight: 2, Work: func(ctx context.Context, rep *Reporter) error {
+		if low1.State() != StatePaused || low2.State() != StatePaused {
+			t.Errorf("low tasks = %v, %v; want both paused", low1.State(), low2.State())
+		}
+		return nil
+	}})
+	if err := heavy.Wait(ctx); err != nil {
+		t.Fatalf("heavy Wait: %v", err)
+	}
+	waitFor(t, waitLimit, "low resumed", func() bool {
+		return low1.State() == StateRunning && low2.State() == StateRunning
+	})
+	_ = low2.Cancel()
+	_ = low2.Wait(ctx)
+
+	// With one slot held by a task of the waiter's own priority, the
+	// waiter cannot be satisfied: the low task is left alone.
+	release := make(chan struct{})
+	peer := submit(Task{ID: "peer", Priority: 10, Work: gatedWork(release)})
+	waitFor(t, waitLimit, "peer running", func() bool { return peer.State() == StateRunning })
+	heavy2 := submit(Task{ID: "heavy-2", Priority: 10, Weight: 2, Work: func(ctx context.Context, rep *Reporter) error { return nil }})
+	waitFor(t, waitLimit, "heavy-2 queued", func() bool { return waitersQueued(e) == 1 })
+	time.Sleep(20 * time.Millisecond)
+	if st := low1.State(); st != StateRunning {
+		t.Errorf("low-1 = %v while the waiter cannot be satisfied, want running", st)
+	}
+	close(release)
+	if err := heavy2.Wait(ctx); err != nil {
+		t.Fatalf("heavy-2 Wait: %v", err)
+	}
+	_ = low1.Cancel()
+	_ = low1.Wait(ctx)
+}
+
+func TestSetConcurrency(t *testing.T) {
+	e := startEngine(t, WithConcurrency(1))
+	var hs []*Handle
+	for i := 0; i < 3; i++ {
+		h, err := e.Submit(Task{ID: fmt.Sprintf("t%d", i), Work: blockingWork()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs = append(hs, h)
+	}
+	waitFor(t, waitLimit, "one running, two queued", func() bool {
+		return slotsUsed(e) == 1 && waitersQueued(e) == 2
+	})
+
+	e.SetConcurrency(3)
+	waitFor(t, waitLimit, "all three running", func() bool {
+		return slotsUsed(e) == 3 && waitersQueued(e) == 0
+	})
+
+	// Lowering the limit does not interrupt running tasks; new ones wait
+	// until the running count drops below it.
+	e.SetConcurrency(1)
+	e.SetConcurrency(0) // ignored
+	if m := e.Metrics(); m.Concurrency != 1 || m.SlotsUsed != 3 {
+		t.Fatalf("metrics: concurrency %d, used %d", m.Concurrency, m.SlotsUsed)
+	}
+	late, err := e.Submit(Task{ID: "late", Work: func(ctx context.Context, rep *Reporter) error { return nil }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, waitLimit, "late queued", func() bool { return waitersQueued(e) == 1 })
+	for _, h := range hs[:2] {
+		_ = h.Cancel()
+		<-h.Done()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if st := late.State(); st.Terminal() || waitersQueued(e) != 1 {
+		t.Fatalf("late admitted over the lowered limit (state %s)", st)
+	}
+	_ = hs[2].Cancel()
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := late.Wait(ctx); err != nil {
+		t.Fatalf("late: %v", err)
+	}
+}
+
+func TestTaskWeight(t *testing.T) {
+	e := startEngine(t, WithConcurrency(4))
+	if _, err := e.Submit(Task{ID: "bad", Weight: -1, Work: blockingWork()}); !errHas(err, ErrInvalidTask) {
+		t.Fatalf("negative weight: %v", err)
+	}
+
+	release := map[string]chan struct{}{}
+	submit := func(id string, weight int) *Handle {
+		t.Helper()
+		release[id] = make(chan struct{})
+		h, err := e.Submit(Task{ID: id, Weight: weight, Work: gatedWork(release[id])})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	heavy1 := submit("heavy1", 3)
+	waitFor(t, waitLimit, "heavy1 running", func() bool { return slotsUsed(e) == 3 })
+	submit("light1", 1)
+	waitFor(t, waitLimit, "light1 running", func() bool { return slotsUsed(e) == 4 })
+
+	// heavy2 does not fit; light2, queued behind it, must not overtake it.
+	submit("heavy2", 3)
+	light2 := submit("light2", 1)
+	waitFor(t, waitLimit, "two queued", func() bool { return waitersQueued(e) == 2 })
+	close(release["light1"])
+	time.Sleep(20 * time.Millisecond)
+	if n := slotsUsed(e); n != 3 || waitersQueued(e) != 2 {
+		t.Fatalf("light2 overtook heavy2: %d slots used, %d queued", n, waitersQueued(e))
+	}
+	close(release["heavy1"])
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := heavy1.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, waitLimit, "heavy2 and light2 running", func() bool {
+		return slotsUsed(e) == 4 && waitersQueued(e) == 0
+	})
+	if m := e.Metrics(); m.Groups[""].Running != 2 {
+		t.Fatalf("running = %d, want 2 tasks", m.Groups[""].Running)
+	}
+	close(release["heavy2"])
+	close(release["light2"])
+	if err := light2.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A task heavier than the engine runs alone instead of never.
+	huge := submit("huge", 10)
+	waitFor(t, waitLimit, "huge running", func() bool { return slotsUsed(e) == 4 })
+	close(release["huge"])
+	if err := huge.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var b tokenBucket
+	b.configure(t0, 100, 500*time.Millisecond) // 50 tokens of burst
+	if d := b.reserve(t0, 50); d != 0 {
+		t.Fatalf("burst reservation waits %v", d)
+	}
+	if d := b.reserve(t0, 100); d != time.Second {
+		t.Fatalf("debt of 100 at 100/s waits %v, want 1s", d)
+	}
+	// Half a second later half of the debt is repaid.
+	if d := b.reserve(t0.Add(500*time.Millisecond), 0); d != 500*time.Millisecond {
+		t.Fatalf("remaining wait %v, want 500ms", d)
+	}
+	b.refund(100)
+	// Idle time refills up to the burst only.
+	if d := b.reserve(t0.Add(time.Hour), 50); d != 0 || b.tokens != 0 {
+		t.Fatalf("after idle: wait %v, tokens %v", d, b.tokens)
+	}
+	// Lowering the rate keeps the level and slows the refill.
+	b.configure(t0.Add(time.Hour), 10, 0)
+	if d := b.reserve(t0.Add(time.Hour), 5); d != 500*time.Millisecond {
+		t.Fatalf("after reconfigure: wait %v, want 500ms", d)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	if _, err := New(WithThrottle(Limit{BytesPerSec: -1})); !errHas(err, ErrInvalidLimit) {
+		t.Fatalf("negative limit: %v", err)
+	}
+	// 1000 B/s with 100ms of burst: the first 100 bytes pass at once,
+	// each further 100 bytes take 100ms.
+	e := startEngine(t, WithConcurrency(2), WithThrottle(Limit{BytesPerSec: 1000, Burst: 100 * time.Millisecond}))
+	copyWork := func(calls int, took *time.Duration) WorkFunc {
+		return func(ctx context.Context, rep *Reporter) error {
+			start := time.Now()
+			for i := 0; i < calls; i++ {
+				if err := rep.Throttle(ctx, 100); err != nil {
+					return err
+				}
+			}
+			*took = time.Since(start)
+			return nil
+		}
+	}
+	run := func(id string, group string, calls int) time.Duration {
+		t.Helper()
+		var took time.Duration
+		h, err := e.Submit(Task{ID: id, Group: group, Work: copyWork(calls, &took)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := waitCtx(t)
+		defer cancel()
+		if err := h.Wait(ctx); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		return took
+	}
+	time.Sleep(100 * time.Millisecond) // let the bucket fill
+	if took := run("global", "", 4); took < 250*time.Millisecond || took > 2*time.Second {
+		t.Fatalf("400 bytes at 1000 B/s took %v, want about 300ms", took)
+	}
+
+	// A group limit applies on top of the global one.
+	if err := e.SetThrottle(Limit{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetGroupThrottle("slow", Limit{OpsPerSec: 20, Burst: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if took := run("fast", "", 20); took > 100*time.Millisecond {
+		t.Fatalf("unthrottled group took %v", took)
+	}
+	if took := run("slow", "slow", 5); took < 150*time.Millisecond {
+		t.Fatalf("5 ops at 20/s took %v, want about 200ms", took)
+	}
+	if err := e.SetGroupThrottle("slow", Limit{OpsPerSec: -1}); !errHas(err, ErrInvalidLimit) {
+		t.Fatalf("negative group limit: %v", err)
+	}
+
+	// A cancelled wait gives its reservation back.
+	if err := e.SetThrottle(Limit{BytesPerSec: 10}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := e.Submit(Task{ID: "cancelled", Work: func(ctx context.Context, rep *Reporter) error {
+		_ = rep.Throttle(ctx, 10)     // the burst
+		return rep.Throttle(ctx, 1e6) // a day of debt
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	_ = h.Cancel()
+	<-h.Done()
+	e.throttle.mu.Lock()
+	tokens := e.throttle.all.bytes.tokens
+	e.throttle.mu.Unlock()
+	if tokens < -1 {
+		t.Fatalf("bucket level %v after cancel, want the debt refunded", tokens)
+	}
+}
+
+func TestThrottleSchedule(t *testing.T) {
+	e := startEngine(t,
+		WithThrottle(Limit{BytesPerSec: 1000}),
+		WithGroupThrottle("tenant-a", Limit{OpsPerSec: 10}),
+		WithThrottleSchedule(ThrottleSchedule{Location: time.UTC, Rules: []ThrottleRule{{
+			Window: Window{Start: 8 * time.Hour, End: 18 * time.Hour},
+			Global: Limit{BytesPerSec: 100},
+			Groups: map[string]Limit{"tenant-b": {OpsPerSec: 1}},
+		}}}),
+	)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at         time.Duration
+		group      string
+		bytes, ops int64
+	}{
+		{3 * time.Hour, "tenant-a", 1000, 10},
+		{3 * time.Hour, "tenant-b", 1000, 0},
+		{9 * time.Hour, "tenant-a", 100, 10}, // not named by the rule: base limit
+		{9 * time.Hour, "tenant-b", 100, 1},
+		{18 * time.Hour, "tenant-b", 1000, 0},
+	}
+	for _, tc := range tests {
+		e.throttle.mu.Lock()
+		g, grp := e.throttle.limitsLocked(day.Add(tc.at), tc.group)
+		e.throttle.mu.Unlock()
+		if g.BytesPerSec != tc.bytes || grp.OpsPerSec != tc.ops {
+			t.Errorf("%v %s: global %+v, group %+v", tc.at, tc.group, g, grp)
+		}
+	}
+
+	if err := e.SetThrottleSchedule(ThrottleSchedule{Rules: []ThrottleRule{{Window: Window{Start: 25 * time.Hour}}}}); !errHas(err, ErrInvalidLimit) {
+		t.Fatalf("window outside a day: %v", err)
+	}
+	if err := e.SetThrottleSchedule(ThrottleSchedule{}); err != nil {
+		t.Fatal(err)
+	}
+	e.throttle.mu.Lock()
+	g, _ := e.throttle.limitsLocked(day.Add(9*time.Hour), "")
+	e.throttle.mu.Unlock()
+	if g.BytesPerSec != 1000 {
+		t.Fatalf("schedule not removed: %+v", g)
+	}
+}
+
+func overlapWork(cur, peak *atomic.Int32) WorkFunc {
+	return func(ctx context.Context, rep *Reporter) error {
+		n := cur.Add(1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		cur.Add(-1)
+		return nil
+	}
+}
+
+func TestResources(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		res      Resource
+		wantPeak int32
+	}{
+		{"exclusive", nil, Resource{Key: "/dev/sdb"}, 1},
+		{"shared", nil, Resource{Key: "/dev/sdb", Mode: Shared}, 4},
+		{"counted", []Option{WithResourceLimit("disk-io-slots", 2)}, Resource{Key: "disk-io-slots", Mode: Shared}, 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := startEngine(t, append([]Option{WithConcurrency(4)}, tc.opts...)...)
+			var cur, peak atomic.Int32
+			var handles []*Handle
+			for i := 0; i < 4; i++ {
+				h, err := e.Submit(Task{
+					ID:        fmt.Sprintf("%s-%d", tc.name, i),
+					Resources: []Resource{tc.res},
+					Work:      overlapWork(&cur, &peak),
+				})
+				if err != nil {
+					t.Fatalf("Submit: %v", err)
+				}
+				handles = append(handles, h)
+			}
+			ctx, cancel := waitCtx(t)
+			defer cancel()
+			for _, h := range handles {
+				if err := h.Wait(ctx); err != nil {
+					t.Fatalf("Wait %s: %v", h.ID(), err)
+				}
+			}
+			if got := peak.Load(); got != tc.wantPeak {
+				t.Errorf("peak overlap = %d, want %d", got, tc.wantPeak)
+			}
+		})
+	}
+}
+
+func TestResourcesNoDeadlock(t *testing.T) {
+	e := startEngine(t, WithConcurrency(4))
+	var cur, peak atomic.Int32
+	var handles []*Handle
+	for i := 0; i < 6; i++ {
+		res := []Resource{{Key: "disk-a"}, {Key: "disk-b"}}
+		if i%2 == 1 {
+			res[0], res[1] = res[1], res[0]
+		}
+		h, err := e.Submit(Task{ID: fmt.Sprintf("ab-%d", i), Resources: res, Work: overlapWork(&cur, &peak)})
+		if err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		handles = append(handles, h)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	for _, h := range handles {
+		if err := h.Wait(ctx); err != nil {
+			t.Fatalf("Wait %s: %v", h.ID(), err)
+		}
+	}
+	if got := peak.Load(); got != 1 {
+		t.Errorf("peak overlap = %d, want 1", got)
+	}
+}
+
+func TestResourceValidation(t *testing.T) {
+	e := startEngine(t, WithResourceLimit("slots", 2))
+	work := func(ctx context.Context, rep *Reporter) error { return nil }
+	cases := []struct {
+		name string
+		res  []Resource
+	}{
+		{"empty key", []Resource{{}}},
+		{"duplicate", []Resource{{Key: "a"}, {Key: "a", Mode: Shared}}},
+		{"bad mode", []Resource{{Key: "a", Mode: ResourceMode(7)}}},
+		{"over limit", []Resource{{Key: "slots", Mode: Shared, Count: 3}}},
+	}
+	for _, c := range cases {
+		if _, err := e.Submit(Task{ID: c.name, Resources: c.res, Work: work}); !errHas(err, ErrInvalidTask) {
+			t.Errorf("%s: Submit = %v, want ErrInvalidTask", c.name, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	loc := time.UTC
+	base := time.Date(2024, 1, 31, 1, 30, 0, 0, loc) // Wednesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 2 * * *", time.Date(2024, 1, 31, 2, 0, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 1, 45, 0, 0, loc)},
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, loc)},
+		{"30 1 * * sat,sun", time.Date(2024, 2, 3, 1, 30, 0, 0, loc)},
+		{"0 9 29 feb *", time.Date(2024, 2, 29, 9, 0, 0, 0, loc)},
+		{"0 12 * * 7", time.Date(2024, 2, 4, 12, 0, 0, 0, loc)},
+		{"0 3 1-7 * 1", time.Date(2024, 2, 1, 3, 0, 0, 0, loc)}, // dom or dow
+		{"@hourly", time.Date(2024, 1, 31, 2, 0, 0, 0, loc)},
+	}
+	for _, tc := range tests {
+		c, err := parseCron(tc.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tc.expr, err)
+		}
+		if got := c.next(base); !got.Equal(tc.want) {
+			t.Errorf("next(%q) = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* * * * mon-", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(bad); !errHas(err, ErrInvalidSchedule) {
+			t.Errorf("parseCron(%q) = %v, want ErrInvalidSchedule", bad, err)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(d time.Weekday, h, m int) time.Time {
+		// 2024-01-07 is a Sunday.
+		return time.Date(2024, 1, 7+int(d), h, m, 0, 0, time.UTC)
+	}
+	night := Window{Start: 22 * time.Hour, End: 2 * time.Hour, Days: []time.Weekday{time.Friday}}
+	tests := []struct {
+		w    Window
+		t    time.Time
+		want bool
+	}{
+		{Window{Start: time.Hour, End: 3 * time.Hour}, at(time.Monday, 1, 0), true},
+		{Window{Start: time.Hour, End: 3 * time.Hour}, at(time.Monday, 3, 0), false},
+		{night, at(time.Friday, 23, 0), true},
+		{night, at(time.Saturday, 1, 59), true},
+		{night, at(time.Saturday, 23, 0), false},
+		{night, at(time.Friday, 1, 0), false},
+	}
+	for i, tc := range tests {
+		if got := tc.w.contains(tc.t); got != tc.want {
+			t.Errorf("case %d: contains(%v) = %v, want %v", i, tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestScheduleEvery(t *testing.T) {
+	tests := []struct {
+		name       string
+		overlap    OverlapPolicy
+		wantMissed bool
+	}{
+		{"skip", OverlapSkip, true},
+		// Runs fall due faster than they finish: the waiting run is
+		// replaced by later ones.
+		{"queue", OverlapQueue, true},
+		{"cancel previous", OverlapCancelPrevious, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := startEngine(t)
+			ch, unsubscribe := e.Subscribe(1024)
+			defer unsubscribe()
+
+			var runs, active, overlaps atomic.Int32
+			s, err := e.Schedule(ScheduleSpec{
+				ID:      "every",
+				Every:   20 * time.Millisecond,
+				Overlap: tc.overlap,
+				Template: Task{Work: func(ctx context.Context, rep *Reporter) error {
+					runs.Add(1)
+					if active.Add(1) > 1 {
+						overlaps.Add(1)
+					}
+					defer active.Add(-1)
+					select {
+					case <-time.After(50 * time.Millisecond):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					return nil
+				}},
+			})
+			if err != nil {
+				t.Fatalf("Schedule: %v", err)
+			}
+			if _, err := e.Schedule(ScheduleSpec{ID: "every", Every: time.Second, Template: Task{Work: blockingWork()}}); !errHas(err, ErrScheduleExists) {
+				t.Errorf("duplicate Schedule = %v, want ErrScheduleExists", err)
+			}
+			waitFor(t, waitLimit, "three runs", func() bool { return runs.Load() >= 3 })
+			s.Stop()
+			if !s.Next().IsZero() {
+				t.Errorf("Next after Stop = %v, want zero", s.Next())
+			}
+
+			var missed, cancelled int
+			for draining := true; draining; {
+				select {
+				case ev := <-ch:
+					if ev.Kind == EventMissed {
+						missed++
+						if !errors.Is(ev.Err, ErrRunMissed) || !strings.HasPrefix(ev.TaskID, "every@") {
+							t.Errorf("missed event = %+v", ev)
+						}
+					}
+					if ev.Kind == EventFinal && ev.State == StateCancelled {
+						cancelled++
+					}
+				default:
+					draining = false
+				}
+			}
+			if (missed > 0) != tc.wantMissed {
+				t.Errorf("missed events = %d, want missed=%v", missed, tc.wantMissed)
+			}
+			if tc.overlap == OverlapCancelPrevious && cancelled == 0 {
+				t.Errorf("no run was cancelled by the next one")
+			}
+			if n := overlaps.Load(); n > 0 {
+				t.Errorf("%d runs started while the previous one was active", n)
+			}
+		})
+	}
+}
+
+func TestScheduleMaintenanceWindow(t *testing.T) {
+	e := startEngine(t)
+	ch, unsubscribe := e.Subscribe(64)
+	defer unsubscribe()
+
+	var runs atomic.Int32
+	s, err := e.Schedule(ScheduleSpec{
+		ID:          "blocked",
+		Every:       10 * time.Millisecond,
+		Maintenance: []Window{{Start: 0, End: 24 * time.Hour}},
+		Template: Task{Work: func(ctx context.Context, rep *Reporter) error {
+			runs.Add(1)
+			return nil
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	defer s.Stop()
+
+	select {
+	case ev := <-ch:
+		if ev.Kind != EventMissed || !strings.Contains(ev.Err.Error(), "maintenance") {
+			t.Errorf("event = %+v, want missed in maintenance window", ev)
+		}
+	case <-time.After(waitLimit):
+		t.Fatal("timeout waiting for missed event")
+	}
+	if n := runs.Load(); n != 0 {
+		t.Errorf("runs = %d, want 0", n)
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	e := startEngine(t)
+	work := Task{Work: blockingWork()}
+	cases := []ScheduleSpec{
+		{Cron: "* * * * *", Template: work},
+		{ID: "both", Cron: "* * * * *", Every: time.Second, Template: work},
+		{ID: "neither", Template: work},
+		{ID: "bad-cron", Cron: "61 * * * *", Template: work},
+		{ID: "bad-window", Every: time.Second, Template: work, Maintenance: []Window{{Start: 25 * time.Hour}}},
+	}
+	for _, spec := range cases {
+		if _, err := e.Schedule(spec); !errHas(err, ErrInvalidSchedule) {
+			t.Errorf("Schedule(%q) = %v, want ErrInvalidSchedule", spec.ID, err)
+		}
+	}
+	if _, err := e.Schedule(ScheduleSpec{ID: "no-work", Every: time.Second}); !errHas(err, ErrInvalidTask) {
+		t.Errorf("Schedule without work = %v, want ErrInvalidTask", err)
+	}
+	// The template gets the checks Submit applies to each run.
+	badRes := Task{Work: blockingWork(), Resources: []Resource{{Key: ""}}}
+	if _, err := e.Schedule(ScheduleSpec{ID: "bad-res", Every: time.Second, Template: badRes}); !errHas(err, ErrInvalidTask) {
+		t.Errorf("Schedule with a bad resource = %v, want ErrInvalidTask", err)
+	}
+	badDep := Task{Work: blockingWork(), DependsOn: []string{"nope"}}
+	if _, err := e.Schedule(ScheduleSpec{ID: "bad-dep", Every: time.Second, Template: badDep}); !errHas(err, ErrTaskNotFound) {
+		t.Errorf("Schedule with an unknown dependency = %v, want ErrTaskNotFound", err)
+	}
+
+	j := startEngine(t, WithJournal(filepath.Join(t.TempDir(), "tasks.journal")))
+	if _, err := j.Schedule(ScheduleSpec{ID: "closure", Every: time.Second, Template: work}); !errHas(err, ErrInvalidTask) {
+		t.Errorf("Schedule without Kind on a journaled engine = %v, want ErrInvalidTask", err)
+	}
+}
+
+func TestScheduleStopDropsQueued(t *testing.T) {
+	e := startEngine(t)
+	ch, unsubscribe := e.Subscribe(256)
+	defer unsubscribe()
+
+	s, err := e.Schedule(ScheduleSpec{
+		ID:       "slow",
+		Every:    10 * time.Millisecond,
+		Overlap:  OverlapQueue,
+		Template: Task{Work: blockingWork()},
+	})
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	waitFor(t, waitLimit, "queued run", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return !s.queued.IsZero()
+	})
+	s.Stop()
+
+	deadline := time.After(waitLimit)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Kind == EventMissed && strings.Contains(ev.Err.Error(), "stopped") {
+				return
+			}
+		case <-deadline:
+			t.Fatal("no missed event for the queued run")
+		}
+	}
+}
+
+func TestSubmitGraph(t *testing.T) {
+	e := startEngine(t, WithConcurrency(4))
+	var mu sync.Mutex
+	var order []string
+	g, err := e.SubmitGraph([]Task{
+		{ID: "verify", DependsOn: []string{"catalog"}, Work: recordingWork(&mu, &order, "verify")},
+		{ID: "catalog", DependsOn: []string{"disk-0", "disk-1"}, Work: recordingWork(&mu, &order, "catalog")},
+		{ID: "disk-0", Work: recordingWork(&mu, &order, "disk")},
+		{ID: "disk-1", Work: recordingWork(&mu, &order, "disk")},
+	})
+	if err != nil {
+		t.Fatalf("SubmitGraph: %v", err)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := g.Wait(ctx); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if want := "[disk disk catalog verify]"; fmt.Sprint(order) != want {
+		t.Errorf("order = %v, want %s", order, want)
+	}
+	if p := g.Progress(); p.Total != 4 || p.Completed != 4 || p.Percent != 100 {
+		t.Errorf("Progress = %+v, want 4/4 completed at 100%%", p)
+	}
+	if ids := g.Handles(); len(ids) != 4 || ids[0].ID() != "verify" {
+		t.Errorf("Handles not in submission order: %v", ids)
+	}
+}
+
+func TestSubmitGraphValidation(t *testing.T) {
+	e := startEngine(t)
+	work := func(ctx context.Context, rep *Reporter) error { return nil }
+	if _, err := e.Submit(Task{ID: "existing", Work: work}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	tests := []struct {
+		name  string
+		tasks []Task
+		want  error
+	}{
+		{"cycle", []Task{
+			{ID: "a", DependsOn: []string{"c"}, Work: work},
+			{ID: "b", DependsOn: []string{"a"}, Work: work},
+			{ID: "c", DependsOn: []string{"b", "existing"}, Work: work},
+		}, ErrCycleDetected},
+		{"duplicate", []Task{{ID: "a", Work: work}, {ID: "a", Work: work}}, ErrTaskExists},
+		{"existing id", []Task{{ID: "existing", Work: work}}, ErrTaskExists},
+		{"unknown dependency", []Task{{ID: "a", DependsOn: []string{"nope"}, Work: work}}, ErrTaskNotFound},
+		{"invalid task", []Task{{ID: "a", Work: work}, {ID: "b"}}, ErrInvalidTask},
+	}
+	for _, tc := range tests {
+		if _, err := e.SubmitGraph(tc.tasks); !errHas(err, tc.want) {
+			t.Errorf("%s: SubmitGraph = %v, want %v", tc.name, err, tc.want)
+		}
+		// Nothing of a rejected graph may be registered.
+		if _, err := e.Get("a"); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("%s: task a registered after rejected graph", tc.name)
+		}
+	}
+}
+
+func TestGroupHandleControl(t *testing.T) {
+	e := startEngine(t, WithConcurrency(2))
+	checkpointing := func(ctx context.Context, rep *Reporter) error {
+		for {
+			if err := rep.Checkpoint(ctx); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(2 * time.Millisecond):
+			}
+		}
+	}
+	g, err := e.SubmitGraph([]Task{
+		{ID: "g-0", Work: checkpointing},
+		{ID: "g-1", Work: checkpointing},
+		{ID: "g-final", DependsOn: []string{"g-0", "g-1"}, Work: checkpointing},
+	})
+	if err != nil {
+		t.Fatalf("SubmitGraph: %v", err)
+	}
+	hs := g.Handles()
+	waitFor(t, waitLimit, "roots running", func() bool {
+		return hs[0].State() == StateRunning && hs[1].State() == StateRunning
+	})
+	g.Pause()
+	waitFor(t, waitLimit, "roots paused", func() bool {
+		return hs[0].State() == StatePaused && hs[1].State() == StatePaused
+	})
+	g.Resume()
+	waitFor(t, waitLimit, "roots resumed", func() bool {
+		return hs[0].State() == StateRunning && hs[1].State() == StateRunning
+	})
+	g.Cancel()
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := g.Wait(ctx); !errHas(err, ErrCancelled) {
+		t.Errorf("Wait = %v, want ErrCancelled", err)
+	}
+	if p := g.Progress(); p.Active != 0 || p.Cancelled != 3 {
+		t.Errorf("Progress = %+v, want all 3 cancelled", p)
+	}
+}
+
+func TestDependencyPolicy(t *testing.T) {
+	e := startEngine(t, WithConcurrency(2))
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	ok := func(ctx context.Context, rep *Reporter) error { return nil }
+	fail := func(ctx context.Context, rep *Reporter) error { return errBoom }
+
+	if _, err := e.Submit(Task{ID: "bad", Work: ok,
+		DependencyPolicy: map[string]DependencyPolicy{"other": RunAlways}}); !errHas(err, ErrInvalidTask) {
+		t.Fatalf("policy for a non-dependency: %v", err)
+	}
+
+	for _, copyFails := range []bool{true, false} {
+		prefix := fmt.Sprintf("fail=%v/", copyFails)
+		copyWork := ok
+		if copyFails {
+			copyWork = fail
+		}
+		var seen TaskInfo
+		g, err := e.SubmitGraph([]Task{
+			{ID: prefix + "copy", Work: copyWork},
+			{ID: prefix + "unmount", DependsOn: []string{prefix + "copy"},
+				DependencyPolicy: map[string]DependencyPolicy{prefix + "copy": RunAlways},
+				Work: func(ctx context.Context, rep *Reporter) error {
+					var err error
+					seen, err = rep.Dependency(prefix + "copy")
+					return err
+				}},
+			{ID: prefix + "compensate", DependsOn: []string{prefix + "copy"},
+				DependencyPolicy: map[string]DependencyPolicy{prefix + "copy": RunOnFailure},
+				Work:             ok},
+			{ID: prefix + "catalog", DependsOn: []string{prefix + "copy"}, Work: ok},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = g.Wait(ctx)
+		hs := g.Handles()
+		if st := hs[1].State(); st != StateCompleted {
+			t.Fatalf("%sunmount: %s (%v)", prefix, st, hs[1].Err())
+		}
+		if seen.State.Success() == copyFails || (seen.Err != nil) != copyFails {
+			t.Fatalf("%sunmount saw copy as %s (%v)", prefix, seen.State, seen.Err)
+		}
+		if copyFails {
+			if st := hs[2].State(); st != StateCompleted {
+				t.Fatalf("compensate: %s (%v)", st, hs[2].Err())
+			}
+			if err := hs[3].Err(); !errors.Is(err, ErrDependencyFailed) {
+				t.Fatalf("catalog: %v", err)
+			}
+		} else {
+			if st, err := hs[2].State(), hs[2].Err(); st != StateCancelled || !errors.Is(err, ErrSkipped) {
+				t.Fatalf("compensate: %s (%v), want skipped", st, err)
+			}
+			if st := hs[3].State(); st != StateCompleted {
+				t.Fatalf("catalog: %s", st)
+			}
+		}
+	}
+
+	// Policies also apply to dependencies finished before the submit.
+	h, err := e.Submit(Task{ID: "late-compensate", DependsOn: []string{"fail=false/copy"},
+		DependencyPolicy: map[string]DependencyPolicy{"fail=false/copy": RunOnFailure}, Work: ok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Wait(ctx); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("late compensate: %v", err)
+	}
+	h, err = e.Submit(Task{ID: "late-cleanup", DependsOn: []string{"fail=true/copy"},
+		DependencyPolicy: map[string]DependencyPolicy{"fail=true/copy": RunAlways}, Work: ok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Wait(ctx); err != nil {
+		t.Fatalf("late cleanup: %v", err)
+	}
+}
+
+func TestGroupCancelRunsFinally(t *testing.T) {
+	e := startEngine(t, WithConcurrency(2))
+	g, err := e.SubmitGraph([]Task{
+		{ID: "copy", Work: blockingWork()},
+		{ID: "verify", DependsOn: []string{"copy"}, Work: blockingWork()},
+		{ID: "cleanup", DependsOn: []string{"copy", "verify"},
+			DependencyPolicy: map[string]DependencyPolicy{"copy": RunAlways, "verify": RunAlways},
+			Work:             func(ctx context.Context, rep *Reporter) error { return nil }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := g.Handles()
+	waitFor(t, waitLimit, "copy running", func() bool { return hs[0].State() == StateRunning })
+	g.Cancel()
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	_ = g.Wait(ctx)
+	if st := hs[0].State(); st != StateCancelled {
+		t.Fatalf("copy: %s", st)
+	}
+	if err := hs[1].Err(); !errHas(err, ErrCancelled) {
+		t.Fatalf("verify: %v", err)
+	}
+	if st := hs[2].State(); st != StateCompleted {
+		t.Fatalf("cleanup: %s (%v)", st, hs[2].Err())
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	t0 := time.Unix(1000, 0)
+	if r := m.update(t0, 0); r != 0 {
+		t.Errorf("first sample rate = %v, want 0", r)
+	}
+	if r := m.update(t0.Add(50*time.Millisecond), 1<<20); r != 0 {
+		t.Errorf("rate after a too-short sample = %v, want 0", r)
+	}
+	if r := m.update(t0.Add(time.Second), 100<<20); r != 100<<20 {
+		t.Errorf("rate = %v, want %v", r, 100<<20)
+	}
+	// A slower second sample moves the average towards it, but only
+	// part of the way.
+	r := m.update(t0.Add(2*time.Second), 150<<20)
+	if r <= 50<<20 || r >= 100<<20 {
+		t.Errorf("smoothed rate = %v, want between 50 and 100 MiB/s", r)
+	}
+	if d := eta(150<<20, 250<<20, 50<<20); d != 2*time.Second {
+		t.Errorf("eta = %v, want 2s", d)
+	}
+	if d := eta(10, 0, 50); d != 0 {
+		t.Errorf("eta with unknown total = %v, want 0", d)
+	}
+}
+
+func TestReportBytesAndSteps(t *testing.T) {
+	e := startEngine(t)
+	ch, unsubscribe := e.Subscribe(256)
+	defer unsubscribe()
+
+	var badErrs []error
+	h, err := e.Submit(Task{ID: "copy", Work: func(ctx context.Context, rep *Reporter) error {
+		rep.SetPhase("copy")
+		badErrs = append(badErrs, rep.ReportBytes(-1, 10), rep.ReportBytes(11, 10))
+		if err := rep.ReportBytes(250, 1000); err != nil {
+			return err
+		}
+		sda := rep.Step("sda", 3)
+		sdb := rep.Step("sdb", 1)
+		if err := sda.ReportBytes(300, 600); err != nil {
+			return err
+		}
+		if err := sdb.ReportBytes(0, 200); err != nil {
+			return err
+		}
+		badErrs = append(badErrs, sdb.Report(101))
+		sdb.Done()
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	events := drainUntilFinal(t, ch, "copy", waitLimit)
+	if err := h.Err(); err != nil {
+		t.Fatalf("task error: %v", err)
+	}
+	for _, err := range badErrs {
+		if !errors.Is(err, ErrInvalidProgress) {
+			t.Errorf("invalid report = %v, want ErrInvalidProgress", err)
+		}
+	}
+
+	var sawBytes bool
+	for _, ev := range events {
+		p := ev.Progress
+		if ev.Kind == EventProgress && p.BytesDone == 250 && p.BytesTotal == 1000 &&
+			p.Percent == 25 && p.Phase == "copy" {
+			sawBytes = true
+		}
+	}
+	if !sawBytes {
+		t.Errorf("no progress event with 250/1000 bytes at 25%% in phase copy: %+v", events)
+	}
+	// sda at 50% with weight 3 and sdb done with weight 1: 62%.
+	final := events[len(events)-1].Progress
+	if final.Percent != 62 || final.BytesDone != 500 || final.BytesTotal != 800 {
+		t.Errorf("final progress = %d%% %d/%d bytes, want 62%% 500/800",
+			final.Percent, final.BytesDone, final.BytesTotal)
+	}
+	if len(final.Steps) != 2 || final.Steps[0].Name != "sda" || final.Steps[1].Percent != 100 {
+		t.Errorf("final steps = %+v", final.Steps)
+	}
+	if p := h.Progress(); p.Percent != 62 || len(p.Steps) != 2 {
+		t.Errorf("Handle.Progress = %+v", p)
+	}
+}
+
+func TestRetryResetsSteps(t *testing.T) {
+	e := startEngine(t)
+
+	var stale *StepReporter
+	var attempts atomic.Int32
+	h, err := e.Submit(Task{
+		ID:           "stepped",
+		Retry:        1,
+		RetryBackoff: 5 * time.Millisecond,
+		Work: func(ctx context.Context, rep *Reporter) error {
+			if attempts.Add(1) == 1 {
+				stale = rep.Step("sda", 1)
+				if err := stale.ReportBytes(900, 1000); err != nil {
+					return err
+				}
+				return errBoom
+			}
+			// A step left over from the failed attempt must not touch
+			// the new attempt's steps.
+			st := rep.Step("sdb", 1)
+			stale.Done()
+			return st.ReportBytes(100, 400)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := h.Wait(ctx); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+
+	p := h.Progress()
+	if len(p.Steps) != 1 || p.Steps[0].Name != "sdb" || p.Steps[0].Percent != 25 {
+		t.Errorf("steps after retry = %+v, want only sdb at 25%%", p.Steps)
+	}
+	if p.Percent != 25 || p.BytesDone != 100 || p.BytesTotal != 400 {
+		t.Errorf("progress after retry = %d%% %d/%d bytes, want 25%% 100/400",
+			p.Percent, p.BytesDone, p.BytesTotal)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	p := ExponentialBackoff{Initial: 100 * time.Millisecond, Max: time.Second, MaxRetries: 6}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		d, ok := p.Backoff(i+1, 0)
+		if !ok || d != w*time.Millisecond {
+			t.Errorf("Backoff(%d) = %v, %v; want %v", i+1, d, ok, w*time.Millisecond)
+		}
+	}
+	if _, ok := p.Backoff(7, 0); ok {
+		t.Errorf("Backoff beyond MaxRetries should give up")
+	}
+
+	p = ExponentialBackoff{Initial: time.Second, MaxElapsed: 10 * time.Second}
+	if _, ok := p.Backoff(1, 8500*time.Millisecond); !ok {
+		t.Errorf("Backoff within MaxElapsed should retry")
+	}
+	if _, ok := p.Backoff(2, 8500*time.Millisecond); ok {
+		t.Errorf("Backoff past MaxElapsed should give up")
+	}
+
+	p = ExponentialBackoff{Initial: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d, _ := p.Backoff(1, 0); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("jittered delay %v outside [0.5s, 1.5s]", d)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	e := startEngine(t)
+	ch, unsubscribe := e.Subscribe(64)
+	defer unsubscribe()
+
+	var calls atomic.Int32
+	h, err := e.Submit(Task{
+		ID: "transient",
+		RetryPolicy: ExponentialBackoff{
+			Initial:    time.Millisecond,
+			Multiplier: 3,
+			MaxRetries: 2,
+		},
+		Work: func(ctx context.Context, rep *Reporter) error {
+			calls.Add(1)
+			return errBoom
+		},
+	})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	events := drainUntilFinal(t, ch, "transient", waitLimit)
+	if h.State() != StateFailed || calls.Load() != 3 {
+		t.Errorf("state = %v after %d calls, want failed after 3", h.State(), calls.Load())
+	}
+	var delays []time.Duration
+	for _, ev := range events {
+		if ev.Kind == EventRetry {
+			delays = append(delays, ev.Delay)
+		}
+	}
+	if fmt.Sprint(delays) != "[1ms 3ms]" {
+		t.Errorf("retry delays = %v, want [1ms 3ms]", delays)
+	}
+
+	// Permanent errors, and errors rejected by RetryIf, are not retried
+	// even with retries left.
+	errMismatch := errors.New("cluster size mismatch with backing")
+	for _, tc := range []struct {
+		id   string
+		task Task
+	}{
+		{"permanent", Task{Retry: 5, Work: func(ctx context.Context, rep *Reporter) error {
+			calls.Add(1)
+			return Permanent(errMismatch)
+		}}},
+		{"classified", Task{
+			RetryPolicy: FixedBackoff{MaxRetries: 5, RetryIf: func(err error) bool {
+				return !errors.Is(err, errMismatch)
+			}},
+			Work: func(ctx context.Context, rep *Reporter) error {
+				calls.Add(1)
+				return fmt.Errorf("open chain: %w", errMismatch)
+			},
+		}},
+	} {
+		calls.Store(0)
+		tc.task.ID = tc.id
+		h, err := e.Submit(tc.task)
+		if err != nil {
+			t.Fatalf("Submit %s: %v", tc.id, err)
+		}
+		events := drainUntilFinal(t, ch, tc.id, waitLimit)
+		if n := countKind(events, EventRetry); n != 0 || calls.Load() != 1 {
+			t.Errorf("%s: %d retries after %d calls, want none after 1", tc.id, n, calls.Load())
+		}
+		if !errors.Is(h.Err(), errMismatch) {
+			t.Errorf("%s: Err = %v, want %v", tc.id, h.Err(), errMismatch)
+		}
+	}
+}
+
+// backupResult is a typed task result used by the result tests.
+type backupResult struct {
+	MetaPath string `json:"metaPath"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func TestResultPassing(t *testing.T) {
+	e := startEngine(t)
+	ch, unsubscribe := e.Subscribe(64)
+	defer unsubscribe()
+
+	want := backupResult{MetaPath: "/images/vm-1/disk0.meta", Bytes: 4096}
+	h, err := e.Submit(Task{ID: "backup", Work: ResultWork(func(ctx context.Context, rep *Reporter) (backupResult, error) {
+		return want, nil
+	})})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	var fromCtx backupResult
+	var fromRep any
+	var errs []error
+	verify, err := e.Submit(Task{ID: "verify", DependsOn: []string{"backup"}, Work: func(ctx context.Context, rep *Reporter) error {
+		var err error
+		if fromCtx, err = DependencyResult[backupResult](ctx, "backup"); err != nil {
+			return err
+		}
+		if fromRep, err = rep.DependencyResult("backup"); err != nil {
+			return err
+		}
+		_, err = DependencyResult[string](ctx, "backup")
+		errs = append(errs, err)
+		_, err = rep.DependencyResult("verify")
+		errs = append(errs, err)
+		rep.SetResult("verified")
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	events := drainUntilFinal(t, ch, "backup", waitLimit)
+	if got := events[len(events)-1].Result; got != want {
+		t.Errorf("EventFinal.Result = %v, want %v", got, want)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := verify.Wait(ctx); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if fromCtx != want || fromRep != want {
+		t.Errorf("dependency result = %v / %v, want %v", fromCtx, fromRep, want)
+	}
+	if !errors.Is(errs[0], ErrResultType) || !errHas(errs[1], ErrTaskNotFound) {
+		t.Errorf("lookup errors = %v, want ErrResultType and ErrTaskNotFound", errs)
+	}
+	if got, ok := ResultAs[backupResult](h); !ok || got != want {
+		t.Errorf("ResultAs = %v, %v; want %v", got, ok, want)
+	}
+	if got := verify.Result(); got != "verified" {
+		t.Errorf("verify Result = %v, want verified", got)
+	}
+
+	// A failed task keeps no result.
+	failed, err := e.Submit(Task{ID: "failed", Work: func(ctx context.Context, rep *Reporter) error {
+		rep.SetResult("partial")
+		return errBoom
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	_ = failed.Wait(ctx)
+	if r := failed.Result(); r != nil {
+		t.Errorf("failed task Result = %v, want nil", r)
+	}
+}
+
+func TestResultJournaled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.journal")
+	want := backupResult{MetaPath: "/images/vm-1/disk0.meta", Bytes: 4096}
+
+	e1, err := New(WithJournal(path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e1.RegisterKind("backup", ResultWork(func(ctx context.Context, rep *Reporter) (backupResult, error) {
+		return want, nil
+	}))
+	_ = e1.RegisterKind("verify", blockingWork())
+	if err := e1.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if _, err := e1.Submit(Task{ID: "backup", Kind: "backup"}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	verify, err := e1.Submit(Task{ID: "verify", Kind: "verify", DependsOn: []string{"backup"}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "verify running", func() bool { return verify.State() == StateRunning })
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	if err := e1.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// After the restart the resumed verify reads the backup result back
+	// from the journal.
+	got := make(chan backupResult, 1)
+	e2, err := New(WithJournal(path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e2.RegisterKind("verify", func(ctx context.Context, rep *Reporter) error {
+		r, err := DependencyResult[backupResult](ctx, "backup")
+		got <- r
+		return err
+	})
+	if err := e2.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer e2.Shutdown(context.Background())
+	h, _ := e2.Get("verify")
+	if err := h.Wait(ctx); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if r := <-got; r != want {
+		t.Errorf("journaled result = %v, want %v", r, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	e := startEngine(t, WithConcurrency(1))
+	_, unsubscribe := e.Subscribe(1) // never drained: drops events
+	defer unsubscribe()
+
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	ok, err := e.Submit(Task{ID: "ok", Group: "tenant-a", Work: func(ctx context.Context, rep *Reporter) error { return nil }})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	flaky, err := e.Submit(Task{ID: "flaky", Group: "tenant-a", Retry: 1, Work: func(ctx context.Context, rep *Reporter) error {
+		return errBoom
+	}})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	_ = ok.Wait(ctx)
+	_ = flaky.Wait(ctx)
+
+	blocker, err := e.Submit(Task{ID: "blocker", Group: `tenant-"b"`, Work: blockingWork()})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "blocker running", func() bool { return blocker.State() == StateRunning })
+	if _, err := e.Submit(Task{ID: "queued", Group: `tenant-"b"`, Work: blockingWork()}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, waitLimit, "queued", func() bool { return waitersQueued(e) == 1 })
+
+	m := e.Metrics()
+	a, b := m.Groups["tenant-a"], m.Groups[`tenant-"b"`]
+	if a.Submitted != 2 || a.Retries != 1 || a.Finished[StateCompleted] != 1 || a.Finished[StateFailed] != 1 {
+		t.Errorf("tenant-a metrics = %+v", a)
+	}
+	if a.Duration.Count != 2 || a.Duration.Counts[0] != 2 {
+		t.Errorf("tenant-a duration = %+v, want 2 observations under 1s", a.Duration)
+	}
+	if b.Queued != 1 || b.OldestQueued <= 0 || b.Running != 1 || b.Tasks[StateRunning] != 2 || m.SlotsUsed != 1 {
+		t.Errorf("tenant-b metrics = %+v, slots used %d", b, m.SlotsUsed)
+	}
+	if m.EventsDropped == 0 || m.Subscribers != 1 {
+		t.Errorf("events dropped = %d with %d subscribers, want drops from one subscriber", m.EventsDropped, m.Subscribers)
+	}
+
+	rec := httptest.NewRecorder()
+	e.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE backup_task_duration_seconds histogram\n",
+		`backup_queue_depth{group="tenant-\"b\""} 1` + "\n",
+		`backup_tasks{group="tenant-a",state="completed"} 1` + "\n",
+		`backup_tasks_finished_total{group="tenant-a",state="failed"} 1` + "\n",
+		`backup_task_retries_total{group="tenant-a"} 1` + "\n",
+		`backup_task_duration_seconds_bucket{group="tenant-a",le="+Inf"} 2` + "\n",
+		"backup_slots_used 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("exposition lacks %q:\n%s", want, body)
+		}
+	}
+}
+
+// ids returns the IDs of infos.
+func ids(infos []TaskInfo) string {
+	var out []string
+	for _, ti := range infos {
+		out = append(out, ti.ID)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestRetentionMaxFinished(t *testing.T) {
+	e := startEngine(t, WithConcurrency(4), WithRetention(RetentionPolicy{MaxFinished: 2}))
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	ok := func(ctx context.Context, rep *Reporter) error { return nil }
+	run := func(task Task) *Handle {
+		t.Helper()
+		h, err := e.Submit(task)
+		if err != nil {
+			t.Fatalf("Submit %s: %v", task.ID, err)
+		}
+		return h
+	}
+
+	_ = run(Task{ID: "failed", Work: func(ctx context.Context, rep *Reporter) error { return errBoom }}).Wait(ctx)
+	_ = run(Task{ID: "parent", Work: ok}).Wait(ctx)
+	// "parent" is kept while its dependent is active.
+	release := make(chan struct{})
+	child := run(Task{ID: "child", DependsOn: []string{"parent"}, Work: func(ctx context.Context, rep *Reporter) error {
+		<-release
+		return nil
+	}})
+	_ = run(Task{ID: "ok-1", Work: ok}).Wait(ctx)
+	_ = run(Task{ID: "ok-2", Work: ok}).Wait(ctx)
+	waitFor(t, waitLimit, "eviction", func() bool { return len(e.List(TaskFilter{})) == 3 })
+	if got := ids(e.List(TaskFilter{})); got != "failed,parent,child" {
+		t.Errorf("List while child is active = %s, want failed,parent,child", got)
+	}
+
+	// Completed tasks are evicted before the failed one.
+	close(release)
+	_ = child.Wait(ctx)
+	waitFor(t, waitLimit, "eviction", func() bool { return len(e.List(TaskFilter{})) == 2 })
+	if got := ids(e.List(TaskFilter{})); got != "failed,child" {
+		t.Errorf("kept tasks = %s, want failed,child", got)
+	}
+	got := e.List(TaskFilter{Evicted: true, States: []TaskState{StateCompleted}})
+	if ids(got) != "ok-1,ok-2,parent,child" || !got[0].Evicted || got[3].Evicted {
+		t.Errorf("List with history = %+v", got)
+	}
+	if got := ids(e.List(TaskFilter{Evicted: true, IDPrefix: "ok-", Limit: 1})); got != "ok-1" {
+		t.Errorf("List by prefix with limit = %s, want ok-1", got)
+	}
+	if _, err := e.Get("parent"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Get evicted = %v, want ErrTaskNotFound", err)
+	}
+	if info, err := e.Info("parent"); err != nil || !info.Evicted || info.State != StateCompleted {
+		t.Errorf("Info evicted = %+v, %v; want completed from the history", info, err)
+	}
+	if info, err := e.Info("failed"); err != nil || info.Evicted || info.State != StateFailed {
+		t.Errorf("Info registered = %+v, %v; want failed", info, err)
+	}
+	if _, err := e.Info("nope"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Info unknown = %v, want ErrTaskNotFound", err)
+	}
+
+	// New tasks may depend on evicted ones.
+	if err := run(Task{ID: "verify", DependsOn: []string{"parent"}, Work: ok}).Wait(ctx); err != nil {
+		t.Errorf("verify depending on evicted task: %v", err)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	e := startEngine(t, WithRetention(RetentionPolicy{
+		MaxAge:       20 * time.Millisecond,
+		FailedMaxAge: time.Hour,
+	}))
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	okH, _ := e.Submit(Task{ID: "ok", Work: func(ctx context.Context, rep *Reporter) error { return nil }})
+	failH, _ := e.Submit(Task{ID: "failed", Work: func(ctx context.Context, rep *Reporter) error { return errBoom }})
+	_ = okH.Wait(ctx)
+	_ = failH.Wait(ctx)
+	waitFor(t, waitLimit, "completed task evicted", func() bool { return len(e.List(TaskFilter{})) == 1 })
+	if got := ids(e.List(TaskFilter{})); got != "failed" {
+		t.Errorf("kept = %s, want failed", got)
+	}
+	if err := okH.Retry(); !errHas(err, ErrTaskNotFound) && !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Retry of evicted task = %v", err)
+	}
+}
+
+func TestRetentionIDReuse(t *testing.T) {
+	work := func(ctx context.Context, rep *Reporter) error { return nil }
+	fail := func(ctx context.Context, rep *Reporter) error { return errBoom }
+	for _, tc := range []struct {
+		policy            ReusePolicy
+		completed, failed bool // whether resubmitting is accepted
+	}{
+		{ReuseNever, false, false},
+		{ReuseAfterFailure, false, true},
+		{ReuseAlways, true, true},
+	} {
+		e := startEngine(t, WithRetention(RetentionPolicy{MaxAge: time.Millisecond, ReuseIDs: tc.policy}))
+		ctx, cancel := waitCtx(t)
+		for _, task := range []Task{{ID: "completed", Work: work}, {ID: "failed", Work: fail}} {
+			h, err := e.Submit(task)
+			if err != nil {
+				t.Fatalf("Submit: %v", err)
+			}
+			_ = h.Wait(ctx)
+		}
+		waitFor(t, waitLimit, "eviction", func() bool { return len(e.List(TaskFilter{})) == 0 })
+		for id, want := range map[string]bool{"completed": tc.completed, "failed": tc.failed} {
+			_, err := e.Submit(Task{ID: id, Work: work})
+			if (err == nil) != want {
+				t.Errorf("policy %d: resubmit %s = %v, want accepted=%v", tc.policy, id, err, want)
+			}
+			if err != nil && !errHas(err, ErrTaskExists) {
+				t.Errorf("policy %d: resubmit %s = %v, want ErrTaskExists", tc.policy, id, err)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestRetentionJournaled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.journal")
+	opts := []Option{WithJournal(path), WithRetention(RetentionPolicy{MaxFinished: 1})}
+	e1, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e1.RegisterKind("ok", func(ctx context.Context, rep *Reporter) error { return nil })
+	if err := e1.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	ctx, cancel := waitCtx(t)
+	defer cancel()
+	for _, id := range []string{"a", "b", "c"} {
+		h, err := e1.Submit(Task{ID: id, Kind: "ok"})
+		if err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		_ = h.Wait(ctx)
+	}
+	waitFor(t, waitLimit, "eviction", func() bool { return len(e1.List(TaskFilter{})) == 1 })
+	_ = e1.Shutdown(ctx)
+
+	e2, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = e2.RegisterKind("ok", func(ctx context.Context, rep *Reporter) error { return nil })
+	if err := e2.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer e2.Shutdown(context.Background())
+	if got := ids(e2.List(TaskFilter{Evicted: true})); got != "a,b,c" {
+		t.Errorf("restored List = %s, want a,b,c", got)
+	}
+	if _, err := e2.Submit(Task{ID: "a", Kind: "ok"}); !errHas(err, ErrTaskExists) {
+		t.Errorf("resubmit evicted a after restart = %v, want ErrTaskExists", err)
+	}
+}
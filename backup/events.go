@@ -18,10 +18,19 @@ type Event struct {
 	Progress Progress
 	// Attempt is the 1-based attempt number for EventRetry events.
 	Attempt int
+	// Delay is the backoff before the next attempt for EventRetry events.
+	Delay time.Duration
 	// Err is the cause for EventRetry and failed EventFinal events.
 	Err error
+	// Result is the task's result (see Reporter.SetResult) for EventFinal
+	// events of completed tasks.
+	Result any
 	// Time is when the event was emitted.
 	Time time.Time
+	// Seq numbers the events published to one subscription, starting at
+	// 1. A gap means the subscriber's buffer was full and the events in
+	// between were dropped.
+	Seq uint64
 }
 
 // subscription is one registered event consumer.
@@ -29,6 +38,7 @@ type subscription struct {
 	ch     chan Event
 	closed bool
 	drops  uint64
+	seq    uint64 // Seq of the last event published, delivered or not
 }
 
 // eventHub is a fan-out event broadcaster with non-blocking publish:
@@ -38,6 +48,7 @@ type eventHub struct {
 	mu     sync.Mutex
 	subs   map[uint64]*subscription
 	nextID uint64
+	drops  uint64 // events dropped over all subscriptions, past and present
 }
 
 func newEventHub() *eventHub {
@@ -83,10 +94,21 @@ func (h *eventHub) publish(ev Event) {
 		if sub.closed {
 			continue
 		}
+		sub.seq++
+		ev.Seq = sub.seq
 		select {
 		case sub.ch <- ev:
 		default:
 			sub.drops++
+			h.drops++
 		}
 	}
 }
+
+// stats returns the number of active subscriptions and the total number
+// of dropped events.
+func (h *eventHub) stats() (subs int, drops uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs), h.drops
+}
@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SubmitGraph validates and registers a set of tasks as one unit, e.g. one
+// task per disk followed by a catalog and a verify task. Dependencies may
+// point at tasks of the same graph, in any order, or at tasks already
+// known to the engine. The whole graph is checked first, including cycle
+// detection among its tasks; on any error nothing is registered. On
+// success every task is registered atomically and a GroupHandle
+// controlling all of them is returned.
+func (e *Engine) SubmitGraph(tasks []Task) (*GroupHandle, error) {
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("%v: empty graph", ErrInvalidTask)
+	}
+	tasks = append([]Task(nil), tasks...)
+	e.mu.Lock()
+	g, err := e.submitGraphLocked(tasks)
+	e.mu.Unlock()
+	if err == nil {
+		e.syncJournal()
+	}
+	return g, err
+}
+
+// submitGraphLocked is SubmitGraph for callers holding e.mu, on a copy of
+// the tasks. The submit records are written but not synced.
+func (e *Engine) submitGraphLocked(tasks []Task) (*GroupHandle, error) {
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+	if !e.started {
+		return nil, ErrEngineNotStarted
+	}
+
+	byID := make(map[string]int, len(tasks))
+	for i := range tasks {
+		t := &tasks[i]
+		if err := e.prepareLocked(t); err != nil {
+			return nil, err
+		}
+		if _, dup := byID[t.ID]; dup {
+			return nil, fmt.Errorf("%v: %s appears twice in the graph", ErrTaskExists, t.ID)
+		}
+		if err := e.checkIDLocked(t.ID); err != nil {
+			return nil, err
+		}
+		byID[t.ID] = i
+	}
+	for i := range tasks {
+		for _, d := range tasks[i].DependsOn {
+			if _, ok := byID[d]; ok {
+				continue
+			}
+			if !e.knownLocked(d) {
+				return nil, fmt.Errorf("%v: %s depends on unknown task %q", ErrTaskNotFound, tasks[i].ID, d)
+			}
+		}
+	}
+	order, err := topoOrder(tasks, byID)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.journal != nil {
+		recs := make([]journalRecord, 0, len(order))
+		for _, i := range order {
+			recs = append(recs, submitRecord(&tasks[i]))
+		}
+		if err := e.journal.appendBatch(recs); err != nil {
+			return nil, fmt.Errorf("backup: journal graph: %v", err)
+		}
+	}
+
+	g := &GroupHandle{handles: make([]*Handle, len(tasks))}
+	for _, i := range order {
+		g.handles[i] = &Handle{item: e.addLocked(tasks[i])}
+	}
+	return g, nil
+}
+
+// topoOrder returns the indexes of tasks in dependency order (Kahn's
+// algorithm), or ErrCycleDetected naming the tasks left on a cycle.
+// Dependencies outside the graph are already registered and cannot be
+// part of a cycle.
+func topoOrder(tasks []Task, byID map[string]int) ([]int, error) {
+	indeg := make([]int, len(tasks))
+	dependents := make([][]int, len(tasks))
+	for i := range tasks {
+		for _, d := range tasks[i].DependsOn {
+			if j, ok := byID[d]; ok {
+				indeg[i]++
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+	order := make([]int, 0, len(tasks))
+	for i := range tasks {
+		if indeg[i] == 0 {
+			order = append(order, i)
+		}
+	}
+	for k := 0; k < len(order); k++ {
+		for _, j := range dependents[order[k]] {
+			if indeg[j]--; indeg[j] == 0 {
+				order = append(order, j)
+			}
+		}
+	}
+	if len(order) == len(tasks) {
+		return order, nil
+	}
+	var stuck []string
+	for i := range tasks {
+		if indeg[i] > 0 {
+			stuck = append(stuck, tasks[i].ID)
+		}
+	}
+	return nil, fmt.Errorf("%v: among %s", ErrCycleDetected, strings.Join(stuck, ", "))
+}
+
+// GroupProgress is an aggregated snapshot of the tasks of a GroupHandle.
+type GroupProgress struct {
+	// Total is the number of tasks in the group.
+	Total int
+	// Completed, Failed (including timed out) and Cancelled count the
+	// tasks in each terminal state; Active counts the rest.
+	Completed, Failed, Cancelled, Active int
+	// Percent is the mean progress over all tasks, counting completed
+	// tasks as 100.
+	Percent int32
+}
+
+// GroupHandle controls and observes the tasks registered by one
+// SubmitGraph call. All methods are safe for concurrent use.
+type GroupHandle struct {
+	handles []*Handle
+}
+
+// Handles returns the handles of the group's tasks, in the order they
+// were passed to SubmitGraph.
+func (g *GroupHandle) Handles() []*Handle {
+	return append([]*Handle(nil), g.handles...)
+}
+
+// Wait blocks until every task of the group reaches a terminal state. It
+// returns nil when all of them completed, otherwise the error of the
+// first unsuccessful task in submission order, or ctx.Err() if ctx is
+// done first.
+func (g *GroupHandle) Wait(ctx context.Context) error {
+	for _, h := range g.handles {
+		select {
+		case <-h.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, h := range g.handles {
+		if err := h.Err(); err != nil {
+			return fmt.Errorf("backup: task %s: %w", h.ID(), err)
+		}
+	}
+	return nil
+}
+
+// Cancel cancels every task of the group that has not finished yet,
+// except finally and compensation steps: tasks with a RunAlways or
+// RunOnFailure policy on another task of the group still run once their
+// dependencies have finished. Other dependents end with
+// ErrDependencyCancelled as usual.
+func (g *GroupHandle) Cancel() {
+	inGroup := make(map[string]bool, len(g.handles))
+	for _, h := range g.handles {
+		inGroup[h.ID()] = true
+	}
+	for _, h := range g.handles {
+		if !h.item.task.guardedBy(inGroup) {
+			_ = h.Cancel()
+		}
+	}
+}
+
+// Pause requests pausing every active task of the group that is not
+// paused already.
+func (g *GroupHandle) Pause() {
+	for _, h := range g.handles {
+		_ = h.Pause()
+	}
+}
+
+// Resume resumes every paused task of the group.
+func (g *GroupHandle) Resume() {
+	for _, h := range g.handles {
+		_ = h.Resume()
+	}
+}
+
+// Progress returns an aggregated snapshot of the group.
+func (g *GroupHandle) Progress() GroupProgress {
+	p := GroupProgress{Total: len(g.handles)}
+	var sum int64
+	for _, h := range g.handles {
+		h.item.mu.Lock()
+		st, pct := h.item.state, h.item.progress.Percent
+		h.item.mu.Unlock()
+		switch st {
+		case StateCompleted:
+			p.Completed++
+			pct = 100
+		case StateFailed, StateTimedOut:
+			p.Failed++
+		case StateCancelled:
+			p.Cancelled++
+		default:
+			p.Active++
+		}
+		sum += int64(pct)
+	}
+	if p.Total > 0 {
+		p.Percent = int32(sum / int64(p.Total))
+	}
+	return p
+}
@@ -2,6 +2,7 @@ package backup
 
 import (
 	"context"
+	"fmt"
 	"time"
 )
 
@@ -25,7 +26,20 @@ func (h *Handle) State() TaskState {
 func (h *Handle) Progress() Progress {
 	h.item.mu.Lock()
 	defer h.item.mu.Unlock()
-	return h.item.progress
+	return h.item.progress.clone()
+}
+
+// Result returns the result of a completed task (see Reporter.SetResult
+// and ResultWork), or nil while the task is active, when it did not
+// complete, or when it completed without a result. Results restored from
+// the journal are json.RawMessage values.
+func (h *Handle) Result() any {
+	h.item.mu.Lock()
+	defer h.item.mu.Unlock()
+	if !h.item.finished {
+		return nil
+	}
+	return h.item.result
 }
 
 // Err returns the terminal error once the task has finished, or nil
@@ -75,7 +89,8 @@ func (h *Handle) Pause() error {
 }
 
 // Resume resumes a paused task. It returns ErrInvalidState when the task
-// is not paused.
+// is not paused by Pause; a task paused by preemption (see WithPreemption)
+// resumes on its own once it gets a slot again.
 func (h *Handle) Resume() error {
 	if !h.item.gate.resume() {
 		return ErrInvalidState
@@ -109,12 +124,17 @@ func (h *Handle) Retry() error {
 	}
 
 	it := h.item
+	if e.items[it.id] != it {
+		return fmt.Errorf("%v: %s was evicted", ErrTaskNotFound, it.id)
+	}
 	it.mu.Lock()
 	if !it.finished {
 		it.mu.Unlock()
 		return ErrInvalidState
 	}
-	if it.state == StateCompleted {
+	if it.state == StateCompleted || it.task.Work == nil {
+		// A task restored from the journal without a registered
+		// kind has nothing to run.
 		it.mu.Unlock()
 		return ErrInvalidState
 	}
@@ -123,6 +143,8 @@ func (h *Handle) Retry() error {
 	it.err = nil
 	it.attempt = 0
 	it.progress = Progress{UpdatedAt: time.Now()}
+	it.meter = rateMeter{}
+	it.result = nil
 	it.doneCh = make(chan struct{})
 	it.mu.Unlock()
 
@@ -140,6 +162,7 @@ func (h *Handle) Retry() error {
 	it.taskCtx, it.taskCancel = context.WithCancel(e.engineCtx)
 
 	e.hub.publish(Event{Kind: EventStateChange, TaskID: it.id, State: StatePending})
+	e.writeJournal(journalRecord{Op: journalOpReset, ID: it.id})
 	e.wakeLocked()
 	return nil
 }
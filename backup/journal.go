@@ -0,0 +1,688 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kisun-bit/drpkg/logger"
+)
+
+// Journal record operations.
+const (
+	journalOpSubmit  = "submit"
+	journalOpState   = "state"
+	journalOpAttempt = "attempt"
+	journalOpFinal   = "final"
+	journalOpReset   = "reset"
+	journalOpEvict   = "evict"
+)
+
+// journalRecord is one line of the journal file. Only the fields relevant
+// to Op are set.
+type journalRecord struct {
+	Op   string    `json:"op"`
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	// submit
+	Kind         string                      `json:"kind,omitempty"`
+	Payload      []byte                      `json:"payload,omitempty"`
+	DependsOn    []string                    `json:"dependsOn,omitempty"`
+	DepPolicy    map[string]DependencyPolicy `json:"depPolicy,omitempty"`
+	Timeout      time.Duration               `json:"timeout,omitempty"`
+	Retry        int                         `json:"retry,omitempty"`
+	RetryBackoff time.Duration               `json:"retryBackoff,omitempty"`
+	Priority     int                         `json:"priority,omitempty"`
+	Group        string                      `json:"group,omitempty"`
+	Weight       int                         `json:"weight,omitempty"`
+	Resources    []Resource                  `json:"resources,omitempty"`
+
+	// state, final, evict
+	State string `json:"state,omitempty"`
+	// attempt
+	Attempt int `json:"attempt,omitempty"`
+	// final, evict
+	Err    string          `json:"err,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// journalTask is the folded view of all records of one task, as read back
+// from the journal.
+type journalTask struct {
+	submit   journalRecord
+	state    TaskState
+	attempt  int
+	finished bool
+	err      string
+	result   json.RawMessage
+	evicted  bool
+	// finishedAt is the time of the final record.
+	finishedAt time.Time
+}
+
+// task rebuilds the Task definition recorded at submission. Work is left
+// nil; the engine resolves it from the registered kinds.
+func (jt *journalTask) task() Task {
+	r := jt.submit
+	return Task{
+		ID:               r.ID,
+		Kind:             r.Kind,
+		Payload:          r.Payload,
+		DependsOn:        r.DependsOn,
+		DependencyPolicy: r.DepPolicy,
+		Timeout:          r.Timeout,
+		Retry:            r.Retry,
+		RetryBackoff:     r.RetryBackoff,
+		Priority:         r.Priority,
+		Group:            r.Group,
+		Weight:           r.Weight,
+		Resources:        r.Resources,
+	}
+}
+
+// journal is an append-only JSON-lines log of task submissions, state
+// transitions, attempts and final results. It is compacted every time it
+// is opened, and by syncLoop whenever it has doubled in size since the
+// last compaction (see journalCompactMin), so that a long-running engine
+// does not grow it without bound. All methods are safe for concurrent
+// use.
+//
+// Records are written while the engine holds its lock, which keeps them in
+// order, but flushed to stable storage outside of it: Submit waits for
+// sync after releasing the lock, and final records are synced by a
+// background goroutine, so one fsync covers all records written before it.
+type journal struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	dirty bool // records were written since the last fsync
+
+	historySize int   // evicted tasks kept by compaction
+	size        int64 // bytes in the file
+	compactAt   int64 // size that triggers the next compaction
+	compactMin  int64 // lower bound of compactAt
+	compactDue  bool  // size reached compactAt; syncLoop compacts
+
+	syncMu sync.Mutex    // serializes fsync and close
+	kick   chan struct{} // wakes syncLoop
+	done   chan struct{} // closed by close to stop syncLoop
+	wg     sync.WaitGroup
+}
+
+// journalCompactMin is the journal size below which a running engine does
+// not compact it. Above it, the journal is compacted whenever it has
+// doubled since the last compaction.
+const journalCompactMin = 4 << 20
+
+// openJournal reads the journal at path (if it exists), compacts it to one
+// snapshot per task and reopens it for appending. It returns the recorded
+// tasks in submission order and the evicted tasks in eviction order, at
+// most historySize of them. A torn last line, left behind by a crash in
+// the middle of a write, is ignored.
+func openJournal(path string, historySize int) (*journal, []*journalTask, []*HistoryEntry, error) {
+	if dir := filepath.Dir(path); dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	tasks, evicted, err := readJournal(path, -1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if historySize < 0 {
+		historySize = 0
+	}
+	if len(evicted) > historySize {
+		evicted = evicted[len(evicted)-historySize:]
+	}
+	f, size, err := writeJournalSnapshot(path, tasks, evicted)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	history := make([]*HistoryEntry, 0, len(evicted))
+	for _, r := range evicted {
+		var st TaskState
+		_ = st.UnmarshalText([]byte(r.State)) // checked by readJournal
+		history = append(history, &HistoryEntry{
+			ID:         r.ID,
+			Kind:       r.Kind,
+			Group:      r.Group,
+			State:      st,
+			Err:        historyError(r.Err),
+			FinishedAt: r.Time,
+		})
+	}
+	j := &journal{
+		path:        path,
+		f:           f,
+		historySize: historySize,
+		size:        size,
+		compactMin:  journalCompactMin,
+		kick:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	j.compactAt = j.nextCompaction()
+	j.wg.Add(1)
+	go j.syncLoop()
+	return j, tasks, history, nil
+}
+
+// readJournal folds the records of the journal file into per-task views
+// and the eviction records of tasks that were not submitted again. Only
+// the first limit bytes are read unless limit is negative.
+func readJournal(path string, limit int64) ([]*journalTask, []journalRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("backup: open journal: %v", err)
+	}
+	defer f.Close()
+
+	var (
+		order   []*journalTask
+		byID    = make(map[string]*journalTask)
+		evicted []journalRecord
+		evictAt = make(map[string]int) // index of the live evict record
+		line    int
+	)
+	var src io.Reader = f
+	if limit >= 0 {
+		src = io.LimitReader(f, limit)
+	}
+	sc := bufio.NewScanner(src)
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		line++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var r journalRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			logger.Warnf("backup: journal %s: skip malformed record at line %d: %v", path, line, err)
+			continue
+		}
+		var st TaskState
+		if r.State != "" {
+			if err := st.UnmarshalText([]byte(r.State)); err != nil {
+				logger.Warnf("backup: journal %s: skip malformed record at line %d: %v", path, line, err)
+				continue
+			}
+		}
+		if r.Op == journalOpSubmit {
+			if i, ok := evictAt[r.ID]; ok {
+				evicted[i].ID = "" // the ID was reused
+				delete(evictAt, r.ID)
+			}
+			jt := &journalTask{submit: r, state: StatePending}
+			if old := byID[r.ID]; old != nil {
+				*old = *jt
+				continue
+			}
+			byID[r.ID] = jt
+			order = append(order, jt)
+			continue
+		}
+		if r.Op == journalOpEvict {
+			// Compacted journals carry evict records without the
+			// task's own records.
+			if jt := byID[r.ID]; jt != nil {
+				jt.evicted = true
+				delete(byID, r.ID)
+			}
+			if i, ok := evictAt[r.ID]; ok {
+				evicted[i].ID = ""
+			}
+			evictAt[r.ID] = len(evicted)
+			evicted = append(evicted, r)
+			continue
+		}
+		jt := byID[r.ID]
+		if jt == nil {
+			continue
+		}
+		switch r.Op {
+		case journalOpState:
+			jt.state = st
+		case journalOpAttempt:
+			jt.attempt = r.Attempt
+		case journalOpFinal:
+			jt.state = st
+			jt.finished = true
+			jt.err = r.Err
+			jt.result = r.Result
+			jt.finishedAt = r.Time
+		case journalOpReset:
+			jt.state = StatePending
+			jt.attempt = 0
+			jt.finished = false
+			jt.err = ""
+			jt.result = nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, fmt.Errorf("backup: read journal: %v", err)
+	}
+	tasks := order[:0]
+	for _, jt := range order {
+		if !jt.evicted {
+			tasks = append(tasks, jt)
+		}
+	}
+	history := evicted[:0]
+	for _, r := range evicted {
+		if r.ID != "" {
+			history = append(history, r)
+		}
+	}
+	return tasks, history, nil
+}
+
+// writeJournalSnapshot atomically replaces the journal with the minimal
+// record set that reproduces tasks and the eviction history, and returns
+// the new file open for appending with its size.
+func writeJournalSnapshot(path string, tasks []*journalTask, evicted []journalRecord) (*os.File, int64, error) {
+	f, size, err := createJournalSnapshot(path+".tmp", tasks, evicted)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("backup: compact journal: %v", err)
+	}
+	return f, size, nil
+}
+
+// createJournalSnapshot writes the snapshot of tasks and evicted to tmp
+// and flushes it to stable storage. It returns the file open for
+// appending with its size.
+func createJournalSnapshot(tmp string, tasks []*journalTask, evicted []journalRecord) (*os.File, int64, error) {
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("backup: compact journal: %v", err)
+	}
+	fail := func(err error) (*os.File, int64, error) {
+		f.Close()
+		return nil, 0, fmt.Errorf("backup: compact journal: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range evicted {
+		if err := enc.Encode(&evicted[i]); err != nil {
+			return fail(err)
+		}
+	}
+	for _, jt := range tasks {
+		recs := []journalRecord{jt.submit}
+		if jt.attempt > 0 {
+			recs = append(recs, journalRecord{Op: journalOpAttempt, ID: jt.submit.ID, Attempt: jt.attempt})
+		}
+		if jt.finished {
+			recs = append(recs, journalRecord{Op: journalOpFinal, ID: jt.submit.ID, Time: jt.finishedAt, State: jt.state.String(), Err: jt.err, Result: jt.result})
+		}
+		for i := range recs {
+			if err := enc.Encode(&recs[i]); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+	return f, size, nil
+}
+
+// append writes one record. It is not flushed to stable storage until
+// the next sync.
+func (j *journal) append(r journalRecord) error {
+	return j.appendBatch([]journalRecord{r})
+}
+
+// appendBatch writes several records with a single write. They are not
+// flushed to stable storage until the next sync.
+func (j *journal) appendBatch(rs []journalRecord) error {
+	var data []byte
+	now := time.Now()
+	for i := range rs {
+		if rs[i].Time.IsZero() {
+			rs[i].Time = now
+		}
+		line, err := json.Marshal(&rs[i])
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return ErrEngineClosed
+	}
+	n, err := j.f.Write(data)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	j.dirty = true
+	if j.size >= j.compactAt && !j.compactDue {
+		j.compactDue = true
+		j.syncLater()
+	}
+	return nil
+}
+
+// nextCompaction returns the size that triggers the compaction after the
+// current one. The caller holds j.mu.
+func (j *journal) nextCompaction() int64 {
+	if n := 2 * j.size; n > j.compactMin {
+		return n
+	}
+	return j.compactMin
+}
+
+// compact rewrites the journal to one snapshot per task, as openJournal
+// does, while the engine keeps appending to it. The records up to the
+// current end are folded and written to a new file without holding j.mu;
+// only the records appended meanwhile are copied over under it, before
+// the new file replaces the old one.
+func (j *journal) compact() error {
+	j.mu.Lock()
+	end := j.size
+	j.mu.Unlock()
+
+	tasks, evicted, err := readJournal(j.path, end)
+	if err != nil {
+		return j.compactFailed(err)
+	}
+	if len(evicted) > j.historySize {
+		evicted = evicted[len(evicted)-j.historySize:]
+	}
+	tmp := j.path + ".tmp"
+	f, size, err := createJournalSnapshot(tmp, tasks, evicted)
+	if err != nil {
+		return j.compactFailed(err)
+	}
+
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		f.Close()
+		os.Remove(tmp)
+		return ErrEngineClosed
+	}
+	if err := j.swapLocked(f, size, end); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		j.compactDue = false
+		j.compactAt = j.nextCompaction()
+		return err
+	}
+	return nil
+}
+
+// swapLocked copies the records written after end to the snapshot f,
+// flushes them and makes f the journal. The caller holds j.syncMu and
+// j.mu.
+func (j *journal) swapLocked(f *os.File, size, end int64) error {
+	if end < j.size {
+		old, err := os.Open(j.path)
+		if err != nil {
+			return fmt.Errorf("backup: compact journal: %v", err)
+		}
+		n, err := io.Copy(f, io.NewSectionReader(old, end, j.size-end))
+		old.Close()
+		if err != nil {
+			return fmt.Errorf("backup: compact journal: %v", err)
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("backup: compact journal: %v", err)
+		}
+		size += n
+	}
+	if err := os.Rename(j.path+".tmp", j.path); err != nil {
+		return fmt.Errorf("backup: compact journal: %v", err)
+	}
+	j.f.Close()
+	j.f, j.size, j.dirty = f, size, false
+	j.compactDue = false
+	j.compactAt = j.nextCompaction()
+	return nil
+}
+
+// compactFailed re-arms the compaction trigger after a failed attempt
+// and returns err.
+func (j *journal) compactFailed(err error) error {
+	j.mu.Lock()
+	j.compactDue = false
+	j.compactAt = j.nextCompaction()
+	j.mu.Unlock()
+	return err
+}
+
+// sync flushes the records written so far to stable storage. Concurrent
+// callers share one fsync when it covers their records.
+func (j *journal) sync() error {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	j.mu.Lock()
+	f, dirty := j.f, j.dirty
+	j.dirty = false
+	j.mu.Unlock()
+	if f == nil || !dirty {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		j.mu.Lock()
+		j.dirty = true
+		j.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// syncLater asks syncLoop to sync the journal without waiting for it.
+func (j *journal) syncLater() {
+	select {
+	case j.kick <- struct{}{}:
+	default: // a sync is already pending and will cover this record
+	}
+}
+
+// syncLoop runs the syncs requested by syncLater until close.
+func (j *journal) syncLoop() {
+	defer j.wg.Done()
+	for {
+		select {
+		case <-j.kick:
+			if err := j.sync(); err != nil {
+				logger.Warnf("backup: sync journal %s: %v", j.path, err)
+			}
+			j.mu.Lock()
+			due := j.compactDue
+			j.mu.Unlock()
+			if due {
+				if err := j.compact(); err != nil {
+					logger.Warnf("backup: compact journal %s: %v", j.path, err)
+				}
+			}
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// close syncs and closes the journal file.
+func (j *journal) close() error {
+	j.mu.Lock()
+	closed := j.f == nil
+	j.mu.Unlock()
+	if closed {
+		return nil
+	}
+	close(j.done)
+	j.wg.Wait()
+
+	serr := j.sync()
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.f.Close()
+	j.f = nil
+	if serr != nil {
+		return serr
+	}
+	return err
+}
+
+// submitRecord builds the journal record for a submitted task.
+func submitRecord(t *Task) journalRecord {
+	return journalRecord{
+		Op:           journalOpSubmit,
+		ID:           t.ID,
+		Kind:         t.Kind,
+		Payload:      t.Payload,
+		DependsOn:    t.DependsOn,
+		DepPolicy:    t.DependencyPolicy,
+		Timeout:      t.Timeout,
+		Retry:        t.Retry,
+		RetryBackoff: t.RetryBackoff,
+		Priority:     t.Priority,
+		Group:        t.Group,
+		Weight:       t.Weight,
+		Resources:    t.Resources,
+	}
+}
+
+// writeJournal appends a record when a journal is configured. Final
+// records are synced in the background; the others ride along with the
+// next sync. Failures are logged: the in-memory engine state stays
+// authoritative. It does not require e.mu.
+func (e *Engine) writeJournal(r journalRecord) {
+	if e.journal == nil {
+		return
+	}
+	if err := e.journal.append(r); err != nil {
+		logger.Warnf("backup: journal %s of task %s: %v", r.Op, r.ID, err)
+		return
+	}
+	if r.Op == journalOpFinal {
+		e.journal.syncLater()
+	}
+}
+
+// syncJournal flushes the submit records written by Submit or
+// SubmitGraph to stable storage. It is called after e.mu is released so
+// that the fsync does not stall the engine; a failure is logged because
+// the tasks are already registered.
+func (e *Engine) syncJournal() {
+	if e.journal == nil {
+		return
+	}
+	if err := e.journal.sync(); err != nil {
+		logger.Warnf("backup: sync journal: %v", err)
+	}
+}
+
+// checkJournalable rejects a task that a journaled engine could not
+// resume after a restart: without a Kind its Work closure cannot be
+// restored from the journal.
+func (e *Engine) checkJournalable(t *Task) error {
+	if e.journal != nil && t.Kind == "" {
+		return fmt.Errorf("%v: %s: a journaled engine requires a Kind", ErrInvalidTask, t.ID)
+	}
+	return nil
+}
+
+// replayLocked restores the tasks read from the journal. Finished tasks
+// are restored in their terminal state so that their IDs stay reserved
+// and dependents resolve correctly. Unfinished tasks are scheduled again
+// with their attempt counters preserved; those whose Kind has no
+// registered WorkFunc fail with ErrKindNotRegistered.
+func (e *Engine) replayLocked(tasks []*journalTask) {
+	for _, jt := range tasks {
+		t := jt.task()
+		if _, ok := e.items[t.ID]; ok {
+			continue
+		}
+		t.Work = e.kinds[t.Kind]
+		if jt.finished {
+			e.restoreFinishedLocked(t, jt)
+			continue
+		}
+		known := true
+		for _, d := range t.DependsOn {
+			if !e.knownLocked(d) {
+				known = false
+				break
+			}
+		}
+		if !known {
+			t.DependsOn = nil
+			it := e.addLocked(t)
+			e.finalizeLocked(it, StateFailed,
+				fmt.Errorf("%v: %s: dependency missing from journal", ErrTaskNotFound, t.ID))
+			continue
+		}
+		if t.Work == nil {
+			it := e.addLocked(t)
+			e.finalizeLocked(it, StateFailed, fmt.Errorf("%w: %q", ErrKindNotRegistered, t.Kind))
+			continue
+		}
+		it := e.addLocked(t)
+		it.mu.Lock()
+		it.attempt = jt.attempt
+		it.mu.Unlock()
+		logger.Debugf("backup: task %s restored from journal (attempt=%d)", t.ID, jt.attempt)
+	}
+}
+
+// restoreFinishedLocked registers a task that already reached a terminal
+// state before the restart.
+func (e *Engine) restoreFinishedLocked(t Task, jt *journalTask) {
+	e.seq++
+	it := &taskItem{
+		engine:     e,
+		id:         t.ID,
+		seq:        e.seq,
+		task:       t,
+		state:      jt.state,
+		attempt:    jt.attempt,
+		finished:   true,
+		finishedAt: jt.finishedAt,
+		submitted:  jt.submit.Time,
+		doneCh:     make(chan struct{}),
+		gate:       newPauseGate(),
+	}
+	if jt.err != "" {
+		it.err = errors.New(jt.err)
+	}
+	if jt.result != nil {
+		it.result = jt.result
+	}
+	close(it.doneCh)
+	for _, d := range t.DependsOn {
+		if dep := e.items[d]; dep != nil {
+			dep.dependents = append(dep.dependents, t.ID)
+		}
+	}
+	e.items[t.ID] = it
+}
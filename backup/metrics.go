@@ -0,0 +1,266 @@
+package backup
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DurationBuckets are the upper bounds, in seconds, of the task duration
+// histogram: from one second up to a day, since backup tasks range from
+// quick catalog updates to multi-terabyte copies.
+var DurationBuckets = []float64{1, 5, 15, 60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400}
+
+// Metrics is a point-in-time snapshot of an engine's counters and gauges,
+// returned by Engine.Metrics.
+type Metrics struct {
+	// Concurrency is the number of concurrency slots.
+	Concurrency int
+	// SlotsUsed is the number of slots held by running tasks.
+	SlotsUsed int
+	// Subscribers is the number of active event subscriptions.
+	Subscribers int
+	// EventsDropped counts events dropped because a subscriber's buffer
+	// was full, since the engine was created.
+	EventsDropped uint64
+	// Groups holds the per-group metrics, keyed by Task.Group.
+	Groups map[string]GroupMetrics
+}
+
+// GroupMetrics are the metrics of one scheduling group.
+type GroupMetrics struct {
+	// Tasks counts the group's known tasks by current state, as reported
+	// by Handle.State. A launched task is StateRunning while it still
+	// waits for a slot; see Running and Queued for the split.
+	Tasks map[TaskState]int
+	// Running is the number of tasks holding a concurrency slot.
+	Running int
+	// Queued is the number of tasks ready to run and waiting for a
+	// concurrency slot (or for their resources).
+	Queued int
+	// OldestQueued is how long the longest-waiting queued task has been
+	// waiting; a value that keeps growing indicates a stuck queue.
+	OldestQueued time.Duration
+	// Submitted counts tasks registered since the engine was created,
+	// including tasks restored from the journal.
+	Submitted uint64
+	// Finished counts tasks that reached each terminal state.
+	Finished map[TaskState]uint64
+	// Retries counts automatic retries.
+	Retries uint64
+	// Duration is the distribution of run durations (first start to
+	// finish) of tasks that ran.
+	Duration Histogram
+}
+
+// Histogram is a cumulative histogram snapshot.
+type Histogram struct {
+	// Bounds are the bucket upper bounds, ascending.
+	Bounds []float64
+	// Counts[i] is the number of observations less than or equal to
+	// Bounds[i].
+	Counts []uint64
+	// Count and Sum are the number and sum of all observations.
+	Count uint64
+	Sum   float64
+}
+
+// observe adds one observation.
+func (h *Histogram) observe(v float64) {
+	if h.Bounds == nil {
+		h.Bounds = DurationBuckets
+		h.Counts = make([]uint64, len(h.Bounds))
+	}
+	for i, b := range h.Bounds {
+		if v <= b {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// groupStats are the cumulative counters of one group. Guarded by the
+// engine's mu.
+type groupStats struct {
+	submitted uint64
+	retries   uint64
+	finished  map[TaskState]uint64
+	duration  Histogram
+}
+
+// statsLocked returns the counters of group, creating them on first use.
+func (e *Engine) statsLocked(group string) *groupStats {
+	s := e.stats[group]
+	if s == nil {
+		s = &groupStats{finished: make(map[TaskState]uint64)}
+		e.stats[group] = s
+	}
+	return s
+}
+
+// Metrics returns a snapshot of the engine's metrics.
+func (e *Engine) Metrics() Metrics {
+	subs, drops := e.hub.stats()
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := Metrics{
+		Concurrency:   e.opts.concurrency,
+		SlotsUsed:     e.slotsUsed,
+		Subscribers:   subs,
+		EventsDropped: drops,
+		Groups:        make(map[string]GroupMetrics),
+	}
+	group := func(name string) GroupMetrics {
+		g, ok := m.Groups[name]
+		if !ok {
+			g = GroupMetrics{Tasks: make(map[TaskState]int), Finished: make(map[TaskState]uint64)}
+		}
+		return g
+	}
+	for name, s := range e.stats {
+		g := group(name)
+		g.Submitted = s.submitted
+		g.Retries = s.retries
+		for st, n := range s.finished {
+			g.Finished[st] = n
+		}
+		g.Duration = s.duration
+		g.Duration.Counts = append([]uint64(nil), s.duration.Counts...)
+		m.Groups[name] = g
+	}
+	for _, it := range e.items {
+		it.mu.Lock()
+		st := it.state
+		it.mu.Unlock()
+		g := group(it.task.Group)
+		g.Tasks[st]++
+		m.Groups[it.task.Group] = g
+	}
+	for _, it := range e.items {
+		if it.slot != nil {
+			g := group(it.task.Group)
+			g.Running++
+			m.Groups[it.task.Group] = g
+		}
+	}
+	for _, w := range e.waiters {
+		g := group(w.it.task.Group)
+		g.Queued++
+		if age := now.Sub(w.since); age > g.OldestQueued {
+			g.OldestQueued = age
+		}
+		m.Groups[w.it.task.Group] = g
+	}
+	return m
+}
+
+// allStates lists the task states in exposition order.
+var allStates = []TaskState{
+	StatePending, StateWaiting, StateRunning, StatePaused,
+	StateCompleted, StateFailed, StateCancelled, StateTimedOut,
+}
+
+// MetricsHandler returns an http.Handler serving the engine's metrics in
+// the Prometheus text exposition format (version 0.0.4), which
+// Prometheus and OpenMetrics scrapers accept. Per-group series carry a
+// "group" label. Useful alerts are, for instance, on
+// backup_queue_oldest_seconds (a stuck queue) and on the rate of
+// backup_events_dropped_total (slow event consumers).
+func (e *Engine) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, e.Metrics())
+		_ = bw.Flush()
+	})
+}
+
+// writeMetrics renders m in the Prometheus text format.
+func writeMetrics(w *bufio.Writer, m Metrics) {
+	groups := make([]string, 0, len(m.Groups))
+	for name := range m.Groups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	perGroup := func(name, typ, help string, value func(g GroupMetrics) string) {
+		header(name, typ, help)
+		for _, g := range groups {
+			fmt.Fprintf(w, "%s{group=%s} %s\n", name, quoteLabel(g), value(m.Groups[g]))
+		}
+	}
+
+	header("backup_slots", "gauge", "Number of concurrency slots.")
+	fmt.Fprintf(w, "backup_slots %d\n", m.Concurrency)
+	header("backup_slots_used", "gauge", "Number of concurrency slots held by running tasks.")
+	fmt.Fprintf(w, "backup_slots_used %d\n", m.SlotsUsed)
+	header("backup_event_subscribers", "gauge", "Number of active event subscriptions.")
+	fmt.Fprintf(w, "backup_event_subscribers %d\n", m.Subscribers)
+	header("backup_events_dropped_total", "counter", "Events dropped because a subscriber buffer was full.")
+	fmt.Fprintf(w, "backup_events_dropped_total %d\n", m.EventsDropped)
+
+	header("backup_tasks", "gauge", "Known tasks by group and current state.")
+	for _, g := range groups {
+		for _, st := range allStates {
+			fmt.Fprintf(w, "backup_tasks{group=%s,state=%q} %d\n", quoteLabel(g), st, m.Groups[g].Tasks[st])
+		}
+	}
+	perGroup("backup_tasks_running", "gauge", "Tasks holding a concurrency slot.",
+		func(g GroupMetrics) string { return strconv.Itoa(g.Running) })
+	perGroup("backup_queue_depth", "gauge", "Tasks ready to run and waiting for a concurrency slot.",
+		func(g GroupMetrics) string { return strconv.Itoa(g.Queued) })
+	perGroup("backup_queue_oldest_seconds", "gauge", "Wait time of the longest-queued task.",
+		func(g GroupMetrics) string { return formatFloat(g.OldestQueued.Seconds()) })
+	perGroup("backup_tasks_submitted_total", "counter", "Tasks registered with the engine.",
+		func(g GroupMetrics) string { return strconv.FormatUint(g.Submitted, 10) })
+	header("backup_tasks_finished_total", "counter", "Tasks that reached a terminal state, by state.")
+	for _, g := range groups {
+		for _, st := range allStates {
+			if st.Terminal() {
+				fmt.Fprintf(w, "backup_tasks_finished_total{group=%s,state=%q} %d\n", quoteLabel(g), st, m.Groups[g].Finished[st])
+			}
+		}
+	}
+	perGroup("backup_task_retries_total", "counter", "Automatic task retries.",
+		func(g GroupMetrics) string { return strconv.FormatUint(g.Retries, 10) })
+
+	header("backup_task_duration_seconds", "histogram", "Run duration of finished tasks, from first start to finish.")
+	for _, g := range groups {
+		h := m.Groups[g].Duration
+		label := quoteLabel(g)
+		bounds := h.Bounds
+		if bounds == nil {
+			bounds = DurationBuckets
+		}
+		for i, b := range bounds {
+			var n uint64
+			if i < len(h.Counts) {
+				n = h.Counts[i]
+			}
+			fmt.Fprintf(w, "backup_task_duration_seconds_bucket{group=%s,le=\"%s\"} %d\n", label, formatFloat(b), n)
+		}
+		fmt.Fprintf(w, "backup_task_duration_seconds_bucket{group=%s,le=\"+Inf\"} %d\n", label, h.Count)
+		fmt.Fprintf(w, "backup_task_duration_seconds_sum{group=%s} %s\n", label, formatFloat(h.Sum))
+		fmt.Fprintf(w, "backup_task_duration_seconds_count{group=%s} %d\n", label, h.Count)
+	}
+}
+
+// quoteLabel quotes a label value with the escaping of the text format.
+func quoteLabel(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
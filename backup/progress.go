@@ -2,6 +2,7 @@ package backup
 
 import (
 	"context"
+	"math"
 	"sync"
 	"time"
 )
@@ -12,10 +13,90 @@ type Progress struct {
 	Percent int32
 	// Message is the latest progress message.
 	Message string
+	// Phase is the current phase name set by Reporter.SetPhase, e.g.
+	// "snapshot", "copy" or "verify".
+	Phase string
+	// BytesDone and BytesTotal are the byte counters set by
+	// Reporter.ReportBytes, or the sums over the task's steps. Zero when
+	// the task does not report bytes.
+	BytesDone, BytesTotal int64
+	// Throughput is the smoothed transfer rate in bytes per second.
+	Throughput float64
+	// ETA is the estimated remaining time at the current Throughput, or
+	// zero when unknown.
+	ETA time.Duration
+	// Steps lists the progress of the steps created with Reporter.Step,
+	// in creation order.
+	Steps []StepProgress
 	// UpdatedAt is the time of the last progress update.
 	UpdatedAt time.Time
 }
 
+// StepProgress is the progress of one step of a task.
+type StepProgress struct {
+	// Name is the step name given to Reporter.Step.
+	Name string
+	// Weight is the step's share of the task's Percent.
+	Weight float64
+	// Percent is the step's completion percentage in [0, 100].
+	Percent int32
+	// BytesDone and BytesTotal are the step's byte counters.
+	BytesDone, BytesTotal int64
+}
+
+// clone returns a copy of p that shares no memory with it.
+func (p Progress) clone() Progress {
+	p.Steps = append([]StepProgress(nil), p.Steps...)
+	return p
+}
+
+// Throughput smoothing: an exponentially weighted moving average with a
+// time constant of rateWindow, sampled at most every rateMinSample.
+const (
+	rateWindow    = 10 * time.Second
+	rateMinSample = 200 * time.Millisecond
+)
+
+// rateMeter keeps a smoothed byte rate from successive byte counts.
+type rateMeter struct {
+	at   time.Time // time of the last sample
+	done int64     // byte count at the last sample
+	rate float64   // bytes per second; 0 until two samples were taken
+}
+
+// update feeds the byte count done observed at now and returns the
+// smoothed rate. Samples closer than rateMinSample to the previous one
+// are folded into the next sample.
+func (m *rateMeter) update(now time.Time, done int64) float64 {
+	if m.at.IsZero() || done < m.done {
+		// First sample, or the counter went backwards (a restarted
+		// copy): start over from here.
+		*m = rateMeter{at: now, done: done}
+		return 0
+	}
+	dt := now.Sub(m.at)
+	if dt < rateMinSample {
+		return m.rate
+	}
+	inst := float64(done-m.done) / dt.Seconds()
+	if m.rate == 0 {
+		m.rate = inst
+	} else {
+		alpha := 1 - math.Exp(-float64(dt)/float64(rateWindow))
+		m.rate += alpha * (inst - m.rate)
+	}
+	m.at, m.done = now, done
+	return m.rate
+}
+
+// eta returns the time left to transfer the remaining bytes at rate.
+func eta(done, total int64, rate float64) time.Duration {
+	if total <= 0 || done >= total || rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(total-done) / rate * float64(time.Second))
+}
+
 // Reporter lets a task's WorkFunc report progress back to the engine.
 // It is safe for concurrent use.
 type Reporter struct {
@@ -29,23 +110,166 @@ func (r *Reporter) Report(percent int32, msg string) error {
 	if percent < 0 || percent > 100 {
 		return ErrInvalidProgress
 	}
-	now := time.Now()
+	r.item.updateProgress(func(p *Progress, _ time.Time) {
+		p.Percent = percent
+		p.Message = msg
+	})
+	return nil
+}
 
+// ReportBytes records that done of total bytes have been processed,
+// derives Percent from them, updates the smoothed Throughput and ETA, and
+// publishes an EventProgress event. A total of zero or less means the
+// size is unknown: Percent is left alone and no ETA is computed.
+// done < 0 or done > total (for a known total) returns
+// ErrInvalidProgress and the update is ignored.
+func (r *Reporter) ReportBytes(done, total int64) error {
+	if done < 0 || (total > 0 && done > total) {
+		return ErrInvalidProgress
+	}
 	item := r.item
-	item.mu.Lock()
-	item.progress.Percent = percent
-	item.progress.Message = msg
-	item.progress.UpdatedAt = now
-	item.mu.Unlock()
-
-	item.engine.publish(Event{
-		Kind:     EventProgress,
-		TaskID:   item.id,
-		Progress: Progress{Percent: percent, Message: msg, UpdatedAt: now},
+	item.updateProgress(func(p *Progress, now time.Time) {
+		p.BytesDone, p.BytesTotal = done, total
+		if total > 0 {
+			p.Percent = int32(done * 100 / total)
+		}
+		item.updateRateLocked(now)
 	})
 	return nil
 }
 
+// SetPhase records the name of the phase the task entered, e.g. "copy",
+// and publishes an EventProgress event.
+func (r *Reporter) SetPhase(name string) {
+	r.item.updateProgress(func(p *Progress, _ time.Time) {
+		p.Phase = name
+	})
+}
+
+// Step adds a step to the task and returns a reporter for it. Once a
+// task has steps, its Percent is the weighted mean of the step
+// percentages and its byte counters are the sums over the steps, so e.g.
+// a task copying several disks in parallel can report each disk on its
+// own step. A non-positive weight counts as 1. Report and ReportBytes on
+// the Reporter itself should not be mixed with steps.
+func (r *Reporter) Step(name string, weight float64) *StepReporter {
+	if weight <= 0 {
+		weight = 1
+	}
+	item := r.item
+	var idx int
+	var seq uint64
+	item.updateProgress(func(p *Progress, now time.Time) {
+		idx, seq = len(p.Steps), item.attemptSeq
+		p.Steps = append(p.Steps, StepProgress{Name: name, Weight: weight})
+		item.rollUpLocked(now)
+	})
+	return &StepReporter{item: item, idx: idx, seq: seq}
+}
+
+// StepReporter reports the progress of one step of a task. It is safe
+// for concurrent use. A StepReporter belongs to the attempt that created
+// it: once the task is retried its updates are ignored.
+type StepReporter struct {
+	item *taskItem
+	idx  int
+	seq  uint64 // attemptSeq of the attempt that created the step
+}
+
+// Report records the step's completion percentage and publishes an
+// EventProgress event for the task. percent outside [0, 100] returns
+// ErrInvalidProgress and the update is ignored.
+func (s *StepReporter) Report(percent int32) error {
+	if percent < 0 || percent > 100 {
+		return ErrInvalidProgress
+	}
+	s.update(func(st *StepProgress) { st.Percent = percent })
+	return nil
+}
+
+// ReportBytes records that done of total bytes of the step have been
+// processed, with the same rules as Reporter.ReportBytes.
+func (s *StepReporter) ReportBytes(done, total int64) error {
+	if done < 0 || (total > 0 && done > total) {
+		return ErrInvalidProgress
+	}
+	s.update(func(st *StepProgress) {
+		st.BytesDone, st.BytesTotal = done, total
+		if total > 0 {
+			st.Percent = int32(done * 100 / total)
+		}
+	})
+	return nil
+}
+
+// Done marks the step as complete.
+func (s *StepReporter) Done() {
+	s.update(func(st *StepProgress) {
+		st.Percent = 100
+		if st.BytesTotal > 0 {
+			st.BytesDone = st.BytesTotal
+		}
+	})
+}
+
+func (s *StepReporter) update(fn func(st *StepProgress)) {
+	item := s.item
+	item.updateProgress(func(p *Progress, now time.Time) {
+		if s.seq != item.attemptSeq || s.idx >= len(p.Steps) {
+			return // a stale step from an earlier attempt
+		}
+		fn(&p.Steps[s.idx])
+		item.rollUpLocked(now)
+	})
+}
+
+// updateProgress applies fn to the task's progress under it.mu, stamps
+// it and publishes the result as an EventProgress event.
+func (it *taskItem) updateProgress(fn func(p *Progress, now time.Time)) {
+	now := time.Now()
+	it.mu.Lock()
+	fn(&it.progress, now)
+	it.progress.UpdatedAt = now
+	prog := it.progress.clone()
+	it.mu.Unlock()
+
+	it.engine.publish(Event{Kind: EventProgress, TaskID: it.id, Progress: prog})
+}
+
+// rollUpLocked recomputes the task's Percent and byte counters from its
+// steps. The caller holds it.mu.
+func (it *taskItem) rollUpLocked(now time.Time) {
+	p := &it.progress
+	var sum, weights float64
+	var done, total int64
+	for _, st := range p.Steps {
+		sum += st.Weight * float64(st.Percent)
+		weights += st.Weight
+		done += st.BytesDone
+		total += st.BytesTotal
+	}
+	if weights > 0 {
+		p.Percent = int32(sum / weights)
+	}
+	if done > 0 || total > 0 {
+		p.BytesDone, p.BytesTotal = done, total
+		it.updateRateLocked(now)
+	}
+}
+
+// updateRateLocked feeds the task's byte count to its rate meter and
+// refreshes Throughput and ETA. The caller holds it.mu.
+func (it *taskItem) updateRateLocked(now time.Time) {
+	p := &it.progress
+	p.Throughput = it.meter.update(now, p.BytesDone)
+	p.ETA = eta(p.BytesDone, p.BytesTotal, p.Throughput)
+}
+
+// Payload returns the Payload of the owning task.
+func (r *Reporter) Payload() []byte {
+	return r.item.task.Payload
+}
+
 // Checkpoint blocks while the owning task is paused and returns when it
 // is resumed. It returns ctx.Err() if ctx is cancelled first (e.g. the
 // task was cancelled while paused).
@@ -0,0 +1,166 @@
+package backup
+
+import "fmt"
+
+// ResourceMode is how a task holds a declared Resource.
+type ResourceMode int
+
+// Resource modes.
+const (
+	// Exclusive holds the resource alone: no other task holding the same
+	// key, in any mode, runs at the same time. This is the zero value.
+	Exclusive ResourceMode = iota
+	// Shared holds the resource together with other Shared holders. For
+	// a counted resource (see WithResourceLimit) each holder takes Count
+	// units of its capacity.
+	Shared
+)
+
+// String returns the mode name.
+func (m ResourceMode) String() string {
+	switch m {
+	case Exclusive:
+		return "exclusive"
+	case Shared:
+		return "shared"
+	default:
+		return "unknown"
+	}
+}
+
+// Resource is something a task needs for itself while it runs, such as a
+// disk, an image chain or an LVM volume group. The engine only admits a
+// task once all of its resources can be acquired at the same time, and
+// holds them until the attempt ends. Because a task never holds some of
+// its resources while waiting for others, resources cannot deadlock.
+type Resource struct {
+	// Key identifies the resource, e.g. "/dev/sdb" or "vg:data". Required.
+	Key string `json:"key"`
+	// Mode is how the resource is held. Default: Exclusive.
+	Mode ResourceMode `json:"mode,omitempty"`
+	// Count is the number of units a Shared holder takes from a counted
+	// resource. Zero means 1. It is ignored for Exclusive holders and for
+	// resources without a configured limit.
+	Count int `json:"count,omitempty"`
+}
+
+// WithResourceLimit turns key into a counted resource with n units,
+// e.g. WithResourceLimit("disk-io-slots", 2): Shared holders take Count
+// units each and are admitted while units remain; an Exclusive holder
+// still excludes everyone. Non-positive n is ignored.
+func WithResourceLimit(key string, n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			if o.resourceLimits == nil {
+				o.resourceLimits = make(map[string]int)
+			}
+			o.resourceLimits[key] = n
+		}
+	}
+}
+
+// resourceState is the current holding of one resource key.
+type resourceState struct {
+	units     int  // units taken by Shared holders
+	exclusive bool // held by an Exclusive holder
+}
+
+// units returns the number of units r takes.
+func (r *Resource) units() int {
+	if r.Count > 0 {
+		return r.Count
+	}
+	return 1
+}
+
+// validateResources checks a task's resource declarations against the
+// engine's limits.
+func (e *Engine) validateResources(t *Task) error {
+	seen := make(map[string]struct{}, len(t.Resources))
+	for _, r := range t.Resources {
+		if r.Key == "" {
+			return fmt.Errorf("%v: %s: empty resource key", ErrInvalidTask, t.ID)
+		}
+		if _, dup := seen[r.Key]; dup {
+			return fmt.Errorf("%v: %s: duplicate resource %q", ErrInvalidTask, t.ID, r.Key)
+		}
+		seen[r.Key] = struct{}{}
+		if r.Mode != Exclusive && r.Mode != Shared {
+			return fmt.Errorf("%v: %s: resource %q has invalid mode", ErrInvalidTask, t.ID, r.Key)
+		}
+		if r.Count < 0 {
+			return fmt.Errorf("%v: %s: resource %q has negative count", ErrInvalidTask, t.ID, r.Key)
+		}
+		if limit, ok := e.opts.resourceLimits[r.Key]; ok && r.Mode == Shared && r.units() > limit {
+			return fmt.Errorf("%v: %s: resource %q needs %d units, limit is %d",
+				ErrInvalidTask, t.ID, r.Key, r.units(), limit)
+		}
+	}
+	return nil
+}
+
+// resourcesFreeLocked reports whether all of the task's resources can be
+// acquired now.
+func (e *Engine) resourcesFreeLocked(it *taskItem) bool {
+	for i := range it.task.Resources {
+		r := &it.task.Resources[i]
+		st := e.resources[r.Key]
+		if st == nil {
+			continue
+		}
+		if st.exclusive || r.Mode == Exclusive {
+			return false
+		}
+		if limit, ok := e.opts.resourceLimits[r.Key]; ok && st.units+r.units() > limit {
+			return false
+		}
+	}
+	return true
+}
+
+// takeResourcesLocked acquires all of the task's resources. The caller
+// has checked resourcesFreeLocked.
+func (e *Engine) takeResourcesLocked(it *taskItem) {
+	for i := range it.task.Resources {
+		r := &it.task.Resources[i]
+		st := e.resources[r.Key]
+		if st == nil {
+			st = &resourceState{}
+			e.resources[r.Key] = st
+		}
+		if r.Mode == Exclusive {
+			st.exclusive = true
+		} else {
+			st.units += r.units()
+		}
+	}
+}
+
+// giveResourcesLocked releases all of the task's resources.
+func (e *Engine) giveResourcesLocked(it *taskItem) {
+	for i := range it.task.Resources {
+		r := &it.task.Resources[i]
+		st := e.resources[r.Key]
+		if st == nil {
+			continue
+		}
+		if r.Mode == Exclusive {
+			st.exclusive = false
+		} else {
+			st.units -= r.units()
+		}
+		if !st.exclusive && st.units <= 0 {
+			delete(e.resources, r.Key)
+		}
+	}
+}
+
+// touchesAny reports whether the task declares any key in keys.
+func touchesAny(it *taskItem, keys map[string]struct{}) bool {
+	for i := range it.task.Resources {
+		if _, ok := keys[it.task.Resources[i].Key]; ok {
+			return true
+		}
+	}
+	return false
+}
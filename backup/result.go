@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ResultFunc is a WorkFunc that also returns a result. Wrap it with
+// ResultWork to use it as Task.Work.
+type ResultFunc[T any] func(ctx context.Context, rep *Reporter) (T, error)
+
+// ResultWork adapts fn into a WorkFunc that stores fn's result on the
+// task when fn succeeds, as if it had called Reporter.SetResult:
+//
+//	Work: backup.ResultWork(func(ctx context.Context, rep *backup.Reporter) (string, error) {
+//		return backupDisk(ctx) // returns the vimg META path
+//	}),
+func ResultWork[T any](fn ResultFunc[T]) WorkFunc {
+	return func(ctx context.Context, rep *Reporter) error {
+		v, err := fn(ctx, rep)
+		if err != nil {
+			return err
+		}
+		rep.SetResult(v)
+		return nil
+	}
+}
+
+// SetResult stores v as the result of the current attempt, replacing any
+// earlier value. The result is kept only if the task completes: it is
+// then available through Handle.Result, to dependents through
+// Reporter.DependencyResult and DependencyResult, and on the task's
+// EventFinal. With WithJournal, results are persisted as JSON, so v
+// should be JSON-marshalable; see DependencyResult for how results read
+// back from the journal are returned.
+func (r *Reporter) SetResult(v any) {
+	item := r.item
+	item.mu.Lock()
+	item.result = v
+	item.mu.Unlock()
+}
+
+// DependencyResult returns the result of dependency id of the owning
+// task, or nil if the dependency completed without one. It returns
+// ErrTaskNotFound when id is not in the task's DependsOn.
+func (r *Reporter) DependencyResult(id string) (any, error) {
+	return r.item.dependencyResult(id)
+}
+
+// DependencyResult returns the result of dependency id of the task whose
+// WorkFunc received ctx, converted to T. A result restored from the
+// journal is held as json.RawMessage and is decoded into T. It returns
+// the zero T if the dependency completed without a result,
+// ErrTaskNotFound if ctx is not a task context or id is not one of the
+// task's dependencies, and ErrResultType if the result is not a T.
+func DependencyResult[T any](ctx context.Context, id string) (T, error) {
+	var zero T
+	it, ok := ctx.Value(taskItemKey{}).(*taskItem)
+	if !ok {
+		return zero, fmt.Errorf("%v: no task in context", ErrTaskNotFound)
+	}
+	v, err := it.dependencyResult(id)
+	if err != nil {
+		return zero, err
+	}
+	return resultAs[T](id, v)
+}
+
+// ResultAs returns the result of the task behind h converted to T, with
+// the same conversion rules as DependencyResult. ok is false if the task
+// has no result or it is not a T.
+func ResultAs[T any](h *Handle) (T, bool) {
+	r := h.Result()
+	v, err := resultAs[T](h.ID(), r)
+	return v, err == nil && r != nil
+}
+
+// resultAs converts the result v of task id to T.
+func resultAs[T any](id string, v any) (T, error) {
+	var zero T
+	if v == nil {
+		return zero, nil
+	}
+	if t, ok := v.(T); ok {
+		return t, nil
+	}
+	if raw, ok := v.(json.RawMessage); ok {
+		var t T
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return zero, fmt.Errorf("%w: %s: %v", ErrResultType, id, err)
+		}
+		return t, nil
+	}
+	return zero, fmt.Errorf("%w: %s: result is %T, want %T", ErrResultType, id, v, zero)
+}
+
+// taskItemKey is the context key under which a task's WorkFunc context
+// carries its taskItem.
+type taskItemKey struct{}
+
+// dependencyResult looks up the result of dependency id of it.
+func (it *taskItem) dependencyResult(id string) (any, error) {
+	if !containsString(it.task.DependsOn, id) {
+		return nil, fmt.Errorf("%v: %s is not a dependency of %s", ErrTaskNotFound, id, it.id)
+	}
+	e := it.engine
+	e.mu.Lock()
+	dep := e.items[id]
+	e.mu.Unlock()
+	if dep == nil {
+		return nil, fmt.Errorf("%v: %s", ErrTaskNotFound, id)
+	}
+	dep.mu.Lock()
+	defer dep.mu.Unlock()
+	return dep.result, nil
+}
@@ -0,0 +1,437 @@
+package backup
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kisun-bit/drpkg/logger"
+)
+
+// ReusePolicy decides whether Submit accepts the ID of a task that was
+// evicted by the retention policy.
+type ReusePolicy int
+
+// ID reuse policies.
+const (
+	// ReuseNever rejects IDs found in the history with ErrTaskExists, as
+	// if the task were still known. This is the zero value.
+	ReuseNever ReusePolicy = iota
+	// ReuseAfterFailure accepts the ID only if the evicted task did not
+	// complete successfully, so failed work can be submitted again under
+	// the same ID.
+	ReuseAfterFailure
+	// ReuseAlways accepts any evicted ID.
+	ReuseAlways
+)
+
+// defaultHistorySize is the history length used when
+// RetentionPolicy.HistorySize is zero.
+const defaultHistorySize = 10000
+
+// RetentionPolicy bounds how long finished tasks stay in an engine. A
+// finished task is evicted once any limit applies to it, but never while
+// one of its dependents is still active. Evicted tasks disappear from Get
+// and List and leave a compact HistoryEntry behind, which keeps their IDs
+// reserved (see ReuseIDs) and lets new tasks depend on them.
+type RetentionPolicy struct {
+	// MaxFinished is the number of finished tasks to keep. Beyond it the
+	// oldest completed tasks are evicted first, unsuccessful ones only
+	// when no completed task is left to evict. Zero means no limit.
+	MaxFinished int
+	// MaxAge evicts completed tasks that finished longer ago than this.
+	// Zero means no limit.
+	MaxAge time.Duration
+	// FailedMaxAge is MaxAge for unsuccessful (failed, timed out or
+	// cancelled) tasks, typically longer so that failures stay visible.
+	// Zero means MaxAge applies to them too.
+	FailedMaxAge time.Duration
+	// HistorySize is the number of evicted tasks remembered; the oldest
+	// entries are forgotten first, which releases their IDs. Zero means
+	// 10000; a negative value disables the history.
+	HistorySize int
+	// ReuseIDs decides whether IDs of evicted tasks may be submitted
+	// again. Default: ReuseNever.
+	ReuseIDs ReusePolicy
+}
+
+// WithRetention enables eviction of finished tasks according to p. By
+// default an engine keeps every task until it is shut down.
+func WithRetention(p RetentionPolicy) Option {
+	return func(o *options) { o.retention = &p }
+}
+
+// HistoryEntry is the compact record of an evicted task.
+type HistoryEntry struct {
+	ID    string
+	Kind  string
+	Group string
+	// State is the terminal state the task finished in.
+	State TaskState
+	// Err is the task's terminal error, nil for completed tasks.
+	Err error
+	// FinishedAt is when the task reached its terminal state.
+	FinishedAt time.Time
+}
+
+// taskHistory is a bounded FIFO of evicted tasks, indexed by ID. Guarded
+// by the engine's mu.
+type taskHistory struct {
+	limit int
+	order *list.List // of *HistoryEntry, oldest first
+	byID  map[string]*list.Element
+}
+
+func newTaskHistory(limit int) *taskHistory {
+	return &taskHistory{limit: limit, order: list.New(), byID: make(map[string]*list.Element)}
+}
+
+// add records h, forgetting the oldest entries beyond the limit.
+func (th *taskHistory) add(h *HistoryEntry) {
+	if th.limit < 0 {
+		return
+	}
+	th.remove(h.ID)
+	th.byID[h.ID] = th.order.PushBack(h)
+	for th.order.Len() > th.limit {
+		old := th.order.Remove(th.order.Front()).(*HistoryEntry)
+		delete(th.byID, old.ID)
+	}
+}
+
+// get returns the entry for id, or nil.
+func (th *taskHistory) get(id string) *HistoryEntry {
+	if el := th.byID[id]; el != nil {
+		return el.Value.(*HistoryEntry)
+	}
+	return nil
+}
+
+// remove forgets the entry for id, if any.
+func (th *taskHistory) remove(id string) {
+	if el := th.byID[id]; el != nil {
+		th.order.Remove(el)
+		delete(th.byID, id)
+	}
+}
+
+// entries returns the entries oldest first.
+func (th *taskHistory) entries() []*HistoryEntry {
+	out := make([]*HistoryEntry, 0, th.order.Len())
+	for el := th.order.Front(); el != nil; el = el.Next() {
+		out = append(out, el.Value.(*HistoryEntry))
+	}
+	return out
+}
+
+// historySize returns the effective history length of the options.
+func (o *options) historySize() int {
+	if o.retention == nil {
+		return -1
+	}
+	if n := o.retention.HistorySize; n != 0 {
+		return n
+	}
+	return defaultHistorySize
+}
+
+// checkIDLocked returns ErrTaskExists when id cannot be used by a new
+// task: it is known to the engine, or it belongs to an evicted task and
+// the reuse policy forbids it. addLocked drops an accepted evicted ID
+// from the history.
+func (e *Engine) checkIDLocked(id string) error {
+	if _, ok := e.items[id]; ok {
+		return fmt.Errorf("%v: %s", ErrTaskExists, id)
+	}
+	h := e.history.get(id)
+	if h == nil {
+		return nil
+	}
+	switch e.opts.retention.ReuseIDs {
+	case ReuseAlways:
+	case ReuseAfterFailure:
+		if h.State == StateCompleted {
+			return fmt.Errorf("%v: %s completed at %s", ErrTaskExists, id, h.FinishedAt.Format(time.RFC3339))
+		}
+	default:
+		return fmt.Errorf("%v: %s was used by an evicted task", ErrTaskExists, id)
+	}
+	return nil
+}
+
+// knownLocked reports whether id names a task a new task may depend on:
+// a registered task or an evicted one.
+func (e *Engine) knownLocked(id string) bool {
+	if _, ok := e.items[id]; ok {
+		return true
+	}
+	return e.history.get(id) != nil
+}
+
+// gcLocked evicts the finished tasks selected by the retention policy.
+// The scheduler runs it after a task finished and on the age-based GC
+// tick, not on every wake.
+func (e *Engine) gcLocked(now time.Time) {
+	p := e.opts.retention
+	if p == nil {
+		return
+	}
+	type candidate struct {
+		it       *taskItem
+		st       TaskState
+		finished time.Time
+	}
+	var cands []candidate
+	nFinished := 0
+	for _, it := range e.items {
+		it.mu.Lock()
+		finished, st, at := it.finished, it.state, it.finishedAt
+		it.mu.Unlock()
+		if !finished {
+			continue
+		}
+		nFinished++
+		if e.evictableLocked(it) {
+			cands = append(cands, candidate{it, st, at})
+		}
+	}
+	// Completed tasks first, oldest first.
+	sort.Slice(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		if (a.st == StateCompleted) != (b.st == StateCompleted) {
+			return a.st == StateCompleted
+		}
+		return a.finished.Before(b.finished)
+	})
+	for _, c := range cands {
+		maxAge := p.MaxAge
+		if c.st != StateCompleted && p.FailedMaxAge > 0 {
+			maxAge = p.FailedMaxAge
+		}
+		tooMany := p.MaxFinished > 0 && nFinished > p.MaxFinished
+		tooOld := maxAge > 0 && now.Sub(c.finished) > maxAge
+		if tooMany || tooOld {
+			e.evictLocked(c.it)
+			nFinished--
+		}
+	}
+}
+
+// evictableLocked reports whether a finished task has no active
+// dependents, whose dependency results and retries need it.
+func (e *Engine) evictableLocked(it *taskItem) bool {
+	for _, id := range it.dependents {
+		if dep := e.items[id]; dep != nil && !dep.isFinished() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictLocked removes a finished task from the engine and records it in
+// the history.
+func (e *Engine) evictLocked(it *taskItem) {
+	it.mu.Lock()
+	h := &HistoryEntry{
+		ID:         it.id,
+		Kind:       it.task.Kind,
+		Group:      it.task.Group,
+		State:      it.state,
+		Err:        it.err,
+		FinishedAt: it.finishedAt,
+	}
+	it.mu.Unlock()
+	delete(e.items, it.id)
+	e.history.add(h)
+	rec := journalRecord{Op: journalOpEvict, ID: h.ID, Time: h.FinishedAt, Kind: h.Kind, Group: h.Group, State: h.State.String()}
+	if h.Err != nil {
+		rec.Err = h.Err.Error()
+	}
+	e.writeJournal(rec)
+	logger.Debugf("backup: task %s evicted (state=%s)", h.ID, h.State)
+}
+
+// gcInterval returns how often age-based eviction runs, or zero when the
+// retention policy has no age limit.
+func (p *RetentionPolicy) gcInterval() time.Duration {
+	age := p.MaxAge
+	if p.FailedMaxAge > 0 && (age == 0 || p.FailedMaxAge < age) {
+		age = p.FailedMaxAge
+	}
+	if age <= 0 {
+		return 0
+	}
+	d := age / 4
+	if d > time.Minute {
+		d = time.Minute
+	}
+	if d < 10*time.Millisecond {
+		d = 10 * time.Millisecond
+	}
+	return d
+}
+
+// TaskFilter selects the tasks returned by Engine.List. Empty fields
+// match everything.
+type TaskFilter struct {
+	// States, Groups and Kinds restrict the result to tasks whose state,
+	// group or kind is in the list.
+	States []TaskState
+	Groups []string
+	Kinds  []string
+	// IDPrefix restricts the result to IDs starting with it.
+	IDPrefix string
+	// Evicted includes evicted tasks from the history.
+	Evicted bool
+	// Limit caps the number of results. Zero means no limit.
+	Limit int
+}
+
+// TaskInfo is a snapshot of one task returned by Engine.List.
+type TaskInfo struct {
+	ID       string
+	Kind     string
+	Group    string
+	Priority int
+	State    TaskState
+	// Err is the terminal error of an unsuccessful task.
+	Err      error
+	Attempt  int
+	Progress Progress
+	// SubmittedAt, StartedAt and FinishedAt are zero when not known or
+	// not reached yet; only FinishedAt is known for evicted tasks.
+	SubmittedAt time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	// Evicted marks an entry taken from the history.
+	Evicted bool
+}
+
+// List returns the tasks matching f: evicted tasks (with f.Evicted) in
+// eviction order, then registered tasks in submission order.
+func (e *Engine) List(f TaskFilter) []TaskInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var out []TaskInfo
+	if f.Evicted {
+		for _, h := range e.history.entries() {
+			out = append(out, h.info())
+		}
+	}
+	items := make([]*taskItem, 0, len(e.items))
+	for _, it := range e.items {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].seq < items[j].seq })
+	for _, it := range items {
+		out = append(out, it.info())
+	}
+
+	n := 0
+	for _, ti := range out {
+		if !f.match(&ti) {
+			continue
+		}
+		if f.Limit > 0 && n == f.Limit {
+			break
+		}
+		out[n] = ti
+		n++
+	}
+	return out[:n]
+}
+
+// Info returns a snapshot of the task with the given ID, looking it up
+// among the registered tasks and then in the history of evicted tasks. It
+// returns ErrTaskNotFound for an unknown ID.
+func (e *Engine) Info(id string) (TaskInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if it, ok := e.items[id]; ok {
+		return it.info(), nil
+	}
+	if h := e.history.get(id); h != nil {
+		return h.info(), nil
+	}
+	return TaskInfo{}, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+}
+
+// info returns a snapshot of a registered task. The caller holds the
+// engine's mu.
+func (it *taskItem) info() TaskInfo {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return TaskInfo{
+		ID:          it.id,
+		Kind:        it.task.Kind,
+		Group:       it.task.Group,
+		Priority:    it.task.Priority,
+		State:       it.state,
+		Err:         it.err,
+		Attempt:     it.attempt,
+		Progress:    it.progress.clone(),
+		SubmittedAt: it.submitted,
+		StartedAt:   it.started,
+		FinishedAt:  it.finishedAt,
+	}
+}
+
+// info returns the TaskInfo of an evicted task.
+func (h *HistoryEntry) info() TaskInfo {
+	return TaskInfo{
+		ID:         h.ID,
+		Kind:       h.Kind,
+		Group:      h.Group,
+		State:      h.State,
+		Err:        h.Err,
+		FinishedAt: h.FinishedAt,
+		Evicted:    true,
+	}
+}
+
+// match reports whether ti passes the filter.
+func (f *TaskFilter) match(ti *TaskInfo) bool {
+	if f.IDPrefix != "" && !strings.HasPrefix(ti.ID, f.IDPrefix) {
+		return false
+	}
+	if len(f.States) > 0 && !containsState(f.States, ti.State) {
+		return false
+	}
+	if len(f.Groups) > 0 && !containsString(f.Groups, ti.Group) {
+		return false
+	}
+	if len(f.Kinds) > 0 && !containsString(f.Kinds, ti.Kind) {
+		return false
+	}
+	return true
+}
+
+func containsState(list []TaskState, st TaskState) bool {
+	for _, x := range list {
+		if x == st {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// historyError rebuilds a terminal error read back from the journal.
+func historyError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed attempt of a task is
+// retried. Implementations must be safe for concurrent use; the built-in
+// ones are immutable values.
+type RetryPolicy interface {
+	// Retryable reports whether an attempt that failed with err may be
+	// retried at all. Returning false fails the task immediately.
+	Retryable(err error) bool
+
+	// Backoff returns the delay before the next attempt, given the number
+	// of attempts made so far (1 after the first failure) and the time
+	// elapsed since the first attempt started. ok is false when the
+	// policy gives up.
+	Backoff(attempt int, elapsed time.Duration) (delay time.Duration, ok bool)
+}
+
+// permanentError marks an error as not worth retrying.
+type permanentError struct{ err error }
+
+func (p *permanentError) Error() string { return p.err.Error() }
+func (p *permanentError) Unwrap() error { return p.err }
+
+// Permanent wraps err so that the built-in retry policies, and the
+// default Retry/RetryBackoff handling, fail the task immediately instead
+// of retrying it. It returns nil for a nil err. The wrapped error still
+// matches err with errors.Is and errors.As.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, was marked with
+// Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// FixedBackoff retries up to MaxRetries times with the same Delay between
+// attempts. It is the policy used for tasks that only set Task.Retry and
+// Task.RetryBackoff.
+type FixedBackoff struct {
+	// Delay is the pause before each retry.
+	Delay time.Duration
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+	// RetryIf classifies errors; nil retries every error that is not
+	// marked Permanent.
+	RetryIf func(err error) bool
+}
+
+// Retryable implements RetryPolicy.
+func (p FixedBackoff) Retryable(err error) bool {
+	return retryable(err, p.RetryIf)
+}
+
+// Backoff implements RetryPolicy.
+func (p FixedBackoff) Backoff(attempt int, _ time.Duration) (time.Duration, bool) {
+	if attempt > p.MaxRetries {
+		return 0, false
+	}
+	return p.Delay, true
+}
+
+// ExponentialBackoff retries with delays growing from Initial by
+// Multiplier per attempt up to Max, randomized by Jitter, until
+// MaxRetries attempts were retried or MaxElapsed has passed since the
+// first attempt started. Zero fields take the documented defaults, so
+// ExponentialBackoff{MaxRetries: 5} is a usable policy.
+type ExponentialBackoff struct {
+	// Initial is the delay before the first retry. Default: 1s.
+	Initial time.Duration
+	// Max caps the delay. Zero means no cap.
+	Max time.Duration
+	// Multiplier is the growth factor per retry. Values below 1 mean 2.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either
+	// direction, e.g. 0.2 gives delays in [0.8d, 1.2d], so that tasks
+	// failing together do not retry in lockstep. It is clamped to [0, 1].
+	Jitter float64
+	// MaxRetries is the number of retries after the first attempt. Zero
+	// means unlimited (bounded by MaxElapsed).
+	MaxRetries int
+	// MaxElapsed stops retrying once this much time has passed since the
+	// first attempt started, including the delay that would follow. Zero
+	// means no limit. With neither MaxRetries nor MaxElapsed set, the
+	// task is retried until it succeeds or is cancelled.
+	MaxElapsed time.Duration
+	// RetryIf classifies errors; nil retries every error that is not
+	// marked Permanent.
+	RetryIf func(err error) bool
+}
+
+// Retryable implements RetryPolicy.
+func (p ExponentialBackoff) Retryable(err error) bool {
+	return retryable(err, p.RetryIf)
+}
+
+// Backoff implements RetryPolicy.
+func (p ExponentialBackoff) Backoff(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if p.MaxRetries > 0 && attempt > p.MaxRetries {
+		return 0, false
+	}
+	initial := p.Initial
+	if initial <= 0 {
+		initial = time.Second
+	}
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+	d := float64(initial) * math.Pow(mult, float64(attempt-1))
+	if p.Max > 0 && d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+	if j := math.Min(math.Max(p.Jitter, 0), 1); j > 0 {
+		d *= 1 + j*(2*rand.Float64()-1)
+	}
+	if d > math.MaxInt64 {
+		d = math.MaxInt64
+	}
+	delay := time.Duration(d)
+	if p.MaxElapsed > 0 && elapsed+delay > p.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
+
+// retryable applies the RetryIf classifier of a built-in policy.
+func retryable(err error, retryIf func(error) bool) bool {
+	if IsPermanent(err) {
+		return false
+	}
+	return retryIf == nil || retryIf(err)
+}
+
+// retryPolicy returns the task's effective retry policy.
+func (t *Task) retryPolicy() RetryPolicy {
+	if t.RetryPolicy != nil {
+		return t.RetryPolicy
+	}
+	return FixedBackoff{Delay: t.RetryBackoff, MaxRetries: t.Retry}
+}
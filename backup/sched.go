@@ -0,0 +1,347 @@
+package backup
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/kisun-bit/drpkg/logger"
+)
+
+// slotWaiter is one request for a concurrency slot. Once granted it is
+// the slot itself, owned by the worker that requested it; this keeps the
+// accounting right when a stale worker and the worker of a manual Retry
+// briefly coexist for the same task.
+type slotWaiter struct {
+	it       *taskItem
+	ready    chan struct{} // closed when the slot is granted
+	res      bool          // the task's resources are held with this slot
+	released bool
+	since    time.Time // when the request was queued
+	slots    int       // concurrency slots taken when granted
+}
+
+// acquireSlot blocks until the task is granted a concurrency slot or ctx
+// is done. Slots are granted by priority, then by weighted fair share of
+// the task's group, then in submission order, and only once the task's
+// resources can be acquired with it; see dispatchLocked. The returned
+// slot must be given back with releaseSlot.
+func (e *Engine) acquireSlot(it *taskItem, ctx context.Context) (*slotWaiter, error) {
+	return e.waitSlot(&slotWaiter{it: it, ready: make(chan struct{})}, ctx)
+}
+
+// waitSlot queues w and blocks until it is granted or ctx is done.
+func (e *Engine) waitSlot(w *slotWaiter, ctx context.Context) (*slotWaiter, error) {
+	w.since = time.Now()
+	e.mu.Lock()
+	e.waiters = append(e.waiters, w)
+	e.dispatchLocked()
+	e.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return w, nil
+	case <-ctx.Done():
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Granted concurrently with the cancellation: give it back.
+			e.releaseSlotLocked(w)
+		default:
+			e.removeWaiterLocked(w)
+			if w.res {
+				w.res = false
+				e.giveResourcesLocked(w.it)
+				e.dispatchLocked()
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// releaseSlot gives a granted slot back.
+func (e *Engine) releaseSlot(w *slotWaiter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.releaseSlotLocked(w)
+}
+
+// releaseSlotLocked gives a granted slot back, once, and grants freed
+// capacity to the next waiters. A pending preemption request on the task
+// is withdrawn: it has given its slot back anyway.
+func (e *Engine) releaseSlotLocked(w *slotWaiter) {
+	if w.released {
+		return
+	}
+	w.released = true
+	it := w.it
+	if it.slot == w {
+		it.slot = nil
+		it.preempted.Store(false)
+	}
+	if w.res {
+		w.res = false
+		e.giveResourcesLocked(it)
+	}
+	e.slotsUsed -= w.slots
+	if g := it.task.Group; e.groupRunning[g] > w.slots {
+		e.groupRunning[g] -= w.slots
+	} else {
+		delete(e.groupRunning, g)
+	}
+	e.dispatchLocked()
+}
+
+// removeWaiterLocked drops w from the wait queue.
+func (e *Engine) removeWaiterLocked(w *slotWaiter) {
+	for i, x := range e.waiters {
+		if x == w {
+			e.waiters = append(e.waiters[:i], e.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatchLocked grants free slots to the best admissible waiters
+// together with their resources and, when waiters remain and preemption
+// is enabled, asks lower-priority running tasks to yield their slots.
+// A waiter whose weight does not fit in the free slots blocks the ones
+// ranked after it, so heavy tasks are not starved by a stream of light
+// ones.
+func (e *Engine) dispatchLocked() {
+	for e.slotsUsed < e.opts.concurrency && len(e.waiters) > 0 {
+		best := e.nextAdmissibleLocked()
+		if best < 0 {
+			break
+		}
+		w := e.waiters[best]
+		slots := e.slotsFor(&w.it.task)
+		if e.slotsUsed+slots > e.opts.concurrency {
+			break
+		}
+		e.waiters = append(e.waiters[:best], e.waiters[best+1:]...)
+
+		if !w.res {
+			e.takeResourcesLocked(w.it)
+			w.res = true
+		}
+		w.it.slot = w
+		w.slots = slots
+		e.slotsUsed += slots
+		e.groupRunning[w.it.task.Group] += slots
+		close(w.ready)
+	}
+	if len(e.waiters) > 0 && e.opts.preempt {
+		e.preemptLocked()
+	}
+}
+
+// slotsFor returns the number of slots an attempt of t takes: its
+// Weight, at least 1 and at most the whole engine.
+func (e *Engine) slotsFor(t *Task) int {
+	n := t.Weight
+	if n < 1 {
+		n = 1
+	}
+	if n > e.opts.concurrency {
+		n = e.opts.concurrency
+	}
+	return n
+}
+
+// SetConcurrency changes the number of concurrency slots of a running
+// engine, e.g. to throttle backups during business hours. Raising it
+// admits waiting tasks at once. Lowering it never interrupts running
+// tasks: they keep their slots, and new tasks are admitted only once
+// enough of them have finished. Non-positive values are ignored.
+func (e *Engine) SetConcurrency(n int) {
+	if n <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if n == e.opts.concurrency {
+		return
+	}
+	logger.Infof("backup: concurrency changed from %d to %d", e.opts.concurrency, n)
+	e.opts.concurrency = n
+	e.dispatchLocked()
+}
+
+// nextAdmissibleLocked returns the index of the best-ranked waiter whose
+// resources can be acquired now, or -1. A waiter blocked on a resource
+// reserves all of its keys: lower-ranked waiters touching any of them are
+// passed over as well, so an Exclusive holder is not starved by a stream
+// of Shared ones.
+func (e *Engine) nextAdmissibleLocked() int {
+	order := make([]int, len(e.waiters))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return e.beforeLocked(e.waiters[order[a]].it, e.waiters[order[b]].it)
+	})
+	var reserved map[string]struct{}
+	for _, i := range order {
+		w := e.waiters[i]
+		if w.res {
+			return i
+		}
+		if len(w.it.task.Resources) == 0 {
+			return i
+		}
+		if !touchesAny(w.it, reserved) && e.resourcesFreeLocked(w.it) {
+			return i
+		}
+		if reserved == nil {
+			reserved = make(map[string]struct{})
+		}
+		for _, r := range w.it.task.Resources {
+			reserved[r.Key] = struct{}{}
+		}
+	}
+	return -1
+}
+
+// beforeLocked reports whether a should be served before b.
+func (e *Engine) beforeLocked(a, b *taskItem) bool {
+	if a.task.Priority != b.task.Priority {
+		return a.task.Priority > b.task.Priority
+	}
+	if ga, gb := a.task.Group, b.task.Group; ga != gb {
+		// runningA/weightA < runningB/weightB, cross-multiplied.
+		sa := e.groupRunning[ga] * e.groupWeight(gb)
+		sb := e.groupRunning[gb] * e.groupWeight(ga)
+		if sa != sb {
+			return sa < sb
+		}
+	}
+	return a.seq < b.seq
+}
+
+// groupWeight returns the configured weight of a scheduling group.
+func (e *Engine) groupWeight(g string) int {
+	if w, ok := e.opts.groupWeights[g]; ok {
+		return w
+	}
+	return 1
+}
+
+// preemptLocked asks running tasks to yield their slots to waiters whose
+// priority reaches the preemption threshold. Urgent waiters are served in
+// scheduling order; each claims victims until the free slots plus the
+// slots of tasks already asked to yield cover its Weight. Victims are the
+// running tasks with the lowest priority strictly below the waiter's (the
+// most recently submitted among equals). A waiter that cannot be covered
+// preempts nothing, and neither do the waiters ranked after it, since
+// dispatchLocked would not admit them before it. Victims are flagged as
+// preempted, leaving their pause gate to the user, and give their slot
+// back at their next Reporter.Checkpoint; see yieldSlot.
+//
+// Waiters blocked on a resource do not preempt: a freed slot would not
+// let them run.
+func (e *Engine) preemptLocked() {
+	var urgent []*slotWaiter
+	for _, w := range e.waiters {
+		if w.it.task.Priority >= e.opts.preemptPriority && (w.res || e.resourcesFreeLocked(w.it)) {
+			urgent = append(urgent, w)
+		}
+	}
+	if len(urgent) == 0 {
+		return
+	}
+	sort.SliceStable(urgent, func(a, b int) bool { return e.beforeLocked(urgent[a].it, urgent[b].it) })
+
+	avail := e.opts.concurrency - e.slotsUsed
+	for _, it := range e.items {
+		if it.slot != nil && it.preempted.Load() {
+			avail += it.slot.slots
+		}
+	}
+	for _, w := range urgent {
+		need := e.slotsFor(&w.it.task)
+		var victims []*taskItem
+		for avail < need {
+			victim := e.victimLocked(w.it.task.Priority, victims)
+			if victim == nil {
+				return
+			}
+			victims = append(victims, victim)
+			avail += victim.slot.slots
+		}
+		for _, v := range victims {
+			v.preempted.Store(true)
+		}
+		avail -= need
+	}
+}
+
+// victimLocked returns the running task to preempt for a waiter of the
+// given priority, skipping those in taken, or nil when there is none.
+func (e *Engine) victimLocked(prio int, taken []*taskItem) *taskItem {
+	var victim *taskItem
+	for _, it := range e.items {
+		// A task paused by the user would not reach a checkpoint to
+		// give its slot back.
+		if it.slot == nil || it.preempted.Load() || it.task.Priority >= prio || it.gate.isPaused() || containsItem(taken, it) {
+			continue
+		}
+		if victim == nil || it.task.Priority < victim.task.Priority ||
+			(it.task.Priority == victim.task.Priority && it.seq > victim.seq) {
+			victim = it
+		}
+	}
+	return victim
+}
+
+func containsItem(list []*taskItem, it *taskItem) bool {
+	for _, x := range list {
+		if x == it {
+			return true
+		}
+	}
+	return false
+}
+
+// yieldSlot is the preempted side of pauseWait: the task gives its slot
+// back, shows as StatePaused while it waits in the queue again with its
+// own priority, and continues as StateRunning once re-admitted.
+//
+// The worker keeps owning the replacement slot: the slot it holds is
+// swapped in place so that its deferred release frees the new one.
+func (e *Engine) yieldSlot(it *taskItem, ctx context.Context) error {
+	e.mu.Lock()
+	held := it.slot
+	if held == nil {
+		// Not inside an attempt: just withdraw the request.
+		it.preempted.Store(false)
+		e.mu.Unlock()
+		return nil
+	}
+	e.mu.Unlock()
+
+	// Show the task as paused before its slot can be handed over. The
+	// task is still in the middle of its attempt, so it keeps its
+	// resources while it waits.
+	e.transition(it, StatePaused)
+	e.mu.Lock()
+	held.res = false
+	e.releaseSlotLocked(held)
+	e.mu.Unlock()
+	w, err := e.waitSlot(&slotWaiter{it: it, ready: make(chan struct{}), res: true}, ctx)
+	e.mu.Lock()
+	if err == nil {
+		*held = *w
+		it.slot = held
+	}
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !it.isFinished() && !it.gate.isPaused() {
+		// A user pause requested meanwhile is honored by pauseWait.
+		e.transition(it, StateRunning)
+	}
+	return nil
+}
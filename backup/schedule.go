@@ -0,0 +1,444 @@
+package backup
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kisun-bit/drpkg/logger"
+)
+
+// OverlapPolicy decides what a Schedule does when a run is due while the
+// previous run is still active.
+type OverlapPolicy int
+
+// Overlap policies.
+const (
+	// OverlapSkip drops the new run and reports it with EventMissed. This
+	// is the default.
+	OverlapSkip OverlapPolicy = iota
+	// OverlapQueue starts the new run as soon as the previous one
+	// reaches a terminal state. At most one run waits: a run falling due
+	// while another one waits replaces it, and the replaced run is
+	// reported with EventMissed, as is a run still waiting when the
+	// schedule stops.
+	OverlapQueue
+	// OverlapCancelPrevious cancels the previous run and starts the new
+	// one once the previous one has reached a terminal state, so the two
+	// never run at the same time.
+	OverlapCancelPrevious
+)
+
+// String returns the policy name.
+func (p OverlapPolicy) String() string {
+	switch p {
+	case OverlapSkip:
+		return "skip"
+	case OverlapQueue:
+		return "queue"
+	case OverlapCancelPrevious:
+		return "cancel-previous"
+	default:
+		return "unknown"
+	}
+}
+
+// Window is a daily time range, e.g. a maintenance window from 01:00 to
+// 03:00. Start and End are offsets from midnight in the schedule's
+// location; an End before Start wraps past midnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+	// Days restricts the window to these weekdays (the day the window
+	// starts on). Empty means every day.
+	Days []time.Weekday
+}
+
+// contains reports whether t, already in the schedule's location, falls
+// inside the window.
+func (w *Window) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	off := t.Sub(midnight)
+	if w.Start <= w.End {
+		return off >= w.Start && off < w.End && w.onDay(t.Weekday())
+	}
+	// Wrapping window: the tail after midnight belongs to yesterday's
+	// window.
+	if off >= w.Start && w.onDay(t.Weekday()) {
+		return true
+	}
+	return off < w.End && w.onDay((t.Weekday()+6)%7)
+}
+
+// onDay reports whether the window applies to weekday d.
+func (w *Window) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, x := range w.Days {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleSpec describes a recurring task. Exactly one of Cron and Every
+// must be set.
+type ScheduleSpec struct {
+	// ID identifies the schedule within the engine. Each run is submitted
+	// as a task with ID "<ID>@<due time>", the due time formatted as
+	// 20060102T150405Z in UTC (with fractional seconds when the due time
+	// has them). Required.
+	ID string
+
+	// Cron is a five-field cron expression such as "0 2 * * *", or a
+	// descriptor such as "@daily".
+	Cron string
+
+	// Every runs the task at a fixed interval, starting one interval
+	// after Schedule is called.
+	Every time.Duration
+
+	// Location is the time zone Cron and Maintenance are evaluated in.
+	// Default: time.Local.
+	Location *time.Location
+
+	// Template is the task submitted for each run. Its ID is replaced;
+	// every other field, including Kind and Payload, is copied.
+	Template Task
+
+	// Overlap decides what happens when a run is due while the previous
+	// one is still active. Default: OverlapSkip.
+	Overlap OverlapPolicy
+
+	// Jitter delays each run by a random duration in [0, Jitter), to
+	// spread load when many agents share a schedule. Optional.
+	Jitter time.Duration
+
+	// Maintenance lists windows during which no run is started; runs due
+	// inside a window are reported with EventMissed. Optional.
+	Maintenance []Window
+
+	// MisfireGrace is how late a run may start, e.g. after the host was
+	// suspended, before it is reported as missed instead of run. Default:
+	// one minute.
+	MisfireGrace time.Duration
+}
+
+// validate checks the spec fields; the Template is validated by the
+// engine.
+func (s *ScheduleSpec) validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("%v: empty ID", ErrInvalidSchedule)
+	}
+	if (s.Cron == "") == (s.Every == 0) {
+		return fmt.Errorf("%v: %s: exactly one of Cron and Every must be set", ErrInvalidSchedule, s.ID)
+	}
+	if s.Every < 0 || s.Jitter < 0 || s.MisfireGrace < 0 {
+		return fmt.Errorf("%v: %s: negative duration", ErrInvalidSchedule, s.ID)
+	}
+	switch s.Overlap {
+	case OverlapSkip, OverlapQueue, OverlapCancelPrevious:
+	default:
+		return fmt.Errorf("%v: %s: invalid overlap policy", ErrInvalidSchedule, s.ID)
+	}
+	for _, w := range s.Maintenance {
+		if w.Start < 0 || w.Start >= 24*time.Hour || w.End < 0 || w.End > 24*time.Hour {
+			return fmt.Errorf("%v: %s: maintenance window outside a day", ErrInvalidSchedule, s.ID)
+		}
+	}
+	return nil
+}
+
+// Schedule is a recurring task registered with Engine.Schedule. All
+// methods are safe for concurrent use.
+type Schedule struct {
+	engine *Engine
+	spec   ScheduleSpec
+	cron   *cronSpec
+	anchor time.Time
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	mu       sync.Mutex
+	next     time.Time
+	stopped  bool
+	active   *Handle    // latest submitted run
+	queued   time.Time  // due time of the run waiting for the active one, or zero
+	submitMu sync.Mutex // serializes starting runs
+}
+
+// Schedule registers a recurring task. Each run is submitted through
+// Submit (so it produces the usual EventSubmitted and subsequent events);
+// runs that are not started are reported with an EventMissed event whose
+// TaskID is the ID the run would have had and whose Err wraps
+// ErrRunMissed with the reason. Schedules stop with the engine and are
+// not persisted by the journal: register them again after a restart.
+func (e *Engine) Schedule(spec ScheduleSpec) (*Schedule, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	if spec.Location == nil {
+		spec.Location = time.Local
+	}
+	if spec.MisfireGrace == 0 {
+		spec.MisfireGrace = time.Minute
+	}
+	s := &Schedule{
+		engine: e,
+		spec:   spec,
+		anchor: time.Now(),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	if spec.Cron != "" {
+		c, err := parseCron(spec.Cron)
+		if err != nil {
+			return nil, err
+		}
+		s.cron = c
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Validate the template the way Submit validates each run, so that a
+	// bad template fails here rather than on every run.
+	t := spec.Template
+	t.ID = spec.ID
+	if err := e.prepareLocked(&t); err != nil {
+		return nil, err
+	}
+	for _, d := range t.DependsOn {
+		if !e.knownLocked(d) {
+			return nil, fmt.Errorf("%v: %s depends on unknown task %q", ErrTaskNotFound, t.ID, d)
+		}
+	}
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+	if !e.started {
+		return nil, ErrEngineNotStarted
+	}
+	if _, ok := e.schedules[spec.ID]; ok {
+		return nil, fmt.Errorf("%v: %s", ErrScheduleExists, spec.ID)
+	}
+	e.schedules[spec.ID] = s
+	e.wg.Add(1)
+	go s.run(e.stopCh)
+	logger.Debugf("backup: schedule %s registered", spec.ID)
+	return s, nil
+}
+
+// ID returns the schedule ID.
+func (s *Schedule) ID() string { return s.spec.ID }
+
+// Next returns the time the next run is planned for, jitter included, or
+// the zero time when the schedule has stopped or has no further runs.
+func (s *Schedule) Next() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+// Stop stops generating runs and waits for the schedule goroutine to
+// exit. Runs already submitted are not affected. Stop is idempotent.
+func (s *Schedule) Stop() {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopCh)
+	}
+	s.mu.Unlock()
+	<-s.doneCh
+
+	e := s.engine
+	e.mu.Lock()
+	if e.schedules[s.spec.ID] == s {
+		delete(e.schedules, s.spec.ID)
+	}
+	e.mu.Unlock()
+}
+
+// nextAfter returns the first due time strictly after t, or the zero time.
+func (s *Schedule) nextAfter(t time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.next(t.In(s.spec.Location))
+	}
+	if t.Before(s.anchor) {
+		return s.anchor.Add(s.spec.Every)
+	}
+	k := t.Sub(s.anchor)/s.spec.Every + 1
+	return s.anchor.Add(k * s.spec.Every)
+}
+
+// run is the schedule goroutine. engineStop is the engine's stop channel
+// captured at registration.
+func (s *Schedule) run(engineStop <-chan struct{}) {
+	defer s.engine.wg.Done()
+	defer close(s.doneCh)
+	defer s.setNext(time.Time{})
+	defer s.dropQueued()
+
+	last := time.Now()
+	for {
+		due := s.nextAfter(last)
+		if due.IsZero() {
+			logger.Warnf("backup: schedule %s has no further runs", s.spec.ID)
+			return
+		}
+		fire := due
+		if s.spec.Jitter > 0 {
+			fire = fire.Add(time.Duration(rand.Int63n(int64(s.spec.Jitter))))
+		}
+		s.setNext(fire)
+
+		timer := time.NewTimer(time.Until(fire))
+		for waiting := true; waiting; {
+			var activeDone <-chan struct{}
+			if h := s.queuedActive(); h != nil {
+				activeDone = h.Done()
+			}
+			select {
+			case <-timer.C:
+				waiting = false
+			case <-activeDone:
+				s.startQueued()
+			case <-s.stopCh:
+				timer.Stop()
+				return
+			case <-engineStop:
+				timer.Stop()
+				return
+			}
+		}
+
+		// Runs that fell due while the goroutine could not act (e.g. the
+		// host was suspended) are reported as missed; only the latest
+		// one may still run.
+		now := time.Now()
+		for n := s.nextAfter(due); !n.IsZero() && !n.After(now); n = s.nextAfter(n) {
+			s.missed(due, "not started in time")
+			due, fire = n, n
+		}
+		last = due
+		if now.Sub(fire) > s.spec.MisfireGrace {
+			s.missed(due, "not started in time")
+			continue
+		}
+		s.fire(due)
+	}
+}
+
+// setNext records the planned time of the next run.
+func (s *Schedule) setNext(t time.Time) {
+	s.mu.Lock()
+	s.next = t
+	s.mu.Unlock()
+}
+
+// queuedActive returns the active run when a queued run waits for it.
+func (s *Schedule) queuedActive() *Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued.IsZero() {
+		return nil
+	}
+	return s.active
+}
+
+// fire handles a run that fell due, applying maintenance windows and the
+// overlap policy.
+func (s *Schedule) fire(due time.Time) {
+	s.mu.Lock()
+	prev := s.active
+	s.mu.Unlock()
+	if prev != nil && !prev.State().Terminal() {
+		switch s.spec.Overlap {
+		case OverlapSkip:
+			s.missed(due, fmt.Sprintf("previous run %s still active", prev.ID()))
+			return
+		case OverlapCancelPrevious:
+			// Cancel is asynchronous: the new run waits in the queue
+			// until the previous one has finished.
+			_ = prev.Cancel()
+		}
+		s.mu.Lock()
+		superseded := s.queued
+		s.queued = due
+		s.mu.Unlock()
+		if !superseded.IsZero() {
+			s.missed(superseded, "superseded by a later run")
+		}
+		return
+	}
+	s.start(due)
+}
+
+// dropQueued reports the run still waiting for the active one as missed
+// when the schedule stops.
+func (s *Schedule) dropQueued() {
+	s.mu.Lock()
+	due := s.queued
+	s.queued = time.Time{}
+	s.mu.Unlock()
+	if !due.IsZero() {
+		s.missed(due, "schedule stopped")
+	}
+}
+
+// startQueued starts the queued run once the active one finished.
+func (s *Schedule) startQueued() {
+	s.mu.Lock()
+	due := s.queued
+	s.queued = time.Time{}
+	s.mu.Unlock()
+	if !due.IsZero() {
+		s.start(due)
+	}
+}
+
+// start submits the run for due unless a maintenance window is open.
+func (s *Schedule) start(due time.Time) {
+	s.submitMu.Lock()
+	defer s.submitMu.Unlock()
+
+	now := time.Now().In(s.spec.Location)
+	for i := range s.spec.Maintenance {
+		if s.spec.Maintenance[i].contains(now) {
+			s.missed(due, "inside maintenance window")
+			return
+		}
+	}
+
+	t := s.spec.Template
+	t.ID = s.runID(due)
+	t.DependsOn = append([]string(nil), t.DependsOn...)
+	t.Resources = append([]Resource(nil), t.Resources...)
+	t.Watchers = append([]Watcher(nil), t.Watchers...)
+	h, err := s.engine.Submit(t)
+	if err != nil {
+		s.missed(due, err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.active = h
+	s.mu.Unlock()
+}
+
+// runID returns the task ID of the run due at due.
+func (s *Schedule) runID(due time.Time) string {
+	return s.spec.ID + "@" + due.UTC().Format("20060102T150405.999999999Z")
+}
+
+// missed publishes EventMissed for the run due at due.
+func (s *Schedule) missed(due time.Time, reason string) {
+	id := s.runID(due)
+	logger.Debugf("backup: schedule %s: run %s missed: %s", s.spec.ID, id, reason)
+	s.engine.publish(Event{
+		Kind:   EventMissed,
+		TaskID: id,
+		Err:    fmt.Errorf("%w: %s", ErrRunMissed, reason),
+	})
+}
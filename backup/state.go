@@ -1,5 +1,7 @@
 package backup
 
+import "fmt"
+
 // TaskState is the lifecycle state of a task managed by an Engine.
 type TaskState int
 
@@ -48,6 +50,23 @@ func (s TaskState) String() string {
 	}
 }
 
+// MarshalText encodes the state as its name, so that it appears as e.g.
+// "running" in JSON.
+func (s TaskState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a state name produced by MarshalText.
+func (s *TaskState) UnmarshalText(b []byte) error {
+	for st := StatePending; st <= StateTimedOut; st++ {
+		if st.String() == string(b) {
+			*s = st
+			return nil
+		}
+	}
+	return fmt.Errorf("backup: unknown task state %q", b)
+}
+
 // Terminal reports whether the state is final (the task will not change
 // state anymore).
 func (s TaskState) Terminal() bool {
@@ -82,8 +101,28 @@ const (
 	// last event for a task; Event.State, Event.Err and Event.Progress
 	// carry the final values.
 	EventFinal
+	// EventMissed: a Schedule did not start a run. Event.TaskID is the
+	// ID the run would have had and Event.Err wraps ErrRunMissed with
+	// the reason (overlap, maintenance window, misfire).
+	EventMissed
 )
 
+// MarshalText encodes the event kind as its name.
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes an event kind name produced by MarshalText.
+func (k *EventKind) UnmarshalText(b []byte) error {
+	for ek := EventSubmitted; ek <= EventMissed; ek++ {
+		if ek.String() == string(b) {
+			*k = ek
+			return nil
+		}
+	}
+	return fmt.Errorf("backup: unknown event kind %q", b)
+}
+
 // String returns the event kind name.
 func (k EventKind) String() string {
 	switch k {
@@ -97,6 +136,8 @@ func (k EventKind) String() string {
 		return "retry"
 	case EventFinal:
 		return "final"
+	case EventMissed:
+		return "missed"
 	default:
 		return "unknown"
 	}
@@ -20,14 +20,31 @@ type Task struct {
 	// ID uniquely identifies the task within an engine. Required.
 	ID string
 
-	// Work is the function to execute. Required.
+	// Work is the function to execute. Required unless Kind names a
+	// WorkFunc registered with Engine.RegisterKind.
 	Work WorkFunc
 
+	// Kind names the registered WorkFunc that runs this task. It is what
+	// binds a task restored from the journal (see WithJournal) to code
+	// again after a restart. Optional.
+	Kind string
+
+	// Payload is opaque task input, available to the WorkFunc through
+	// Reporter.Payload. Unlike a closure it is persisted in the journal,
+	// so kind-based tasks should carry their parameters here. Optional.
+	Payload []byte
+
 	// DependsOn lists IDs of tasks that must complete successfully
-	// before this task starts. Dependencies may be submitted in any
-	// order; a dependency on an unknown ID is an error at Submit time.
+	// before this task starts, unless DependencyPolicy says otherwise. A
+	// dependency on an unknown ID is an error at Submit time.
 	DependsOn []string
 
+	// DependencyPolicy overrides, per dependency ID, how the task reacts
+	// to that dependency's outcome: RunAlways for finally steps,
+	// RunOnFailure for compensation steps. Dependencies not listed use
+	// RunOnSuccess. Every key must appear in DependsOn. Optional.
+	DependencyPolicy map[string]DependencyPolicy
+
 	// Timeout bounds a single attempt of the task. Zero means no
 	// timeout. The work function observes the timeout through its ctx.
 	Timeout time.Duration
@@ -40,6 +57,34 @@ type Task struct {
 	// retries start immediately.
 	RetryBackoff time.Duration
 
+	// RetryPolicy, when set, replaces Retry and RetryBackoff: it decides
+	// which errors are retried and how long to wait before each retry,
+	// e.g. ExponentialBackoff. It is not persisted in the journal; tasks
+	// restored from it fall back to Retry and RetryBackoff. Optional.
+	RetryPolicy RetryPolicy
+
+	// Priority orders tasks competing for a concurrency slot: higher
+	// values are admitted first. Zero is the default; negative values
+	// are allowed. See also WithPreemption.
+	Priority int
+
+	// Group names the scheduling group the task belongs to, e.g. a tenant
+	// or a protected host. Among tasks of equal Priority, slots are
+	// shared between groups according to their weights (see
+	// WithGroupWeight). Tasks without a group share the "" group.
+	Group string
+
+	// Weight is the number of concurrency slots an attempt of the task
+	// takes, so that e.g. a full-disk copy can count as four catalog
+	// updates. Zero means 1; a weight above the engine's concurrency
+	// takes every slot, i.e. the task runs alone.
+	Weight int
+
+	// Resources are declared resources the task holds while an attempt
+	// runs, e.g. {Key: "/dev/sdb", Mode: Exclusive}. The task is only
+	// admitted when all of them can be acquired together. Optional.
+	Resources []Resource
+
 	// Watchers are periodic checks that run while the task is active.
 	// They start when the task begins executing and stop when it reaches
 	// a terminal state. A check can terminate the task by returning
@@ -64,6 +109,9 @@ func (t *Task) validate() error {
 	if t.RetryBackoff < 0 {
 		return fmt.Errorf("%v: %s: negative RetryBackoff", ErrInvalidTask, t.ID)
 	}
+	if t.Weight < 0 {
+		return fmt.Errorf("%v: %s: negative Weight", ErrInvalidTask, t.ID)
+	}
 	for _, d := range t.DependsOn {
 		if d == "" {
 			return fmt.Errorf("%v: %s: empty dependency ID", ErrInvalidTask, t.ID)
@@ -72,6 +120,9 @@ func (t *Task) validate() error {
 			return fmt.Errorf("%v: %s depends on itself", ErrCycleDetected, t.ID)
 		}
 	}
+	if err := t.validateDependencyPolicy(); err != nil {
+		return err
+	}
 	for i := range t.Watchers {
 		if err := t.Watchers[i].validate(); err != nil {
 			return fmt.Errorf("%v: %s: watcher %d", err, t.ID, i)
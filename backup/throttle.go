@@ -0,0 +1,360 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limit is a throughput limit enforced by token buckets that tasks draw
+// from with Reporter.Throttle. Zero fields mean unlimited.
+type Limit struct {
+	// BytesPerSec caps the bytes passed to Throttle per second.
+	BytesPerSec int64
+	// OpsPerSec caps the Throttle calls (IO operations) per second.
+	OpsPerSec int64
+	// Burst is how much unused capacity a bucket may save up while idle,
+	// expressed as a duration of its rate. Default: one second.
+	Burst time.Duration
+}
+
+// unlimited reports whether l does not limit anything.
+func (l Limit) unlimited() bool {
+	return l.BytesPerSec == 0 && l.OpsPerSec == 0
+}
+
+func (l Limit) validate() error {
+	if l.BytesPerSec < 0 || l.OpsPerSec < 0 || l.Burst < 0 {
+		return fmt.Errorf("%v: negative field in %+v", ErrInvalidLimit, l)
+	}
+	return nil
+}
+
+// ThrottleRule overrides the limits during a daily window. Global, when
+// not unlimited, replaces the engine-wide limit; Groups replace the
+// limits of the groups they name. Groups the rule does not name keep
+// their base limit.
+type ThrottleRule struct {
+	Window Window
+	Global Limit
+	Groups map[string]Limit
+}
+
+// ThrottleSchedule switches limits by time of day, e.g. a low limit
+// during business hours and none at night. The first rule whose window
+// contains the current time applies; outside every window the base
+// limits (WithThrottle, WithGroupThrottle, SetThrottle, SetGroupThrottle)
+// apply.
+type ThrottleSchedule struct {
+	// Location is the time zone the windows are evaluated in. Default:
+	// time.Local.
+	Location *time.Location
+	Rules    []ThrottleRule
+}
+
+func (s *ThrottleSchedule) validate() error {
+	for i := range s.Rules {
+		r := &s.Rules[i]
+		w := r.Window
+		if w.Start < 0 || w.Start >= 24*time.Hour || w.End < 0 || w.End > 24*time.Hour {
+			return fmt.Errorf("%v: rule %d: window outside a day", ErrInvalidLimit, i)
+		}
+		if err := r.Global.validate(); err != nil {
+			return fmt.Errorf("%v (rule %d)", err, i)
+		}
+		for g, l := range r.Groups {
+			if err := l.validate(); err != nil {
+				return fmt.Errorf("%v (rule %d, group %q)", err, i, g)
+			}
+		}
+	}
+	return nil
+}
+
+// WithThrottle sets the engine-wide base limit shared by all tasks.
+func WithThrottle(l Limit) Option {
+	return func(o *options) { o.throttle = l }
+}
+
+// WithGroupThrottle sets the base limit shared by the tasks of one
+// scheduling group (see Task.Group). It applies in addition to the
+// engine-wide limit.
+func WithGroupThrottle(group string, l Limit) Option {
+	return func(o *options) {
+		if o.groupThrottles == nil {
+			o.groupThrottles = make(map[string]Limit)
+		}
+		o.groupThrottles[group] = l
+	}
+}
+
+// WithThrottleSchedule sets time-of-day overrides of the base limits.
+func WithThrottleSchedule(s ThrottleSchedule) Option {
+	return func(o *options) { o.throttleSchedule = &s }
+}
+
+// SetThrottle changes the engine-wide base limit at runtime. Callers
+// blocked in Throttle keep their reservation; later calls see the new
+// limit.
+func (e *Engine) SetThrottle(l Limit) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	e.throttle.mu.Lock()
+	defer e.throttle.mu.Unlock()
+	e.throttle.global = l
+	return nil
+}
+
+// SetGroupThrottle changes the base limit of a scheduling group at
+// runtime. An unlimited Limit removes the group's limit.
+func (e *Engine) SetGroupThrottle(group string, l Limit) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	e.throttle.mu.Lock()
+	defer e.throttle.mu.Unlock()
+	if l.unlimited() {
+		delete(e.throttle.groups, group)
+	} else {
+		e.throttle.groups[group] = l
+	}
+	return nil
+}
+
+// SetThrottleSchedule replaces the time-of-day overrides. A schedule
+// without rules removes them.
+func (e *Engine) SetThrottleSchedule(s ThrottleSchedule) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	e.throttle.mu.Lock()
+	defer e.throttle.mu.Unlock()
+	if len(s.Rules) == 0 {
+		e.throttle.schedule = nil
+	} else {
+		e.throttle.schedule = &s
+	}
+	return nil
+}
+
+// Throttle blocks until the engine-wide and group limits allow an IO
+// operation of n bytes, and returns ctx.Err() if ctx is done first. Work
+// functions call it before (or after) each read or write:
+//
+//	n, err := src.Read(buf)
+//	if err := rep.Throttle(ctx, int64(n)); err != nil {
+//		return err
+//	}
+//
+// Each call counts as one operation against OpsPerSec. A request larger
+// than a bucket's burst is granted on credit: it returns once the bucket
+// has refilled enough to cover it, and later callers wait for the debt
+// to be paid off. Without any limit Throttle returns immediately.
+func (r *Reporter) Throttle(ctx context.Context, n int64) error {
+	if n < 0 {
+		n = 0
+	}
+	return r.item.engine.throttle.wait(ctx, r.item.task.Group, n)
+}
+
+// tokenBucket is a token bucket whose level may go negative: reservations
+// are always granted and the caller sleeps until the debt is repaid.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// configure applies a rate and burst window, keeping the current level.
+func (b *tokenBucket) configure(now time.Time, rate int64, burst time.Duration) {
+	if burst <= 0 {
+		burst = time.Second
+	}
+	r := float64(rate)
+	size := r * burst.Seconds()
+	if size < 1 {
+		size = 1
+	}
+	if b.last.IsZero() {
+		b.tokens, b.last = size, now
+	} else {
+		b.advance(now)
+	}
+	b.rate, b.burst = r, size
+	if b.tokens > size {
+		b.tokens = size
+	}
+}
+
+// advance refills the bucket up to now.
+func (b *tokenBucket) advance(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// reserve takes n tokens and returns how long the caller must wait until
+// they are covered.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.advance(now)
+	b.tokens -= n
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back tokens of an abandoned reservation.
+func (b *tokenBucket) refund(n float64) {
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// limitBuckets are the bytes and ops buckets of one limit.
+type limitBuckets struct {
+	bytes, ops tokenBucket
+}
+
+// throttler holds the engine's limits and their buckets. It has its own
+// lock so that IO-heavy work functions do not contend on the engine's.
+type throttler struct {
+	mu       sync.Mutex
+	global   Limit
+	groups   map[string]Limit
+	schedule *ThrottleSchedule
+	all      limitBuckets             // engine-wide
+	buckets  map[string]*limitBuckets // per group, created on first use
+}
+
+func newThrottler(o *options) *throttler {
+	t := &throttler{
+		global:   o.throttle,
+		groups:   make(map[string]Limit),
+		schedule: o.throttleSchedule,
+		buckets:  make(map[string]*limitBuckets),
+	}
+	for g, l := range o.groupThrottles {
+		if !l.unlimited() {
+			t.groups[g] = l
+		}
+	}
+	if t.schedule != nil && len(t.schedule.Rules) == 0 {
+		t.schedule = nil
+	}
+	return t
+}
+
+// validateThrottle checks the throttling options given to New.
+func (o *options) validateThrottle() error {
+	if err := o.throttle.validate(); err != nil {
+		return err
+	}
+	for g, l := range o.groupThrottles {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("%v (group %q)", err, g)
+		}
+	}
+	if o.throttleSchedule != nil {
+		return o.throttleSchedule.validate()
+	}
+	return nil
+}
+
+// limitsLocked returns the engine-wide and group limits in effect at now.
+func (t *throttler) limitsLocked(now time.Time, group string) (global, grp Limit) {
+	global, grp = t.global, t.groups[group]
+	if t.schedule == nil {
+		return global, grp
+	}
+	loc := t.schedule.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	for i := range t.schedule.Rules {
+		r := &t.schedule.Rules[i]
+		if !r.Window.contains(local) {
+			continue
+		}
+		if !r.Global.unlimited() {
+			global = r.Global
+		}
+		if l, ok := r.Groups[group]; ok {
+			grp = l
+		}
+		break
+	}
+	return global, grp
+}
+
+// reservation is the tokens taken from one bucket by a Throttle call.
+type reservation struct {
+	b *tokenBucket
+	n float64
+}
+
+// wait reserves n bytes and one operation from every limited bucket of
+// the group and sleeps until all of them are covered.
+func (t *throttler) wait(ctx context.Context, group string, n int64) error {
+	now := time.Now()
+	t.mu.Lock()
+	global, grp := t.limitsLocked(now, group)
+	var (
+		res   []reservation
+		delay time.Duration
+	)
+	take := func(lb *limitBuckets, l Limit) {
+		for _, x := range []struct {
+			b    *tokenBucket
+			rate int64
+			n    float64
+		}{{&lb.bytes, l.BytesPerSec, float64(n)}, {&lb.ops, l.OpsPerSec, 1}} {
+			if x.rate == 0 {
+				continue
+			}
+			x.b.configure(now, x.rate, l.Burst)
+			if d := x.b.reserve(now, x.n); d > delay {
+				delay = d
+			}
+			res = append(res, reservation{x.b, x.n})
+		}
+	}
+	if !global.unlimited() {
+		take(&t.all, global)
+	}
+	if !grp.unlimited() {
+		lb := t.buckets[group]
+		if lb == nil {
+			lb = &limitBuckets{}
+			t.buckets[group] = lb
+		}
+		take(lb, grp)
+	}
+	t.mu.Unlock()
+
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		for _, r := range res {
+			r.b.refund(r.n)
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStore 将对象存放为本地文件，名称即文件路径。
+type fileStore struct{}
+
+// NewFileStore 返回本地文件系统后端。
+func NewFileStore() Store {
+	return fileStore{}
+}
+
+func (fileStore) Create(name string) (Object, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileObject{f: f}, nil
+}
+
+func (fileStore) Open(name string) (Object, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileObject{f: f}, nil
+}
+
+func (fileStore) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// WriteFile 先写临时文件再重命名，替换是原子的：崩溃后读到的要么是旧内容，要么是新内容。
+func (fileStore) WriteFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (fileStore) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (fileStore) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, filepath.Join(dir, e.Name()))
+	}
+	return names, nil
+}
+
+func (fileStore) Abs(name string) string {
+	if p, err := filepath.Abs(name); err == nil {
+		return p
+	}
+	return name
+}
+
+func (fileStore) IsAbs(name string) bool {
+	return filepath.IsAbs(name)
+}
+
+func (fileStore) Dir(name string) string {
+	return filepath.Dir(name)
+}
+
+func (fileStore) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (fileStore) Rel(base, target string) (string, error) {
+	return filepath.Rel(base, target)
+}
+
+// fileObject 是基于本地文件的只追加对象。
+type fileObject struct {
+	mu sync.Mutex // 保证 Seek + Write 的原子性
+	f  *os.File
+}
+
+func (o *fileObject) ReadAt(p []byte, off int64) (int, error) {
+	return o.f.ReadAt(p, off)
+}
+
+func (o *fileObject) Append(p []byte) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	off, err := o.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := o.f.Write(p); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+func (o *fileObject) Size() (int64, error) {
+	stat, err := o.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (o *fileObject) Sync() error {
+	return o.f.Sync()
+}
+
+// Close 按 Object 的约定先持久化数据再关闭文件，返回第一个错误。
+func (o *fileObject) Close() error {
+	err := o.f.Sync()
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 寻址方式。
+const (
+	// StylePath 表示路径风格：https://endpoint/bucket/key。
+	StylePath = "path"
+
+	// StyleVirtualHosted 表示虚拟主机风格：https://bucket.endpoint/key。
+	StyleVirtualHosted = "virtual-hosted"
+)
+
+const (
+	defaultS3Region      = "us-east-1"
+	defaultS3Timeout     = 30 * time.Second
+	defaultS3SegmentSize = 8 << 20
+)
+
+// S3Config 描述一个 S3 兼容对象存储中的桶。
+type S3Config struct {
+	// Endpoint 服务地址，例如 "s3.amazonaws.com"、"127.0.0.1:9000"。
+	// 也可以带上 scheme（"http://127.0.0.1:9000"），此时忽略 Insecure。
+	Endpoint string
+
+	// AccessKey / SecretKey 访问凭证。
+	AccessKey string
+	SecretKey string
+
+	// Region 签名使用的区域，默认 "us-east-1"。
+	Region string
+
+	// Style 寻址方式：StylePath（默认）或 StyleVirtualHosted。
+	Style string
+
+	// Bucket 桶名（必须）。
+	Bucket string
+
+	// Insecure 为 true 时使用 HTTP，默认 HTTPS。
+	Insecure bool
+
+	// Timeout 单个请求的超时时间，默认 30 秒。
+	Timeout time.Duration
+
+	// SegmentSize 只追加对象单个分段对象的最大字节数，默认 8 MiB。
+	SegmentSize int64
+}
+
+// s3Store 将对象存放在 S3 兼容的对象存储中，名称即对象 key。
+//
+// 对象存储不支持追加写，只追加对象因此以分段对象的形式保存：
+//
+//	{name}                       空的标记对象，表示该对象存在
+//	{name}.seg/{偏移，16 位十六进制}  分段对象，依偏移顺序首尾相接
+//
+// 追加的数据先缓存在内存中，在 Sync、Close 或缓存达到 SegmentSize 时
+// 作为一个新分段整体 PUT；最后一个分段不足 SegmentSize 时则与其合并后重写该分段，
+// 因此除最后一个外每个分段都不小于 SegmentSize，频繁 Sync 也不会产生大量小分段
+// （代价是每次 Sync 至多重写 SegmentSize 字节）。
+// 读取时按偏移定位分段并使用 ranged GET。
+// 未采用 multipart 上传，是因为 multipart 在完成之前不可读，
+// 而镜像要求 Sync 之后的数据立即对其他句柄可见。
+//
+// 打开时列出一次分段，之后只跟踪本句柄写入的分段：
+// 同一对象同时只允许一个写入者。
+type s3Store struct {
+	client *s3Client
+}
+
+// NewS3Store 返回 S3 兼容对象存储后端。
+func NewS3Store(cfg S3Config) (Store, error) {
+	endpoint := strings.TrimSpace(cfg.Endpoint)
+	if endpoint == "" {
+		return nil, errors.New("s3: endpoint is required")
+	}
+	if strings.TrimSpace(cfg.Bucket) == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+
+	scheme := "https"
+	if cfg.Insecure {
+		scheme = "http"
+	}
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		scheme, endpoint = endpoint[:i], endpoint[i+3:]
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("s3: unsupported endpoint scheme %q", scheme)
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+
+	switch cfg.Style {
+	case "":
+		cfg.Style = StylePath
+	case StylePath, StyleVirtualHosted:
+	default:
+		return nil, fmt.Errorf("s3: unsupported style %q", cfg.Style)
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultS3Timeout
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultS3SegmentSize
+	}
+
+	return &s3Store{client: &s3Client{
+		cfg:    cfg,
+		scheme: scheme,
+		host:   endpoint,
+		http:   &http.Client{Timeout: cfg.Timeout},
+	}}, nil
+}
+
+func segmentPrefix(name string) string {
+	return name + ".seg/"
+}
+
+func segmentKey(name string, off int64) string {
+	return fmt.Sprintf("%s%016x", segmentPrefix(name), off)
+}
+
+func (s *s3Store) Create(name string) (Object, error) {
+	if err := s.removeSegments(name); err != nil {
+		return nil, err
+	}
+	if err := s.client.put(name, nil); err != nil {
+		return nil, err
+	}
+	return &s3Object{client: s.client, name: name}, nil
+}
+
+func (s *s3Store) Open(name string) (Object, error) {
+	if err := s.client.head(name); err != nil {
+		return nil, err
+	}
+	objs, err := s.client.list(segmentPrefix(name))
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]segment, 0, len(objs))
+	for _, o := range objs {
+		off, err := strconv.ParseInt(strings.TrimPrefix(o.Key, segmentPrefix(name)), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("s3: object %q: invalid segment key %q", name, o.Key)
+		}
+		segs = append(segs, segment{off: off, size: o.Size})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].off < segs[j].off })
+
+	var size int64
+	for _, sg := range segs {
+		if sg.off != size {
+			return nil, fmt.Errorf("s3: object %q: segment at %d, expected %d", name, sg.off, size)
+		}
+		size += sg.size
+	}
+	return &s3Object{client: s.client, name: name, segments: segs, size: size}, nil
+}
+
+func (s *s3Store) ReadFile(name string) ([]byte, error) {
+	return s.client.get(name)
+}
+
+func (s *s3Store) WriteFile(name string, data []byte) error {
+	return s.client.put(name, data)
+}
+
+func (s *s3Store) Remove(name string) error {
+	if err := s.removeSegments(name); err != nil {
+		return err
+	}
+	return s.client.delete(name)
+}
+
+// List 由前缀下的全部 key 推导直接包含的名称，"目录"即 key 的公共前缀。
+func (s *s3Store) List(dir string) ([]string, error) {
+	prefix := s.Abs(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	objs, err := s.client.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, o := range objs {
+		name := strings.TrimPrefix(o.Key, prefix)
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[:i]
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, prefix+name)
+	}
+	return names, nil
+}
+
+func (s *s3Store) removeSegments(name string) error {
+	objs, err := s.client.list(segmentPrefix(name))
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if err := s.client.delete(o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abs 规范化 key：去掉开头的 '/' 以及 "." / ".." 路径元素。
+func (s *s3Store) Abs(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// IsAbs 总是返回 true：key 总是相对于桶根。
+func (s *s3Store) IsAbs(name string) bool {
+	return true
+}
+
+func (s *s3Store) Dir(name string) string {
+	return path.Dir(name)
+}
+
+func (s *s3Store) Join(elem ...string) string {
+	return s.Abs(path.Join(elem...))
+}
+
+// Rel 原样返回 target：key 总是相对于桶根。
+func (s *s3Store) Rel(base, target string) (string, error) {
+	return target, nil
+}
+
+type segment struct {
+	off, size int64
+}
+
+// s3Object 是以分段对象保存的只追加对象。
+type s3Object struct {
+	client *s3Client
+	name   string
+
+	mu       sync.Mutex
+	segments []segment // 已上传的分段，按偏移排序且首尾相接
+	size     int64     // 已上传的字节数
+	tail     []byte    // 不足 SegmentSize 的最后一个分段的内容（合并时使用，按需读取）
+	pending  []byte    // 尚未上传的追加数据，位于 size 之后
+	closed   bool
+}
+
+// ReadAt 在锁内确定各段的读取位置并复制未上传的数据，
+// 锁外再发起 ranged GET，多个读取可以并发进行。
+// 已上传的分段只会被合并重写为更长的内容，已有部分不会改变。
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("s3: object %q: negative offset", o.name)
+	}
+
+	type rangeRead struct {
+		key   string
+		inner int64
+		pos   int // 在 p 中的位置
+		l     int
+	}
+	var reads []rangeRead
+	var eof error
+
+	o.mu.Lock()
+	n := 0
+	for n < len(p) {
+		if off >= o.size {
+			po := off - o.size
+			if po >= int64(len(o.pending)) {
+				eof = io.EOF
+				break
+			}
+			c := copy(p[n:], o.pending[po:])
+			n += c
+			off += int64(c)
+			continue
+		}
+
+		i := sort.Search(len(o.segments), func(i int) bool {
+			return o.segments[i].off+o.segments[i].size > off
+		})
+		sg := o.segments[i]
+		inner := off - sg.off
+		l := len(p) - n
+		if rest := sg.size - inner; int64(l) > rest {
+			l = int(rest)
+		}
+		reads = append(reads, rangeRead{segmentKey(o.name, sg.off), inner, n, l})
+		n += l
+		off += int64(l)
+	}
+	o.mu.Unlock()
+
+	for _, r := range reads {
+		if err := o.client.getRange(r.key, r.inner, p[r.pos:r.pos+r.l]); err != nil {
+			return r.pos, err
+		}
+	}
+	return n, eof
+}
+
+func (o *s3Object) Append(p []byte) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return 0, fmt.Errorf("s3: object %q is closed", o.name)
+	}
+	off := o.size + int64(len(o.pending))
+	o.pending = append(o.pending, p...)
+	if int64(len(o.pending)) >= o.client.cfg.SegmentSize {
+		if err := o.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return off, nil
+}
+
+// flushLocked 上传缓存的追加数据：最后一个分段不足 SegmentSize 时合并到该分段，
+// 否则作为一个新分段。重写同一 key 的 PUT 是原子的，读取者看到的要么是旧内容，要么是新内容。
+func (o *s3Object) flushLocked() error {
+	if len(o.pending) == 0 {
+		return nil
+	}
+
+	off, data := o.size, o.pending
+	n := len(o.segments)
+	merge := n > 0 && o.segments[n-1].size < o.client.cfg.SegmentSize
+	if merge {
+		last := o.segments[n-1]
+		if int64(len(o.tail)) != last.size {
+			tail := make([]byte, last.size)
+			if err := o.client.getRange(segmentKey(o.name, last.off), 0, tail); err != nil {
+				return err
+			}
+			o.tail = tail
+		}
+		off = last.off
+		data = make([]byte, 0, len(o.tail)+len(o.pending))
+		data = append(append(data, o.tail...), o.pending...)
+	}
+
+	if err := o.client.put(segmentKey(o.name, off), data); err != nil {
+		return err
+	}
+	if merge {
+		o.segments[n-1].size = int64(len(data))
+	} else {
+		o.segments = append(o.segments, segment{off: off, size: int64(len(data))})
+	}
+	o.size += int64(len(o.pending))
+	o.pending = nil
+	o.tail = nil
+	if int64(len(data)) < o.client.cfg.SegmentSize {
+		o.tail = data
+	}
+	return nil
+}
+
+func (o *s3Object) Size() (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size + int64(len(o.pending)), nil
+}
+
+func (o *s3Object) Sync() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.flushLocked()
+}
+
+func (o *s3Object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.flushLocked()
+}
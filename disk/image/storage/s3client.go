@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client 是最小的 S3 REST 客户端：PUT / GET（含 Range）/ HEAD / DELETE
+// 与 ListObjectsV2，请求使用 AWS Signature Version 4 签名。
+type s3Client struct {
+	cfg    S3Config
+	scheme string
+	host   string
+	http   *http.Client
+}
+
+// objectURL 返回对象 key 的请求地址；key 为空时返回桶地址。
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := &url.URL{Scheme: c.scheme, Host: c.host}
+	p := "/" + key
+	if c.cfg.Style == StyleVirtualHosted {
+		u.Host = c.cfg.Bucket + "." + c.host
+	} else if key == "" {
+		p = "/" + c.cfg.Bucket
+	} else {
+		p = "/" + c.cfg.Bucket + p
+	}
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	return u
+}
+
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.ContentLength = int64(len(body))
+	signV4(req, c.cfg.AccessKey, c.cfg.SecretKey, c.cfg.Region, hashHex(body), time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, responseError(method, key, resp)
+	}
+	return resp, nil
+}
+
+func (c *s3Client) put(key string, data []byte) error {
+	h := http.Header{}
+	h.Set("Content-Type", "application/octet-stream")
+	resp, err := c.do(http.MethodPut, key, nil, h, data)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+func (c *s3Client) get(key string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// getRange 以 ranged GET 读取 [off, off+len(p)) 到 p。
+func (c *s3Client) getRange(key string, off int64, p []byte) error {
+	h := http.Header{}
+	h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := c.do(http.MethodGet, key, nil, h, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 不支持 Range 的服务会返回整个对象。
+	if resp.StatusCode == http.StatusOK && off > 0 {
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return err
+		}
+	}
+	if _, err := io.ReadFull(resp.Body, p); err != nil {
+		return fmt.Errorf("s3: GET %s range %d+%d: %v", key, off, len(p), err)
+	}
+	return nil
+}
+
+func (c *s3Client) head(key string) error {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+func (c *s3Client) delete(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+type objectInfo struct {
+	Key  string
+	Size int64
+}
+
+type listBucketResult struct {
+	Contents              []objectInfo `xml:"Contents"`
+	IsTruncated           bool         `xml:"IsTruncated"`
+	NextContinuationToken string       `xml:"NextContinuationToken"`
+}
+
+// list 列出前缀下的全部对象（ListObjectsV2，自动翻页）。
+func (c *s3Client) list(prefix string) ([]objectInfo, error) {
+	var (
+		all   []objectInfo
+		token string
+	)
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: list %q: %v", prefix, err)
+		}
+		all = append(all, res.Contents...)
+		if !res.IsTruncated {
+			return all, nil
+		}
+		if res.NextContinuationToken == "" {
+			return nil, fmt.Errorf("s3: list %q: truncated result without continuation token", prefix)
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func drain(resp *http.Response) error {
+	defer resp.Body.Close()
+	_, err := io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// responseError 将失败响应转换为错误；404 转换为满足 os.IsNotExist 的错误。
+func responseError(method, key string, resp *http.Response) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	_ = xml.Unmarshal(data, &body)
+
+	if resp.StatusCode == http.StatusNotFound && body.Code != "NoSuchBucket" {
+		return &fs.PathError{Op: "s3 " + method, Path: key, Err: fs.ErrNotExist}
+	}
+	if body.Code == "" {
+		return fmt.Errorf("s3: %s %s: %s", method, key, resp.Status)
+	}
+	return fmt.Errorf("s3: %s %s: %s: %s: %s", method, key, resp.Status, body.Code, body.Message)
+}
+
+/*********************** Signature V4 *************************/
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat  = "20060102T150405Z"
+)
+
+// signV4 为请求加上 x-amz-date、x-amz-content-sha256 与 Authorization 头。
+// 参与签名的头为 host、content-type、content-md5、range 及全部 x-amz-*。
+func signV4(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	names := []string{"host"}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || lk == "content-md5" || lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+			values[lk] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, n := range names {
+		headers.WriteString(n)
+		headers.WriteByte(':')
+		headers.WriteString(values[n])
+		headers.WriteByte('\n')
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := uriEncode(req.URL.Path, false)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery(req.URL.Query()),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery 按 SigV4 规则编码查询参数：按名称排序，名称与值均严格编码。
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode 按 SigV4 规则编码：除 A-Z a-z 0-9 - _ . ~ 外全部百分号编码，
+// encodeSlash 为 false 时保留 '/'。
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,276 @@
+// Package s3test 提供一个用于测试的内存 S3 兼容服务。
+//
+// 支持路径风格寻址下的 PUT / GET（含 Range）/ HEAD / DELETE 对象，
+// 以及 ListObjectsV2；请求必须带有 AccessKey 对应的 SigV4 Authorization 头，
+// 且 x-amz-content-sha256 必须与请求体一致。
+package s3test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 测试服务接受的凭证。
+const (
+	AccessKey = "s3test-access-key"
+	SecretKey = "s3test-secret-key"
+)
+
+// Server 是内存 S3 服务。
+type Server struct {
+	// URL 服务地址，形如 "http://127.0.0.1:port"。
+	URL string
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	pageSize int
+	buckets  map[string]map[string][]byte
+	requests map[string]int
+}
+
+// NewServer 启动服务并创建给定的桶。
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		pageSize: 1000,
+		buckets:  make(map[string]map[string][]byte),
+		requests: make(map[string]int),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string][]byte)
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close 关闭服务。
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetPageSize 设置 ListObjectsV2 单页最多返回的 key 数，用于测试翻页。
+func (s *Server) SetPageSize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pageSize = n
+}
+
+// Keys 返回桶中带有给定前缀的全部 key（已排序）。
+func (s *Server) Keys(bucket, prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keysLocked(bucket, prefix)
+}
+
+// Object 返回对象内容的副本。
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.buckets[bucket][key]
+	return append([]byte(nil), data...), ok
+}
+
+// Requests 返回某类请求的次数，kind 为 HTTP 方法名，或 "LIST"、"RANGE"
+// （分别表示 ListObjectsV2 与带 Range 头的 GET，它们不计入 "GET"）。
+func (s *Server) Requests(kind string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[kind]
+}
+
+func (s *Server) keysLocked(bucket, prefix string) []string {
+	var keys []string
+	for k := range s.buckets[bucket] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type errorBody struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(errorBody{Code: code, Message: msg})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+AccessKey+"/") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "missing or unknown credential")
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash mismatch")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objs, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	if key == "" {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			s.requests["LIST"]++
+			s.listLocked(w, r, bucket)
+			return
+		}
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" on bucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		s.requests["PUT"]++
+		objs[key] = body
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		s.requests["DELETE"]++
+		delete(objs, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodHead, http.MethodGet:
+		data, ok := objs[key]
+		rng := r.Header.Get("Range")
+		switch {
+		case r.Method == http.MethodHead:
+			s.requests["HEAD"]++
+		case rng != "":
+			s.requests["RANGE"]++
+		default:
+			s.requests["GET"]++
+		}
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				writeError(w, http.StatusNotFound, "NoSuchKey", key)
+			}
+			return
+		}
+		if rng == "" || r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(data)
+			}
+			return
+		}
+		start, end, ok := parseRange(rng, len(data))
+		if !ok {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rng)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[start : end+1])
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// parseRange 解析 "bytes=a-b" 或 "bytes=a-"，返回闭区间。
+func parseRange(h string, size int) (int, int, bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	a, b, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(a)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if b != "" {
+		e, err := strconv.Atoi(b)
+		if err != nil || e < start {
+			return 0, 0, false
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return start, end, true
+}
+
+type listContents struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+type listResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContents `xml:"Contents"`
+}
+
+// listLocked 实现 ListObjectsV2；continuation token 即上一页最后一个 key。
+func (s *Server) listLocked(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	token := q.Get("continuation-token")
+
+	maxKeys := s.pageSize
+	if v := q.Get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	res := listResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys, ContinuationToken: token}
+	for _, k := range s.keysLocked(bucket, prefix) {
+		if token != "" && k <= token {
+			continue
+		}
+		if len(res.Contents) == maxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = res.Contents[len(res.Contents)-1].Key
+			break
+		}
+		res.Contents = append(res.Contents, listContents{Key: k, Size: len(s.buckets[bucket][k])})
+	}
+	res.KeyCount = len(res.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// SegmentName 返回分段对象 name 的第 i 个分段的名称，例如 DATA.000001。
+func SegmentName(name string, i int) string {
+	return fmt.Sprintf("%s.%06d", name, i)
+}
+
+// segmentedObject 将一个逻辑上的只追加对象切分为多个固定大小的对象：
+// 第 i 个分段保存 [i*size, (i+1)*size)，只有最后一个分段可以不满。
+// 用于在有单文件大小限制的文件系统上保存大的 DATA。
+type segmentedObject struct {
+	st   Store
+	name string
+	size int64
+
+	mu   sync.Mutex
+	segs []Object
+	last int64 // 最后一个分段的长度
+}
+
+// CreateSegmented 创建一个空的分段对象，并删除同名的残留分段。
+func CreateSegmented(st Store, name string, segmentSize int64) (Object, error) {
+	if segmentSize <= 0 {
+		return nil, errors.New("segment size must be positive")
+	}
+	if err := RemoveSegmented(st, name); err != nil {
+		return nil, err
+	}
+	first, err := st.Create(SegmentName(name, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &segmentedObject{st: st, name: name, size: segmentSize, segs: []Object{first}}, nil
+}
+
+// OpenSegmented 打开已存在的分段对象。
+func OpenSegmented(st Store, name string, segmentSize int64) (Object, error) {
+	if segmentSize <= 0 {
+		return nil, errors.New("segment size must be positive")
+	}
+	o := &segmentedObject{st: st, name: name, size: segmentSize}
+	for i := 0; ; i++ {
+		seg, err := st.Open(SegmentName(name, i))
+		if os.IsNotExist(err) && i > 0 {
+			break
+		}
+		if err != nil {
+			_ = o.Close()
+			return nil, err
+		}
+		o.segs = append(o.segs, seg)
+	}
+
+	for i, seg := range o.segs {
+		n, err := seg.Size()
+		if err != nil {
+			_ = o.Close()
+			return nil, err
+		}
+		if i < len(o.segs)-1 && n != segmentSize {
+			_ = o.Close()
+			return nil, fmt.Errorf("segment %s has %d bytes, expected %d", SegmentName(name, i), n, segmentSize)
+		}
+		if n > segmentSize {
+			_ = o.Close()
+			return nil, fmt.Errorf("segment %s has %d bytes, larger than segment size %d", SegmentName(name, i), n, segmentSize)
+		}
+		o.last = n
+	}
+	return o, nil
+}
+
+// RemoveSegmented 删除分段对象的全部分段。
+func RemoveSegmented(st Store, name string) error {
+	for i := 0; ; i++ {
+		// S3 删除不存在的对象也会成功，因此先确认分段存在。
+		seg, err := st.Open(SegmentName(name, i))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_ = seg.Close()
+		if err := st.Remove(SegmentName(name, i)); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadAt 只在获取分段列表时持锁，多个读取可以并发进行。
+func (o *segmentedObject) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	segs := o.segs
+	o.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		i := int(off / o.size)
+		if i >= len(segs) {
+			return n, io.EOF
+		}
+		inner := off % o.size
+		l := int64(len(p) - n)
+		if rest := o.size - inner; l > rest {
+			l = rest
+		}
+		c, err := segs[i].ReadAt(p[n:n+int(l)], inner)
+		n += c
+		off += int64(c)
+		if err == io.EOF && int64(c) == l && i < len(segs)-1 {
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (o *segmentedObject) Append(p []byte) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	start := int64(len(o.segs)-1)*o.size + o.last
+	for len(p) > 0 {
+		if o.last == o.size {
+			// 新分段创建前先持久化已写满的分段。
+			if err := o.segs[len(o.segs)-1].Sync(); err != nil {
+				return 0, err
+			}
+			seg, err := o.st.Create(SegmentName(o.name, len(o.segs)))
+			if err != nil {
+				return 0, err
+			}
+			o.segs = append(o.segs, seg)
+			o.last = 0
+		}
+		l := int64(len(p))
+		if rest := o.size - o.last; l > rest {
+			l = rest
+		}
+		if _, err := o.segs[len(o.segs)-1].Append(p[:l]); err != nil {
+			return 0, err
+		}
+		o.last += l
+		p = p[l:]
+	}
+	return start, nil
+}
+
+func (o *segmentedObject) Size() (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return int64(len(o.segs)-1)*o.size + o.last, nil
+}
+
+// Sync 持久化最后一个分段；之前的分段在写满时已经持久化。
+func (o *segmentedObject) Sync() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.segs[len(o.segs)-1].Sync()
+}
+
+func (o *segmentedObject) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var firstErr error
+	for _, seg := range o.segs {
+		if err := seg.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,69 @@
+// Package storage 为镜像格式提供统一的存储抽象，使 DATA / IDX / META
+// 既可以存放在本地文件系统中，也可以存放在 S3 兼容的对象存储中。
+//
+// 镜像文件只有两种访问模式：
+//   - 只追加对象（DATA、IDX）：顺序追加写入，按偏移随机读取，见 Object；
+//   - 整体读写的小对象（META）：见 Store.ReadFile / Store.WriteFile。
+//
+// 名称在文件系统后端为文件路径，在 S3 后端为桶内对象 key。
+// 名称的拼接与解析必须通过 Store 的 Join / Dir / Abs / IsAbs 完成，
+// 不能直接使用 path/filepath。
+package storage
+
+import "io"
+
+// Store 按名称存取对象。
+type Store interface {
+	// Create 创建一个空的只追加对象；已存在时将其截断。
+	Create(name string) (Object, error)
+
+	// Open 打开已存在的只追加对象，不存在时返回的错误满足 os.IsNotExist。
+	Open(name string) (Object, error)
+
+	// ReadFile 读取整个对象，不存在时返回的错误满足 os.IsNotExist。
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile 以 data 整体替换对象内容，替换是原子的。
+	WriteFile(name string, data []byte) error
+
+	// Remove 删除对象（包括只追加对象的全部分段）。
+	Remove(name string) error
+
+	// List 返回目录（或 key 前缀）下直接包含的名称（文件与子目录），顺序不定。
+	List(dir string) ([]string, error)
+
+	// Abs 返回规范化的绝对名称。
+	Abs(name string) string
+
+	// IsAbs 判断名称是否为绝对名称。
+	IsAbs(name string) bool
+
+	// Dir 返回名称的上级目录（或 key 前缀）。
+	Dir(name string) string
+
+	// Join 拼接名称。
+	Join(elem ...string) string
+
+	// Rel 返回 target 相对于 base 的名称，用于记录可随目录整体移动的引用；
+	// 不支持相对名称的后端原样返回 target。
+	Rel(base, target string) (string, error)
+}
+
+// Object 是一个只追加对象。
+// 写入通过 Append 追加到末尾，已写入的数据不可修改；
+// 追加后的数据立即可以通过 ReadAt 读到，但只有在 Sync 成功后才保证持久化。
+type Object interface {
+	io.ReaderAt
+
+	// Append 将 p 追加到对象末尾，返回写入位置的偏移。
+	Append(p []byte) (int64, error)
+
+	// Size 返回对象当前长度（包括尚未 Sync 的数据）。
+	Size() (int64, error)
+
+	// Sync 将已追加的数据持久化。
+	Sync() error
+
+	// Close 持久化剩余数据并关闭对象。
+	Close() error
+}
@@ -0,0 +1,209 @@
+package vimg
+
+import (
+	"container/list"
+	"sync"
+)
+
+/*********************** Cache *************************/
+
+const (
+	defaultCacheSize = 64 << 20
+	defaultReadAhead = 16
+)
+
+// cacheKey 标识 DATA 中的一个帧。DATA 只追加写入，同一代中偏移不会被复用，
+// 因此重写 Cluster 或 Compact 之后旧的缓存项只会自然淘汰，无需失效。
+type cacheKey struct {
+	guid       string
+	generation uint64
+	offset     uint64
+}
+
+type cacheItem struct {
+	key  cacheKey
+	data []byte
+}
+
+// clusterCache 是解码后 Cluster 的有界 LRU 缓存，由一条 backing 链上的所有镜像共享。
+// nil 表示不缓存。
+type clusterCache struct {
+	mu    sync.Mutex
+	limit int64
+	size  int64
+	ll    *list.List
+	items map[cacheKey]*list.Element
+}
+
+func newClusterCache(limit int64) *clusterCache {
+	return &clusterCache{limit: limit, ll: list.New(), items: make(map[cacheKey]*list.Element)}
+}
+
+// get 命中时将数据复制到 buf。
+func (c *clusterCache) get(key cacheKey, buf []byte) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.ll.MoveToFront(e)
+	fillZero(buf)
+	copy(buf, e.Value.(*cacheItem).data)
+	return true
+}
+
+// add 缓存 data，调用方之后不得修改 data。
+func (c *clusterCache) add(key cacheKey, data []byte) {
+	if c == nil || int64(len(data)) > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheItem{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.limit {
+		e := c.ll.Back()
+		item := c.ll.Remove(e).(*cacheItem)
+		delete(c.items, item.key)
+		c.size -= int64(len(item.data))
+	}
+}
+
+// setReadOptions 按打开选项创建整条链共享的缓存以及顶层句柄的预读。
+func (img *image) setReadOptions(opts OpenOptions) {
+	size := opts.CacheSize
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	if size < 0 {
+		return
+	}
+	img.setCache(newClusterCache(size))
+
+	window := opts.ReadAhead
+	if window == 0 {
+		window = defaultReadAhead
+	}
+	if window > 0 {
+		img.ra = &readAhead{window: uint64(window)}
+	}
+}
+
+// setCache 为整条 backing 链设置共享缓存。
+func (img *image) setCache(c *clusterCache) {
+	for l := img; l != nil; l = l.backing {
+		l.cache = c
+	}
+}
+
+func (img *image) cacheKey(entry IndexEntry) cacheKey {
+	return cacheKey{guid: img.meta.Guid, generation: img.meta.Generation, offset: entry.OffsetInDATA}
+}
+
+/*********************** ReadAhead *************************/
+
+// readAhead 检测顺序读取并在后台预读之后的 Cluster 到缓存中，用于顺序还原。
+type readAhead struct {
+	window uint64 // 预读的 Cluster 数
+
+	mu         sync.Mutex
+	next       uint64 // 顺序读取时下一次读取的偏移
+	streak     int    // 连续顺序读取的次数
+	prefetched uint64 // 已预读到的 Cluster（不含）
+	running    bool
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// observe 记录一次读取，连续顺序读取时启动预读。
+func (ra *readAhead) observe(img *image, off, length uint64) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if off == ra.next {
+		ra.streak++
+	} else {
+		ra.streak, ra.prefetched = 0, 0
+	}
+	ra.next = off + length
+	if ra.streak < 2 || ra.running || ra.closed {
+		return
+	}
+
+	clusterSize := uint64(img.meta.ClusterSize)
+	start := ra.next / clusterSize
+	// 预读窗口剩余过半时不必再次启动。
+	if ra.prefetched >= start+ra.window/2 {
+		return
+	}
+	from := start
+	if ra.prefetched > from {
+		from = ra.prefetched
+	}
+	end := start + ra.window
+	ra.prefetched = end
+
+	ra.running = true
+	ra.wg.Add(1)
+	go func() {
+		defer ra.wg.Done()
+		img.prefetch(from, end, ra)
+		ra.mu.Lock()
+		ra.running = false
+		ra.mu.Unlock()
+	}()
+}
+
+func (ra *readAhead) stopped() bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.closed
+}
+
+// close 停止预读并等待进行中的预读结束。
+func (ra *readAhead) close() {
+	ra.mu.Lock()
+	ra.closed = true
+	ra.mu.Unlock()
+	ra.wg.Wait()
+}
+
+// prefetch 读取 [from, end) 中的 Cluster，解码结果由 readLocalCluster 放入缓存。
+// 预读失败不影响正常读取，错误会在真正读取时返回。
+func (img *image) prefetch(from, end uint64, ra *readAhead) {
+	buf := make([]byte, img.meta.ClusterSize)
+	for idx := from; idx < end && !ra.stopped(); idx++ {
+		img.mu.RLock()
+		if !img.clusterIndexInRange(idx) {
+			img.mu.RUnlock()
+			return
+		}
+		err := img.readCluster(idx, buf)
+		img.mu.RUnlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// getClusterBuf / putClusterBuf 复用读取时的临时 Cluster 缓冲。
+func (img *image) getClusterBuf() []byte {
+	if b, ok := img.bufPool.Get().(*[]byte); ok && len(*b) == int(img.meta.ClusterSize) {
+		return *b
+	}
+	return make([]byte, img.meta.ClusterSize)
+}
+
+func (img *image) putClusterBuf(b []byte) {
+	img.bufPool.Put(&b)
+}
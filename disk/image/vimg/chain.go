@@ -0,0 +1,414 @@
+package vimg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*********************** Chain *************************/
+
+// 镜像只记录自己的 backing，子镜像通过扫描存放目录（CreateOptions.Dir）得到，
+// 与按 GUID 查找 backing（guessMetaFromGuid）的范围一致。
+// 存放在其他目录中、以本目录镜像为 backing 的子镜像不会被发现。
+
+// ChainNode 描述存放目录中的一个镜像及其在 backing 链中的位置。
+type ChainNode struct {
+	Guid     string `json:"guid"`
+	MetaPath string `json:"metaPath"`
+
+	// BackingGuid 父镜像 GUID，为空表示完整镜像。
+	BackingGuid string `json:"backingGuid,omitempty"`
+
+	// BackingMissing 父镜像不在存放目录中。
+	BackingMissing bool `json:"backingMissing,omitempty"`
+
+	// Children 以本镜像为 backing 的镜像 GUID（按 GUID 排序）。
+	Children []string `json:"children,omitempty"`
+
+	// Depth 到链根（完整镜像或 BackingMissing 的镜像）的层数，链根为 0。
+	Depth int `json:"depth"`
+
+	VirtualSize uint64 `json:"virtualSize"`
+}
+
+// Chain 返回存放目录 dir 中全部镜像的父子关系，按 Depth、GUID 排序，
+// 即父镜像总在子镜像之前。
+func (m *manager) Chain(dir string) ([]ChainNode, error) {
+	nodes, err := m.scanImages(m.store.Abs(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]ChainNode, 0, len(nodes))
+	for _, n := range nodes {
+		list = append(list, *n)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Depth != list[j].Depth {
+			return list[i].Depth < list[j].Depth
+		}
+		return list[i].Guid < list[j].Guid
+	})
+	return list, nil
+}
+
+// scanImages 读取 dir 中两种布局的全部 META，按 GUID 返回并填充 Children 与 Depth。
+func (m *manager) scanImages(dir string) (map[string]*ChainNode, error) {
+	st := m.store
+	names, err := st.List(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]*ChainNode{}, nil
+		}
+		return nil, err
+	}
+
+	nodes := make(map[string]*ChainNode)
+	for _, name := range names {
+		meta := name
+		if !strings.HasSuffix(name, ".META") {
+			// LayoutDir 的镜像目录以 GUID 命名，不含扩展名。
+			if base := name[strings.LastIndexAny(name, `/\`)+1:]; strings.Contains(base, ".") {
+				continue
+			}
+			meta = st.Join(name, dirMetaName)
+		}
+
+		v := &VImg{}
+		if err := readJSON(st, meta, v); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("read meta %s: %v", meta, err)
+		}
+		if v.Guid == "" {
+			continue
+		}
+		if prev, ok := nodes[v.Guid]; ok {
+			return nil, fmt.Errorf("duplicate image %s: %s and %s", v.Guid, prev.MetaPath, meta)
+		}
+		nodes[v.Guid] = &ChainNode{
+			Guid:        v.Guid,
+			MetaPath:    meta,
+			BackingGuid: v.BackingGuid,
+			VirtualSize: v.VirtualSize,
+		}
+	}
+
+	for _, n := range nodes {
+		if n.BackingGuid == "" {
+			continue
+		}
+		if p, ok := nodes[n.BackingGuid]; ok {
+			p.Children = append(p.Children, n.Guid)
+		} else {
+			n.BackingMissing = true
+		}
+	}
+	for _, n := range nodes {
+		sort.Strings(n.Children)
+		depth := 0
+		for p := n; p.BackingGuid != "" && !p.BackingMissing; p = nodes[p.BackingGuid] {
+			if depth++; depth > len(nodes) {
+				return nil, fmt.Errorf("detected backing cycle at %s", n.MetaPath)
+			}
+		}
+		n.Depth = depth
+	}
+	return nodes, nil
+}
+
+// childrenOf 返回与 meta 同一存放目录中以 guid 为 backing 的镜像。
+func (m *manager) childrenOf(meta, guid string) ([]ChainNode, error) {
+	nodes, err := m.scanImages(imagesRoot(m.store, meta))
+	if err != nil {
+		return nil, err
+	}
+	n, ok := nodes[guid]
+	if !ok {
+		return nil, nil
+	}
+	children := make([]ChainNode, 0, len(n.Children))
+	for _, c := range n.Children {
+		children = append(children, *nodes[c])
+	}
+	return children, nil
+}
+
+/*********************** Delete *************************/
+
+// DeleteOptions 是 Manager.DeleteWithOptions 的选项。
+type DeleteOptions struct {
+	// Merge 存在子镜像时，先将本镜像提供的数据合并到每个子镜像再删除：
+	// 本镜像有 backing 时子镜像 Rebase 到该 backing，否则子镜像 Flatten。
+	// 默认存在子镜像时拒绝删除。
+	// 合并期间这些子镜像的其他句柄必须关闭。
+	Merge bool
+}
+
+// Delete 删除镜像，存在子镜像时返回错误。
+func (m *manager) Delete(metaPath string) error {
+	return m.DeleteWithOptions(metaPath, DeleteOptions{})
+}
+
+func (m *manager) DeleteWithOptions(metaPath string, opts DeleteOptions) error {
+	if len(metaPath) < 5 {
+		return errors.New("invalid meta path")
+	}
+	absMeta := m.store.Abs(metaPath)
+
+	v := &VImg{}
+	if err := readJSON(m.store, absMeta, v); err != nil {
+		if os.IsNotExist(err) {
+			// 清理中断的删除可能残留的 DATA / IDX。
+			removeImage(m.store, absMeta)
+			return nil
+		}
+		return err
+	}
+
+	children, err := m.childrenOf(absMeta, v.Guid)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 && !opts.Merge {
+		guids := make([]string, 0, len(children))
+		for _, c := range children {
+			guids = append(guids, c.Guid)
+		}
+		return fmt.Errorf("image %s has child images: %s", v.Guid, strings.Join(guids, ", "))
+	}
+	for _, c := range children {
+		if err := m.detachChild(c.MetaPath, v.Guid); err != nil {
+			return fmt.Errorf("merge into child %s: %v", c.Guid, err)
+		}
+	}
+
+	removeImage(m.store, absMeta)
+	return nil
+}
+
+// detachChild 使子镜像不再依赖其 backing（guid），读取结果保持不变。
+func (m *manager) detachChild(childMeta, guid string) error {
+	child, err := m.open(childMeta, map[string]struct{}{})
+	if err != nil {
+		return err
+	}
+	if child.backing == nil || child.backing.meta.Guid != guid {
+		_ = child.Close()
+		return fmt.Errorf("backing of %s is not %s", child.meta.Guid, guid)
+	}
+
+	if grand := child.backing.backing; grand != nil {
+		err = child.Rebase(grand.metaPath)
+	} else {
+		err = child.Flatten()
+	}
+	if closeErr := child.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/*********************** Flatten *************************/
+
+// Flatten 将 backing 链提供的数据复制到本层并解除 backing，使镜像成为完整镜像。
+// backing 链本身不受影响。
+func (img *image) Flatten() error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if img.backing == nil {
+		return nil
+	}
+	if err := img.copyBackingDiffNoLock(nil); err != nil {
+		return err
+	}
+	return img.switchBackingNoLock(nil)
+}
+
+/*********************** CommitInto *************************/
+
+// CommitInto 将 metaPath 所指镜像（N）及其与祖先 ancestorGuid（M）之间的各层合并到 M，
+// 然后将 N 的子镜像改为以 M 为 backing，并删除被合并的各层。
+// 用于合并旧的增量：链 M ← N1 ← N2 ← top 执行 CommitInto(N2, M) 后为 M ← top。
+//
+// M 的数据被修改，因此 M 除被合并的一层外不能有其他子镜像，被合并的各层也只能有链上的子镜像，
+// 否则返回错误。期间链上各镜像的其他句柄必须关闭。
+// 每一步完成后链都是一致的：合并中断时 N 的子镜像读取结果不变，可以重新执行。
+func (m *manager) CommitInto(metaPath, ancestorGuid string) error {
+	top, err := m.open(metaPath, map[string]struct{}{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if top != nil {
+			_ = top.Close()
+		}
+	}()
+
+	var layers []*image // N ... M 的子镜像
+	target := top
+	for ; target != nil && target.meta.Guid != ancestorGuid; target = target.backing {
+		layers = append(layers, target)
+	}
+	if target == nil {
+		return fmt.Errorf("image %s is not an ancestor of %s", ancestorGuid, top.meta.Guid)
+	}
+	if len(layers) == 0 {
+		return errors.New("cannot commit image into itself")
+	}
+	for _, l := range layers {
+		if l.meta.ClusterSize != target.meta.ClusterSize {
+			return fmt.Errorf("cluster size mismatch: %s=%d %s=%d", l.meta.Guid, l.meta.ClusterSize, target.meta.Guid, target.meta.ClusterSize)
+		}
+	}
+
+	nodes, err := m.scanImages(imagesRoot(m.store, top.metaPath))
+	if err != nil {
+		return err
+	}
+	// 除 N 外，每一层（包括 M）的子镜像只能是链上的下一层。
+	for i := 1; i <= len(layers); i++ {
+		l, above := target, layers[i-1]
+		if i < len(layers) {
+			l = layers[i]
+		}
+		if n, ok := nodes[l.meta.Guid]; ok {
+			for _, c := range n.Children {
+				if c != above.meta.Guid {
+					return fmt.Errorf("image %s has another child image %s", l.meta.Guid, c)
+				}
+			}
+		}
+	}
+
+	top.mu.Lock()
+	err = commitNoLock(top, layers, target)
+	top.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 合并的数据已在 M 中持久化，N 的子镜像改为直接以 M 为 backing。
+	if n, ok := nodes[top.meta.Guid]; ok {
+		for _, c := range n.Children {
+			child := nodes[c]
+			if child.VirtualSize > top.meta.VirtualSize && target.meta.VirtualSize > top.meta.VirtualSize {
+				// 子镜像超出 N 的部分原本读取为 0，而 M 在此范围可能有数据，需要复制差异。
+				err = m.rebase(child.MetaPath, target.metaPath)
+			} else {
+				err = m.setBackingMeta(child.MetaPath, target)
+			}
+			if err != nil {
+				return fmt.Errorf("rebase child %s: %v", c, err)
+			}
+		}
+	}
+
+	metas := make([]string, 0, len(layers))
+	for _, l := range layers {
+		metas = append(metas, l.metaPath)
+	}
+	err = top.Close()
+	top = nil
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		removeImage(m.store, meta)
+	}
+	return nil
+}
+
+// commitNoLock 将经由 top 读取的数据写入 target，使 target 在 [0, top 的 VirtualSize) 中
+// 读取到的数据与 top 相同，此范围之外保持不变；target 较小时先扩大到 top 的大小。
+// layers 为从 top 到 target（不含）的各层。调用方持有 top 的写锁。
+func commitNoLock(top *image, layers []*image, target *image) error {
+	clusterSize := uint64(target.meta.ClusterSize)
+	size := top.meta.VirtualSize
+	end := (size + clusterSize - 1) / clusterSize
+
+	// 需要写入的 Cluster：各层提供的 Cluster，以及被较小的一层截断、
+	// 而 target 一侧有数据的 Cluster。
+	clusters := make(map[uint64]struct{})
+	collectAllocated(top, 0, end, target, clusters)
+	bound := size
+	for _, l := range layers {
+		if l.meta.VirtualSize < bound {
+			bound = l.meta.VirtualSize
+		}
+	}
+	target.mu.Lock()
+	collectAllocated(target, bound/clusterSize, end, nil, clusters)
+	var err error
+	if target.meta.VirtualSize < size {
+		err = target.resizeNoLock(size)
+	}
+	target.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, clusterSize)
+	cur := make([]byte, clusterSize)
+	for _, idx := range sortedClusters(clusters) {
+		if err := top.readCluster(idx, buf); err != nil {
+			return err
+		}
+
+		target.mu.Lock()
+		data := buf
+		if tail := size - idx*clusterSize; tail < clusterSize {
+			// top 的末尾 Cluster：target 中超出 top 大小的部分保持不变。
+			err = target.readCluster(idx, cur)
+			copy(cur, buf[:tail])
+			data = cur
+		}
+		if err == nil {
+			err = target.storeCluster(idx, data)
+		}
+		target.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	return target.flushNoLock()
+}
+
+// rebase 打开 meta 所指镜像并 Rebase 到 backingMeta。
+func (m *manager) rebase(meta, backingMeta string) error {
+	img, err := m.open(meta, map[string]struct{}{})
+	if err != nil {
+		return err
+	}
+	err = img.Rebase(backingMeta)
+	if closeErr := img.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// setBackingMeta 将 META 中记录的 backing 改为 backing。
+func (m *manager) setBackingMeta(meta string, backing *image) error {
+	v := &VImg{}
+	if err := readJSON(m.store, meta, v); err != nil {
+		return err
+	}
+	info, err := getStoragePrivateInfo(v)
+	if err != nil {
+		return err
+	}
+	v.BackingGuid = backing.meta.Guid
+	info.setBackingName(v.StorageType, backingRef(m.store, v.Layout, meta, backing.metaPath))
+	if err := setStoragePrivateInfo(v, info); err != nil {
+		return err
+	}
+	return writeJSON(m.store, meta, v)
+}
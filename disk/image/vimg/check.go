@@ -0,0 +1,353 @@
+package vimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+)
+
+/*********************** Check *************************/
+
+// CheckOptions 是 Manager.Check 的选项。
+type CheckOptions struct {
+	// Repair 修复本层发现的问题：丢弃残缺的尾部以及损坏的索引项，
+	// 以有效数据重写新一代 DATA / IDX（与 Compact 相同的原子切换）。
+	// 修复期间同一镜像的其他句柄必须关闭。
+	Repair bool
+
+	// Chain 同时逐层检查整条 backing 链（Repair 时也会逐层修复）。
+	// 默认只检查本层的数据，backing 只检查存在且与本层一致。
+	Chain bool
+}
+
+// CheckIssueKind 表示检查发现的问题类型。
+type CheckIssueKind uint8
+
+const (
+	// CheckIssueTornIndex IDX 末尾存在不完整的索引项（写入 IDX 时中断）。
+	CheckIssueTornIndex CheckIssueKind = iota
+
+	// CheckIssueTornData DATA 末尾存在未被任何索引项引用的数据（写入 DATA 后、写入 IDX 前中断）。
+	CheckIssueTornData
+
+	// CheckIssueOutOfRange 索引项的 ClusterIndex 超出 VirtualSize（缩小后留下的零标记除外）。
+	CheckIssueOutOfRange
+
+	// CheckIssuePastEOF 索引项引用的帧超出 DATA 末尾。
+	CheckIssuePastEOF
+
+	// CheckIssueBadFrame 帧头非法、CRC 不匹配或无法解码。
+	CheckIssueBadFrame
+
+	// CheckIssueOverlap 两个有效索引项引用的帧在 DATA 中重叠。
+	CheckIssueOverlap
+
+	// CheckIssueBacking backing 缺失，或 GUID、ClusterSize 与本层不一致，或链中存在环。
+	// 此类问题不会被自动修复。
+	CheckIssueBacking
+)
+
+// CheckIssue 描述一个问题。
+type CheckIssue struct {
+	Kind CheckIssueKind `json:"kind"`
+
+	// Entry 问题索引项在 IDX 中的序号（从 0 开始），-1 表示与单个索引项无关。
+	Entry int64 `json:"entry"`
+
+	// ClusterIndex 问题索引项对应的 Cluster，Entry 为 -1 时无意义。
+	ClusterIndex uint64 `json:"clusterIndex"`
+
+	// Message 问题描述，包括丢弃该索引项后读取回退到的位置。
+	Message string `json:"message"`
+}
+
+// CheckReport 是一个镜像的检查结果。
+type CheckReport struct {
+	Guid     string `json:"guid"`
+	MetaPath string `json:"metaPath"`
+
+	// IndexEntries IDX 中完整的索引项总数。
+	IndexEntries uint64 `json:"indexEntries"`
+
+	// LiveEntries 检查（及修复）后有效的 Cluster 数。
+	LiveEntries uint64 `json:"liveEntries"`
+
+	// DroppedEntries 因损坏而被丢弃的最新索引项数，这些 Cluster 的读取回退到
+	// 本层较早写入的有效版本，没有时回退到 backing。
+	DroppedEntries uint64 `json:"droppedEntries"`
+
+	Issues []CheckIssue `json:"issues,omitempty"`
+
+	// Repaired 是否已重写本层 DATA / IDX。
+	Repaired bool `json:"repaired"`
+
+	// Backing backing 的检查结果，仅在 CheckOptions.Chain 时填写。
+	Backing *CheckReport `json:"backing,omitempty"`
+}
+
+// OK 报告本层及已检查的 backing 是否都没有问题。
+func (r *CheckReport) OK() bool {
+	for ; r != nil; r = r.Backing {
+		if len(r.Issues) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CheckReport) addIssue(kind CheckIssueKind, entry int64, clusterIndex uint64, format string, args ...any) {
+	r.Issues = append(r.Issues, CheckIssue{
+		Kind:         kind,
+		Entry:        entry,
+		ClusterIndex: clusterIndex,
+		Message:      fmt.Sprintf(format, args...),
+	})
+}
+
+// Check 检查镜像的完整性：逐项核对 IDX 与 DATA，校验每个有效帧的帧头与 CRC
+// 并完整解码，检测超出 DATA 末尾或相互重叠的索引项，并检查 backing 链是否一致。
+//
+// 无法读取 META / DATA / IDX 时返回错误；其余问题记录在报告中。
+func (m *manager) Check(metaPath string, opts CheckOptions) (*CheckReport, error) {
+	return m.check(m.store.Abs(metaPath), opts, map[string]struct{}{})
+}
+
+func (m *manager) check(absMeta string, opts CheckOptions, visiting map[string]struct{}) (*CheckReport, error) {
+	visiting[absMeta] = struct{}{}
+	defer delete(visiting, absMeta)
+
+	img, info, err := m.openLayer(absMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	r := &CheckReport{Guid: img.meta.Guid, MetaPath: absMeta}
+	index, err := img.checkLayer(r)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Repair && len(r.Issues) > 0 {
+		if err := img.rewriteNoLock(index); err != nil {
+			return nil, err
+		}
+		r.Repaired = true
+	}
+
+	v := img.meta
+	if v.BackingGuid == "" {
+		return r, nil
+	}
+
+	var bv *VImg
+	var backingMeta string
+	for _, c := range backingMetaCandidates(m.store, absMeta, v, info) {
+		bv, backingMeta = &VImg{}, c
+		if err = readJSON(m.store, c, bv); !os.IsNotExist(err) {
+			break
+		}
+	}
+	switch {
+	case err != nil:
+		r.addIssue(CheckIssueBacking, -1, 0, "backing %s: %v", v.BackingGuid, err)
+	case bv.Guid != v.BackingGuid:
+		r.addIssue(CheckIssueBacking, -1, 0, "backing guid mismatch: expected %s, got %s at %s", v.BackingGuid, bv.Guid, backingMeta)
+	case bv.ClusterSize != v.ClusterSize:
+		r.addIssue(CheckIssueBacking, -1, 0, "backing %s cluster size %d differs from %d", bv.Guid, bv.ClusterSize, v.ClusterSize)
+	default:
+		if _, ok := visiting[m.store.Abs(backingMeta)]; ok {
+			r.addIssue(CheckIssueBacking, -1, 0, "detected backing cycle at %s", backingMeta)
+		} else if opts.Chain {
+			if r.Backing, err = m.check(m.store.Abs(backingMeta), opts, visiting); err != nil {
+				r.addIssue(CheckIssueBacking, -1, 0, "backing %s: %v", bv.Guid, err)
+			}
+		}
+	}
+	return r, nil
+}
+
+// checkLayer 检查本层 DATA / IDX，返回丢弃问题索引项后的有效索引。
+func (img *image) checkLayer(r *CheckReport) (map[uint64]IndexEntry, error) {
+	idxSize, err := img.idxFile.Size()
+	if err != nil {
+		return nil, err
+	}
+	dataSize, err := img.dataFile.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	entrySize := int64(binary.Size(IndexEntry{}))
+	entries := make([]IndexEntry, idxSize/entrySize)
+	if len(entries) > 0 {
+		buf := make([]byte, int64(len(entries))*entrySize)
+		if _, err := img.idxFile.ReadAt(buf, 0); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, entries); err != nil {
+			return nil, err
+		}
+	}
+	r.IndexEntries = uint64(len(entries))
+	if tail := idxSize % entrySize; tail != 0 {
+		r.addIssue(CheckIssueTornIndex, int64(len(entries)), 0, "%d trailing bytes after the last complete index entry", tail)
+	}
+
+	// 每个 Cluster 的写入历史（IDX 序号，从旧到新），以及所有帧覆盖到的 DATA 末尾。
+	history := make(map[uint64][]int)
+	var dataEnd uint64
+	for i, e := range entries {
+		history[e.ClusterIndex] = append(history[e.ClusterIndex], i)
+		if end := e.OffsetInDATA + uint64(e.LengthInDATA); end <= uint64(dataSize) && end > dataEnd {
+			dataEnd = end
+		}
+	}
+	if uint64(dataSize) > dataEnd {
+		r.addIssue(CheckIssueTornData, -1, 0, "%d trailing bytes in DATA are not referenced by any index entry", uint64(dataSize)-dataEnd)
+	}
+
+	clusters := make([]uint64, 0, len(history))
+	for idx := range history {
+		clusters = append(clusters, idx)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i] < clusters[j] })
+
+	// pick 返回 Cluster 最新的可用索引项序号，没有时返回 -1。
+	rejected := make(map[int]bool)
+	pick := func(idx uint64) int {
+		h := history[idx]
+		for k := len(h) - 1; k >= 0; k-- {
+			if !rejected[h[k]] && img.checkFrame(entries[h[k]], dataSize) == nil {
+				return h[k]
+			}
+		}
+		return -1
+	}
+	// fallback 描述丢弃最新索引项后该 Cluster 的读取来源。
+	fallback := func(pos int) string {
+		switch {
+		case pos >= 0:
+			return fmt.Sprintf("falls back to entry %d", pos)
+		case img.meta.BackingGuid != "":
+			return "falls back to backing"
+		default:
+			return "reads as zero"
+		}
+	}
+
+	chosen := make(map[uint64]int, len(clusters))
+	for _, idx := range clusters {
+		h := history[idx]
+		live := h[len(h)-1]
+		if !img.clusterIndexInRange(idx) {
+			// 缩小（Image.Resize）只允许移除读取为 0 的区间，留下的零标记不是问题。
+			if isZeroEntry(entries[live]) {
+				continue
+			}
+			for _, pos := range h {
+				rejected[pos] = true
+			}
+			r.addIssue(CheckIssueOutOfRange, int64(live), idx, "cluster %d is beyond virtual size %d", idx, img.meta.VirtualSize)
+			continue
+		}
+		if err := img.checkFrame(entries[live], dataSize); err != nil {
+			rejected[live] = true
+			pos := pick(idx)
+			r.addIssue(frameIssueKind(err), int64(live), idx, "cluster %d: %v; %s", idx, err, fallback(pos))
+			r.DroppedEntries++
+			if pos < 0 {
+				continue
+			}
+			live = pos
+		}
+		chosen[idx] = live
+	}
+
+	// 有效帧按偏移排序后不应重叠；重叠时丢弃较早写入的一项，该 Cluster 继续回退。
+	for {
+		frames := make([]int, 0, len(chosen))
+		for _, pos := range chosen {
+			if !isZeroEntry(entries[pos]) {
+				frames = append(frames, pos)
+			}
+		}
+		sort.Slice(frames, func(i, j int) bool {
+			return entries[frames[i]].OffsetInDATA < entries[frames[j]].OffsetInDATA
+		})
+
+		drop, other := -1, -1
+		for i, prev := 1, 0; i < len(frames); i++ {
+			a, b := entries[frames[prev]], entries[frames[i]]
+			if b.OffsetInDATA < a.OffsetInDATA+uint64(a.LengthInDATA) {
+				drop, other = frames[prev], frames[i]
+				if other < drop {
+					drop, other = other, drop
+				}
+				break
+			}
+			if b.OffsetInDATA+uint64(b.LengthInDATA) > a.OffsetInDATA+uint64(a.LengthInDATA) {
+				prev = i
+			}
+		}
+		if drop < 0 {
+			break
+		}
+
+		idx := entries[drop].ClusterIndex
+		rejected[drop] = true
+		delete(chosen, idx)
+		pos := pick(idx)
+		r.addIssue(CheckIssueOverlap, int64(drop), idx, "cluster %d: frame overlaps entry %d; %s", idx, other, fallback(pos))
+		r.DroppedEntries++
+		if pos >= 0 {
+			chosen[idx] = pos
+		}
+	}
+
+	index := make(map[uint64]IndexEntry, len(chosen))
+	for idx, pos := range chosen {
+		index[idx] = entries[pos]
+	}
+	r.LiveEntries = uint64(len(index))
+	return index, nil
+}
+
+type frameError struct {
+	kind CheckIssueKind
+	err  error
+}
+
+func (e *frameError) Error() string { return e.err.Error() }
+
+func frameIssueKind(err error) CheckIssueKind {
+	if fe, ok := err.(*frameError); ok {
+		return fe.kind
+	}
+	return CheckIssueBadFrame
+}
+
+// checkFrame 读取并完整解码索引项引用的帧。
+func (img *image) checkFrame(e IndexEntry, dataSize int64) error {
+	if isZeroEntry(e) {
+		return nil
+	}
+	end := e.OffsetInDATA + uint64(e.LengthInDATA)
+	if end < e.OffsetInDATA || end > uint64(dataSize) {
+		return &frameError{CheckIssuePastEOF, fmt.Errorf("frame [%d, %d) is past end of DATA (%d)", e.OffsetInDATA, end, dataSize)}
+	}
+
+	stored := make([]byte, e.LengthInDATA)
+	if _, err := img.dataFile.ReadAt(stored, int64(e.OffsetInDATA)); err != nil {
+		return err
+	}
+	plain, err := img.decodeCluster(e.ClusterIndex, stored)
+	if err != nil {
+		return err
+	}
+	if len(plain) != int(img.meta.ClusterSize) {
+		return fmt.Errorf("decoded cluster size %d, want %d", len(plain), img.meta.ClusterSize)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package vimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+/*********************** Compact *************************/
+
+// SpaceUsage 描述镜像本层 DATA / IDX 的空间使用情况。
+// DATA 只追加写入，同一 Cluster 重写后旧帧成为死数据，IDX 中旧索引项同样失效；
+// 可据 DeadRatio 判断是否值得执行 Compact。
+type SpaceUsage struct {
+	// DataBytes DATA 总字节数。
+	DataBytes uint64 `json:"dataBytes"`
+
+	// LiveBytes 被当前索引引用的帧字节数。
+	LiveBytes uint64 `json:"liveBytes"`
+
+	// DeadBytes 不再被引用的字节数（DataBytes - LiveBytes）。
+	DeadBytes uint64 `json:"deadBytes"`
+
+	// IndexEntries IDX 中的索引项总数。
+	IndexEntries uint64 `json:"indexEntries"`
+
+	// LiveEntries 有效索引项数，即本层已分配的 Cluster 数。
+	LiveEntries uint64 `json:"liveEntries"`
+
+	// DeadRatio DeadBytes / DataBytes，DATA 为空时为 0。
+	DeadRatio float64 `json:"deadRatio"`
+}
+
+func (img *image) SpaceUsage() (*SpaceUsage, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if err := img.loadIndexNoLock(); err != nil {
+		return nil, err
+	}
+	return img.spaceUsageNoLock()
+}
+
+func (img *image) spaceUsageNoLock() (*SpaceUsage, error) {
+	size, err := img.dataFile.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &SpaceUsage{
+		DataBytes:    uint64(size),
+		IndexEntries: uint64(img.indexLoaded / int64(binary.Size(IndexEntry{}))),
+		LiveEntries:  uint64(len(img.index)),
+	}
+	for _, e := range img.index {
+		u.LiveBytes += uint64(e.LengthInDATA)
+	}
+	if u.LiveBytes < u.DataBytes {
+		u.DeadBytes = u.DataBytes - u.LiveBytes
+	}
+	if u.DataBytes > 0 {
+		u.DeadRatio = float64(u.DeadBytes) / float64(u.DataBytes)
+	}
+	return u, nil
+}
+
+// Compact 将本层仍被引用的帧按 Cluster 顺序原样复制到新一代 DATA / IDX
+// （不解码，压缩与加密保持不变），然后更新 META 中的 Generation 完成切换。
+// META 的写入是原子的，因此任何时刻崩溃，镜像要么仍是旧的一代，要么是新的一代；
+// 残留的另一代文件会在下次 Compact 或 Delete 时清理。
+//
+// Compact 期间持有写锁，本句柄的读写会等待其完成；
+// 同一镜像的其他句柄（包括以它为 backing 的子镜像）必须先关闭。
+func (img *image) Compact() error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if err := img.loadIndexNoLock(); err != nil {
+		return err
+	}
+
+	// 没有 backing 时零标记与未分配等价，无需保留；
+	// 超出 VirtualSize 的索引项（缩小后留下）不可见，扩大时会重新屏蔽 backing，也无需保留。
+	index := make(map[uint64]IndexEntry, len(img.index))
+	for idx, e := range img.index {
+		if isZeroEntry(e) && img.meta.BackingGuid == "" || !img.clusterIndexInRange(idx) {
+			continue
+		}
+		index[idx] = e
+	}
+	return img.rewriteNoLock(index)
+}
+
+// rewriteNoLock 将 index 引用的帧按 Cluster 顺序原样复制到新一代 DATA / IDX，
+// 并通过原子更新 META 切换到新一代，旧一代随后删除。
+func (img *image) rewriteNoLock(index map[uint64]IndexEntry) error {
+	// 帧从 DATA 中复制，缓冲中的写入需要先落盘。
+	if err := img.flushNoLock(); err != nil {
+		return err
+	}
+
+	st := img.mgr.store
+	oldNames := namesFromMeta(st, img.meta.Layout, img.metaPath, img.meta.Generation)
+	newGen := img.meta.Generation + 1
+	newNames := namesFromMeta(st, img.meta.Layout, img.metaPath, newGen)
+
+	dataFile, err := createData(st, img.meta, newNames.data)
+	if err != nil {
+		return err
+	}
+	idxFile, err := st.Create(newNames.idx)
+	if err != nil {
+		_ = dataFile.Close()
+		removeGeneration(st, img.meta.Layout, newNames)
+		return err
+	}
+	abort := func(err error) error {
+		_ = dataFile.Close()
+		_ = idxFile.Close()
+		removeGeneration(st, img.meta.Layout, newNames)
+		return err
+	}
+
+	clusters := make([]uint64, 0, len(index))
+	for idx := range index {
+		clusters = append(clusters, idx)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i] < clusters[j] })
+
+	newIndex := make(map[uint64]IndexEntry, len(clusters))
+	var idxBuf bytes.Buffer
+	var dataSize int64
+	for _, idx := range clusters {
+		old := index[idx]
+		entry := IndexEntry{ClusterIndex: idx}
+		if !isZeroEntry(old) {
+			frame := make([]byte, old.LengthInDATA)
+			if _, err := img.dataFile.ReadAt(frame, int64(old.OffsetInDATA)); err != nil {
+				return abort(err)
+			}
+			offset, err := dataFile.Append(frame)
+			if err != nil {
+				return abort(err)
+			}
+			entry.OffsetInDATA, entry.LengthInDATA = uint64(offset), old.LengthInDATA
+			dataSize = offset + int64(old.LengthInDATA)
+		}
+		if err := writeStruct(&idxBuf, &entry); err != nil {
+			return abort(err)
+		}
+		newIndex[idx] = entry
+	}
+	if _, err := idxFile.Append(idxBuf.Bytes()); err != nil {
+		return abort(err)
+	}
+
+	// 新一代数据必须先于 META 持久化。
+	if err := dataFile.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := idxFile.Sync(); err != nil {
+		return abort(err)
+	}
+
+	img.meta.Generation = newGen
+	if err := writeJSON(st, img.metaPath, img.meta); err != nil {
+		img.meta.Generation = newGen - 1
+		return abort(err)
+	}
+
+	_ = img.dataFile.Close()
+	_ = img.idxFile.Close()
+	img.dataFile = dataFile
+	img.idxFile = idxFile
+	img.index = newIndex
+	img.indexLoaded = int64(idxBuf.Len())
+	img.dataWritten = dataSize
+
+	removeGeneration(st, img.meta.Layout, oldNames)
+	return nil
+}
@@ -0,0 +1,233 @@
+package vimg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*********************** Flush *************************/
+
+// 写入路径分组提交：编码后的帧先进入内存中的 DATA 缓冲，索引项进入 IDX 缓冲，
+// 缓冲中的 Cluster 立即可读。持久化时按以下顺序进行：
+//  1. 将 DATA 缓冲追加到 DATA 并 Sync；
+//  2. 将 IDX 缓冲追加到 IDX 并 Sync。
+// DATA 缓冲满时只写入 DATA 不 Sync；IDX 缓冲满时完成第 1 步并追加 IDX，但不 Sync IDX。
+// 任何时刻 IDX 中的索引项引用的 DATA 都已落盘。
+
+const (
+	defaultBufferSize   = 4 << 20
+	defaultSyncInterval = time.Second
+
+	// maxPendingIndexBytes IDX 缓冲上限（约 50 万个索引项）。
+	maxPendingIndexBytes = 10 << 20
+)
+
+func validateOpenOptions(opts OpenOptions, storageType StorageType) error {
+	if opts.Durability > DurabilityInterval {
+		return fmt.Errorf("unsupported durability: %d", opts.Durability)
+	}
+	if opts.Durability == DurabilityPerWrite && storageType == StorageTypeS3 {
+		return errors.New("DurabilityPerWrite is not supported on S3, use DurabilityInterval or DurabilityFlush")
+	}
+	if opts.SyncInterval < 0 {
+		return errors.New("sync interval must not be negative")
+	}
+	if opts.BufferSize < 0 {
+		return errors.New("buffer size must not be negative")
+	}
+	return nil
+}
+
+// setDurability 应用打开选项，DurabilityInterval 时启动后台持久化。
+func (img *image) setDurability(opts OpenOptions) {
+	img.durability = opts.Durability
+	if opts.BufferSize > 0 {
+		img.bufferSize = opts.BufferSize
+	}
+	if opts.Durability != DurabilityInterval {
+		return
+	}
+
+	interval := opts.SyncInterval
+	if interval == 0 {
+		interval = defaultSyncInterval
+	}
+	img.stopSync = make(chan struct{})
+	img.syncDone = make(chan struct{})
+	go img.syncLoop(interval)
+}
+
+func (img *image) syncLoop(interval time.Duration) {
+	defer close(img.syncDone)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-img.stopSync:
+			return
+		case <-t.C:
+			img.mu.Lock()
+			if err := img.flushNoLock(); err != nil && img.flushErr == nil {
+				img.flushErr = err
+			}
+			img.mu.Unlock()
+		}
+	}
+}
+
+func (img *image) stopSyncLoop() {
+	if img.stopSync == nil {
+		return
+	}
+	close(img.stopSync)
+	<-img.syncDone
+	img.stopSync = nil
+}
+
+// Flush 持久化此前的全部写入。
+func (img *image) Flush() error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if err := img.takeFlushErr(); err != nil {
+		return err
+	}
+	return img.flushNoLock()
+}
+
+// writeDoneNoLock 在一次 WriteAt / Discard 完成后按 Durability 持久化。
+func (img *image) writeDoneNoLock() error {
+	if err := img.takeFlushErr(); err != nil {
+		return err
+	}
+	if img.durability == DurabilityPerWrite {
+		return img.flushNoLock()
+	}
+	return nil
+}
+
+func (img *image) takeFlushErr() error {
+	err := img.flushErr
+	img.flushErr = nil
+	return err
+}
+
+// appendFrameNoLock 将帧放入 DATA 缓冲，返回其在 DATA 中的偏移。
+func (img *image) appendFrameNoLock(frame []byte) (int64, error) {
+	if img.writeErr != nil {
+		return 0, img.writeErr
+	}
+	if len(img.dataBuf) == 0 {
+		// 同一镜像的其他句柄可能已追加写入 DATA（例如经由子镜像 Commit）。
+		size, err := img.dataFile.Size()
+		if err != nil {
+			return 0, err
+		}
+		img.dataWritten = size
+	}
+	offset := img.dataWritten + int64(len(img.dataBuf))
+	img.dataBuf = append(img.dataBuf, frame...)
+	if len(img.dataBuf) >= img.bufferSize {
+		if err := img.writeDataNoLock(); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// appendIndexNoLock 将索引项放入 IDX 缓冲并立即生效。
+func (img *image) appendIndexNoLock(entry IndexEntry) error {
+	if err := writeStruct(&img.idxBuf, &entry); err != nil {
+		return err
+	}
+	img.index[entry.ClusterIndex] = entry
+	if img.idxBuf.Len() >= maxPendingIndexBytes {
+		return img.writeIndexNoLock()
+	}
+	return nil
+}
+
+// readFrameNoLock 读取索引项引用的帧，尚在缓冲中的帧直接从缓冲读取。
+func (img *image) readFrameNoLock(entry IndexEntry) ([]byte, error) {
+	frame := make([]byte, entry.LengthInDATA)
+	start := int64(entry.OffsetInDATA) - img.dataWritten
+	if start >= 0 && start+int64(len(frame)) <= int64(len(img.dataBuf)) {
+		copy(frame, img.dataBuf[start:])
+		return frame, nil
+	}
+	if _, err := img.dataFile.ReadAt(frame, int64(entry.OffsetInDATA)); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeDataNoLock 将 DATA 缓冲追加到 DATA（不 Sync）。
+func (img *image) writeDataNoLock() error {
+	if len(img.dataBuf) == 0 {
+		return nil
+	}
+	if img.writeErr != nil {
+		return img.writeErr
+	}
+	offset, err := img.dataFile.Append(img.dataBuf)
+	if err != nil {
+		// 未写入任何数据时保留缓冲，可以重试；部分写入后 DATA 末尾已无法与缓冲对应，
+		// 本句柄不能再写入（重新打开后残缺的末尾被忽略，见 Manager.Check）。
+		if size, sizeErr := img.dataFile.Size(); sizeErr != nil || size != img.dataWritten {
+			img.writeErr = fmt.Errorf("DATA append failed, reopen the image to continue writing: %v", err)
+			return img.writeErr
+		}
+		return err
+	}
+	if offset != img.dataWritten {
+		return fmt.Errorf("DATA was appended by another writer: expected offset %d, got %d", img.dataWritten, offset)
+	}
+	img.dataWritten += int64(len(img.dataBuf))
+	img.dataBuf = img.dataBuf[:0]
+	img.dataDirty = true
+	return nil
+}
+
+// writeIndexNoLock 先将 DATA 落盘，再将 IDX 缓冲追加到 IDX（不 Sync IDX）。
+func (img *image) writeIndexNoLock() error {
+	if err := img.writeDataNoLock(); err != nil {
+		return err
+	}
+	if img.dataDirty {
+		if err := img.dataFile.Sync(); err != nil {
+			return err
+		}
+		img.dataDirty = false
+	}
+	if img.idxBuf.Len() == 0 {
+		return nil
+	}
+
+	offset, err := img.idxFile.Append(img.idxBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	// 自己追加的索引项已在 index 中，不必再由 loadIndexNoLock 读回。
+	if offset == img.indexLoaded {
+		img.indexLoaded += int64(img.idxBuf.Len())
+	}
+	img.idxBuf.Reset()
+	img.idxDirty = true
+	return nil
+}
+
+// flushNoLock 持久化全部缓冲的写入。
+func (img *image) flushNoLock() error {
+	if err := img.writeIndexNoLock(); err != nil {
+		return err
+	}
+	if img.idxDirty {
+		if err := img.idxFile.Sync(); err != nil {
+			return err
+		}
+		img.idxDirty = false
+	}
+	return nil
+}
@@ -14,11 +14,12 @@ import (
 	"hash/crc32"
 	"io"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/kisun-bit/drpkg/disk/image/storage"
 )
 
 const (
@@ -29,22 +30,114 @@ const (
 	clusterFrameFlagCompressed uint8 = 1 << 0
 	clusterFrameFlagEncrypted  uint8 = 1 << 1
 
+	// 帧头字段偏移：
+	//   [0:4]   magic
+	//   [4]     version
+	//   [5]     flags
+	//   [6]     压缩算法（仅在 clusterFrameFlagCompressed 时有效）
+	//   [8:12]  原始数据长度
+	//   [12:16] 负载 CRC32
+	//   [16:18] nonce 长度
+	//   [20:24] 负载长度
+	clusterFrameCompressionOff = 6
+
 	aes256KeySize = 32
 )
 
 type storagePrivateInfo struct {
 	Version         int    `json:"version"`
-	FilePath        string `json:"filePath"`
+	FilePath        string `json:"filePath,omitempty"`
 	BackingFilePath string `json:"backingFilePath,omitempty"`
-	EncryptionKey   string `json:"encryptionKey,omitempty"` // base64-encoded 32-byte key
+	EncryptionKey   string `json:"encryptionKey,omitempty"` // base64-encoded 32-byte key（未使用 KeyProvider 时）
+	WrappedKey      string `json:"wrappedKey,omitempty"`    // base64，由 KeyProvider 包装的数据密钥
+	KeyProvider     string `json:"keyProvider,omitempty"`   // 包装数据密钥的 KeyProvider.ID()
+
+	// StorageTypeS3
+	Endpoint   string `json:"endpoint,omitempty"`
+	AccessKey  string `json:"accessKey,omitempty"`
+	SecretKey  string `json:"secretKey,omitempty"`
+	Region     string `json:"region,omitempty"`
+	Style      string `json:"style,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Key        string `json:"key,omitempty"`
+	BackingKey string `json:"backingKey,omitempty"`
+	Secure     *bool  `json:"secure,omitempty"`
+	TimeoutSec int    `json:"timeoutSec,omitempty"`
+}
+
+// metaName 返回当前镜像 META 的位置（文件路径或对象 key）。
+func (info *storagePrivateInfo) metaName(t StorageType) string {
+	if t == StorageTypeS3 {
+		return info.Key
+	}
+	return info.FilePath
+}
+
+// backingName 返回父镜像 META 的位置（文件路径或对象 key）。
+func (info *storagePrivateInfo) backingName(t StorageType) string {
+	if t == StorageTypeS3 {
+		return info.BackingKey
+	}
+	return info.BackingFilePath
+}
+
+func (info *storagePrivateInfo) setBackingName(t StorageType, name string) {
+	if t == StorageTypeS3 {
+		info.BackingKey = name
+	} else {
+		info.BackingFilePath = name
+	}
 }
 
 /*********************** Manager *************************/
 
-type manager struct{}
+type manager struct {
+	store       storage.Store
+	storageType StorageType
+	s3          storage.S3Config
 
+	keysMu sync.RWMutex
+	keys   map[string]KeyProvider // 按 KeyProvider.ID() 索引
+}
+
+// NewManager 返回使用本地文件系统存储的 Manager。
 func NewManager() Manager {
-	return &manager{}
+	return &manager{store: storage.NewFileStore(), storageType: StorageTypeFilesystem}
+}
+
+// NewS3Manager 返回使用 S3 兼容对象存储的 Manager。
+// CreateOptions.Dir 作为对象 key 前缀，Open / Delete 的参数为 META 对象 key。
+func NewS3Manager(cfg storage.S3Config) (Manager, error) {
+	st, err := storage.NewS3Store(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &manager{store: st, storageType: StorageTypeS3, s3: cfg}, nil
+}
+
+// newStoragePrivateInfo 返回记录 META 位置的 StoragePrivateInfo。
+func (m *manager) newStoragePrivateInfo(metaName string) storagePrivateInfo {
+	if m.storageType != StorageTypeS3 {
+		return storagePrivateInfo{Version: 1, FilePath: metaName}
+	}
+	secure := !m.s3.Insecure
+	if strings.HasPrefix(m.s3.Endpoint, "https://") {
+		secure = true
+	} else if strings.HasPrefix(m.s3.Endpoint, "http://") {
+		secure = false
+	}
+	return storagePrivateInfo{
+		Version:    1,
+		Endpoint:   m.s3.Endpoint,
+		AccessKey:  m.s3.AccessKey,
+		SecretKey:  m.s3.SecretKey,
+		Region:     m.s3.Region,
+		Style:      m.s3.Style,
+		Bucket:     m.s3.Bucket,
+		Key:        metaName,
+		Secure:     &secure,
+		TimeoutSec: int(m.s3.Timeout / time.Second),
+	}
 }
 
 func (m *manager) Create(opts CreateOptions) (*VImg, error) {
@@ -53,17 +146,27 @@ func (m *manager) Create(opts CreateOptions) (*VImg, error) {
 	}
 
 	guid := "vimg_" + strings.ReplaceAll(uuid.New().String(), "-", "")
-	base := filepath.Join(opts.Dir, guid)
-
-	metaPath := base + ".META"
-	dataPath := base + ".DATA"
-	idxPath := base + ".IDX"
+	names := newImageNames(m.store, opts.Layout, m.store.Abs(m.store.Join(opts.Dir, guid)))
+	metaPath := names.meta
 
-	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
-		return nil, err
+	v := &VImg{
+		Guid:        guid,
+		VirtualSize: opts.VirtualSize,
+		ClusterSize: opts.ClusterSize,
+		Layout:      opts.Layout,
+		State:       StateCreated,
+		Compression: opts.Compression,
+		Encryption:  opts.Encryption,
+		StorageType: m.storageType,
+	}
+	if opts.Layout == LayoutDir {
+		v.DataSegmentSize = opts.DataSegmentSize
+		if v.DataSegmentSize == 0 {
+			v.DataSegmentSize = defaultDataSegmentSize
+		}
 	}
 
-	dataFile, err := os.Create(dataPath)
+	dataFile, err := createData(m.store, v, names.data)
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +174,7 @@ func (m *manager) Create(opts CreateOptions) (*VImg, error) {
 		return nil, err
 	}
 
-	idxFile, err := os.Create(idxPath)
+	idxFile, err := m.store.Create(names.idx)
 	if err != nil {
 		return nil, err
 	}
@@ -79,34 +182,25 @@ func (m *manager) Create(opts CreateOptions) (*VImg, error) {
 		return nil, err
 	}
 
-	v := &VImg{
-		Guid:        guid,
-		VirtualSize: opts.VirtualSize,
-		ClusterSize: opts.ClusterSize,
-		Layout:      LayoutFile,
-		State:       StateCreated,
-		Compression: opts.Compression,
-		Encryption:  opts.Encryption,
-		StorageType: StorageTypeFilesystem,
-	}
-
 	key, err := resolveEncryptionKey(opts.Encryption, opts.EncryptionKey)
 	if err != nil {
 		return nil, err
 	}
 
-	info := storagePrivateInfo{
-		Version:  1,
-		FilePath: metaPath,
-	}
-	if len(key) > 0 {
+	info := m.newStoragePrivateInfo(metaPath)
+	if opts.KeyProvider != nil {
+		if err := wrapEncryptionKey(&info, opts.KeyProvider, key); err != nil {
+			return nil, err
+		}
+		m.AddKeyProvider(opts.KeyProvider)
+	} else if len(key) > 0 {
 		info.EncryptionKey = base64.StdEncoding.EncodeToString(key)
 	}
 	if err := setStoragePrivateInfo(v, info); err != nil {
 		return nil, err
 	}
 
-	if err := writeJSON(metaPath, v); err != nil {
+	if err := writeJSON(m.store, metaPath, v); err != nil {
 		return nil, err
 	}
 
@@ -126,15 +220,15 @@ func (m *manager) CreateFromBacking(opts CreateFromBackingOptions) (*VImg, error
 
 	backingMeta := strings.TrimSpace(opts.BackingMetaPath)
 	if backingMeta == "" && strings.TrimSpace(opts.BackingGuid) != "" {
-		backingMeta = guessMetaFromGuid(metaPath, opts.BackingGuid)
+		backingMeta = guessMetaFromGuid(m.store, metaPath, opts.BackingGuid)
 	}
 	if backingMeta == "" {
 		return nil, errors.New("backingMetaPath or backingGuid is required")
 	}
-	backingMeta = resolveMetaPath(metaPath, backingMeta)
+	backingMeta = resolveMetaPath(m.store, metaPath, backingMeta)
 
 	backingMetaInfo := &VImg{}
-	if err := readJSON(backingMeta, backingMetaInfo); err != nil {
+	if err := readJSON(m.store, backingMeta, backingMetaInfo); err != nil {
 		return nil, fmt.Errorf("failed to open backing meta %q: %v", backingMeta, err)
 	}
 	if opts.BackingGuid != "" && opts.BackingGuid != backingMetaInfo.Guid {
@@ -150,29 +244,42 @@ func (m *manager) CreateFromBacking(opts CreateFromBackingOptions) (*VImg, error
 	if err != nil {
 		return nil, err
 	}
-	info.BackingFilePath = backingMeta
+	info.setBackingName(v.StorageType, backingRef(m.store, v.Layout, metaPath, backingMeta))
 	if err := setStoragePrivateInfo(v, info); err != nil {
 		return nil, err
 	}
 
-	return v, writeJSON(metaPath, v)
+	return v, writeJSON(m.store, metaPath, v)
 }
 
 func (m *manager) Open(metaPath string) (*Image, error) {
+	var opts OpenOptions
+	if m.storageType == StorageTypeS3 {
+		// S3 上每次 Sync 都会重写最后一个分段，逐次写入持久化的代价过高，
+		// 默认改为周期持久化：崩溃时最多丢失最近一个 SyncInterval 内的写入。
+		opts.Durability = DurabilityInterval
+	}
+	return m.OpenWithOptions(metaPath, opts)
+}
+
+func (m *manager) OpenWithOptions(metaPath string, opts OpenOptions) (*Image, error) {
+	if err := validateOpenOptions(opts, m.storageType); err != nil {
+		return nil, err
+	}
+
 	img, err := m.open(metaPath, map[string]struct{}{})
 	if err != nil {
 		return nil, err
 	}
+	img.setDurability(opts)
+	img.setReadOptions(opts)
 
 	var i Image = img
 	return &i, nil
 }
 
 func (m *manager) open(metaPath string, opening map[string]struct{}) (*image, error) {
-	absMeta := metaPath
-	if p, err := filepath.Abs(metaPath); err == nil {
-		absMeta = p
-	}
+	absMeta := m.store.Abs(metaPath)
 
 	if _, ok := opening[absMeta]; ok {
 		return nil, fmt.Errorf("detected backing cycle at %s", absMeta)
@@ -180,57 +287,34 @@ func (m *manager) open(metaPath string, opening map[string]struct{}) (*image, er
 	opening[absMeta] = struct{}{}
 	defer delete(opening, absMeta)
 
-	v := &VImg{}
-	if err := readJSON(absMeta, v); err != nil {
-		return nil, err
-	}
-
-	info, err := getStoragePrivateInfo(v)
-	if err != nil {
-		return nil, err
-	}
-
-	key, err := decodeStoredEncryptionKey(v, info)
-	if err != nil {
-		return nil, err
-	}
-
-	dataPath := replaceExt(absMeta, ".DATA")
-	idxPath := replaceExt(absMeta, ".IDX")
-
-	dataFile, err := os.OpenFile(dataPath, os.O_RDWR, 0644)
+	img, info, err := m.openLayer(absMeta)
 	if err != nil {
 		return nil, err
 	}
 
-	idxFile, err := os.OpenFile(idxPath, os.O_RDWR, 0644)
-	if err != nil {
-		_ = dataFile.Close()
-		return nil, err
-	}
-
-	img := &image{
-		meta:          v,
-		dataFile:      dataFile,
-		idxFile:       idxFile,
-		index:         make(map[uint64]IndexEntry),
-		encryptionKey: key,
-	}
-
 	if err := img.loadIndex(); err != nil {
 		_ = img.Close()
 		return nil, err
 	}
 
+	v := img.meta
 	if v.BackingGuid != "" {
-		backingMeta := strings.TrimSpace(info.BackingFilePath)
-		if backingMeta == "" {
-			backingMeta = guessMetaFromGuid(absMeta, v.BackingGuid)
+		var backingImg *image
+		for i, backingMeta := range backingMetaCandidates(m.store, absMeta, v, info) {
+			backingImg, err = m.open(backingMeta, opening)
+			if err == nil && i > 0 {
+				// 记录的路径已失效（例如链被整体移动），改用按 GUID 找到的位置。
+				info.setBackingName(v.StorageType, backingRef(m.store, v.Layout, absMeta, backingMeta))
+				err = setStoragePrivateInfo(v, info)
+			}
+			if !os.IsNotExist(err) {
+				break
+			}
 		}
-		backingMeta = resolveMetaPath(absMeta, backingMeta)
-
-		backingImg, err := m.open(backingMeta, opening)
 		if err != nil {
+			if backingImg != nil {
+				_ = backingImg.Close()
+			}
 			_ = img.Close()
 			return nil, err
 		}
@@ -245,29 +329,122 @@ func (m *manager) open(metaPath string, opening map[string]struct{}) (*image, er
 	return img, nil
 }
 
-func (m *manager) Delete(metaPath string) error {
-	if len(metaPath) < 5 {
-		return errors.New("invalid meta path")
+// openLayer 打开单个镜像的 META / DATA / IDX，不载入索引，也不打开 backing。
+func (m *manager) openLayer(absMeta string) (*image, storagePrivateInfo, error) {
+	v := &VImg{}
+	if err := readJSON(m.store, absMeta, v); err != nil {
+		return nil, storagePrivateInfo{}, err
 	}
-	base := metaPath[:len(metaPath)-5]
-	_ = os.Remove(base + ".DATA")
-	_ = os.Remove(base + ".IDX")
-	_ = os.Remove(base + ".META")
-	return nil
+	if v.StorageType != m.storageType {
+		return nil, storagePrivateInfo{}, fmt.Errorf("storage type mismatch: image %s has %d, manager uses %d", v.Guid, v.StorageType, m.storageType)
+	}
+
+	info, err := getStoragePrivateInfo(v)
+	if err != nil {
+		return nil, info, err
+	}
+
+	key, err := m.loadEncryptionKey(v, info)
+	if err != nil {
+		return nil, info, err
+	}
+
+	// 镜像（或 LayoutDir 下的整条链）可能已被移动，以实际打开的位置为准。
+	if info.metaName(v.StorageType) != absMeta {
+		if v.StorageType == StorageTypeS3 {
+			info.Key = absMeta
+		} else {
+			info.FilePath = absMeta
+		}
+		if err := setStoragePrivateInfo(v, info); err != nil {
+			return nil, info, err
+		}
+	}
+
+	names := namesFromMeta(m.store, v.Layout, absMeta, v.Generation)
+
+	dataFile, err := openData(m.store, v, names.data)
+	if err != nil {
+		return nil, info, err
+	}
+
+	idxFile, err := m.store.Open(names.idx)
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, info, err
+	}
+
+	dataSize, err := dataFile.Size()
+	if err != nil {
+		_ = dataFile.Close()
+		_ = idxFile.Close()
+		return nil, info, err
+	}
+
+	return &image{
+		mgr:           m,
+		metaPath:      absMeta,
+		meta:          v,
+		dataFile:      dataFile,
+		idxFile:       idxFile,
+		index:         make(map[uint64]IndexEntry),
+		encryptionKey: key,
+		bufferSize:    defaultBufferSize,
+		dataWritten:   dataSize,
+	}, info, nil
+}
+
+// backingMetaCandidates 返回父镜像 META 的候选位置：先是 META 中记录的位置，
+// 其次是在当前存放目录中按 GUID 查找到的位置（与前者相同时省略）。
+func backingMetaCandidates(st storage.Store, absMeta string, v *VImg, info storagePrivateInfo) []string {
+	guess := guessMetaFromGuid(st, absMeta, v.BackingGuid)
+	recorded := strings.TrimSpace(info.backingName(v.StorageType))
+	if recorded == "" {
+		return []string{guess}
+	}
+	recorded = resolveMetaPath(st, absMeta, recorded)
+	if recorded == guess {
+		return []string{recorded}
+	}
+	return []string{recorded, guess}
 }
 
 /*********************** Image *************************/
 
 type image struct {
+	mgr      *manager
+	metaPath string // 打开时使用的 META 位置
 	meta     *VImg
-	dataFile *os.File
-	idxFile  *os.File
+	dataFile storage.Object
+	idxFile  storage.Object
 
-	index map[uint64]IndexEntry
-	mu    sync.RWMutex
+	// mu 保护镜像状态：写入、Commit、Compact 等持有写锁，ReadAt / Map 持有读锁。
+	// 持有读锁时读取或刷新 index 还需持有 indexMu（见 lookupEntry）。
+	index       map[uint64]IndexEntry
+	indexLoaded int64 // 已载入 index 的 IDX 长度
+	mu          sync.RWMutex
+	indexMu     sync.Mutex
 
 	backing       *image
 	encryptionKey []byte
+
+	// 写缓冲（见 flush.go）。
+	durability  Durability
+	bufferSize  int
+	dataBuf     []byte       // 尚未写入 DATA 的帧，起始于 dataWritten
+	dataWritten int64        // 已写入 DATA 的长度
+	dataDirty   bool         // DATA 有未 Sync 的写入
+	idxBuf      bytes.Buffer // 尚未写入 IDX 的索引项
+	idxDirty    bool         // IDX 有未 Sync 的写入
+	flushErr    error        // 后台持久化失败的错误，由下一次写入或 Flush 返回
+	writeErr    error        // DATA 部分写入后无法继续写入，此后的写入与 Flush 都返回该错误
+	stopSync    chan struct{}
+	syncDone    chan struct{}
+
+	// 读取（见 cache.go）。
+	cache   *clusterCache // 与 backing 链共享
+	ra      *readAhead    // 仅顶层句柄
+	bufPool sync.Pool
 }
 
 func (img *image) Info() *VImg {
@@ -275,8 +452,8 @@ func (img *image) Info() *VImg {
 }
 
 func (img *image) Backing() (*BackingRef, error) {
-	img.mu.Lock()
-	defer img.mu.Unlock()
+	img.mu.RLock()
+	defer img.mu.RUnlock()
 
 	if strings.TrimSpace(img.meta.BackingGuid) == "" {
 		return nil, nil
@@ -287,8 +464,9 @@ func (img *image) Backing() (*BackingRef, error) {
 		return nil, err
 	}
 
-	curMeta := info.FilePath
-	backingMeta := strings.TrimSpace(info.BackingFilePath)
+	st := img.mgr.store
+	curMeta := info.metaName(img.meta.StorageType)
+	backingMeta := strings.TrimSpace(info.backingName(img.meta.StorageType))
 	if backingMeta == "" {
 		if strings.TrimSpace(curMeta) == "" {
 			curMeta, err = getMetaPath(img.meta)
@@ -296,9 +474,9 @@ func (img *image) Backing() (*BackingRef, error) {
 				return nil, err
 			}
 		}
-		backingMeta = guessMetaFromGuid(curMeta, img.meta.BackingGuid)
+		backingMeta = guessMetaFromGuid(st, curMeta, img.meta.BackingGuid)
 	} else if strings.TrimSpace(curMeta) != "" {
-		backingMeta = resolveMetaPath(curMeta, backingMeta)
+		backingMeta = resolveMetaPath(st, curMeta, backingMeta)
 	}
 
 	return &BackingRef{
@@ -308,7 +486,15 @@ func (img *image) Backing() (*BackingRef, error) {
 }
 
 func (img *image) Close() error {
-	var firstErr error
+	if img.ra != nil {
+		img.ra.close()
+	}
+	img.stopSyncLoop()
+
+	img.mu.Lock()
+	firstErr := img.flushNoLock()
+	img.mu.Unlock()
+
 	if img.dataFile != nil {
 		if err := img.dataFile.Close(); err != nil && firstErr == nil {
 			firstErr = err
@@ -334,13 +520,13 @@ func (img *image) WriteAt(p []byte, off uint64) error {
 		return nil
 	}
 
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
 	if err := img.validateRWRange(off, len(p)); err != nil {
 		return err
 	}
 
-	img.mu.Lock()
-	defer img.mu.Unlock()
-
 	clusterSize := uint64(img.meta.ClusterSize)
 
 	for len(p) > 0 {
@@ -351,13 +537,16 @@ func (img *image) WriteAt(p []byte, off uint64) error {
 
 		buf := make([]byte, clusterSize)
 
-		if err := img.readCluster(idx, buf); err != nil {
-			return err
+		// 整个 Cluster 被覆盖时无需读取原数据。
+		if writeLen != clusterSize {
+			if err := img.readCluster(idx, buf); err != nil {
+				return err
+			}
 		}
 
 		copy(buf[inner:], p[:writeLen])
 
-		if err := img.writeCluster(idx, buf); err != nil {
+		if err := img.storeCluster(idx, buf); err != nil {
 			return err
 		}
 
@@ -365,7 +554,7 @@ func (img *image) WriteAt(p []byte, off uint64) error {
 		off += writeLen
 	}
 
-	return nil
+	return img.writeDoneNoLock()
 }
 
 func (img *image) writeCluster(index uint64, data []byte) error {
@@ -373,43 +562,25 @@ func (img *image) writeCluster(index uint64, data []byte) error {
 		return fmt.Errorf("invalid cluster payload length: got %d, want %d", len(data), img.meta.ClusterSize)
 	}
 
-	stored, err := img.encodeCluster(index, data)
-	if err != nil {
-		return err
+	if isZero(data) {
+		return img.writeZeroMarker(index)
 	}
 
-	offset, err := img.dataFile.Seek(0, io.SeekEnd)
+	stored, err := img.encodeCluster(index, data)
 	if err != nil {
 		return err
 	}
 
-	if _, err := img.dataFile.Write(stored); err != nil {
-		return err
-	}
-
-	if _, err := img.idxFile.Seek(0, io.SeekEnd); err != nil {
+	offset, err := img.appendFrameNoLock(stored)
+	if err != nil {
 		return err
 	}
 
-	entry := IndexEntry{
+	return img.appendIndexNoLock(IndexEntry{
 		ClusterIndex: index,
 		OffsetInDATA: uint64(offset),
 		LengthInDATA: uint32(len(stored)),
-	}
-
-	if err := writeStruct(img.idxFile, &entry); err != nil {
-		return err
-	}
-
-	if err := img.dataFile.Sync(); err != nil {
-		return err
-	}
-	if err := img.idxFile.Sync(); err != nil {
-		return err
-	}
-
-	img.index[index] = entry
-	return nil
+	})
 }
 
 func (img *image) encodeCluster(index uint64, data []byte) ([]byte, error) {
@@ -420,7 +591,11 @@ func (img *image) encodeCluster(index uint64, data []byte) ([]byte, error) {
 	switch img.meta.Compression {
 	case CompressionNone:
 	case CompressionLZ4:
-		return nil, errors.New("compression LZ4 is not implemented yet")
+		// 压缩收益不足以抵消帧头开销时按原文存储，读取端依据帧标志区分。
+		if c := lz4CompressBlock(payload); len(c)+clusterFrameHeaderSize < len(payload) {
+			payload = c
+			flags |= clusterFrameFlagCompressed
+		}
 	default:
 		return nil, fmt.Errorf("unsupported compression algorithm: %d", img.meta.Compression)
 	}
@@ -446,6 +621,9 @@ func (img *image) encodeCluster(index uint64, data []byte) ([]byte, error) {
 	binary.LittleEndian.PutUint32(header[0:4], clusterFrameMagic)
 	header[4] = clusterFrameVersion
 	header[5] = flags
+	if flags&clusterFrameFlagCompressed != 0 {
+		header[clusterFrameCompressionOff] = uint8(img.meta.Compression)
+	}
 	binary.LittleEndian.PutUint32(header[8:12], uint32(len(data)))
 	binary.LittleEndian.PutUint32(header[12:16], crc32.ChecksumIEEE(payload))
 	binary.LittleEndian.PutUint16(header[16:18], uint16(len(nonce)))
@@ -465,12 +643,16 @@ func (img *image) ReadAt(p []byte, off uint64) error {
 		return nil
 	}
 
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+
 	if err := img.validateRWRange(off, len(p)); err != nil {
 		return err
 	}
 
-	img.mu.Lock()
-	defer img.mu.Unlock()
+	if img.ra != nil {
+		img.ra.observe(img, off, uint64(len(p)))
+	}
 
 	clusterSize := uint64(img.meta.ClusterSize)
 
@@ -480,14 +662,21 @@ func (img *image) ReadAt(p []byte, off uint64) error {
 
 		readLen := min(uint64(len(p)), clusterSize-inner)
 
-		buf := make([]byte, clusterSize)
-
-		if err := img.readCluster(idx, buf); err != nil {
-			return err
+		// 整个 Cluster 直接读入 p，否则经由临时缓冲。
+		if readLen == clusterSize {
+			if err := img.readCluster(idx, p[:clusterSize]); err != nil {
+				return err
+			}
+		} else {
+			buf := img.getClusterBuf()
+			err := img.readCluster(idx, buf)
+			copy(p[:readLen], buf[inner:inner+readLen])
+			img.putClusterBuf(buf)
+			if err != nil {
+				return err
+			}
 		}
 
-		copy(p[:readLen], buf[inner:inner+readLen])
-
 		p = p[readLen:]
 		off += readLen
 	}
@@ -505,39 +694,48 @@ func (img *image) readCluster(index uint64, buf []byte) error {
 	if err != nil {
 		return err
 	}
-	if found {
-		return nil
+	if !found {
+		if img.backing != nil {
+			if err := img.backing.readClusterWithLock(index, buf); err != nil {
+				return err
+			}
+		} else {
+			fillZero(buf)
+		}
 	}
 
-	if img.backing != nil {
-		return img.backing.readClusterWithLock(index, buf)
+	// 末尾 Cluster 超出 VirtualSize 的部分总是读为 0，
+	// 较大的 backing 或缩小前写入的数据不会透出。
+	if end := img.meta.VirtualSize - index*uint64(img.meta.ClusterSize); end < uint64(len(buf)) {
+		fillZero(buf[end:])
 	}
-
-	fillZero(buf)
 	return nil
 }
 
 func (img *image) readClusterWithLock(index uint64, buf []byte) error {
-	img.mu.Lock()
-	defer img.mu.Unlock()
+	img.mu.RLock()
+	defer img.mu.RUnlock()
 	return img.readCluster(index, buf)
 }
 
 func (img *image) readLocalCluster(index uint64, buf []byte) (bool, error) {
-	entry, ok := img.index[index]
-	if !ok {
-		// 其他进程/句柄可能已追加写入 IDX，这里在 miss 时做一次刷新。
-		if err := img.loadIndexNoLock(); err != nil {
-			return false, err
-		}
-		entry, ok = img.index[index]
-		if !ok {
-			return false, nil
-		}
+	entry, ok, err := img.lookupEntry(index)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if isZeroEntry(entry) {
+		fillZero(buf)
+		return true, nil
 	}
 
-	data := make([]byte, entry.LengthInDATA)
-	if _, err := img.dataFile.ReadAt(data, int64(entry.OffsetInDATA)); err != nil {
+	key := img.cacheKey(entry)
+	if img.cache.get(key, buf) {
+		return true, nil
+	}
+
+	data, err := img.readFrameNoLock(entry)
+	if err != nil {
 		return true, err
 	}
 
@@ -551,9 +749,26 @@ func (img *image) readLocalCluster(index uint64, buf []byte) (bool, error) {
 		return true, fmt.Errorf("decoded cluster size too large: got %d, buf=%d", len(plain), len(buf))
 	}
 	copy(buf, plain)
+	img.cache.add(key, plain)
 	return true, nil
 }
 
+// lookupEntry 查找本层索引项。其他进程/句柄可能已追加写入 IDX，未命中时刷新一次。
+// 调用方至少持有读锁。
+func (img *image) lookupEntry(index uint64) (IndexEntry, bool, error) {
+	img.indexMu.Lock()
+	defer img.indexMu.Unlock()
+
+	if entry, ok := img.index[index]; ok {
+		return entry, true, nil
+	}
+	if err := img.loadIndexNoLock(); err != nil {
+		return IndexEntry{}, false, err
+	}
+	entry, ok := img.index[index]
+	return entry, ok, nil
+}
+
 func (img *image) decodeCluster(index uint64, stored []byte) ([]byte, error) {
 	if len(stored) < clusterFrameHeaderSize {
 		return append([]byte(nil), stored...), nil
@@ -600,8 +815,18 @@ func (img *image) decodeCluster(index uint64, stored []byte) ([]byte, error) {
 		}
 	}
 
+	// 帧自描述压缩与加密方式，与镜像当前的 Compression 设置无关，
+	// 因此同一 DATA 中新旧帧可以混合存在。
 	if flags&clusterFrameFlagCompressed != 0 {
-		return nil, errors.New("compression LZ4 is not implemented yet")
+		if algo := Compression(stored[clusterFrameCompressionOff]); algo != CompressionLZ4 {
+			return nil, fmt.Errorf("unsupported cluster frame compression: %d", algo)
+		}
+		raw := make([]byte, rawSize)
+		n, err := lz4DecompressBlock(plain, raw)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %d: %v", index, err)
+		}
+		plain = raw[:n]
 	}
 
 	if len(plain) != int(rawSize) {
@@ -616,6 +841,10 @@ func (img *image) Map(off, length uint64) ([]MapSegment, error) {
 	if length == 0 {
 		return []MapSegment{}, nil
 	}
+
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+
 	if off >= img.meta.VirtualSize {
 		return nil, fmt.Errorf("offset out of range: off=%d size=%d", off, img.meta.VirtualSize)
 	}
@@ -624,10 +853,10 @@ func (img *image) Map(off, length uint64) ([]MapSegment, error) {
 		return nil, fmt.Errorf("range out of bounds: off=%d len=%d size=%d", off, length, img.meta.VirtualSize)
 	}
 
-	img.mu.Lock()
-	defer img.mu.Unlock()
-
-	if err := img.loadIndexNoLock(); err != nil {
+	img.indexMu.Lock()
+	err := img.loadIndexNoLock()
+	img.indexMu.Unlock()
+	if err != nil {
 		return nil, err
 	}
 
@@ -646,26 +875,25 @@ func (img *image) Map(off, length uint64) ([]MapSegment, error) {
 			clusterEnd = end
 		}
 
-		source, ownerGuid, err := img.resolveMapSourceNoLock(clusterIndex, topGuid)
+		source, ownerGuid, limit, err := img.resolveMapSourceNoLock(clusterIndex, topGuid)
 		if err != nil {
 			return nil, err
 		}
 
-		seg := MapSegment{
+		// 链中较小的一层截断了该 Cluster，超出部分读取为 0。
+		if limit < clusterEnd && (source == MapSourceData || source == MapSourceBacking) {
+			if limit > pos {
+				segments = appendMapSegment(segments, MapSegment{Offset: pos, Length: limit - pos, Source: source, OwnerGuid: ownerGuid})
+				pos = limit
+			}
+			source, ownerGuid = MapSourceZero, ""
+		}
+		segments = appendMapSegment(segments, MapSegment{
 			Offset:    pos,
 			Length:    clusterEnd - pos,
 			Source:    source,
 			OwnerGuid: ownerGuid,
-		}
-
-		if n := len(segments); n > 0 &&
-			segments[n-1].Offset+segments[n-1].Length == seg.Offset &&
-			segments[n-1].Source == seg.Source &&
-			segments[n-1].OwnerGuid == seg.OwnerGuid {
-			segments[n-1].Length += seg.Length
-		} else {
-			segments = append(segments, seg)
-		}
+		})
 
 		pos = clusterEnd
 	}
@@ -673,33 +901,51 @@ func (img *image) Map(off, length uint64) ([]MapSegment, error) {
 	return segments, nil
 }
 
-func (img *image) resolveMapSourceNoLock(clusterIndex uint64, topGuid string) (MapSource, string, error) {
+// appendMapSegment 追加 seg，与前一段相邻且来源相同时合并。
+func appendMapSegment(segments []MapSegment, seg MapSegment) []MapSegment {
+	if n := len(segments); n > 0 &&
+		segments[n-1].Offset+segments[n-1].Length == seg.Offset &&
+		segments[n-1].Source == seg.Source &&
+		segments[n-1].OwnerGuid == seg.OwnerGuid {
+		segments[n-1].Length += seg.Length
+		return segments
+	}
+	return append(segments, seg)
+}
+
+// resolveMapSourceNoLock 返回 Cluster 的来源以及经过的各层中最小的 VirtualSize（limit），
+// limit 之后的数据读取为 0。
+func (img *image) resolveMapSourceNoLock(clusterIndex uint64, topGuid string) (MapSource, string, uint64, error) {
+	limit := img.meta.VirtualSize
 	if !img.clusterIndexInRange(clusterIndex) {
-		return MapSourceZero, "", nil
+		return MapSourceZero, "", limit, nil
 	}
 
-	if _, ok := img.index[clusterIndex]; !ok {
-		// 避免多句柄下 map 看到过期索引。
-		if err := img.loadIndexNoLock(); err != nil {
-			return MapSourceZero, "", err
-		}
+	// 未命中时刷新索引，避免多句柄下 map 看到过期索引。
+	e, ok, err := img.lookupEntry(clusterIndex)
+	if err != nil {
+		return MapSourceZero, "", limit, err
 	}
-	if _, ok := img.index[clusterIndex]; ok {
+	if ok {
+		if isZeroEntry(e) {
+			return MapSourceZeroed, img.meta.Guid, limit, nil
+		}
 		if img.meta.Guid == topGuid {
-			return MapSourceData, img.meta.Guid, nil
+			return MapSourceData, img.meta.Guid, limit, nil
 		}
-		return MapSourceBacking, img.meta.Guid, nil
+		return MapSourceBacking, img.meta.Guid, limit, nil
 	}
 
 	if img.backing == nil {
-		return MapSourceZero, "", nil
+		return MapSourceZero, "", limit, nil
 	}
-	return img.backing.resolveMapSourceWithLock(clusterIndex, topGuid)
+	source, owner, backingLimit, err := img.backing.resolveMapSourceWithLock(clusterIndex, topGuid)
+	return source, owner, min(limit, backingLimit), err
 }
 
-func (img *image) resolveMapSourceWithLock(clusterIndex uint64, topGuid string) (MapSource, string, error) {
-	img.mu.Lock()
-	defer img.mu.Unlock()
+func (img *image) resolveMapSourceWithLock(clusterIndex uint64, topGuid string) (MapSource, string, uint64, error) {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
 	return img.resolveMapSourceNoLock(clusterIndex, topGuid)
 }
 
@@ -717,33 +963,20 @@ func (img *image) Commit() error {
 	img.mu.Lock()
 	defer img.mu.Unlock()
 
-	img.backing.mu.Lock()
-	defer img.backing.mu.Unlock()
-
-	for idx := range img.index {
-		buf := make([]byte, img.meta.ClusterSize)
-
-		found, err := img.readLocalCluster(idx, buf)
-		if err != nil {
-			return err
-		}
-		if !found {
-			continue
-		}
-
-		if err := img.backing.writeCluster(idx, buf); err != nil {
-			return err
-		}
+	if err := commitNoLock(img, []*image{img}, img.backing); err != nil {
+		return err
 	}
 
 	// 重新加载父镜像索引，确保其内存中的 index map 是最新的
+	img.backing.mu.Lock()
+	defer img.backing.mu.Unlock()
 	return img.backing.loadIndexNoLock()
 }
 
 /*********************** Rebase *************************/
 
 func (img *image) Rebase(newBackingMeta string) error {
-	newImg, err := NewManager().Open(newBackingMeta)
+	newImg, err := img.mgr.Open(newBackingMeta)
 	if err != nil {
 		return err
 	}
@@ -767,65 +1000,89 @@ func (img *image) Rebase(newBackingMeta string) error {
 	img.mu.Lock()
 	defer img.mu.Unlock()
 
+	if err := img.copyBackingDiffNoLock(newBacking); err != nil {
+		_ = newBacking.Close()
+		return err
+	}
+	if err := img.switchBackingNoLock(newBacking); err != nil {
+		_ = newBacking.Close()
+		return err
+	}
+	return nil
+}
+
+// copyBackingDiffNoLock 将本层未覆盖、且经由当前 backing 与 newBacking 读取结果不同的
+// Cluster 复制到本层，使切换 backing 后本层读取到的数据不变。newBacking 为 nil 表示全 0。
+func (img *image) copyBackingDiffNoLock(newBacking *image) error {
 	clusterSize := uint64(img.meta.ClusterSize)
 	totalClusters := img.meta.VirtualSize / clusterSize
 	if img.meta.VirtualSize%clusterSize != 0 {
 		totalClusters++
 	}
 
+	oldBuf := make([]byte, img.meta.ClusterSize)
+	newBuf := make([]byte, img.meta.ClusterSize)
 	for idx := uint64(0); idx < totalClusters; idx++ {
 		if _, ok := img.index[idx]; ok {
 			// 本地已覆盖，不受 backing 变化影响。
 			continue
 		}
 
-		oldBuf := make([]byte, img.meta.ClusterSize)
-		newBuf := make([]byte, img.meta.ClusterSize)
-
+		fillZero(oldBuf)
+		fillZero(newBuf)
 		if img.backing != nil {
 			if err := img.backing.readClusterWithLock(idx, oldBuf); err != nil {
-				_ = newBacking.Close()
 				return err
 			}
 		}
-		if err := newBacking.readClusterWithLock(idx, newBuf); err != nil {
-			_ = newBacking.Close()
-			return err
+		if newBacking != nil {
+			if err := newBacking.readClusterWithLock(idx, newBuf); err != nil {
+				return err
+			}
 		}
 
 		if !byteSliceEqual(oldBuf, newBuf) {
 			if err := img.writeCluster(idx, oldBuf); err != nil {
-				_ = newBacking.Close()
 				return err
 			}
 		}
 	}
+	return nil
+}
 
-	oldBacking := img.backing
-	img.backing = newBacking
-	img.meta.BackingGuid = newBacking.meta.Guid
+// switchBackingNoLock 将 backing 切换为 newBacking（nil 表示不再有 backing）并原子地更新 META，
+// 成功后关闭原 backing。复制到本层的数据先于 META 持久化。
+func (img *image) switchBackingNoLock(newBacking *image) error {
+	if err := img.flushNoLock(); err != nil {
+		return err
+	}
 
 	info, err := getStoragePrivateInfo(img.meta)
 	if err != nil {
-		_ = newBacking.Close()
 		return err
 	}
-	info.BackingFilePath = newBackingMeta
-	if err := setStoragePrivateInfo(img.meta, info); err != nil {
-		_ = newBacking.Close()
-		return err
+	oldGuid, oldInfo := img.meta.BackingGuid, img.meta.StoragePrivateInfo
+	if newBacking != nil {
+		img.meta.BackingGuid = newBacking.meta.Guid
+		info.setBackingName(img.meta.StorageType, backingRef(img.mgr.store, img.meta.Layout, img.metaPath, newBacking.metaPath))
+	} else {
+		img.meta.BackingGuid = ""
+		info.setBackingName(img.meta.StorageType, "")
 	}
-
-	metaPath, err := getMetaPath(img.meta)
-	if err != nil {
-		_ = newBacking.Close()
+	if err := setStoragePrivateInfo(img.meta, info); err != nil {
+		img.meta.BackingGuid = oldGuid
 		return err
 	}
-	if err := writeJSON(metaPath, img.meta); err != nil {
-		_ = newBacking.Close()
+	if err := writeJSON(img.mgr.store, img.metaPath, img.meta); err != nil {
+		img.meta.BackingGuid, img.meta.StoragePrivateInfo = oldGuid, oldInfo
 		return err
 	}
 
+	oldBacking := img.backing
+	img.backing = newBacking
+	if newBacking != nil {
+		newBacking.setCache(img.cache)
+	}
 	if oldBacking != nil {
 		_ = oldBacking.Close()
 	}
@@ -871,28 +1128,38 @@ func (img *image) loadIndex() error {
 }
 
 func (img *image) loadIndexNoLock() error {
-	img.index = make(map[uint64]IndexEntry)
-
-	stat, err := img.idxFile.Stat()
+	size, err := img.idxFile.Size()
 	if err != nil {
 		return err
 	}
+	if size < img.indexLoaded {
+		// IDX 被截断或替换，整体重新载入。
+		img.indexLoaded = 0
+		img.index = make(map[uint64]IndexEntry)
+	}
 
-	size := stat.Size()
-	var offset int64
-
+	// 只读取上次载入之后追加的索引项，对象存储上一次读取即可完成。
 	entrySize := int64(binary.Size(IndexEntry{}))
-	for offset+entrySize <= size {
+	n := (size - img.indexLoaded) / entrySize
+	if n == 0 {
+		return nil
+	}
+	buf := make([]byte, n*entrySize)
+	if _, err := img.idxFile.ReadAt(buf, img.indexLoaded); err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(buf)
+	for i := int64(0); i < n; i++ {
 		var e IndexEntry
-		if err := readStruct(img.idxFile, &e, offset); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
 			return err
 		}
-
 		img.index[e.ClusterIndex] = e
-		offset += entrySize
 	}
+	img.indexLoaded += n * entrySize
 
-	// 忽略末尾残缺索引，避免崩溃恢复场景直接打开失败。
+	// 忽略末尾残缺索引，避免崩溃恢复场景直接打开失败；可用 Manager.Check 修复。
 	return nil
 }
 
@@ -908,10 +1175,17 @@ func validateCreateOptions(opts CreateOptions) error {
 	if opts.ClusterSize == 0 || opts.ClusterSize%512 != 0 {
 		return errors.New("cluster size must be non-zero and 512-byte aligned")
 	}
+	switch opts.Layout {
+	case LayoutFile:
+	case LayoutDir:
+		if opts.DataSegmentSize != 0 && opts.DataSegmentSize < uint64(opts.ClusterSize) {
+			return errors.New("data segment size must not be smaller than cluster size")
+		}
+	default:
+		return fmt.Errorf("unsupported layout: %d", opts.Layout)
+	}
 	switch opts.Compression {
-	case CompressionNone:
-	case CompressionLZ4:
-		return errors.New("compression LZ4 is not implemented yet")
+	case CompressionNone, CompressionLZ4:
 	default:
 		return fmt.Errorf("unsupported compression algorithm: %d", opts.Compression)
 	}
@@ -920,6 +1194,9 @@ func validateCreateOptions(opts CreateOptions) error {
 	default:
 		return fmt.Errorf("unsupported encryption algorithm: %d", opts.Encryption)
 	}
+	if opts.KeyProvider != nil && opts.Encryption == EncryptionNone {
+		return errors.New("key provider requires encryption")
+	}
 	return nil
 }
 
@@ -1087,16 +1364,16 @@ func fillZero(buf []byte) {
 	}
 }
 
-func writeJSON(path string, v any) error {
+func writeJSON(st storage.Store, path string, v any) error {
 	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	return st.WriteFile(path, data)
 }
 
-func readJSON(path string, v any) error {
-	data, err := os.ReadFile(path)
+func readJSON(st storage.Store, path string, v any) error {
+	data, err := st.ReadFile(path)
 	if err != nil {
 		return err
 	}
@@ -1107,16 +1384,6 @@ func writeStruct(w io.Writer, v any) error {
 	return binary.Write(w, binary.LittleEndian, v)
 }
 
-func readStruct(r io.ReaderAt, v any, off int64) error {
-	buf := make([]byte, binary.Size(v))
-
-	if _, err := r.ReadAt(buf, off); err != nil {
-		return err
-	}
-
-	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, v)
-}
-
 func min(a, b uint64) uint64 {
 	if a < b {
 		return a
@@ -1139,10 +1406,14 @@ func getMetaPath(v *VImg) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if strings.TrimSpace(info.FilePath) == "" {
+	name := info.metaName(v.StorageType)
+	if strings.TrimSpace(name) == "" {
+		if v.StorageType == StorageTypeS3 {
+			return "", errors.New("key not found in StoragePrivateInfo")
+		}
 		return "", errors.New("filePath not found in StoragePrivateInfo")
 	}
-	return info.FilePath, nil
+	return name, nil
 }
 
 func getStoragePrivateInfo(v *VImg) (storagePrivateInfo, error) {
@@ -1175,14 +1446,9 @@ func setStoragePrivateInfo(v *VImg, info storagePrivateInfo) error {
 	return nil
 }
 
-func guessMetaFromGuid(curMeta, guid string) string {
-	dir := filepath.Dir(curMeta)
-	return filepath.Join(dir, guid+".META")
-}
-
-func resolveMetaPath(curMetaPath, target string) string {
-	if filepath.IsAbs(target) {
+func resolveMetaPath(st storage.Store, curMetaPath, target string) string {
+	if st.IsAbs(target) {
 		return target
 	}
-	return filepath.Join(filepath.Dir(curMetaPath), target)
+	return st.Join(st.Dir(curMetaPath), target)
 }
@@ -1,12 +1,30 @@
 package vimg
 
+import "time"
+
 type Manager interface {
 	Create(opts CreateOptions) (*VImg, error)
 	CreateFromBacking(opts CreateFromBackingOptions) (*VImg, error)
 
+	// Open 以默认选项打开镜像：本地文件系统上为 DurabilityPerWrite，S3 上为 DurabilityInterval。
+	// OpenWithOptions 在 S3 上不接受 DurabilityPerWrite（见 Durability）。
 	Open(metaPath string) (*Image, error)
+	OpenWithOptions(metaPath string, opts OpenOptions) (*Image, error)
+
+	// AddKeyProvider 注册打开加密镜像时用于解包数据密钥的 KeyProvider
+	AddKeyProvider(p KeyProvider)
+
+	// Delete 删除镜像，存在子镜像时返回错误；DeleteWithOptions 可将其数据合并到子镜像后删除
+	Delete(metaPath string) error
+	DeleteWithOptions(metaPath string, opts DeleteOptions) error
 
-	Delete(guid string) error
+	// Chain 返回存放目录中全部镜像的父子关系
+	Chain(dir string) ([]ChainNode, error)
+	// CommitInto 将镜像及其与祖先之间的各层合并到祖先 ancestorGuid 并删除这些层
+	CommitInto(metaPath, ancestorGuid string) error
+
+	// Check 检查镜像完整性，可选修复（见 CheckOptions）
+	Check(metaPath string, opts CheckOptions) (*CheckReport, error)
 }
 
 type Image interface {
@@ -14,11 +32,25 @@ type Image interface {
 
 	WriteAt(p []byte, off uint64) error
 	ReadAt(p []byte, off uint64) error
+	Discard(off, length uint64) error // 置零并释放区间（trim / unmap）
+	Flush() error                     // 持久化缓冲的写入（见 Durability）
 	Map(off, length uint64) ([]MapSegment, error)
 	Backing() (*BackingRef, error)
 
 	Commit() error // merge 到 backing
 	Rebase(newBacking string) error
+	Flatten() error // 复制 backing 链的数据到本层并解除 backing
+
+	// Resize 调整虚拟磁盘大小，缩小时被移除的区间必须读取为全 0
+	Resize(newSize uint64) error
+
+	// Rekey 用新的 KeyProvider 重新包装本层数据密钥，不重写 DATA
+	Rekey(p KeyProvider) error
+
+	// SpaceUsage 返回本层 DATA / IDX 的有效与失效数据统计
+	SpaceUsage() (*SpaceUsage, error)
+	// Compact 回收本层失效数据，期间同一镜像的其他句柄必须关闭
+	Compact() error
 
 	Close() error
 }
@@ -26,10 +58,11 @@ type Image interface {
 type CreateOptions struct {
 	// Dir 镜像存放目录（filesystem 模式）
 	// 例如：/data/vimg/
+	// S3 模式下为对象 key 前缀，例如：pool/vimg
 	Dir string
 
 	// VirtualSize 虚拟磁盘大小（字节）
-	// 支持任意正整数（字节粒度）
+	// 支持任意正整数（字节粒度），之后可由 Image.Resize 调整
 	VirtualSize uint64
 
 	// ClusterSize 数据块大小（字节）
@@ -37,6 +70,13 @@ type CreateOptions struct {
 	// 必须 512 对齐
 	ClusterSize uint32
 
+	// Layout 镜像布局（默认 LayoutFile）
+	Layout Layout
+
+	// DataSegmentSize DATA 分段文件大小（字节，仅 LayoutDir）
+	// 为 0 时默认 1GiB，不能小于 ClusterSize
+	DataSegmentSize uint64
+
 	// Compression 压缩算法
 	Compression Compression
 
@@ -45,9 +85,16 @@ type CreateOptions struct {
 
 	// EncryptionKey 可选加密密钥（仅在 EncryptionAES256 时使用）
 	// 支持 32 字节原文、64 字符 hex 或 base64 编码的 32 字节密钥
-	// 为空时会自动生成随机密钥并写入 META 的 StoragePrivateInfo
+	// 为空时会自动生成随机密钥
+	// 警告：未指定 KeyProvider 时密钥原文写入 META 的 StoragePrivateInfo，
+	// 任何能读取 META 的人都能解密 DATA，只应在 META 与 DATA 受同等保护时使用；
+	// 否则请指定 KeyProvider，或之后用 Image.Rekey 改为包装存储
 	EncryptionKey string
 
+	// KeyProvider 包装数据密钥的 KeyProvider（可选，仅在 EncryptionAES256 时使用）
+	// 指定后 META 中只保存包装后的密钥，并自动注册到 Manager
+	KeyProvider KeyProvider
+
 	// Preallocate 是否预分配空间（可选）
 	// true  → 预分配 DATA 文件（提升顺序写性能）
 	// false → 稀疏文件（默认）
@@ -60,6 +107,45 @@ type CreateOptions struct {
 	CustomMeta map[string]string
 }
 
+// Durability 表示写入何时持久化。
+// 无论哪种方式，DATA 总是先于引用它的 IDX 落盘，崩溃后 IDX 不会引用未写入的 DATA；
+// 尚未持久化的写入在崩溃后丢失，读取回退到此前的数据。
+type Durability uint8
+
+const (
+	// DurabilityPerWrite 每次 WriteAt / Discard 返回前持久化（默认）。
+	// S3 上不支持：对象存储的每次 Sync 都要重新上传最后一个未满的分段（至多 SegmentSize，默认 8MiB），
+	// 逐次写入持久化会使每个 Cluster 的写入上传数 MiB 数据。
+	DurabilityPerWrite Durability = iota
+
+	// DurabilityFlush 仅在 Flush / Close 时持久化，适合备份等顺序写入。
+	DurabilityFlush
+
+	// DurabilityInterval 后台按 SyncInterval 周期持久化，Flush / Close 时同样持久化。
+	DurabilityInterval
+)
+
+type OpenOptions struct {
+	// Durability 写入的持久化方式（默认 DurabilityPerWrite，S3 上必须指定其他方式）
+	Durability Durability
+
+	// SyncInterval DurabilityInterval 下的持久化周期
+	// 为 0 时默认 1s
+	SyncInterval time.Duration
+
+	// BufferSize 写缓冲大小（字节）
+	// 缓冲满时写入 DATA 但不 Sync；为 0 时默认 4MiB
+	BufferSize int
+
+	// CacheSize 解码后 Cluster 的 LRU 缓存大小（字节），由整条 backing 链共享
+	// 为 0 时默认 64MiB，小于 0 时不缓存
+	CacheSize int64
+
+	// ReadAhead 顺序读取时预读的 Cluster 数（需要缓存）
+	// 为 0 时默认 16，小于 0 时不预读
+	ReadAhead int
+}
+
 type CreateFromBackingOptions struct {
 	CreateOptions
 
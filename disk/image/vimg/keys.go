@@ -0,0 +1,331 @@
+package vimg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*********************** KeyProvider *************************/
+
+// KeyProvider 使用密钥加密密钥（KEK）包装与解包镜像的数据密钥（DEK）。
+// 使用 KeyProvider 时 META 中只保存包装后的 DEK 与 ID()，不再保存 DEK 原文；
+// 更换 KEK 只需重新包装 DEK（见 Image.Rekey），无需重写 DATA。
+type KeyProvider interface {
+	// ID 标识 KEK，写入 META，打开镜像时据此选择已注册的 KeyProvider（见 Manager.AddKeyProvider）。
+	ID() string
+
+	// Wrap 包装 DEK，返回值写入 META。
+	Wrap(dek []byte) ([]byte, error)
+
+	// Unwrap 解包 Wrap 的结果，KEK 不匹配时返回错误。
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// KMS 是外部密钥管理服务的最小接口，KEK 不离开 KMS。
+type KMS interface {
+	Encrypt(keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+const (
+	// defaultPassphraseIterations 口令派生 KEK 的默认 PBKDF2 迭代次数。
+	defaultPassphraseIterations = 600000
+
+	passphraseSaltSize = 16
+)
+
+// wrapKeyAAD 绑定到包装结果，避免其他用途的密文被当作 DEK 解包。
+var wrapKeyAAD = []byte("vimg-dek")
+
+// keyFileProvider 使用本地密钥文件中的 KEK。
+type keyFileProvider struct {
+	id  string
+	kek []byte
+}
+
+// NewKeyFileProvider 从密钥文件读取 KEK，文件内容格式与 CreateOptions.EncryptionKey 相同
+// （32 字节原文、64 字符 hex 或 base64）。ID 含 KEK 指纹，可同时注册多个密钥文件。
+func NewKeyFileProvider(path string) (KeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := parseEncryptionKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %v", path, err)
+	}
+	if len(kek) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", path)
+	}
+	sum := sha256.Sum256(kek)
+	return &keyFileProvider{id: "keyfile:" + hex.EncodeToString(sum[:8]), kek: kek}, nil
+}
+
+func (p *keyFileProvider) ID() string {
+	return p.id
+}
+
+func (p *keyFileProvider) Wrap(dek []byte) ([]byte, error) {
+	return sealKey(p.kek, dek)
+}
+
+func (p *keyFileProvider) Unwrap(wrapped []byte) ([]byte, error) {
+	return openKey(p.kek, wrapped)
+}
+
+// passphraseProvider 以 PBKDF2-HMAC-SHA256 从口令派生 KEK。
+// 包装结果为：迭代次数（4 字节大端）| 盐 | nonce | 密文。
+type passphraseProvider struct {
+	label      string
+	passphrase []byte
+	iterations int
+}
+
+// NewPassphraseProvider 返回由口令派生 KEK 的 KeyProvider，ID 为 "passphrase:" + label。
+// label 区分不同的口令：使用不同口令的镜像（或 Rekey 前后的口令）需要不同的 label，
+// 才能同时注册到一个 Manager。
+// iterations 为 0 时默认 600000；解包时使用包装时记录的迭代次数与盐。
+func NewPassphraseProvider(label, passphrase string, iterations int) (KeyProvider, error) {
+	if strings.TrimSpace(label) == "" {
+		return nil, errors.New("passphrase label must not be empty")
+	}
+	if passphrase == "" {
+		return nil, errors.New("passphrase must not be empty")
+	}
+	if iterations < 0 {
+		return nil, errors.New("iterations must not be negative")
+	}
+	if iterations == 0 {
+		iterations = defaultPassphraseIterations
+	}
+	return &passphraseProvider{label: label, passphrase: []byte(passphrase), iterations: iterations}, nil
+}
+
+func (p *passphraseProvider) ID() string {
+	return "passphrase:" + p.label
+}
+
+func (p *passphraseProvider) Wrap(dek []byte) ([]byte, error) {
+	header := make([]byte, 4+passphraseSaltSize)
+	binary.BigEndian.PutUint32(header[:4], uint32(p.iterations))
+	if _, err := rand.Read(header[4:]); err != nil {
+		return nil, err
+	}
+	kek := pbkdf2SHA256(p.passphrase, header[4:], p.iterations, aes256KeySize)
+	sealed, err := sealKey(kek, dek)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+func (p *passphraseProvider) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 4+passphraseSaltSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	iterations := int(binary.BigEndian.Uint32(wrapped[:4]))
+	if iterations == 0 {
+		return nil, errors.New("invalid wrapped key iterations")
+	}
+	salt := wrapped[4 : 4+passphraseSaltSize]
+	kek := pbkdf2SHA256(p.passphrase, salt, iterations, aes256KeySize)
+	dek, err := openKey(kek, wrapped[4+passphraseSaltSize:])
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupt wrapped key")
+	}
+	return dek, nil
+}
+
+// kmsProvider 委托 KMS 包装 DEK。
+type kmsProvider struct {
+	kms   KMS
+	keyID string
+}
+
+// NewKMSProvider 返回使用 KMS 中 keyID 对应密钥的 KeyProvider。
+func NewKMSProvider(kms KMS, keyID string) (KeyProvider, error) {
+	if kms == nil {
+		return nil, errors.New("kms must not be nil")
+	}
+	if strings.TrimSpace(keyID) == "" {
+		return nil, errors.New("kms key id must not be empty")
+	}
+	return &kmsProvider{kms: kms, keyID: keyID}, nil
+}
+
+func (p *kmsProvider) ID() string {
+	return "kms:" + p.keyID
+}
+
+func (p *kmsProvider) Wrap(dek []byte) ([]byte, error) {
+	return p.kms.Encrypt(p.keyID, dek)
+}
+
+func (p *kmsProvider) Unwrap(wrapped []byte) ([]byte, error) {
+	return p.kms.Decrypt(p.keyID, wrapped)
+}
+
+// sealKey 以 AES-256-GCM 加密 DEK，返回 nonce | 密文。
+func sealKey(kek, dek []byte) ([]byte, error) {
+	gcm, err := newKeyGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dek, wrapKeyAAD), nil
+}
+
+func openKey(kek, sealed []byte) ([]byte, error) {
+	gcm, err := newKeyGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, sealed[:n], sealed[n:], wrapKeyAAD)
+}
+
+func newKeyGCM(kek []byte) (cipher.AEAD, error) {
+	if len(kek) != aes256KeySize {
+		return nil, fmt.Errorf("invalid key encryption key size: %d", len(kek))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 实现 RFC 8018 中的 PBKDF2，PRF 为 HMAC-SHA256。
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	var counter [4]byte
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for i := 2; i <= iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+/*********************** Key management *************************/
+
+// AddKeyProvider 注册 KeyProvider，打开 META 中记录了相同 ID 的镜像时使用。
+// 相同 ID 的 KeyProvider 会被替换。
+func (m *manager) AddKeyProvider(p KeyProvider) {
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	if m.keys == nil {
+		m.keys = make(map[string]KeyProvider)
+	}
+	m.keys[p.ID()] = p
+}
+
+func (m *manager) keyProvider(id string) KeyProvider {
+	m.keysMu.RLock()
+	defer m.keysMu.RUnlock()
+	return m.keys[id]
+}
+
+// wrapEncryptionKey 将 DEK 包装后写入 info，并清除 DEK 原文。
+func wrapEncryptionKey(info *storagePrivateInfo, p KeyProvider, dek []byte) error {
+	wrapped, err := p.Wrap(dek)
+	if err != nil {
+		return fmt.Errorf("wrap data key: %v", err)
+	}
+	info.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+	info.KeyProvider = p.ID()
+	info.EncryptionKey = ""
+	return nil
+}
+
+// loadEncryptionKey 返回镜像的 DEK：包装过的 DEK 由已注册的 KeyProvider 解包，
+// 否则读取旧格式中的 DEK 原文。
+func (m *manager) loadEncryptionKey(v *VImg, info storagePrivateInfo) ([]byte, error) {
+	if v.Encryption != EncryptionAES256 || info.WrappedKey == "" {
+		return decodeStoredEncryptionKey(v, info)
+	}
+
+	p := m.keyProvider(info.KeyProvider)
+	if p == nil {
+		return nil, fmt.Errorf("no key provider registered for %q (image %s)", info.KeyProvider, v.Guid)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(info.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key encoding: %v", err)
+	}
+	dek, err := p.Unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key of image %s: %v", v.Guid, err)
+	}
+	if len(dek) != aes256KeySize {
+		return nil, fmt.Errorf("invalid encryption key size: got %d, want %d", len(dek), aes256KeySize)
+	}
+	return dek, nil
+}
+
+// Rekey 用 p 重新包装本层的 DEK 并原子地更新 META，DATA 保持不变。
+// 旧格式（META 中保存 DEK 原文）的镜像经 Rekey 后不再保存原文。
+func (img *image) Rekey(p KeyProvider) error {
+	if p == nil {
+		return errors.New("key provider must not be nil")
+	}
+	if img.meta.Encryption == EncryptionNone {
+		return errors.New("image is not encrypted")
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	old := img.meta.StoragePrivateInfo
+	info, err := getStoragePrivateInfo(img.meta)
+	if err != nil {
+		return err
+	}
+	if err := wrapEncryptionKey(&info, p, img.encryptionKey); err != nil {
+		return err
+	}
+	if err := setStoragePrivateInfo(img.meta, info); err != nil {
+		return err
+	}
+	if err := writeJSON(img.mgr.store, img.metaPath, img.meta); err != nil {
+		img.meta.StoragePrivateInfo = old
+		return err
+	}
+
+	img.mgr.AddKeyProvider(p)
+	return nil
+}
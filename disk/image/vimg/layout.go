@@ -0,0 +1,162 @@
+package vimg
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kisun-bit/drpkg/disk/image/storage"
+)
+
+const (
+	// LayoutDir 下镜像目录内的文件名。
+	dirMetaName = "META"
+	dirDataName = "DATA"
+	dirIdxName  = "IDX"
+
+	// defaultDataSegmentSize LayoutDir 下 DATA 单个分段文件的默认大小。
+	defaultDataSegmentSize = 1 << 30
+)
+
+// imageNames 是一个镜像的 META / DATA / IDX 名称。
+// LayoutDir 下 DATA 为分段文件的公共前缀，实际文件为 DATA.000000、DATA.000001 …
+type imageNames struct {
+	meta, data, idx string
+}
+
+// newImageNames 返回新镜像的名称，base 为 Join(dir, guid)。
+func newImageNames(st storage.Store, layout Layout, base string) imageNames {
+	if layout == LayoutDir {
+		return imageNames{
+			meta: st.Join(base, dirMetaName),
+			data: st.Join(base, dirDataName),
+			idx:  st.Join(base, dirIdxName),
+		}
+	}
+	return imageNames{meta: base + ".META", data: base + ".DATA", idx: base + ".IDX"}
+}
+
+// namesFromMeta 由 META 名称推导同一镜像第 gen 代的 DATA / IDX 名称。
+func namesFromMeta(st storage.Store, layout Layout, meta string, gen uint64) imageNames {
+	var n imageNames
+	if layout == LayoutDir {
+		n = newImageNames(st, layout, st.Dir(meta))
+	} else {
+		n = imageNames{meta: meta, data: replaceExt(meta, ".DATA"), idx: replaceExt(meta, ".IDX")}
+	}
+	return n.generation(gen)
+}
+
+// generation 返回第 gen 代的名称：第 0 代不带后缀，之后为 DATA.g1、IDX.g1 …
+// 每次 Compact 写出新一代 DATA / IDX，并通过更新 META 原子地切换。
+func (n imageNames) generation(gen uint64) imageNames {
+	if gen == 0 {
+		return n
+	}
+	suffix := fmt.Sprintf(".g%d", gen)
+	n.data += suffix
+	n.idx += suffix
+	return n
+}
+
+// layoutOfMeta 依据 META 名称判断布局：LayoutDir 的 META 固定为 {guid}/META。
+func layoutOfMeta(st storage.Store, meta string) Layout {
+	if st.Join(st.Dir(meta), dirMetaName) == meta {
+		return LayoutDir
+	}
+	return LayoutFile
+}
+
+// imagesRoot 返回镜像所在的存放目录（即创建时的 CreateOptions.Dir）。
+func imagesRoot(st storage.Store, meta string) string {
+	if layoutOfMeta(st, meta) == LayoutDir {
+		return st.Dir(st.Dir(meta))
+	}
+	return st.Dir(meta)
+}
+
+func dataSegmentSize(v *VImg) int64 {
+	if v.DataSegmentSize == 0 {
+		return defaultDataSegmentSize
+	}
+	return int64(v.DataSegmentSize)
+}
+
+// createData 创建空的 DATA。
+func createData(st storage.Store, v *VImg, name string) (storage.Object, error) {
+	if v.Layout == LayoutDir {
+		return storage.CreateSegmented(st, name, dataSegmentSize(v))
+	}
+	return st.Create(name)
+}
+
+// openData 打开已有的 DATA。
+func openData(st storage.Store, v *VImg, name string) (storage.Object, error) {
+	if v.Layout == LayoutDir {
+		return storage.OpenSegmented(st, name, dataSegmentSize(v))
+	}
+	return st.Open(name)
+}
+
+// removeImage 删除镜像的全部文件；LayoutDir 下同时删除镜像目录。
+// 除当前一代外，也会清理 Compact 中断时可能残留的上一代与下一代。
+func removeImage(st storage.Store, meta string) {
+	layout := layoutOfMeta(st, meta)
+	var gen uint64
+	v := &VImg{}
+	if err := readJSON(st, meta, v); err == nil {
+		gen = v.Generation
+	}
+	for g := gen + 1; ; g-- {
+		removeGeneration(st, layout, namesFromMeta(st, layout, meta, g))
+		if g == 0 || g+1 == gen {
+			break
+		}
+	}
+	_ = st.Remove(meta)
+	if layout == LayoutDir {
+		_ = st.Remove(st.Dir(meta))
+	}
+}
+
+// removeGeneration 删除一代 DATA / IDX。
+func removeGeneration(st storage.Store, layout Layout, names imageNames) {
+	if layout == LayoutDir {
+		_ = storage.RemoveSegmented(st, names.data)
+	} else {
+		_ = st.Remove(names.data)
+	}
+	_ = st.Remove(names.idx)
+}
+
+// guessMetaFromGuid 在当前镜像的存放目录中按 GUID 查找父镜像 META，
+// 两种布局都会尝试；都不存在时返回与当前镜像布局相同的候选。
+func guessMetaFromGuid(st storage.Store, curMeta, guid string) string {
+	root := imagesRoot(st, curMeta)
+	candidates := []string{
+		st.Join(root, guid+".META"),
+		st.Join(root, guid, dirMetaName),
+	}
+	if layoutOfMeta(st, curMeta) == LayoutDir {
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+	}
+	for _, c := range candidates {
+		if _, err := st.ReadFile(c); err == nil {
+			return c
+		} else if !os.IsNotExist(err) {
+			break
+		}
+	}
+	return candidates[0]
+}
+
+// backingRef 返回写入 StoragePrivateInfo 的父镜像引用。
+// LayoutDir 记录相对于镜像目录的路径，整条链可以作为目录整体移动或复制。
+func backingRef(st storage.Store, layout Layout, curMeta, backingMeta string) string {
+	if layout != LayoutDir {
+		return backingMeta
+	}
+	if rel, err := st.Rel(st.Dir(curMeta), backingMeta); err == nil {
+		return rel
+	}
+	return backingMeta
+}
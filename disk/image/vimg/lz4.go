@@ -0,0 +1,178 @@
+package vimg
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// LZ4 块格式（block format）的最小实现，仅用于 Cluster 负载压缩。
+//
+// 每个序列由 token、字面量与匹配组成：
+//   - token 高 4 位为字面量长度，低 4 位为匹配长度减 4，取值 15 时后续以 255 累加扩展；
+//   - 匹配偏移为 2 字节小端，范围 [1, 65535]；
+//   - 最后一个序列只有字面量；末尾 5 字节必须为字面量，且最后一个匹配须在末尾 12 字节之前开始。
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 14
+)
+
+var errLZ4Corrupt = errors.New("lz4: corrupt block")
+
+// lz4CompressBound 返回长度为 n 的输入压缩后的最大长度。
+func lz4CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4CompressBlock 将 src 压缩为一个 LZ4 块（贪心匹配，单哈希表）。
+func lz4CompressBlock(src []byte) []byte {
+	dst := make([]byte, 0, lz4CompressBound(len(src)))
+	anchor := 0
+
+	if len(src) > lz4MFLimit {
+		var table [1 << lz4HashLog]int32 // 位置 + 1，0 表示空
+		limit := len(src) - lz4MFLimit
+		matchLimit := len(src) - lz4LastLiterals
+
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := lz4Hash(seq)
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+
+			if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				// 不可压缩的数据逐渐加大步长，避免逐字节探测。
+				i += 1 + (i-anchor)>>6
+				continue
+			}
+
+			// 向前扩展匹配。
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+
+			// 向后扩展匹配。
+			end := i + lz4MinMatch
+			for end < matchLimit && src[end] == src[ref+end-i] {
+				end++
+			}
+
+			dst = lz4AppendSequence(dst, src[anchor:i], i-ref, end-i-lz4MinMatch)
+			i = end
+			anchor = end
+		}
+	}
+
+	// 最后一个序列：仅字面量。
+	lit := src[anchor:]
+	dst = append(dst, lz4Token(len(lit), 0))
+	dst = lz4AppendLength(dst, len(lit))
+	return append(dst, lit...)
+}
+
+func lz4AppendSequence(dst, lit []byte, offset, matchLen int) []byte {
+	dst = append(dst, lz4Token(len(lit), matchLen))
+	dst = lz4AppendLength(dst, len(lit))
+	dst = append(dst, lit...)
+	dst = append(dst, byte(offset), byte(offset>>8))
+	return lz4AppendLength(dst, matchLen)
+}
+
+func lz4Token(litLen, matchLen int) byte {
+	if litLen > 15 {
+		litLen = 15
+	}
+	if matchLen > 15 {
+		matchLen = 15
+	}
+	return byte(litLen<<4 | matchLen)
+}
+
+// lz4AppendLength 写出长度 n 超出 token 中 15 的部分。
+func lz4AppendLength(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	n -= 15
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock 将 LZ4 块解压到 dst，返回写入的字节数。
+// 输出超出 dst 容量或输入格式非法时返回错误，不会越界访问。
+func lz4DecompressBlock(src, dst []byte) (int, error) {
+	si, di := 0, 0
+	for {
+		if si >= len(src) {
+			return 0, errLZ4Corrupt
+		}
+		token := src[si]
+		si++
+
+		lit, ok := lz4ReadLength(src, &si, int(token>>4))
+		if !ok || lit > len(src)-si || lit > len(dst)-di {
+			return 0, errLZ4Corrupt
+		}
+		di += copy(dst[di:], src[si:si+lit])
+		si += lit
+		if si == len(src) {
+			return di, nil
+		}
+
+		if len(src)-si < 2 {
+			return 0, errLZ4Corrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return 0, errLZ4Corrupt
+		}
+
+		matchLen, ok := lz4ReadLength(src, &si, int(token&15))
+		if !ok {
+			return 0, errLZ4Corrupt
+		}
+		matchLen += lz4MinMatch
+		if matchLen > len(dst)-di {
+			return 0, errLZ4Corrupt
+		}
+
+		start := di - offset
+		if offset >= matchLen {
+			di += copy(dst[di:di+matchLen], dst[start:start+matchLen])
+		} else {
+			// 重叠拷贝（如游程），必须逐字节进行。
+			for k := 0; k < matchLen; k++ {
+				dst[di+k] = dst[start+k]
+			}
+			di += matchLen
+		}
+	}
+}
+
+func lz4ReadLength(src []byte, si *int, n int) (int, bool) {
+	if n != 15 {
+		return n, true
+	}
+	for {
+		if *si >= len(src) || n > len(src)*255 {
+			return 0, false
+		}
+		b := src[*si]
+		*si++
+		n += int(b)
+		if b != 255 {
+			return n, true
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package vimg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/*********************** Resize *************************/
+
+// 链中各层的 VirtualSize 可以不同：每一层只提供 [0, VirtualSize) 中的数据，
+// 超出部分（包括末尾不完整 Cluster 的剩余部分）读取为 0，不会再向 backing 查找。
+
+// Resize 将虚拟磁盘大小调整为 newSize，可在读写期间进行。
+//
+// 扩大时新增区间读取为全 0：backing 在该区间有数据时，本层记录零标记将其覆盖。
+// 缩小时被移除的区间 [newSize, VirtualSize) 必须读取为全 0，否则返回错误且不做修改，
+// 需要缩小时可先对该区间执行 Discard。
+// 因此调整前后，以本镜像为 backing 的子镜像读取到的数据不变。
+//
+// 同一镜像的其他句柄（包括以它为 backing 打开的链）需要重新打开才能看到新的大小。
+func (img *image) Resize(newSize uint64) error {
+	if newSize == 0 {
+		return errors.New("virtual size must be positive")
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if err := img.takeFlushErr(); err != nil {
+		return err
+	}
+	if err := img.loadIndexNoLock(); err != nil {
+		return err
+	}
+	return img.resizeNoLock(newSize)
+}
+
+func (img *image) resizeNoLock(newSize uint64) error {
+	oldSize := img.meta.VirtualSize
+	switch {
+	case newSize == oldSize:
+		return nil
+	case newSize > oldSize:
+		if err := img.maskGrowNoLock(oldSize, newSize); err != nil {
+			return err
+		}
+	default:
+		if err := img.checkShrinkNoLock(newSize); err != nil {
+			return err
+		}
+	}
+
+	// 扩大时写入的零标记必须先于 META 持久化。
+	if err := img.flushNoLock(); err != nil {
+		return err
+	}
+	img.meta.VirtualSize = newSize
+	if err := writeJSON(img.mgr.store, img.metaPath, img.meta); err != nil {
+		img.meta.VirtualSize = oldSize
+		return err
+	}
+	return nil
+}
+
+// maskGrowNoLock 在扩大前调用，使 [oldSize, newSize) 扩大后仍读取为 0：
+// 本层或 backing 在该区间有数据的 Cluster 以扩大前的读取结果重写。
+func (img *image) maskGrowNoLock(oldSize, newSize uint64) error {
+	clusterSize := uint64(img.meta.ClusterSize)
+	first := oldSize / clusterSize
+	end := (newSize + clusterSize - 1) / clusterSize
+
+	// 只考虑本层索引项，本层之下的各层按扩大后的大小截断。
+	clusters := make(map[uint64]struct{})
+	for idx := range img.index {
+		if idx >= first && idx < end {
+			clusters[idx] = struct{}{}
+		}
+	}
+	if img.backing != nil {
+		img.backing.mu.RLock()
+		collectAllocated(img.backing, first, end, nil, clusters)
+		img.backing.mu.RUnlock()
+	}
+
+	grown := make([]byte, clusterSize)
+	for _, idx := range sortedClusters(clusters) {
+		found, err := img.readLocalCluster(idx, grown)
+		if err != nil {
+			return err
+		}
+		if !found {
+			fillZero(grown)
+			if img.backing != nil {
+				if err := img.backing.readClusterWithLock(idx, grown); err != nil {
+					return err
+				}
+			}
+		}
+
+		// 扩大前的读取结果：oldSize 之后为 0。
+		from := uint64(0)
+		if start := idx * clusterSize; start < oldSize {
+			from = oldSize - start
+		}
+		if isZero(grown[from:]) {
+			continue
+		}
+		fillZero(grown[from:])
+		if err := img.writeCluster(idx, grown); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkShrinkNoLock 确认 [newSize, VirtualSize) 读取为全 0。
+func (img *image) checkShrinkNoLock(newSize uint64) error {
+	clusterSize := uint64(img.meta.ClusterSize)
+	first := newSize / clusterSize
+	end := (img.meta.VirtualSize + clusterSize - 1) / clusterSize
+
+	clusters := make(map[uint64]struct{})
+	collectAllocated(img, first, end, nil, clusters)
+
+	buf := make([]byte, clusterSize)
+	for _, idx := range sortedClusters(clusters) {
+		if err := img.readCluster(idx, buf); err != nil {
+			return err
+		}
+		from := uint64(0)
+		if start := idx * clusterSize; start < newSize {
+			from = newSize - start
+		}
+		for i, b := range buf[from:] {
+			if b != 0 {
+				return fmt.Errorf("cannot shrink to %d: data at offset %d would be lost, discard the range first",
+					newSize, idx*clusterSize+from+uint64(i))
+			}
+		}
+	}
+	return nil
+}
+
+// collectAllocated 将 [first, end) 中从 img 到 stop（不含，nil 表示整条链）
+// 各层有索引项的 Cluster 加入 clusters，每一层截断其下各层的范围。
+// 其余 Cluster 经由 img 读取为 0（或来自 stop）。调用方持有 img 的锁。
+func collectAllocated(img *image, first, end uint64, stop *image, clusters map[uint64]struct{}) {
+	for l := img; l != nil && l != stop; l = l.backing {
+		if l != img {
+			l.mu.RLock()
+		}
+		clusterSize := uint64(l.meta.ClusterSize)
+		if n := (l.meta.VirtualSize + clusterSize - 1) / clusterSize; n < end {
+			end = n
+		}
+		l.indexMu.Lock()
+		for idx := range l.index {
+			if idx >= first && idx < end {
+				clusters[idx] = struct{}{}
+			}
+		}
+		l.indexMu.Unlock()
+		if l != img {
+			l.mu.RUnlock()
+		}
+	}
+}
+
+func sortedClusters(clusters map[uint64]struct{}) []uint64 {
+	list := make([]uint64, 0, len(clusters))
+	for idx := range clusters {
+		list = append(list, idx)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
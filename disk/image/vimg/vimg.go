@@ -7,7 +7,8 @@ const (
 	// StorageTypeFilesystem 表示镜像存储在本地文件系统中。
 	StorageTypeFilesystem StorageType = iota
 
-	// StorageTypeS3 表示镜像存储在 S3 兼容的对象存储中。
+	// StorageTypeS3 表示镜像存储在 S3 兼容的对象存储中（见 NewS3Manager）。
+	// DATA / IDX 以分段对象追加写入、以 ranged GET 读取，META 为单个对象。
 	StorageTypeS3
 )
 
@@ -23,12 +24,15 @@ const (
 	//   vimg_xxx.META
 	LayoutFile Layout = iota
 
-	// FIXME: 当前版本暂不实现
 	// LayoutDir 表示“目录布局”：
 	// 每个镜像为一个目录，目录名为 {guid}，内部包含：
-	//   DATA  数据文件
-	//   IDX   索引文件
-	//   META  元数据文件
+	//   META        元数据文件
+	//   IDX         索引文件
+	//   DATA.000000 数据文件，按 DataSegmentSize 切分为固定大小的分段，
+	//   DATA.000001 只有最后一个分段可以不满
+	//   ...
+	// 父镜像以相对于镜像目录的路径记录（如 ../vimg_yyy/META），
+	// 因此整条链可以作为目录整体移动或复制。
 	LayoutDir
 )
 
@@ -39,7 +43,8 @@ const (
 	// CompressionNone 表示不进行压缩。
 	CompressionNone Compression = iota
 
-	// CompressionLZ4 表示使用 LZ4 压缩。
+	// CompressionLZ4 表示使用 LZ4 压缩（块格式）。
+	// 压缩后不能节省空间的 Cluster 按原文存储，由帧标志区分。
 	CompressionLZ4
 )
 
@@ -82,9 +87,12 @@ const (
 //   - 顺序追加写入 Cluster（不允许覆盖写）。
 //   - 每次写入必须对齐并写满一个 Cluster：
 //     若写入数据不足一个 Cluster，需要从 Backing 镜像读取剩余部分补齐。
+//   - 重写 Cluster 留下的失效数据由 Image.Compact 回收（见 Image.SpaceUsage）。
+//   - 全 0 的 Cluster 不写入 DATA，只在 IDX 中记录零标记（见 IndexEntry）。
 //
 // IDX：
 //   - 顺序追加写入 IndexEntry，用于定位 DATA 中的 Cluster。
+//   - 索引项只在其引用的 DATA 落盘后才追加写入（见 Durability）。
 //   - 查找逻辑：
 //     若 IDX 中存在该 Cluster → 从 DATA 读取
 //     若不存在：
@@ -106,6 +114,13 @@ type VImg struct {
 	// ClusterSize 数据块大小（字节），必须 512 对齐。
 	ClusterSize uint32 `json:"clusterSize"`
 
+	// DataSegmentSize DATA 分段文件大小（字节），仅用于 LayoutDir。
+	DataSegmentSize uint64 `json:"dataSegmentSize,omitempty"`
+
+	// Generation 当前 DATA / IDX 的代数，每次 Compact 加一。
+	// 第 0 代文件不带后缀，第 n 代为 {DATA}.g{n}、{IDX}.g{n}。
+	Generation uint64 `json:"generation,omitempty"`
+
 	// Guid 镜像唯一标识。
 	// 格式为："vimg_" + 32位十六进制字符串（UUID 去除连字符）。
 	Guid string `json:"guid"`
@@ -131,6 +146,8 @@ type VImg struct {
 	//   - 建议包含 "version" 字段，用于兼容未来扩展。
 	//   - 所有路径 / key 指向“当前镜像的 META 文件”。
 	//   - backingXXX 字段用于指向父镜像的 META 文件（可选）。
+	//   - EncryptionAES256 时，"wrappedKey" 为由 "keyProvider"（KeyProvider.ID()）包装的数据密钥；
+	//     旧格式在 "encryptionKey" 中保存密钥原文。
 	//
 	// 当 StorageType 为 StorageTypeFilesystem 时：
 	// {
@@ -156,6 +173,12 @@ type VImg struct {
 	//   "secure":     true,     // 是否使用 HTTPS（默认 true）
 	//   "timeoutSec": 30        // 请求超时（秒，可选）
 	// }
+	//
+	// S3 中的对象布局（以 key 前缀 pool/ 为例）：
+	//   pool/vimg_xxx.META                      META 对象
+	//   pool/vimg_xxx.DATA                      空标记对象
+	//   pool/vimg_xxx.DATA.seg/{16 位十六进制偏移}  DATA 分段
+	//   pool/vimg_xxx.IDX、pool/vimg_xxx.IDX.seg/… 同上
 	StoragePrivateInfo string `json:"storagePrivateInfo"`
 }
 
@@ -186,6 +209,7 @@ type IndexEntry struct {
 	OffsetInDATA uint64
 
 	// LengthInDATA 数据块在 DATA 文件中的长度（字节）。
+	// 为 0 表示零标记：该 Cluster 为全 0，不占用 DATA，读取时也不再查找 backing。
 	LengthInDATA uint32
 }
 
@@ -201,6 +225,11 @@ const (
 
 	// MapSourceZero 表示该区间没有任何层提供数据，读取结果应为全 0。
 	MapSourceZero
+
+	// MapSourceZeroed 表示该区间被某一层显式记录为全 0（写入全 0 或 Discard），
+	// 读取结果为全 0，OwnerGuid 为记录零标记的镜像。
+	// 与 MapSourceZero 一样，还原精简磁盘时可以跳过。
+	MapSourceZeroed
 )
 
 // MapSegment 表示一个连续字节区间在逻辑上的数据来源映射。
@@ -210,7 +239,7 @@ type MapSegment struct {
 	Source MapSource `json:"source"`
 
 	// OwnerGuid 为提供数据的镜像 GUID。
-	// 当 Source=MapSourceZero 时为空字符串。
+	// 当 Source=MapSourceZero 时为空字符串；MapSourceZeroed 时为记录零标记的镜像。
 	OwnerGuid string `json:"ownerGuid,omitempty"`
 }
 
@@ -2,10 +2,19 @@ package vimg
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/kisun-bit/drpkg/disk/image/storage"
+	"github.com/kisun-bit/drpkg/disk/image/storage/s3test"
 )
 
 func newTestDir(t *testing.T) string {
@@ -1046,3 +1055,1740 @@ func TestNoLeakBeyondIntermediateBackingSize(t *testing.T) {
 		t.Fatalf("unexpected map result: %+v", segs)
 	}
 }
+
+/************** LZ4 压缩 **************/
+
+func TestLZ4RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 64<<10)
+	rnd.Read(random)
+	text := bytes.Repeat([]byte("vimg cluster payload, mostly repetitive; "), 2000)
+	mixed := append(append([]byte(nil), random[:5000]...), make([]byte, 20000)...)
+	mixed = append(mixed, text[:7000]...)
+
+	inputs := map[string][]byte{
+		"empty":   {},
+		"short":   []byte("abc"),
+		"mflimit": []byte("aaaaaaaaaaaaa"),
+		"zeros":   make([]byte, 64<<10),
+		"random":  random,
+		"text":    text,
+		"mixed":   mixed,
+	}
+	for name, in := range inputs {
+		c := lz4CompressBlock(in)
+		if len(c) > lz4CompressBound(len(in)) {
+			t.Fatalf("%s: compressed %d bytes beyond bound %d", name, len(c), lz4CompressBound(len(in)))
+		}
+		out := make([]byte, len(in))
+		n, err := lz4DecompressBlock(c, out)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(out[:n], in) {
+			t.Fatalf("%s: round trip mismatch", name)
+		}
+	}
+	if c := lz4CompressBlock(make([]byte, 64<<10)); len(c) > 1024 {
+		t.Fatalf("zeros compressed to %d bytes", len(c))
+	}
+
+	// 损坏或截断的输入只能返回错误，不能越界。
+	c := lz4CompressBlock(mixed)
+	out := make([]byte, len(mixed))
+	for i := 0; i < 2000; i++ {
+		bad := append([]byte(nil), c...)
+		bad[rnd.Intn(len(bad))] ^= byte(1 + rnd.Intn(255))
+		bad = bad[:rnd.Intn(len(bad)+1)]
+		_, _ = lz4DecompressBlock(bad, out)
+	}
+	if _, err := lz4DecompressBlock(c, out[:100]); err == nil {
+		t.Fatal("expected error when output buffer is too small")
+	}
+}
+
+func newCompressedImage(t *testing.T, dir string, enc Encryption) (*Image, string) {
+	m := NewManager()
+	v, err := m.Create(CreateOptions{
+		Dir:         dir,
+		VirtualSize: 1 << 20,
+		ClusterSize: 4096,
+		Compression: CompressionLZ4,
+		Encryption:  enc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath, err := getMetaPath(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := m.Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img, metaPath
+}
+
+func TestCompressedReadWrite(t *testing.T) {
+	for _, enc := range []Encryption{EncryptionNone, EncryptionAES256} {
+		dir := newTestDir(t)
+		img, metaPath := newCompressedImage(t, dir, enc)
+
+		text := bytes.Repeat([]byte("compressible backup data "), 8*4096/25+1)[:8*4096]
+		random := make([]byte, 2*4096)
+		rand.New(rand.NewSource(2)).Read(random)
+
+		if err := (*img).WriteAt(text, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := (*img).WriteAt(random, 16*4096); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]byte, len(text))
+		if err := (*img).ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, text) {
+			t.Fatalf("enc=%d: compressed data mismatch", enc)
+		}
+		got = make([]byte, len(random))
+		if err := (*img).ReadAt(got, 16*4096); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, random) {
+			t.Fatalf("enc=%d: raw fallback data mismatch", enc)
+		}
+
+		// 可压缩的 cluster 带压缩标志，随机数据回退为原文存储。
+		impl := (*img).(*image)
+		for idx, wantCompressed := range map[uint64]bool{0: true, 7: true, 16: false, 17: false} {
+			e := impl.index[idx]
+			stored := make([]byte, e.LengthInDATA)
+			if _, err := impl.dataFile.ReadAt(stored, int64(e.OffsetInDATA)); err != nil {
+				t.Fatal(err)
+			}
+			compressed := len(stored) >= clusterFrameHeaderSize &&
+				binary.LittleEndian.Uint32(stored) == clusterFrameMagic &&
+				stored[5]&clusterFrameFlagCompressed != 0
+			if compressed != wantCompressed {
+				t.Fatalf("enc=%d cluster %d: compressed=%v, stored %d bytes", enc, idx, compressed, len(stored))
+			}
+			if wantCompressed && len(stored) >= 4096/4 {
+				t.Fatalf("enc=%d cluster %d: stored %d bytes, expected a much smaller frame", enc, idx, len(stored))
+			}
+		}
+		if err := (*img).Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if enc == EncryptionAES256 {
+			raw, err := os.ReadFile(replaceExt(metaPath, ".DATA"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(raw, []byte("compressible backup")) || bytes.Contains(raw, random[:64]) {
+				t.Fatal("raw DATA file unexpectedly contains plaintext payload")
+			}
+		}
+	}
+}
+
+func TestMixedCompressionFrames(t *testing.T) {
+	dir := newTestDir(t)
+	img, v := newImage(t, dir)
+	metaPath, _ := getMetaPath(v)
+
+	old := bytes.Repeat([]byte{0xAB}, 4096)
+	if err := (*img).WriteAt(old, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 已有镜像改为启用压缩：旧的原文帧与新的压缩帧混合存在。
+	v.Compression = CompressionLZ4
+	if err := writeJSON(storage.NewFileStore(), metaPath, v); err != nil {
+		t.Fatal(err)
+	}
+	img, err := NewManager().Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := bytes.Repeat([]byte{0xCD}, 4096)
+	if err := (*img).WriteAt(newer, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭压缩后依然能读取压缩帧。
+	v.Compression = CompressionNone
+	if err := writeJSON(storage.NewFileStore(), metaPath, v); err != nil {
+		t.Fatal(err)
+	}
+	img, err = NewManager().Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*img).Close()
+	got := make([]byte, 2*4096)
+	if err := (*img).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:4096], old) || !bytes.Equal(got[4096:], newer) {
+		t.Fatal("mixed frame read mismatch")
+	}
+}
+
+/************** S3 存储 **************/
+
+func TestS3Storage(t *testing.T) {
+	srv := s3test.NewServer("vimg")
+	defer srv.Close()
+
+	m, err := NewS3Manager(storage.S3Config{
+		Endpoint:    srv.URL,
+		AccessKey:   s3test.AccessKey,
+		SecretKey:   s3test.SecretKey,
+		Bucket:      "vimg",
+		SegmentSize: 64 << 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseV, err := m.Create(CreateOptions{
+		Dir:         "pool/images",
+		VirtualSize: 1 << 20,
+		ClusterSize: 4096,
+		Compression: CompressionLZ4,
+		Encryption:  EncryptionAES256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseV.StorageType != StorageTypeS3 {
+		t.Fatalf("storage type = %d", baseV.StorageType)
+	}
+	baseMeta, err := getMetaPath(baseV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseMeta != "pool/images/"+baseV.Guid+".META" {
+		t.Fatalf("meta key = %q", baseMeta)
+	}
+	if _, ok := srv.Object("vimg", baseMeta); !ok {
+		t.Fatal("META object not written")
+	}
+
+	base, err := m.Open(baseMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseData := bytes.Repeat([]byte("base layer "), 3000)
+	if err := (*base).WriteAt(baseData, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*base).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := srv.Keys("vimg", baseMeta[:len(baseMeta)-5]+".DATA.seg/"); len(keys) == 0 {
+		t.Fatal("DATA segments not written")
+	}
+
+	childV, err := m.CreateFromBacking(CreateFromBackingOptions{
+		CreateOptions: CreateOptions{
+			Dir:         "pool/images",
+			VirtualSize: 1 << 20,
+			ClusterSize: 4096,
+		},
+		BackingGuid: baseV.Guid,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	childMeta, _ := getMetaPath(childV)
+
+	child, err := m.Open(childMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := (*child).Backing()
+	if err != nil || ref.MetaPath != baseMeta {
+		t.Fatalf("backing ref = %+v, %v", ref, err)
+	}
+
+	patch := []byte("child patch")
+	if err := (*child).WriteAt(patch, 5000); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte(nil), baseData...)
+	copy(want[5000:], patch)
+
+	ranges := srv.Requests("RANGE")
+	got := make([]byte, len(want))
+	if err := (*child).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("child read mismatch")
+	}
+	if srv.Requests("RANGE") == ranges {
+		t.Fatal("expected DATA reads through ranged GETs")
+	}
+
+	segs, err := (*child).Map(0, 3*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 3 || segs[1].Source != MapSourceData || segs[0].OwnerGuid != baseV.Guid {
+		t.Fatalf("unexpected map: %+v", segs)
+	}
+
+	if err := (*child).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*child).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开父镜像，提交的数据已持久化到对象存储。
+	base, err = m.Open(baseMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, len(want))
+	if err := (*base).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("committed base read mismatch")
+	}
+	if err := (*base).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件系统 Manager 不能打开 S3 镜像。
+	if _, err := NewManager().Open(baseMeta); err == nil {
+		t.Fatal("filesystem manager opened an S3 image")
+	}
+
+	for _, meta := range []string{childMeta, baseMeta} {
+		if err := m.Delete(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := srv.Keys("vimg", ""); len(keys) != 0 {
+		t.Fatalf("objects left after delete: %v", keys)
+	}
+}
+
+/************** 目录布局 **************/
+
+func TestDirLayout(t *testing.T) {
+	root := t.TempDir()
+	pool := root + "/pool"
+	m := NewManager()
+
+	const segSize = 3*4096 + 512
+	baseV, err := m.Create(CreateOptions{
+		Dir:             pool,
+		VirtualSize:     1 << 20,
+		ClusterSize:     4096,
+		Layout:          LayoutDir,
+		DataSegmentSize: segSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseMeta, _ := getMetaPath(baseV)
+	if baseMeta != pool+"/"+baseV.Guid+"/META" {
+		t.Fatalf("meta path = %q", baseMeta)
+	}
+
+	base, err := m.Open(baseMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseData := make([]byte, 10*4096)
+	rand.New(rand.NewSource(3)).Read(baseData)
+	if err := (*base).WriteAt(baseData, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*base).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 个 cluster 切分为 4 个分段，只有最后一个不满。
+	for i := 0; i < 4; i++ {
+		st, err := os.Stat(fmt.Sprintf("%s/%s/DATA.%06d", pool, baseV.Guid, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 && st.Size() != segSize {
+			t.Fatalf("segment %d has %d bytes", i, st.Size())
+		}
+	}
+
+	// 目录布局的子镜像，基于文件布局的中间层。
+	midV, err := m.CreateFromBacking(CreateFromBackingOptions{
+		CreateOptions: CreateOptions{Dir: pool, VirtualSize: 1 << 20, ClusterSize: 4096},
+		BackingGuid:   baseV.Guid,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	midMeta, _ := getMetaPath(midV)
+	childV, err := m.CreateFromBacking(CreateFromBackingOptions{
+		CreateOptions: CreateOptions{Dir: pool, VirtualSize: 1 << 20, ClusterSize: 4096, Layout: LayoutDir},
+		BackingGuid:   midV.Guid,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := getStoragePrivateInfo(childV)
+	if info.BackingFilePath != "../"+midV.Guid+".META" {
+		t.Fatalf("backing ref = %q, want relative path", info.BackingFilePath)
+	}
+
+	childMeta, _ := getMetaPath(childV)
+	child, err := m.Open(childMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := bytes.Repeat([]byte{0x5A}, 6000)
+	if err := (*child).WriteAt(patch, 4000); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*child).Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte(nil), baseData...)
+	copy(want[4000:], patch)
+
+	// 整条链作为目录移动后依然可以打开。
+	moved := root + "/moved"
+	if err := os.Rename(pool, moved); err != nil {
+		t.Fatal(err)
+	}
+	child, err = m.Open(moved + "/" + childV.Guid + "/META")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if err := (*child).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("moved chain read mismatch")
+	}
+	ref, err := (*child).Backing()
+	if err != nil || ref.MetaPath != moved+"/"+midV.Guid+".META" {
+		t.Fatalf("backing ref after move = %+v, %v", ref, err)
+	}
+
+	// 变基到目录布局的 base，跳过中间层。
+	if err := (*child).Rebase(moved + "/" + baseV.Guid + "/META"); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*child).Close(); err != nil {
+		t.Fatal(err)
+	}
+	child, err = m.Open(moved + "/" + childV.Guid + "/META")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*child).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("rebased chain read mismatch")
+	}
+	ref, _ = (*child).Backing()
+	if ref.Guid != baseV.Guid {
+		t.Fatalf("backing after rebase = %+v", ref)
+	}
+	if err := (*child).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, meta := range []string{
+		moved + "/" + childV.Guid + "/META",
+		moved + "/" + midMeta[len(pool)+1:],
+		moved + "/" + baseV.Guid + "/META",
+	} {
+		if err := m.Delete(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("files left after delete: %v", entries)
+	}
+}
+
+/************** 空间回收 **************/
+
+func TestCompact(t *testing.T) {
+	for _, layout := range []Layout{LayoutFile, LayoutDir} {
+		dir := t.TempDir()
+		m := NewManager()
+		v, err := m.Create(CreateOptions{
+			Dir:         dir,
+			VirtualSize: 1 << 20,
+			ClusterSize: 4096,
+			Compression: CompressionLZ4,
+			Encryption:  EncryptionAES256,
+			Layout:      layout,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		metaPath, _ := getMetaPath(v)
+		img, err := m.Open(metaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make([]byte, 8*4096)
+		r := rand.New(rand.NewSource(4))
+		for round := 0; round < 3; round++ {
+			r.Read(want)
+			if err := (*img).WriteAt(want, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		u, err := (*img).SpaceUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.LiveEntries != 8 || u.IndexEntries != 24 || u.DeadRatio < 0.6 || u.DeadBytes+u.LiveBytes != u.DataBytes {
+			t.Fatalf("layout %d: usage before compact: %+v", layout, u)
+		}
+
+		if err := (*img).Compact(); err != nil {
+			t.Fatal(err)
+		}
+		u, err = (*img).SpaceUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.DeadBytes != 0 || u.IndexEntries != 8 || u.LiveEntries != 8 {
+			t.Fatalf("layout %d: usage after compact: %+v", layout, u)
+		}
+		if (*img).Info().Generation != 1 {
+			t.Fatalf("generation = %d", (*img).Info().Generation)
+		}
+
+		got := make([]byte, len(want))
+		if err := (*img).ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("layout %d: read after compact mismatch", layout)
+		}
+
+		// 压缩后继续写入，再次压缩，旧一代文件被删除。
+		if err := (*img).WriteAt(want[:4096], 100*4096); err != nil {
+			t.Fatal(err)
+		}
+		if err := (*img).Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := (*img).Close(); err != nil {
+			t.Fatal(err)
+		}
+		names := namesFromMeta(storage.NewFileStore(), layout, metaPath, 0)
+		for _, name := range []string{names.idx, names.generation(1).idx} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Fatalf("layout %d: old generation %s still exists: %v", layout, name, err)
+			}
+		}
+		if _, err := os.Stat(names.generation(2).idx); err != nil {
+			t.Fatal(err)
+		}
+
+		img, err = m.Open(metaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (*img).ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("layout %d: read after reopen mismatch", layout)
+		}
+		if err := (*img).ReadAt(got[:4096], 100*4096); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:4096], want[:4096]) {
+			t.Fatalf("layout %d: cluster written between compactions mismatch", layout)
+		}
+		if err := (*img).Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.Delete(metaPath); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Fatalf("layout %d: files left after delete: %v", layout, entries)
+		}
+	}
+}
+
+/************** 零标记与 Discard **************/
+
+func TestZeroClusters(t *testing.T) {
+	const clusterSize = 4096
+
+	dir := t.TempDir()
+	m := NewManager()
+
+	base, err := m.Create(CreateOptions{Dir: dir, VirtualSize: 16 * clusterSize, ClusterSize: clusterSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseMeta, _ := getMetaPath(base)
+	baseImg, err := m.Open(baseMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*baseImg).Close()
+
+	// 没有 backing 时写入全 0 不产生任何索引项。
+	zeros := make([]byte, 4*clusterSize)
+	if err := (*baseImg).WriteAt(zeros, 0); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := (*baseImg).SpaceUsage(); u.IndexEntries != 0 || u.DataBytes != 0 {
+		t.Fatalf("zero write on standalone image: %+v", u)
+	}
+
+	pattern := bytes.Repeat([]byte{0x5A}, 8*clusterSize)
+	if err := (*baseImg).WriteAt(pattern, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	child, err := m.CreateFromBacking(CreateFromBackingOptions{
+		CreateOptions:   CreateOptions{Dir: dir, VirtualSize: 16 * clusterSize, ClusterSize: clusterSize},
+		BackingMetaPath: baseMeta,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	childMeta, _ := getMetaPath(child)
+	childImg, err := m.Open(childMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*childImg).Close()
+
+	// 写入全 0 覆盖 backing 中的数据，但不占用 DATA。
+	if err := (*childImg).WriteAt(zeros[:2*clusterSize], 0); err != nil {
+		t.Fatal(err)
+	}
+	// 跨 Cluster 的部分 Discard 只清除区间内的字节。
+	if err := (*childImg).Discard(4*clusterSize+100, clusterSize+200); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]byte(nil), pattern...)
+	fillZero(want[:2*clusterSize])
+	fillZero(want[4*clusterSize+100 : 5*clusterSize+300])
+	got := make([]byte, len(want))
+	if err := (*childImg).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("read after zero write / discard mismatch")
+	}
+
+	u, err := (*childImg).SpaceUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.LiveEntries != 4 || u.LiveBytes != 2*clusterSize {
+		t.Fatalf("child usage: %+v", u)
+	}
+
+	segs, err := (*childImg).Map(0, 4*clusterSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 2 {
+		t.Fatalf("map segments: %+v", segs)
+	}
+	if segs[0].Offset != 0 || segs[0].Length != 2*clusterSize || segs[0].Source != MapSourceZeroed || segs[0].OwnerGuid != child.Guid {
+		t.Fatalf("segment0 mismatch: %+v", segs[0])
+	}
+	if segs[1].Source != MapSourceBacking || segs[1].OwnerGuid != base.Guid {
+		t.Fatalf("segment1 mismatch: %+v", segs[1])
+	}
+
+	// 整 Cluster 的 Discard 在重写后再次生效，Compact 保留零标记。
+	if err := (*childImg).WriteAt(pattern[:clusterSize], 10*clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*childImg).Discard(10*clusterSize, clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*childImg).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := (*childImg).SpaceUsage(); u.LiveEntries != 5 || u.DeadBytes != 0 {
+		t.Fatalf("child usage after compact: %+v", u)
+	}
+	if err := (*childImg).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("read after compact mismatch")
+	}
+
+	// Commit 将零区间合并到 backing。
+	if err := (*childImg).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*baseImg).(*image).loadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*baseImg).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("backing read after commit mismatch")
+	}
+
+	if err := (*childImg).Discard(15*clusterSize, 2*clusterSize); err == nil {
+		t.Fatal("discard beyond virtual size succeeded")
+	}
+}
+
+/************** 完整性检查与修复 **************/
+
+func TestCheck(t *testing.T) {
+	const clusterSize = 4096
+
+	dir := t.TempDir()
+	m := NewManager()
+	opts := CreateOptions{
+		Dir:         dir,
+		VirtualSize: 16 * clusterSize,
+		ClusterSize: clusterSize,
+		Compression: CompressionLZ4,
+	}
+
+	base, err := m.Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseMeta, _ := getMetaPath(base)
+	baseImg, err := m.Open(baseMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basePayload := bytes.Repeat([]byte{0xB0}, 4*clusterSize)
+	if err := (*baseImg).WriteAt(basePayload, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*baseImg).Close()
+
+	child, err := m.CreateFromBacking(CreateFromBackingOptions{CreateOptions: opts, BackingMetaPath: baseMeta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	childMeta, _ := getMetaPath(child)
+	childImg, err := m.Open(childMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 可压缩的数据，保证每个帧都带帧头与 CRC。
+	r := rand.New(rand.NewSource(5))
+	chunk := make([]byte, 64)
+	r.Read(chunk)
+	v1 := bytes.Repeat(chunk, 4*clusterSize/len(chunk))
+	r.Read(chunk)
+	v2 := bytes.Repeat(chunk, 2*clusterSize/len(chunk))
+	// entry 0..3: cluster 0..3；entry 4: cluster 1 的新版本。
+	if err := (*childImg).WriteAt(v1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*childImg).WriteAt(v2[:clusterSize], clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*childImg).Close()
+
+	report, err := m.Check(childMeta, CheckOptions{Chain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.IndexEntries != 5 || report.LiveEntries != 4 || report.Backing == nil || report.Backing.Guid != base.Guid {
+		t.Fatalf("clean chain report: %+v", report)
+	}
+
+	names := namesFromMeta(storage.NewFileStore(), LayoutFile, childMeta, 0)
+	idxData, err := os.ReadFile(names.idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]IndexEntry, 5)
+	if err := binary.Read(bytes.NewReader(idxData), binary.LittleEndian, entries); err != nil {
+		t.Fatal(err)
+	}
+	dataData, err := os.ReadFile(names.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 损坏 cluster 1 的新版本（回退到 entry 1）与 cluster 2 唯一的版本（回退到 backing）。
+	for _, e := range []IndexEntry{entries[4], entries[2]} {
+		dataData[e.OffsetInDATA+uint64(e.LengthInDATA)-1] ^= 0xFF
+	}
+	dataData = append(dataData, "torn data"...)
+	var extra bytes.Buffer
+	for _, e := range []IndexEntry{
+		{ClusterIndex: 5, OffsetInDATA: uint64(len(dataData)), LengthInDATA: 100},  // 超出 DATA
+		{ClusterIndex: 99, OffsetInDATA: 0, LengthInDATA: entries[0].LengthInDATA}, // 超出 VirtualSize
+		{ClusterIndex: 6, OffsetInDATA: entries[3].OffsetInDATA, LengthInDATA: entries[3].LengthInDATA},
+	} {
+		if err := writeStruct(&extra, &e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idxData = append(idxData, extra.Bytes()...)
+	idxData = append(idxData, 1, 2, 3)
+	if err := os.WriteFile(names.data, dataData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(names.idx, idxData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = m.Check(childMeta, CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[CheckIssueKind]int{}
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	want := map[CheckIssueKind]int{
+		CheckIssueTornIndex:  1,
+		CheckIssueTornData:   1,
+		CheckIssueOutOfRange: 1,
+		CheckIssuePastEOF:    1,
+		CheckIssueBadFrame:   2,
+		CheckIssueOverlap:    1,
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) || report.Repaired || report.Backing != nil {
+		t.Fatalf("issues: %+v", report.Issues)
+	}
+	// cluster 1 回退到 entry 1，cluster 2 回退到 backing，cluster 3 与 6 重叠时丢弃较早的 cluster 3。
+	if report.LiveEntries != 3 || report.DroppedEntries != 4 {
+		t.Fatalf("report: %+v", report)
+	}
+	if info, _ := os.Stat(names.idx); info.Size() != int64(len(idxData)) {
+		t.Fatal("check without repair modified IDX")
+	}
+
+	report, err = m.Check(childMeta, CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired {
+		t.Fatalf("not repaired: %+v", report)
+	}
+	if report, err = m.Check(childMeta, CheckOptions{Chain: true}); err != nil || !report.OK() {
+		t.Fatalf("check after repair: %+v, %v", report, err)
+	}
+
+	childImg, err = m.Open(childMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := append([]byte(nil), v1...)
+	copy(expect[2*clusterSize:], basePayload[2*clusterSize:3*clusterSize])
+	copy(expect[3*clusterSize:], basePayload[3*clusterSize:])
+	got := make([]byte, len(expect))
+	if err := (*childImg).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expect) {
+		t.Fatal("read after repair mismatch")
+	}
+	if err := (*childImg).ReadAt(got[:clusterSize], 6*clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:clusterSize], v1[3*clusterSize:]) {
+		t.Fatal("cluster 6 mismatch after repair")
+	}
+	_ = (*childImg).Close()
+
+	// backing 缺失不会被修复，只记录在报告中。
+	if err := os.Remove(baseMeta); err != nil {
+		t.Fatal(err)
+	}
+	report, err = m.Check(childMeta, CheckOptions{Chain: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Kind != CheckIssueBacking || report.Repaired {
+		t.Fatalf("missing backing report: %+v", report)
+	}
+}
+
+/************** 写缓冲与 Flush **************/
+
+func TestWriteDurability(t *testing.T) {
+	const clusterSize = 4096
+
+	dir := t.TempDir()
+	m := NewManager()
+	v, err := m.Create(CreateOptions{Dir: dir, VirtualSize: 64 * clusterSize, ClusterSize: clusterSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath, _ := getMetaPath(v)
+	names := namesFromMeta(storage.NewFileStore(), LayoutFile, metaPath, 0)
+	fileSize := func(name string) int64 {
+		t.Helper()
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	if _, err := m.OpenWithOptions(metaPath, OpenOptions{Durability: DurabilityInterval + 1}); err == nil {
+		t.Fatal("opened with invalid durability")
+	}
+	if err := validateOpenOptions(OpenOptions{}, StorageTypeS3); err == nil {
+		t.Fatal("accepted DurabilityPerWrite on S3")
+	}
+	if err := validateOpenOptions(OpenOptions{Durability: DurabilityInterval}, StorageTypeS3); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := m.OpenWithOptions(metaPath, OpenOptions{Durability: DurabilityFlush, BufferSize: 3 * clusterSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 8*clusterSize)
+	rand.New(rand.NewSource(6)).Read(want)
+	for off := 0; off < len(want); off += clusterSize {
+		if err := (*img).WriteAt(want[off:off+clusterSize], uint64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 缓冲满时 DATA 已写入，但 IDX 在 Flush 前不引用任何数据。
+	if fileSize(names.data) == 0 || fileSize(names.idx) != 0 {
+		t.Fatalf("before flush: DATA=%d IDX=%d", fileSize(names.data), fileSize(names.idx))
+	}
+	got := make([]byte, len(want))
+	if err := (*img).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("buffered read mismatch")
+	}
+	other, err := m.Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*other).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(got) {
+		t.Fatal("unflushed writes visible to another handle")
+	}
+
+	if err := (*img).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	entrySize := int64(binary.Size(IndexEntry{}))
+	if fileSize(names.idx) != 8*entrySize {
+		t.Fatalf("IDX after flush = %d", fileSize(names.idx))
+	}
+	if err := (*other).ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("flushed writes not visible to another handle")
+	}
+	_ = (*other).Close()
+
+	// Close 持久化剩余的写入。
+	if err := (*img).WriteAt(want[:clusterSize], 20*clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fileSize(names.idx) != 9*entrySize {
+		t.Fatalf("IDX after close = %d", fileSize(names.idx))
+	}
+
+	// 周期持久化。
+	img, err = m.OpenWithOptions(metaPath, OpenOptions{Durability: DurabilityInterval, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*img).Close()
+	if err := (*img).WriteAt(want[:clusterSize], 30*clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fileSize(names.idx) != 10*entrySize {
+		if time.Now().After(deadline) {
+			t.Fatal("interval sync did not persist the write")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+/************** 并发读取、缓存与预读 **************/
+
+func TestConcurrentReadsAndCache(t *testing.T) {
+	const clusterSize = 4096
+	const clusters = 32
+
+	dir := t.TempDir()
+	m := NewManager()
+	opts := CreateOptions{
+		Dir:         dir,
+		VirtualSize: clusters * clusterSize,
+		ClusterSize: clusterSize,
+		Compression: CompressionLZ4,
+		Encryption:  EncryptionAES256,
+	}
+	base, err := m.Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseMeta, _ := getMetaPath(base)
+	baseImg, err := m.Open(baseMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, clusters*clusterSize)
+	rand.New(rand.NewSource(7)).Read(want)
+	if err := (*baseImg).WriteAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*baseImg).Close()
+
+	child, err := m.CreateFromBacking(CreateFromBackingOptions{CreateOptions: opts, BackingMetaPath: baseMeta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	childMeta, _ := getMetaPath(child)
+	img, err := m.OpenWithOptions(childMeta, OpenOptions{ReadAhead: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*img).Close()
+	// 奇数 Cluster 由子镜像提供。
+	for i := 1; i < clusters; i += 2 {
+		off := i * clusterSize
+		rand.New(rand.NewSource(int64(i))).Read(want[off : off+clusterSize])
+		if err := (*img).WriteAt(want[off:off+clusterSize], uint64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	top := (*img).(*image)
+	if top.cache == nil || top.backing.cache != top.cache {
+		t.Fatal("cache is not shared across the chain")
+	}
+	cached := func() int {
+		top.cache.mu.Lock()
+		defer top.cache.mu.Unlock()
+		return len(top.cache.items)
+	}
+
+	// 连续顺序读取 2 个 Cluster 后预读之后的 4 个。
+	got := make([]byte, clusterSize)
+	for i := 0; i < 2; i++ {
+		if err := (*img).ReadAt(got, uint64(i*clusterSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	top.ra.wg.Wait()
+	if n := cached(); n != 6 {
+		t.Fatalf("cached clusters after read-ahead = %d, want 6", n)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			buf := make([]byte, 3*clusterSize)
+			for i := 0; i < 200; i++ {
+				off := r.Intn(len(want) - len(buf))
+				n := 1 + r.Intn(len(buf))
+				if err := (*img).ReadAt(buf[:n], uint64(off)); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf[:n], want[off:off+n]) {
+					errs <- fmt.Errorf("mismatch at %d+%d", off, n)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := cached(); n != clusters {
+		t.Fatalf("cached clusters = %d, want %d", n, clusters)
+	}
+
+	// 缓存容量不足时按 LRU 淘汰。
+	c := newClusterCache(2 * clusterSize)
+	for i := uint64(0); i < 3; i++ {
+		c.add(cacheKey{offset: i}, make([]byte, clusterSize))
+	}
+	if c.get(cacheKey{offset: 0}, got) || !c.get(cacheKey{offset: 2}, got) || c.size != 2*clusterSize {
+		t.Fatal("LRU eviction mismatch")
+	}
+}
+
+/************** 信封加密与 Rekey **************/
+
+type testKMS map[string][]byte
+
+func (k testKMS) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	return sealKey(k[keyID], plaintext)
+}
+
+func (k testKMS) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	return openKey(k[keyID], ciphertext)
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 第 11 节。
+	got := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if fmt.Sprintf("%x", got) != want {
+		t.Fatalf("pbkdf2 = %x", got)
+	}
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := dir + "/kek"
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyFileProvider, err := NewKeyFileProvider(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager()
+	v, err := m.Create(CreateOptions{
+		Dir:         dir,
+		VirtualSize: 1 << 20,
+		ClusterSize: 4096,
+		Encryption:  EncryptionAES256,
+		KeyProvider: keyFileProvider,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath, _ := getMetaPath(v)
+	info, _ := getStoragePrivateInfo(v)
+	if info.EncryptionKey != "" || info.WrappedKey == "" || info.KeyProvider != keyFileProvider.ID() {
+		t.Fatalf("META key fields: %+v", info)
+	}
+
+	want := make([]byte, 3*4096)
+	rand.New(rand.NewSource(8)).Read(want)
+	img, err := m.Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).WriteAt(want, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	names := namesFromMeta(storage.NewFileStore(), LayoutFile, metaPath, 0)
+	dataBefore, err := os.ReadFile(names.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase, err := NewPassphraseProvider("primary", "correct horse", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Rekey(passphrase); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*img).Close()
+
+	if dataAfter, _ := os.ReadFile(names.data); !bytes.Equal(dataBefore, dataAfter) {
+		t.Fatal("Rekey rewrote DATA")
+	}
+
+	check := func(m Manager) error {
+		img, err := m.Open(metaPath)
+		if err != nil {
+			return err
+		}
+		defer (*img).Close()
+		got := make([]byte, len(want))
+		if err := (*img).ReadAt(got, 4096); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return errors.New("data mismatch")
+		}
+		return nil
+	}
+
+	// 新的 Manager 需要注册匹配的 KeyProvider。
+	m2 := NewManager()
+	if err := check(m2); err == nil {
+		t.Fatal("opened without key provider")
+	}
+	m2.AddKeyProvider(keyFileProvider)
+	if err := check(m2); err == nil {
+		t.Fatal("opened with the key file after rekey")
+	}
+	wrong, _ := NewPassphraseProvider("primary", "wrong", 1000)
+	m2.AddKeyProvider(wrong)
+	if err := check(m2); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	m2.AddKeyProvider(passphrase)
+	if err := check(m2); err != nil {
+		t.Fatal(err)
+	}
+	// 不同 label 的口令可以同时注册，不会替换已有的。
+	other, _ := NewPassphraseProvider("secondary", "other", 1000)
+	if other.ID() == passphrase.ID() {
+		t.Fatalf("providers with different labels share ID %q", other.ID())
+	}
+	m2.AddKeyProvider(other)
+	if err := check(m2); err != nil {
+		t.Fatal(err)
+	}
+
+	// 切换到 KMS。
+	kms := testKMS{"disk-key": bytes.Repeat([]byte{7}, aes256KeySize)}
+	kmsProvider, err := NewKMSProvider(kms, "disk-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = m2.Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Rekey(kmsProvider); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*img).Close()
+	m3 := NewManager()
+	m3.AddKeyProvider(kmsProvider)
+	if err := check(m3); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧格式的镜像经 Rekey 后不再保存密钥原文。
+	legacy, err := m.Create(CreateOptions{Dir: dir, VirtualSize: 1 << 20, ClusterSize: 4096, Encryption: EncryptionAES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyMeta, _ := getMetaPath(legacy)
+	img, err = m.Open(legacyMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Rekey(kmsProvider); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*img).Close()
+	raw, err := os.ReadFile(legacyMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "encryptionKey") {
+		t.Fatalf("plaintext key left in META: %s", raw)
+	}
+
+	if _, err := m.Create(CreateOptions{Dir: dir, VirtualSize: 1 << 20, ClusterSize: 4096, KeyProvider: kmsProvider}); err == nil {
+		t.Fatal("created unencrypted image with key provider")
+	}
+}
+
+/************** 链操作 **************/
+
+func TestChainOperations(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager()
+
+	create := func(backingGuid string) (string, string) {
+		opts := CreateOptions{Dir: dir, VirtualSize: 1 << 20, ClusterSize: 4096}
+		var v *VImg
+		var err error
+		if backingGuid == "" {
+			v, err = m.Create(opts)
+		} else {
+			v, err = m.CreateFromBacking(CreateFromBackingOptions{CreateOptions: opts, BackingGuid: backingGuid})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, _ := getMetaPath(v)
+		return v.Guid, meta
+	}
+	write := func(meta string, clusters map[uint64]string) {
+		img, err := m.Open(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer (*img).Close()
+		for idx, s := range clusters {
+			if err := (*img).WriteAt([]byte(s), idx*4096); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read := func(meta string) []byte {
+		img, err := m.Open(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer (*img).Close()
+		buf := make([]byte, 6*4096)
+		if err := (*img).ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	chain := func() map[string]ChainNode {
+		nodes, err := m.Chain(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byGuid := make(map[string]ChainNode)
+		for i, n := range nodes {
+			if i > 0 && nodes[i-1].Depth > n.Depth {
+				t.Fatalf("Chain not ordered by depth: %+v", nodes)
+			}
+			byGuid[n.Guid] = n
+		}
+		return byGuid
+	}
+
+	// A ← B ← C ← D，以及 B ← E。
+	a, aMeta := create("")
+	b, bMeta := create(a)
+	c, cMeta := create(b)
+	d, dMeta := create(c)
+	e, eMeta := create(b)
+	write(aMeta, map[uint64]string{0: "A0", 1: "A1"})
+	write(bMeta, map[uint64]string{1: "B1", 2: "B2"})
+	write(cMeta, map[uint64]string{2: "C2", 3: "C3"})
+	write(dMeta, map[uint64]string{4: "D4"})
+	write(eMeta, map[uint64]string{5: "E5"})
+	want := read(dMeta)
+
+	nodes := chain()
+	if len(nodes) != 5 {
+		t.Fatalf("Chain returned %d images", len(nodes))
+	}
+	if n := nodes[b]; n.Depth != 1 || strings.Join(n.Children, ",") != strings.Join(sortedStrings(c, e), ",") {
+		t.Fatalf("node B: %+v", n)
+	}
+	if n := nodes[d]; n.Depth != 3 || n.BackingGuid != c || len(n.Children) != 0 {
+		t.Fatalf("node D: %+v", n)
+	}
+
+	// 存在子镜像时拒绝删除；中间层 B 还有子镜像 E，不能将 C 合并到 A。
+	if err := m.Delete(bMeta); err == nil {
+		t.Fatal("deleted image with children")
+	}
+	if err := m.CommitInto(cMeta, a); err == nil {
+		t.Fatal("committed through layer with another child")
+	}
+	if err := m.CommitInto(dMeta, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(eMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	// D 已合并到 C 并删除。
+	nodes = chain()
+	if _, ok := nodes[d]; ok || len(nodes[c].Children) != 0 {
+		t.Fatalf("after CommitInto(D, C): %+v", nodes)
+	}
+	if got := read(cMeta); !bytes.Equal(got, want) {
+		t.Fatal("data changed after CommitInto(D, C)")
+	}
+
+	// 将 C、B 合并到 A，C 的子镜像 F 改为以 A 为 backing。
+	f, fMeta := create(c)
+	write(fMeta, map[uint64]string{0: "F0"})
+	wantF := read(fMeta)
+	if err := m.CommitInto(cMeta, a); err != nil {
+		t.Fatal(err)
+	}
+	nodes = chain()
+	if len(nodes) != 2 || nodes[f].BackingGuid != a || nodes[f].Depth != 1 {
+		t.Fatalf("after CommitInto(C, A): %+v", nodes)
+	}
+	for _, meta := range []string{bMeta, cMeta, dMeta} {
+		if _, err := os.Stat(meta); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed: %v", meta, err)
+		}
+	}
+	if got := read(fMeta); !bytes.Equal(got, wantF) {
+		t.Fatal("child data changed after CommitInto(C, A)")
+	}
+	if got := read(aMeta); !bytes.Equal(got, want) {
+		t.Fatal("ancestor data mismatch after CommitInto(C, A)")
+	}
+
+	// 合并删除：删除 F 时 G Rebase 到 A，删除 A 时 G 被 Flatten。
+	g, gMeta := create(f)
+	write(gMeta, map[uint64]string{3: "G3"})
+	wantG := read(gMeta)
+	if err := m.DeleteWithOptions(fMeta, DeleteOptions{}); err == nil {
+		t.Fatal("deleted image with children")
+	}
+	if err := m.DeleteWithOptions(fMeta, DeleteOptions{Merge: true}); err != nil {
+		t.Fatal(err)
+	}
+	if nodes = chain(); len(nodes) != 2 || nodes[g].BackingGuid != a {
+		t.Fatalf("after merge delete of F: %+v", nodes)
+	}
+	if got := read(gMeta); !bytes.Equal(got, wantG) {
+		t.Fatal("data changed after merge delete of F")
+	}
+	if err := m.DeleteWithOptions(aMeta, DeleteOptions{Merge: true}); err != nil {
+		t.Fatal(err)
+	}
+	if nodes = chain(); len(nodes) != 1 || nodes[g].BackingGuid != "" || nodes[g].Depth != 0 {
+		t.Fatalf("after merge delete of A: %+v", nodes)
+	}
+	if got := read(gMeta); !bytes.Equal(got, wantG) {
+		t.Fatal("data changed after Flatten")
+	}
+}
+
+func sortedStrings(s ...string) []string {
+	sort.Strings(s)
+	return s
+}
+
+/************** 调整大小 **************/
+
+func TestResize(t *testing.T) {
+	const clusterSize = 4096
+
+	dir := t.TempDir()
+	m := NewManager()
+
+	create := func(size uint64, backingGuid string) (*Image, string) {
+		opts := CreateOptions{Dir: dir, VirtualSize: size, ClusterSize: clusterSize}
+		var v *VImg
+		var err error
+		if backingGuid == "" {
+			v, err = m.Create(opts)
+		} else {
+			v, err = m.CreateFromBacking(CreateFromBackingOptions{CreateOptions: opts, BackingGuid: backingGuid})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, _ := getMetaPath(v)
+		img, err := m.Open(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img, v.Guid
+	}
+	fill := func(img *Image, b byte) []byte {
+		data := bytes.Repeat([]byte{b}, int((*img).Info().VirtualSize))
+		if err := (*img).WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	readAll := func(img *Image) []byte {
+		buf := make([]byte, (*img).Info().VirtualSize)
+		if err := (*img).ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	// 扩大：原大小之后 backing 中的数据不会出现。
+	base, baseGuid := create(16*clusterSize, "")
+	baseData := fill(base, 0xAA)
+	child, _ := create(10000, baseGuid)
+	if err := (*child).Resize(40000); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 40000)
+	copy(want, baseData[:10000])
+	if got := readAll(child); !bytes.Equal(got, want) {
+		t.Fatal("grown range is not zero")
+	}
+	segs, err := (*child).Map(10000, 30000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range segs {
+		if seg.Source == MapSourceBacking {
+			t.Fatalf("grown range mapped to backing: %+v", segs)
+		}
+	}
+
+	// 缩小：被移除的区间有数据时拒绝，Discard 后可以缩小。
+	if err := (*child).WriteAt([]byte("tail"), 30000); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*child).Resize(20000); err == nil {
+		t.Fatal("shrink discarded data")
+	}
+	if err := (*child).Discard(20000, 20000); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*child).Resize(20000); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*child).ReadAt(make([]byte, 1), 20000); err == nil {
+		t.Fatal("read beyond shrunk size")
+	}
+	childMeta := (*child).(*image).metaPath
+	_ = (*child).Close()
+	child, err = m.Open(childMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := (*child).Info().VirtualSize; size != 20000 {
+		t.Fatalf("VirtualSize after reopen = %d", size)
+	}
+	if got := readAll(child); !bytes.Equal(got, want[:20000]) {
+		t.Fatal("data mismatch after shrink")
+	}
+	_ = (*child).Close()
+
+	// backing 小于子镜像：backing 末尾不完整 Cluster 之后为 0。
+	small, smallGuid := create(6000, "")
+	smallData := fill(small, 0xBB)
+	big, _ := create(4*clusterSize, smallGuid)
+	segs, err = (*big).Map(0, 4*clusterSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 2 || segs[0].Source != MapSourceBacking || segs[0].Length != 6000 || segs[1].Source != MapSourceZero {
+		t.Fatalf("unexpected map result: %+v", segs)
+	}
+
+	// 子镜像较大时 Commit 先扩大 backing。
+	if err := (*big).WriteAt([]byte("X"), 12000); err != nil {
+		t.Fatal(err)
+	}
+	wantBig := readAll(big)
+	if !bytes.Equal(wantBig[:6000], smallData) {
+		t.Fatal("child view of backing mismatch")
+	}
+	smallMeta := (*small).(*image).metaPath
+	_ = (*small).Close()
+	if err := (*big).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*big).Close()
+	small, err = m.Open(smallMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := (*small).Info().VirtualSize; size != 4*clusterSize {
+		t.Fatalf("backing size after commit = %d", size)
+	}
+	if got := readAll(small); !bytes.Equal(got, wantBig) {
+		t.Fatal("backing data mismatch after commit from larger child")
+	}
+	_ = (*small).Close()
+
+	// 子镜像较小时 Commit 不改变 backing 中超出子镜像的部分。
+	baseMeta := (*base).(*image).metaPath
+	_ = (*base).Close()
+	tiny, _ := create(6000, baseGuid)
+	if err := (*tiny).WriteAt([]byte("Y"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*tiny).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	_ = (*tiny).Close()
+	baseData[5000] = 'Y'
+	base, err = m.Open(baseMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(base); !bytes.Equal(got, baseData) {
+		t.Fatal("backing data mismatch after commit from smaller child")
+	}
+	_ = (*base).Close()
+}
+
+func TestShrinkThenCheck(t *testing.T) {
+	const clusterSize = 4096
+
+	dir := t.TempDir()
+	m := NewManager()
+	v, err := m.Create(CreateOptions{Dir: dir, VirtualSize: 8 * clusterSize, ClusterSize: clusterSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath, _ := getMetaPath(v)
+	img, err := m.Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).WriteAt(bytes.Repeat([]byte{1}, clusterSize), 7*clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Discard(7*clusterSize, clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Resize(5 * clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := m.Check(metaPath, CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("Check after shrink reported issues: %+v", r.Issues)
+	}
+
+	// Compact 丢弃超出 VirtualSize 的索引项，再扩大后该区间仍读取为 0。
+	img, err = m.Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*img).Close()
+	if err := (*img).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := (*img).SpaceUsage(); u.LiveEntries != 0 {
+		t.Fatalf("LiveEntries after compact = %d", u.LiveEntries)
+	}
+	if err := (*img).Resize(8 * clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, clusterSize)
+	if err := (*img).ReadAt(buf, 7*clusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(buf) {
+		t.Fatal("cluster beyond shrunk size is not zero after growing")
+	}
+}
+
+// failingAppendObject 的 Append 写入 p 的前 n 字节后返回错误。
+type failingAppendObject struct {
+	storage.Object
+	n int
+}
+
+func (o *failingAppendObject) Append(p []byte) (int64, error) {
+	if o.n > 0 {
+		if _, err := o.Object.Append(p[:o.n]); err != nil {
+			return 0, err
+		}
+	}
+	return 0, errors.New("no space left on device")
+}
+
+func TestWriteAppendFailure(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager()
+	v, err := m.Create(CreateOptions{Dir: dir, VirtualSize: 1 << 20, ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaPath, _ := getMetaPath(v)
+	img, err := m.OpenWithOptions(metaPath, OpenOptions{Durability: DurabilityFlush})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := (*img).(*image)
+	data := make([]byte, 2*4096)
+	rand.New(rand.NewSource(21)).Read(data)
+
+	// 未写入任何数据的失败可以重试。
+	if err := (*img).WriteAt(data[:4096], 0); err != nil {
+		t.Fatal(err)
+	}
+	dataFile := in.dataFile
+	in.dataFile = &failingAppendObject{Object: dataFile}
+	if err := (*img).Flush(); err == nil {
+		t.Fatal("Flush succeeded with failing DATA")
+	}
+	in.dataFile = dataFile
+	if err := (*img).Flush(); err != nil {
+		t.Fatalf("Flush after transient failure: %v", err)
+	}
+
+	// 部分写入后本句柄不能再写入，缓冲中的数据仍可读取。
+	if err := (*img).WriteAt(data[4096:], 4096); err != nil {
+		t.Fatal(err)
+	}
+	in.dataFile = &failingAppendObject{Object: dataFile, n: 100}
+	if err := (*img).Flush(); err == nil {
+		t.Fatal("Flush succeeded after partial append")
+	}
+	in.dataFile = dataFile
+	if err := (*img).WriteAt(data[:4096], 0); err == nil {
+		t.Fatal("WriteAt succeeded on failed handle")
+	}
+	if err := (*img).Flush(); err == nil {
+		t.Fatal("Flush succeeded on failed handle")
+	}
+	got := make([]byte, len(data))
+	if err := (*img).ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read from failed handle: %v", err)
+	}
+	_ = (*img).Close()
+
+	// 重新打开后只保留已持久化的写入，残缺的末尾不影响之后的写入。
+	img, err = m.Open(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*img).Close()
+	if err := (*img).WriteAt(data[4096:], 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := (*img).ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read after reopen: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package vimg
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*********************** Zero *************************/
+
+// 全 0 的 Cluster 不写入 DATA，而是在 IDX 中追加一个 LengthInDATA 为 0 的
+// 索引项（零标记）。读取时零标记直接返回全 0，不会再向 backing 查找，
+// 因此既能覆盖 backing 中的数据，又几乎不占用空间。
+
+// isZeroEntry 判断索引项是否为零标记。
+func isZeroEntry(e IndexEntry) bool {
+	return e.LengthInDATA == 0
+}
+
+var zeroBlock [4096]byte
+
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		n := len(b)
+		if n > len(zeroBlock) {
+			n = len(zeroBlock)
+		}
+		if !bytes.Equal(b[:n], zeroBlock[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// storeCluster 写入一个完整 Cluster。
+// 全 0 且本层与 backing 都不提供该 Cluster 时，读取本来就是全 0，无需记录。
+func (img *image) storeCluster(index uint64, data []byte) error {
+	if img.backing == nil && isZero(data) {
+		if _, ok := img.index[index]; !ok {
+			return nil
+		}
+	}
+	return img.writeCluster(index, data)
+}
+
+// writeZeroMarker 为 Cluster 追加零标记。
+func (img *image) writeZeroMarker(index uint64) error {
+	return img.appendIndexNoLock(IndexEntry{ClusterIndex: index})
+}
+
+// Discard 将 [off, off+length) 置为全 0 并释放其占用的空间（trim / unmap）。
+// 完整覆盖的 Cluster 直接记录零标记，不读取原数据；首尾不完整的 Cluster
+// 按写入全 0 处理。即使 backing 中有数据，之后读取该区间也返回全 0。
+// 被释放的 DATA 由 Compact 回收。
+func (img *image) Discard(off, length uint64) error {
+	if length == 0 {
+		return nil
+	}
+	if length > uint64(^uint(0)>>1) {
+		return fmt.Errorf("range out of bounds: off=%d len=%d size=%d", off, length, img.meta.VirtualSize)
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if err := img.validateRWRange(off, int(length)); err != nil {
+		return err
+	}
+
+	clusterSize := uint64(img.meta.ClusterSize)
+	buf := make([]byte, clusterSize)
+
+	for end := off + length; off < end; {
+		idx := off / clusterSize
+		inner := off % clusterSize
+		n := min(end-off, clusterSize-inner)
+
+		// VirtualSize 不是 Cluster 整数倍时，末尾 Cluster 超出部分按已覆盖处理。
+		full := n == clusterSize || (inner == 0 && off+n == img.meta.VirtualSize)
+		if full {
+			fillZero(buf)
+		} else {
+			if err := img.readCluster(idx, buf); err != nil {
+				return err
+			}
+			fillZero(buf[inner : inner+n])
+		}
+		if err := img.storeCluster(idx, buf); err != nil {
+			return err
+		}
+
+		off += n
+	}
+	return img.writeDoneNoLock()
+}